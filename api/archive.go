@@ -0,0 +1,108 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PowPool/dashpool/archive"
+	. "github.com/PowPool/dashpool/util"
+)
+
+// Pages of archived history: ?cursor=<cursor>&limit=<rows>. Reply has opaque "next" cursor
+// when there may be more rows, which points at the last row of the page.
+type archivePage struct {
+	after *archive.Cursor
+	limit int
+}
+
+func (s *ApiServer) parseArchivePage(w http.ResponseWriter, r *http.Request) (*archivePage, bool) {
+	if s.archive == nil {
+		writeError(w, http.StatusNotFound, "Archive is disabled")
+		return nil, false
+	}
+	query := r.URL.Query()
+	after, err := archive.ParseCursor(query.Get("cursor"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid cursor")
+		return nil, false
+	}
+	limit := int(s.config.Payments)
+	if limit <= 0 {
+		limit = archive.MaxLimit
+	}
+	if value := query.Get("limit"); len(value) > 0 {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > archive.MaxLimit {
+			writeError(w, http.StatusBadRequest, "Invalid limit")
+			return nil, false
+		}
+	}
+	return &archivePage{after: after, limit: limit}, true
+}
+
+func (s *ApiServer) ArchiveBlocksIndex(w http.ResponseWriter, r *http.Request) {
+	page, ok := s.parseArchivePage(w, r)
+	if !ok {
+		return
+	}
+	blocks, err := s.archive.GetBlocks(page.after, page.limit)
+	if err != nil {
+		Error.Printf("Failed to fetch blocks from archive: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	reply := map[string]interface{}{"blocks": blocks}
+	if len(blocks) == page.limit {
+		reply["next"] = blocks[len(blocks)-1].Cursor().String()
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// Payments of the pool or of a login
+func (s *ApiServer) ArchivePaymentsIndex(w http.ResponseWriter, r *http.Request) {
+	login := mux.Vars(r)["login"]
+	if len(login) > 0 && !IsValidDashAddress(login) {
+		writeError(w, http.StatusBadRequest, "Invalid login")
+		return
+	}
+	page, ok := s.parseArchivePage(w, r)
+	if !ok {
+		return
+	}
+	payments, err := s.archive.GetPayments(login, page.after, page.limit)
+	if err != nil {
+		Error.Printf("Failed to fetch payments from archive: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	reply := map[string]interface{}{"payments": payments}
+	if len(payments) == page.limit {
+		reply["next"] = payments[len(payments)-1].Cursor().String()
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+func (s *ApiServer) ArchiveCreditsIndex(w http.ResponseWriter, r *http.Request) {
+	login := mux.Vars(r)["login"]
+	if !IsValidDashAddress(login) {
+		writeError(w, http.StatusBadRequest, "Invalid login")
+		return
+	}
+	page, ok := s.parseArchivePage(w, r)
+	if !ok {
+		return
+	}
+	credits, err := s.archive.GetCredits(login, page.after, page.limit)
+	if err != nil {
+		Error.Printf("Failed to fetch credits from archive: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	reply := map[string]interface{}{"credits": credits}
+	if len(credits) == page.limit {
+		reply["next"] = credits[len(credits)-1].Cursor().String()
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+// Chart covers that many buckets when range is not requested
+const defaultChartPoints = 144
+
+func (s *ApiServer) writeCharts() {
+	if !s.elector.IsLeader() {
+		Debug.Println("Skipping hashrate history, this node is not a leader")
+		return
+	}
+	n, err := s.backend.WriteCharts(s.hashrateWindow)
+	if err != nil {
+		Error.Printf("Failed to write hashrate history to backend: %v", err)
+	} else if n > 0 {
+		Info.Printf("Wrote %v hashrate history buckets", n)
+	}
+}
+
+// Hashrate history of the pool, a login or its worker:
+// ?resolution=10m|1h&from=<unix>&to=<unix>
+func (s *ApiServer) ChartsIndex(w http.ResponseWriter, r *http.Request) {
+	login := mux.Vars(r)["login"]
+	id := mux.Vars(r)["worker"]
+	if len(login) > 0 && !IsValidDashAddress(login) {
+		writeError(w, http.StatusBadRequest, "Invalid login")
+		return
+	}
+	if len(id) > 0 && !workerPattern.MatchString(id) {
+		writeError(w, http.StatusBadRequest, "Invalid worker")
+		return
+	}
+
+	query := r.URL.Query()
+	res := storage.ChartResolutions[0]
+	if name := query.Get("resolution"); len(name) > 0 {
+		res = storage.GetChartResolution(name)
+		if res == nil {
+			writeError(w, http.StatusBadRequest, "Invalid resolution")
+			return
+		}
+	}
+
+	now := time.Now().Unix()
+	to, err := parseTimestamp(query.Get("to"), now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid to")
+		return
+	}
+	from, err := parseTimestamp(query.Get("from"), to-defaultChartPoints*int64(res.Bucket/time.Second))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid from")
+		return
+	}
+	// Nothing is kept beyond retention, do not return long runs of empty buckets
+	if min := now - int64(res.Retention/time.Second); from < min {
+		from = min
+	}
+	if from >= to {
+		writeError(w, http.StatusBadRequest, "Invalid range")
+		return
+	}
+
+	points, err := s.backend.GetChart(res, login, id, from, to)
+	if err != nil {
+		Error.Printf("Failed to fetch hashrate history from backend: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	reply := map[string]interface{}{
+		"resolution": res.Name,
+		"bucket":     int64(res.Bucket / time.Second),
+		"from":       from,
+		"to":         to,
+		"points":     points,
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+func parseTimestamp(value string, def int64) (int64, error) {
+	if len(value) == 0 {
+		return def, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+const testLogin = "XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob"
+
+func TestMain(m *testing.M) {
+	InitLog(os.DevNull, os.DevNull, os.DevNull, os.DevNull, ERROR)
+	os.Exit(m.Run())
+}
+
+func newTestServer(backend storage.Backend) *ApiServer {
+	cfg := &ApiConfig{HashrateWindow: "30m", HashrateLargeWindow: "3h", Payments: 50, Blocks: 50}
+	s := NewApiServer(cfg, backend, nil, nil)
+	s.statsIntv = time.Minute
+	return s
+}
+
+// Serves request through API router, decoding JSON reply into v
+func serveJSON(t *testing.T, s *ApiServer, url string, v interface{}) int {
+	w := httptest.NewRecorder()
+	s.router().ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("%v must reply with JSON: %v, %v", url, w.Body.String(), err)
+	}
+	return w.Code
+}
+
+func TestWorkerCharts(t *testing.T) {
+	backend := storage.NewMemoryBackend("test")
+	now := MakeTimestamp() / 1000
+	bucket := (now-60)/600*600 - 600
+	backend.WriteShares([]*storage.ShareData{
+		{Login: testLogin, Id: "rig1", Diff: 3600, Ms: (bucket + 5) * 1000},
+		{Login: testLogin, Id: "rig2", Diff: 7200, Ms: (bucket + 100) * 1000},
+	}, time.Hour)
+	backend.WriteCharts(30 * time.Minute)
+	s := newTestServer(backend)
+
+	var reply struct {
+		Points []storage.ChartPoint `json:"points"`
+	}
+	query := fmt.Sprintf("?resolution=10m&from=%v&to=%v", bucket, bucket+600)
+	for url, hashrate := range map[string]int64{
+		"/api/accounts/" + testLogin + "/charts" + query:                 18,
+		"/api/accounts/" + testLogin + "/workers/rig2/charts" + query:    12,
+		"/api/accounts/" + testLogin + "/workers/rig1/charts" + query:    6,
+		"/api/accounts/" + testLogin + "/workers/unknown/charts" + query: 0,
+	} {
+		reply.Points = nil
+		if code := serveJSON(t, s, url, &reply); code != http.StatusOK || len(reply.Points) != 1 || reply.Points[0].Hashrate != hashrate {
+			t.Errorf("Invalid chart of %v: %v, %+v", url, code, reply.Points)
+		}
+	}
+
+	var errReply map[string]string
+	if code := serveJSON(t, s, "/api/accounts/"+testLogin+"/workers/rig%2A/charts", &errReply); code != http.StatusBadRequest {
+		t.Errorf("Must reject invalid worker: %v, %v", code, errReply)
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+const maxHistoryLimit = 1000
+
+// Filter and page of blocks and payments history read from backend:
+// ?login=<finder>&minHeight=<height>&maxHeight=<height>&from=<unix>&to=<unix>&cursor=<cursor>&limit=<rows>.
+// Reply has opaque "next" cursor when there may be more rows, page may be short when scan of a filter is cut.
+func parseHistoryQuery(w http.ResponseWriter, r *http.Request, def int64) (*storage.HistoryQuery, bool) {
+	query := r.URL.Query()
+	q := &storage.HistoryQuery{Login: query.Get("login"), Cursor: query.Get("cursor"), Limit: int(def)}
+	if login, ok := mux.Vars(r)["login"]; ok {
+		q.Login = login
+	}
+	if len(q.Login) > 0 && !IsValidDashAddress(q.Login) {
+		writeError(w, http.StatusBadRequest, "Invalid login")
+		return nil, false
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *int64
+	}{
+		{"minHeight", &q.MinHeight},
+		{"maxHeight", &q.MaxHeight},
+		{"from", &q.From},
+		{"to", &q.To},
+	} {
+		value, err := parseTimestamp(query.Get(param.name), 0)
+		if err != nil || value < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid "+param.name)
+			return nil, false
+		}
+		*param.value = value
+	}
+
+	if q.Limit <= 0 || q.Limit > maxHistoryLimit {
+		q.Limit = maxHistoryLimit
+	}
+	if value := query.Get("limit"); len(value) > 0 {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxHistoryLimit {
+			writeError(w, http.StatusBadRequest, "Invalid limit")
+			return nil, false
+		}
+		q.Limit = limit
+	}
+	return q, true
+}
+
+func writeHistoryError(w http.ResponseWriter, err error) {
+	if err == storage.ErrInvalidCursor {
+		writeError(w, http.StatusBadRequest, "Invalid cursor")
+		return
+	}
+	Error.Printf("Failed to fetch history from backend: %v", err)
+	writeError(w, http.StatusInternalServerError, "Internal error")
+}
+
+// Candidates, immature, matured or orphaned blocks
+func (s *ApiServer) BlocksHistoryIndex(w http.ResponseWriter, r *http.Request) {
+	kind := mux.Vars(r)["kind"]
+	if !storage.IsBlocksKind(kind) {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	q, ok := parseHistoryQuery(w, r, s.config.Blocks)
+	if !ok {
+		return
+	}
+	blocks, next, err := s.backend.GetBlocksPage(kind, q)
+	if err != nil {
+		writeHistoryError(w, err)
+		return
+	}
+	reply := map[string]interface{}{"blocks": blocks}
+	if len(next) > 0 {
+		reply["next"] = next
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// Payments of the pool or of a login
+func (s *ApiServer) PaymentsHistoryIndex(w http.ResponseWriter, r *http.Request) {
+	q, ok := parseHistoryQuery(w, r, s.config.Payments)
+	if !ok {
+		return
+	}
+	payments, next, err := s.backend.GetPaymentsPage(q)
+	if err != nil {
+		writeHistoryError(w, err)
+		return
+	}
+	reply := map[string]interface{}{"payments": payments}
+	if len(next) > 0 {
+		reply["next"] = next
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
@@ -3,14 +3,16 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+	"regexp"
 	"sort"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 
+	"github.com/PowPool/dashpool/archive"
+	"github.com/PowPool/dashpool/election"
 	"github.com/PowPool/dashpool/storage"
 	. "github.com/PowPool/dashpool/util"
 )
@@ -27,11 +29,16 @@ type ApiConfig struct {
 	Blocks                int64  `json:"blocks"`
 	PurgeOnly             bool   `json:"purgeOnly"`
 	PurgeInterval         string `json:"purgeInterval"`
+	Charts                bool   `json:"charts"`
+	// Lowest payout threshold miners may set, payouts.minThreshold
+	MinThreshold int64 `json:"-"`
 }
 
 type ApiServer struct {
 	config              *ApiConfig
-	backend             *storage.RedisClient
+	backend             storage.Backend
+	archive             archive.Archive
+	elector             *election.Elector
 	hashrateWindow      time.Duration
 	hashrateLargeWindow time.Duration
 	stats               atomic.Value
@@ -40,18 +47,23 @@ type ApiServer struct {
 	statsIntv           time.Duration
 }
 
+// Worker ids miners may connect with
+var workerPattern = regexp.MustCompile("^[0-9a-zA-Z-_.]{1,64}$")
+
 type Entry struct {
 	stats     map[string]interface{}
 	updatedAt int64
 }
 
-func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
+func NewApiServer(cfg *ApiConfig, backend storage.Backend, archive archive.Archive, elector *election.Elector) *ApiServer {
 	hashrateWindow := MustParseDuration(cfg.HashrateWindow)
 	hashrateLargeWindow := MustParseDuration(cfg.HashrateLargeWindow)
 
 	return &ApiServer{
 		config:              cfg,
 		backend:             backend,
+		archive:             archive,
+		elector:             elector,
 		hashrateWindow:      hashrateWindow,
 		hashrateLargeWindow: hashrateLargeWindow,
 		miners:              make(map[string]*Entry),
@@ -89,6 +101,9 @@ func (s *ApiServer) Start() {
 				if !s.config.PurgeOnly {
 					s.collectStats()
 				}
+				if s.config.Charts {
+					s.writeCharts()
+				}
 				statsTimer.Reset(s.statsIntv)
 			case <-purgeTimer.C:
 				s.purgeStale()
@@ -103,27 +118,45 @@ func (s *ApiServer) Start() {
 }
 
 func (s *ApiServer) listen() {
+	err := http.ListenAndServe(s.config.Listen, s.router())
+	if err != nil {
+		Error.Fatalf("Failed to start API: %v", err)
+	}
+}
+
+func (s *ApiServer) router() *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/api/stats", s.StatsIndex)
 	r.HandleFunc("/api/miners", s.MinersIndex)
 	r.HandleFunc("/api/blocks", s.BlocksIndex)
+	r.HandleFunc("/api/blocks/{kind}", s.BlocksHistoryIndex)
 	r.HandleFunc("/api/payments", s.PaymentsIndex)
-	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}", s.AccountIndex)
+	r.HandleFunc("/api/payments/history", s.PaymentsHistoryIndex)
+	r.HandleFunc("/api/charts", s.ChartsIndex)
+	r.HandleFunc("/api/archive/blocks", s.ArchiveBlocksIndex)
+	r.HandleFunc("/api/archive/payments", s.ArchivePaymentsIndex)
+	r.HandleFunc("/api/accounts/{login}", s.AccountIndex)
+	r.HandleFunc("/api/accounts/{login}/settings", s.AccountSettingsIndex).Methods("GET")
+	r.HandleFunc("/api/accounts/{login}/settings", s.UpdateAccountSettings).Methods("POST")
+	r.HandleFunc("/api/accounts/{login}/charts", s.ChartsIndex)
+	r.HandleFunc("/api/accounts/{login}/payments", s.PaymentsHistoryIndex)
+	r.HandleFunc("/api/accounts/{login}/archive/payments", s.ArchivePaymentsIndex)
+	r.HandleFunc("/api/accounts/{login}/archive/credits", s.ArchiveCreditsIndex)
+	r.HandleFunc("/api/accounts/{login}/workers/{worker}", s.WorkerIndex)
+	r.HandleFunc("/api/accounts/{login}/workers/{worker}/charts", s.ChartsIndex)
 	r.NotFoundHandler = http.HandlerFunc(notFound)
-	err := http.ListenAndServe(s.config.Listen, r)
-	if err != nil {
-		Error.Fatalf("Failed to start API: %v", err)
-	}
+	return r
 }
 
 func notFound(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.WriteHeader(http.StatusNotFound)
+	writeError(w, http.StatusNotFound, "Not found")
 }
 
 func (s *ApiServer) purgeStale() {
+	if !s.elector.IsLeader() {
+		Debug.Println("Skipping stale stats purge, this node is not a leader")
+		return
+	}
 	start := time.Now()
 	total, err := s.backend.FlushStaleStats(s.hashrateWindow, s.hashrateLargeWindow)
 	if err != nil {
@@ -131,6 +164,14 @@ func (s *ApiServer) purgeStale() {
 	} else {
 		Info.Printf("Purged stale stats from backend, %v shares affected, elapsed time %v", total, time.Since(start))
 	}
+	if s.config.Charts {
+		total, err = s.backend.FlushStaleCharts()
+		if err != nil {
+			Error.Println("Failed to purge stale hashrate history from backend:", err)
+		} else {
+			Info.Printf("Purged %v stale hashrate history buckets from backend", total)
+		}
+	}
 }
 
 func (s *ApiServer) collectStats() {
@@ -164,6 +205,18 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 	}
 	reply["nodes"] = nodes
 
+	halts, err := s.backend.GetHalts()
+	if err != nil {
+		Error.Printf("Failed to get halted modules from backend: %v", err)
+	}
+	reply["halts"] = halts
+
+	leader, _, err := s.backend.GetLeader(election.Role)
+	if err != nil {
+		Error.Printf("Failed to get leader from backend: %v", err)
+	}
+	reply["leader"] = leader
+
 	stats := s.getStats()
 	if stats != nil {
 		reply["now"] = MakeTimestamp()
@@ -246,11 +299,68 @@ func (s *ApiServer) PaymentsIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Cache-Control", "no-cache")
+	login := mux.Vars(r)["login"]
+	if !IsValidDashAddress(login) {
+		writeError(w, http.StatusBadRequest, "Invalid login")
+		return
+	}
+	stats, err := s.getMinerStats(login)
+	if err != nil {
+		Error.Printf("Failed to fetch stats from backend: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if stats == nil {
+		writeError(w, http.StatusNotFound, "Miner not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// Hashrate and rejected shares of one worker of login
+func (s *ApiServer) WorkerIndex(w http.ResponseWriter, r *http.Request) {
+	login := mux.Vars(r)["login"]
+	id := mux.Vars(r)["worker"]
+	if !IsValidDashAddress(login) {
+		writeError(w, http.StatusBadRequest, "Invalid login")
+		return
+	}
+	if !workerPattern.MatchString(id) {
+		writeError(w, http.StatusBadRequest, "Invalid worker")
+		return
+	}
+	stats, err := s.getMinerStats(login)
+	if err != nil {
+		Error.Printf("Failed to fetch stats from backend: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if stats == nil {
+		writeError(w, http.StatusNotFound, "Miner not found")
+		return
+	}
+	workers, _ := stats["workers"].(map[string]storage.Worker)
+	worker, ok := workers[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Worker not found")
+		return
+	}
+	rejectsByWorker, _ := stats["rejects"].(map[string]map[string]int64)
+	rejects := rejectsByWorker[id]
+	if rejects == nil {
+		rejects = make(map[string]int64)
+	}
+	reply := map[string]interface{}{
+		"now":     MakeTimestamp(),
+		"id":      id,
+		"worker":  worker,
+		"rejects": rejects,
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
 
-	login := strings.ToLower(mux.Vars(r)["login"])
+// Cached stats of login, refreshed once per stats interval, nil when there is no such miner
+func (s *ApiServer) getMinerStats(login string) (map[string]interface{}, error) {
 	s.minersMu.Lock()
 	defer s.minersMu.Unlock()
 
@@ -260,42 +370,29 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 	// Refresh stats if stale
 	if !ok || reply.updatedAt < now-cacheIntv {
 		exist, err := s.backend.IsMinerExists(login)
-		if !exist {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			Error.Printf("Failed to fetch stats from backend: %v", err)
-			return
+			return nil, err
+		}
+		if !exist {
+			return nil, nil
 		}
 
-		stats, err := s.backend.GetMinerStats(login, s.config.Payments)
+		stats, err := s.backend.GetMinerStats(login)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			Error.Printf("Failed to fetch stats from backend: %v", err)
-			return
+			return nil, err
 		}
 
 		workers, err := s.backend.CollectWorkersStats(s.hashrateWindow, s.hashrateLargeWindow, login)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			Error.Printf("Failed to fetch stats from backend: %v", err)
-			return
+			return nil, err
 		}
 		for key, value := range workers {
 			stats[key] = value
 		}
-		stats["pageSize"] = s.config.Payments
 		reply = &Entry{stats: stats, updatedAt: now}
 		s.miners[login] = reply
 	}
-
-	w.WriteHeader(http.StatusOK)
-	err := json.NewEncoder(w).Encode(reply.stats)
-	if err != nil {
-		Error.Println("Error serializing API response: ", err)
-	}
+	return reply.stats, nil
 }
 
 func (s *ApiServer) getStats() map[string]interface{} {
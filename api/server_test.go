@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+func TestAccountRoutes(t *testing.T) {
+	backend := storage.NewMemoryBackend("test")
+	now := MakeTimestamp()
+	backend.WriteShares([]*storage.ShareData{{Login: testLogin, Id: "rig1", Diff: 3600, Ms: now}}, time.Hour)
+	backend.WriteRejectShare(now, now/1000, testLogin, "rig1", 3600, "ntimeTooOld")
+	s := newTestServer(backend)
+
+	var account map[string]interface{}
+	if code := serveJSON(t, s, "/api/accounts/"+testLogin, &account); code != http.StatusOK || account["workersTotal"] != float64(1) {
+		t.Errorf("Must serve account of base58 login: %v, %v", code, account)
+	}
+	var payments map[string]interface{}
+	if code := serveJSON(t, s, "/api/accounts/"+testLogin+"/payments", &payments); code != http.StatusOK {
+		t.Errorf("Must serve payments of base58 login: %v, %v", code, payments)
+	}
+
+	var worker struct {
+		Id      string           `json:"id"`
+		Worker  storage.Worker   `json:"worker"`
+		Rejects map[string]int64 `json:"rejects"`
+	}
+	if code := serveJSON(t, s, "/api/accounts/"+testLogin+"/workers/rig1", &worker); code != http.StatusOK ||
+		worker.Id != "rig1" || worker.Worker.LastBeat != now/1000 || worker.Rejects["ntimeTooOld"] != 1 {
+		t.Errorf("Must serve worker detail: %v, %+v", code, worker)
+	}
+
+	for url, expected := range map[string]struct {
+		code  int
+		error string
+	}{
+		"/api/accounts/0x0000000000000000000000000000000000000000":   {http.StatusBadRequest, "Invalid login"},
+		"/api/accounts/" + testLogin + "x":                           {http.StatusBadRequest, "Invalid login"},
+		"/api/accounts/" + testLogin + "/workers/rig%2A":             {http.StatusBadRequest, "Invalid worker"},
+		"/api/accounts/" + testLogin + "/workers/rig2":               {http.StatusNotFound, "Worker not found"},
+		"/api/accounts/" + testLogin + "/payments?limit=0":           {http.StatusBadRequest, "Invalid limit"},
+		"/api/accounts/0x0000000000000000000000000000000000000000/x": {http.StatusNotFound, "Not found"},
+		"/api/unknown": {http.StatusNotFound, "Not found"},
+	} {
+		var reply map[string]string
+		if code := serveJSON(t, s, url, &reply); code != expected.code || reply["error"] != expected.error {
+			t.Errorf("Invalid error reply of %v: %v, %v", url, code, reply)
+		}
+	}
+
+	// Stats of miner which hold no workers
+	s.miners[testLogin] = &Entry{stats: map[string]interface{}{}, updatedAt: MakeTimestamp()}
+	var reply map[string]string
+	if code := serveJSON(t, s, "/api/accounts/"+testLogin+"/workers/rig1", &reply); code != http.StatusNotFound {
+		t.Errorf("Must not find worker in stats without workers: %v, %v", code, reply)
+	}
+
+	// Valid login without any shares
+	empty := newTestServer(storage.NewMemoryBackend("test"))
+	for _, url := range []string{"/api/accounts/" + testLogin, "/api/accounts/" + testLogin + "/workers/rig1"} {
+		var reply map[string]string
+		if code := serveJSON(t, empty, url, &reply); code != http.StatusNotFound || reply["error"] != "Miner not found" {
+			t.Errorf("Invalid error reply of %v: %v, %v", url, code, reply)
+		}
+	}
+}
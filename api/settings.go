@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PowPool/dashpool/dashcoin"
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+// Signed settings requests older than this are rejected
+const settingsSignatureTTL = 10 * time.Minute
+
+var emailPattern = regexp.MustCompile("^[^@\\s:]+@[^@\\s:]+\\.[^@\\s:]+$")
+
+type SettingsRequest struct {
+	Threshold     int64  `json:"threshold"`
+	Email         string `json:"email"`
+	PayoutAddress string `json:"payoutAddress"`
+	Timestamp     int64  `json:"timestamp"`
+	Signature     string `json:"signature"`
+}
+
+// Message miner has to sign with "signmessage <login> <message>"
+func (req *SettingsRequest) Message(login string) string {
+	return strings.Join([]string{"dashpool", "settings", login, fmt.Sprint(req.Threshold), req.Email,
+		req.PayoutAddress, fmt.Sprint(req.Timestamp)}, ":")
+}
+
+func writeJSON(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		Error.Println("Error serializing API response: ", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{"error": message})
+}
+
+func maskEmail(email string) string {
+	i := strings.Index(email, "@")
+	if i < 1 {
+		return ""
+	}
+	return email[:1] + "***" + email[i:]
+}
+
+func (s *ApiServer) AccountSettingsIndex(w http.ResponseWriter, r *http.Request) {
+	login := mux.Vars(r)["login"]
+	if !IsValidDashAddress(login) {
+		writeError(w, http.StatusBadRequest, "Invalid login")
+		return
+	}
+
+	settings, err := s.backend.GetMinerSettings(login)
+	if err != nil {
+		Error.Printf("Failed to fetch settings from backend: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	reply := map[string]interface{}{
+		"threshold":     settings.Threshold,
+		"email":         maskEmail(settings.Email),
+		"payoutAddress": settings.PayoutAddress,
+		"updatedAt":     settings.UpdatedAt,
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+func (s *ApiServer) UpdateAccountSettings(w http.ResponseWriter, r *http.Request) {
+	login := mux.Vars(r)["login"]
+	if !IsValidDashAddress(login) {
+		writeError(w, http.StatusBadRequest, "Invalid login")
+		return
+	}
+
+	var req SettingsRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Malformed request")
+		return
+	}
+	// Zero threshold resets it to pool default
+	if req.Threshold < 0 || (req.Threshold > 0 && req.Threshold < s.config.MinThreshold) {
+		writeError(w, http.StatusBadRequest, "Invalid threshold")
+		return
+	}
+	if len(req.Email) > 0 && (len(req.Email) > 254 || !emailPattern.MatchString(req.Email)) {
+		writeError(w, http.StatusBadRequest, "Invalid email")
+		return
+	}
+	if len(req.PayoutAddress) > 0 && !IsValidDashAddress(req.PayoutAddress) {
+		writeError(w, http.StatusBadRequest, "Invalid payout address")
+		return
+	}
+
+	now := time.Now()
+	signedAt := time.Unix(req.Timestamp, 0)
+	if signedAt.Before(now.Add(-settingsSignatureTTL)) || signedAt.After(now.Add(settingsSignatureTTL)) {
+		writeError(w, http.StatusBadRequest, "Signature expired")
+		return
+	}
+
+	valid, err := dashcoin.VerifyMessage(login, req.Signature, req.Message(login))
+	if err != nil || !valid {
+		writeError(w, http.StatusForbidden, "Invalid signature")
+		return
+	}
+
+	settings := &storage.MinerSettings{
+		Threshold:     req.Threshold,
+		Email:         req.Email,
+		PayoutAddress: req.PayoutAddress,
+		UpdatedAt:     req.Timestamp,
+	}
+	err = s.backend.WriteMinerSettings(login, settings)
+	// Do not allow to replay previously signed request
+	if err == storage.ErrStaleSettings {
+		writeError(w, http.StatusConflict, "Stale settings request")
+		return
+	}
+	if err != nil {
+		Error.Printf("Failed to write settings to backend: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	Info.Printf("Updated settings for %v: threshold %v, payout address %v", login, settings.Threshold, settings.PayoutAddress)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"updatedAt": settings.UpdatedAt})
+}
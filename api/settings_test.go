@@ -0,0 +1,37 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PowPool/dashpool/storage"
+)
+
+func TestUpdateSettingsThreshold(t *testing.T) {
+	s := newTestServer(storage.NewMemoryBackend("test"))
+	s.config.MinThreshold = 10000000
+
+	for threshold, expected := range map[int64]string{
+		-1:       "Invalid threshold",
+		1:        "Invalid threshold",
+		9999999:  "Invalid threshold",
+		10000000: "Invalid signature",
+		0:        "Invalid signature",
+	} {
+		body, _ := json.Marshal(SettingsRequest{Threshold: threshold, Timestamp: time.Now().Unix(), Signature: "x"})
+		w := httptest.NewRecorder()
+		s.router().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/accounts/"+testLogin+"/settings", strings.NewReader(string(body))))
+		var reply map[string]string
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		if reply["error"] != expected {
+			t.Errorf("Threshold %v must be replied with %v: %v, %v", threshold, expected, w.Code, reply)
+		}
+		if expected == "Invalid threshold" && w.Code != http.StatusBadRequest {
+			t.Errorf("Threshold %v must be rejected with 400: %v", threshold, w.Code)
+		}
+	}
+}
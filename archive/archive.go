@@ -0,0 +1,112 @@
+package archive
+
+import (
+	"math/big"
+
+	"github.com/PowPool/dashpool/storage"
+)
+
+// Pages of history are limited to that many rows
+const MaxLimit = 1000
+
+type Config struct {
+	Enabled bool `json:"enabled"`
+	// PostgreSQL connection string, "postgres://user@host/db?sslmode=disable"
+	Url               string `json:"url"`
+	PasswordEncrypted string `json:"passwordEncrypted"`
+	Password          string `json:"-"`
+	MaxOpenConns      int    `json:"maxOpenConns"`
+}
+
+// Matured or orphaned block, the same fields API returns for blocks from backend
+type Block struct {
+	Height      int64  `json:"height"`
+	Hash        string `json:"hash"`
+	Nonce       string `json:"-"`
+	Timestamp   int64  `json:"timestamp"`
+	Difficulty  int64  `json:"difficulty"`
+	TotalShares int64  `json:"shares"`
+	Reward      int64  `json:"reward"`
+	Orphan      bool   `json:"orphan"`
+}
+
+type Payment struct {
+	TxHash    string `json:"tx"`
+	Login     string `json:"address"`
+	Amount    int64  `json:"amount"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type Credit struct {
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+	Login  string `json:"-"`
+	Amount int64  `json:"amount"`
+}
+
+// Long term history of blocks, credits and payments, which backend keeps in memory.
+// Writes are idempotent, so the same record may be streamed and backfilled.
+type Archive interface {
+	// Credits are empty for orphans
+	WriteBlock(block *Block, credits map[string]int64) error
+	WritePayment(payment *Payment) error
+
+	// Newest first, starting after cursor of the last row of the previous page or from the newest row when nil
+	GetBlocks(after *Cursor, limit int) ([]*Block, error)
+	GetPayments(login string, after *Cursor, limit int) ([]*Payment, error)
+	GetCredits(login string, after *Cursor, limit int) ([]*Credit, error)
+	Close() error
+}
+
+// Opens PostgreSQL archive and brings its schema to the latest version, nil when disabled
+func New(cfg *Config, coin string) (Archive, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	a, err := NewPostgresArchive(cfg, coin)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Archived form of matured or orphaned block of backend
+func NewBlock(b *storage.BlockData) *Block {
+	block := &Block{
+		Height:      b.Height,
+		Hash:        b.Hash,
+		Nonce:       b.Nonce,
+		Timestamp:   b.Timestamp,
+		Difficulty:  b.Difficulty,
+		TotalShares: b.TotalShares,
+		Orphan:      b.Orphan,
+	}
+	// As backend stores blocks without hash
+	if len(block.Hash) == 0 {
+		block.Hash = "0x0"
+	}
+	// Blocks read back from backend only have reward string
+	if b.Reward != nil {
+		block.Reward = b.Reward.Int64()
+	} else if reward, ok := new(big.Int).SetString(b.RewardString, 10); ok {
+		block.Reward = reward.Int64()
+	}
+	return block
+}
+
+// Archived form of payment row of backend
+func NewPayment(p map[string]interface{}) *Payment {
+	payment := &Payment{}
+	payment.TxHash, _ = p["tx"].(string)
+	payment.Login, _ = p["address"].(string)
+	payment.Amount, _ = p["amount"].(int64)
+	payment.Timestamp, _ = p["timestamp"].(int64)
+	return payment
+}
+
+func limitOrMax(limit int) int {
+	if limit <= 0 || limit > MaxLimit {
+		return MaxLimit
+	}
+	return limit
+}
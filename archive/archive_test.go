@@ -0,0 +1,203 @@
+package archive
+
+import (
+	"math/big"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+func TestMain(m *testing.M) {
+	InitLog(os.DevNull, os.DevNull, os.DevNull, os.DevNull, ERROR)
+	os.Exit(m.Run())
+}
+
+// Mines, matures and pays out one round, then orphans another one
+func writeHistory(t *testing.T, backend storage.Backend) {
+	backend.WriteShare("x", "rig1", []string{"0x1", "0x0", "0x0"}, 100, 10, time.Hour)
+	backend.WriteShare("z", "rig1", []string{"0x2", "0x0", "0x0"}, 300, 10, time.Hour)
+	backend.WriteBlock("x", "rig1", []string{"0x3", "0x0", "0x0"}, 100, 500, 10, "0xb10c", 1000, 0, time.Hour)
+	backend.WriteBlock("z", "rig1", []string{"0x4", "0x0", "0x0"}, 100, 500, 12, "0xb10d", 1000, 0, time.Hour)
+
+	candidates, _ := backend.GetCandidates(12)
+	if len(candidates) != 2 {
+		t.Fatalf("Must return candidates: %v", candidates)
+	}
+	rewards := map[string]int64{"x": 490, "z": 490}
+	for _, block := range candidates {
+		block.Reward = big.NewInt(1000)
+		block.ExtraReward = big.NewInt(0)
+		backend.WriteImmatureBlock(block, rewards)
+	}
+	immature, _ := backend.GetImmatureBlocks(12)
+	for _, block := range immature {
+		block.Reward = big.NewInt(1000)
+		if block.Height == 12 {
+			block.Orphan = true
+			backend.WriteOrphan(block)
+		} else {
+			backend.WriteMaturedBlock(block, rewards, 0)
+		}
+	}
+
+	backend.LockPayouts("x", 490)
+	backend.UpdateBalance("x", 490)
+	backend.WritePayment("x", "0xbeef", 490)
+}
+
+func TestBackfill(t *testing.T) {
+	backend := storage.NewMemoryBackend("test")
+	writeHistory(t, backend)
+
+	a := NewMemoryArchive()
+	// Second run must not duplicate anything
+	for i := 0; i < 2; i++ {
+		result, err := Backfill(backend, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := &BackfillResult{Blocks: 1, Orphans: 1, Credits: 2, Payments: 1}
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("Invalid backfill result: %+v", result)
+		}
+	}
+
+	blocks, _ := a.GetBlocks(nil, 10)
+	if len(blocks) != 2 || blocks[0].Height != 12 || !blocks[0].Orphan || blocks[1].Reward != 1000 {
+		t.Errorf("Invalid archived blocks: %+v, %+v", blocks[0], blocks[1])
+	}
+	if older, _ := a.GetBlocks(blocks[0].Cursor(), 10); len(older) != 1 || older[0].Height != 10 {
+		t.Errorf("Must return blocks before cursor: %v", older)
+	}
+	credits, _ := a.GetCredits("z", nil, 10)
+	if len(credits) != 1 || credits[0].Amount != 490 || credits[0].Hash != "0xb10c" {
+		t.Errorf("Invalid archived credits: %v", credits)
+	}
+	payments, _ := a.GetPayments("x", nil, 10)
+	if len(payments) != 1 || payments[0].TxHash != "0xbeef" || payments[0].Amount != 490 {
+		t.Errorf("Invalid archived payments: %v", payments)
+	}
+	if payments, _ := a.GetPayments("z", nil, 10); len(payments) != 0 {
+		t.Errorf("Must filter payments by login: %v", payments)
+	}
+}
+
+// Rows sharing height or time with the last row of a page must be on the next page
+func writeTies(a Archive) {
+	for _, nonce := range []string{"0x1", "0x2", "0x3"} {
+		a.WriteBlock(&Block{Height: 20, Nonce: nonce, Hash: "0xb1" + nonce[2:], Orphan: nonce != "0x1"},
+			map[string]int64{"x": 10})
+	}
+	for i, login := range []string{"x", "z", "x", "z", "y"} {
+		a.WritePayment(&Payment{TxHash: "0xa" + strconv.Itoa(i/2), Login: login, Amount: 10, Timestamp: 3000})
+	}
+}
+
+// Walks all pages of size two, returns rows in order
+func pageTies(t *testing.T, a Archive) []string {
+	var rows []string
+	var after *Cursor
+	for i := 0; i < 5; i++ {
+		blocks, err := a.GetBlocks(after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range blocks {
+			rows = append(rows, b.Nonce)
+		}
+		if len(blocks) < 2 {
+			break
+		}
+		after = blocks[len(blocks)-1].Cursor()
+	}
+	after = nil
+	for i := 0; i < 5; i++ {
+		payments, _ := a.GetPayments("", after, 2)
+		for _, p := range payments {
+			rows = append(rows, p.TxHash+"/"+p.Login)
+		}
+		if len(payments) < 2 {
+			break
+		}
+		after = payments[len(payments)-1].Cursor()
+	}
+	after = nil
+	for i := 0; i < 5; i++ {
+		credits, _ := a.GetCredits("x", after, 2)
+		for _, c := range credits {
+			rows = append(rows, c.Hash)
+		}
+		if len(credits) < 2 {
+			break
+		}
+		after = credits[len(credits)-1].Cursor()
+	}
+	return rows
+}
+
+func TestArchivePages(t *testing.T) {
+	a := NewMemoryArchive()
+	writeTies(a)
+
+	rows := pageTies(t, a)
+	expected := []string{"0x3", "0x2", "0x1", "0xa2/y", "0xa1/z", "0xa1/x", "0xa0/z", "0xa0/x", "0xb13", "0xb12", "0xb11"}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Pages must hold every row once: %v", rows)
+	}
+	if _, err := ParseCursor(a.payments[paymentKey{"0xa0", "x"}].Cursor().String()); err != nil {
+		t.Errorf("Cursor must survive encoding: %v", err)
+	}
+	if _, err := ParseCursor("!"); err != ErrInvalidCursor {
+		t.Errorf("Must reject invalid cursor: %v", err)
+	}
+}
+
+// Runs against real PostgreSQL when DASHPOOL_TEST_POSTGRES holds its connection string
+func TestPostgresArchive(t *testing.T) {
+	url := os.Getenv("DASHPOOL_TEST_POSTGRES")
+	if len(url) == 0 {
+		t.Skip("DASHPOOL_TEST_POSTGRES is not set")
+	}
+	coin := "test" + time.Now().Format("150405.000000")
+	a, err := NewPostgresArchive(&Config{Url: url}, coin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if err := a.Migrate(); err != nil {
+		t.Fatalf("Migrations must be applied once: %v", err)
+	}
+
+	backend := storage.NewMemoryBackend("test")
+	writeHistory(t, backend)
+	expected := NewMemoryArchive()
+	Backfill(backend, expected)
+	for i := 0; i < 2; i++ {
+		if _, err := Backfill(backend, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blocks, _ := a.GetBlocks(nil, 10)
+	expectedBlocks, _ := expected.GetBlocks(nil, 10)
+	payments, _ := a.GetPayments("", nil, 10)
+	expectedPayments, _ := expected.GetPayments("", nil, 10)
+	credits, _ := a.GetCredits("x", &Cursor{Value: 11}, 10)
+	expectedCredits, _ := expected.GetCredits("x", &Cursor{Value: 11}, 10)
+	if !reflect.DeepEqual(blocks, expectedBlocks) || !reflect.DeepEqual(payments, expectedPayments) ||
+		!reflect.DeepEqual(credits, expectedCredits) {
+		t.Errorf("PostgreSQL archive must behave like memory one:\n%v %v %v\n%v %v %v",
+			blocks, payments, credits, expectedBlocks, expectedPayments, expectedCredits)
+	}
+
+	writeTies(a)
+	writeTies(expected)
+	if rows, expectedRows := pageTies(t, a), pageTies(t, expected); !reflect.DeepEqual(rows, expectedRows) {
+		t.Errorf("PostgreSQL pages must match memory ones:\n%v\n%v", rows, expectedRows)
+	}
+}
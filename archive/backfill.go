@@ -0,0 +1,64 @@
+package archive
+
+import (
+	"github.com/PowPool/dashpool/storage"
+)
+
+// Backend history is read in pages of that many rows
+const backfillPage = 1000
+
+type BackfillResult struct {
+	Blocks   int `json:"blocks"`
+	Orphans  int `json:"orphans"`
+	Credits  int `json:"credits"`
+	Payments int `json:"payments"`
+}
+
+// Imports matured blocks with their credits, orphans and payments kept in backend.
+// Records already archived are skipped, so it is safe to run it while pool is working.
+func Backfill(backend storage.Backend, a Archive) (*BackfillResult, error) {
+	result := &BackfillResult{}
+
+	for start := int64(0); ; start += backfillPage {
+		blocks, err := backend.GetMaturedBlocks(start, start+backfillPage-1)
+		if err != nil {
+			return result, err
+		}
+		for _, block := range blocks {
+			var credits map[string]int64
+			if block.Orphan {
+				result.Orphans++
+			} else {
+				credits, err = backend.GetRoundCredits(block.Height, block.Hash)
+				if err != nil {
+					return result, err
+				}
+				result.Blocks++
+				result.Credits += len(credits)
+			}
+			if err := a.WriteBlock(NewBlock(block), credits); err != nil {
+				return result, err
+			}
+		}
+		if len(blocks) < backfillPage {
+			break
+		}
+	}
+
+	for start := int64(0); ; start += backfillPage {
+		payments, err := backend.GetPayments(start, start+backfillPage-1)
+		if err != nil {
+			return result, err
+		}
+		for _, payment := range payments {
+			if err := a.WritePayment(NewPayment(payment)); err != nil {
+				return result, err
+			}
+			result.Payments++
+		}
+		if len(payments) < backfillPage {
+			break
+		}
+	}
+	return result, nil
+}
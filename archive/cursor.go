@@ -0,0 +1,72 @@
+package archive
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Keyset position of the last row of a page, the next page holds rows sorting after it.
+// Value is height of blocks and credits or time of payments, keys break ties between rows
+// of equal value: nonce of blocks, hash of credits, tx hash and login of payments.
+type Cursor struct {
+	Value int64  `json:"v"`
+	Key   string `json:"k"`
+	Login string `json:"l,omitempty"`
+}
+
+func (b *Block) Cursor() *Cursor {
+	return &Cursor{Value: b.Height, Key: b.Nonce}
+}
+
+func (p *Payment) Cursor() *Cursor {
+	return &Cursor{Value: p.Timestamp, Key: p.TxHash, Login: p.Login}
+}
+
+func (c *Credit) Cursor() *Cursor {
+	return &Cursor{Value: c.Height, Key: c.Hash}
+}
+
+// Opaque form for API replies
+func (c *Cursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Nil cursor of empty string starts from the newest row
+func ParseCursor(value string) (*Cursor, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &Cursor{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// Position before any row, as rows have values below max and keys are not empty
+func afterOrFirst(c *Cursor) *Cursor {
+	if c == nil {
+		return &Cursor{Value: math.MaxInt64}
+	}
+	return c
+}
+
+// Rows are ordered by value, key and login, all descending
+func (c *Cursor) isAfter(value int64, key, login string) bool {
+	if value != c.Value {
+		return value < c.Value
+	}
+	if key != c.Key {
+		return key < c.Key
+	}
+	return login < c.Login
+}
@@ -0,0 +1,148 @@
+package archive
+
+import (
+	"sort"
+	"sync"
+)
+
+// In-process stand-in of PostgreSQL archive with the same keys and ordering, for tests
+type MemoryArchive struct {
+	sync.Mutex
+	blocks   map[blockKey]*Block
+	credits  map[creditKey]*Credit
+	payments map[paymentKey]*Payment
+}
+
+// Primary keys of archive tables
+type blockKey struct {
+	height int64
+	nonce  string
+}
+
+type creditKey struct {
+	height int64
+	hash   string
+	login  string
+}
+
+type paymentKey struct {
+	txHash string
+	login  string
+}
+
+func NewMemoryArchive() *MemoryArchive {
+	return &MemoryArchive{
+		blocks:   make(map[blockKey]*Block),
+		credits:  make(map[creditKey]*Credit),
+		payments: make(map[paymentKey]*Payment),
+	}
+}
+
+func (a *MemoryArchive) WriteBlock(block *Block, credits map[string]int64) error {
+	a.Lock()
+	defer a.Unlock()
+
+	key := blockKey{block.Height, block.Nonce}
+	if _, ok := a.blocks[key]; !ok {
+		b := *block
+		a.blocks[key] = &b
+	}
+	for login, amount := range credits {
+		key := creditKey{block.Height, block.Hash, login}
+		if _, ok := a.credits[key]; !ok {
+			a.credits[key] = &Credit{Height: block.Height, Hash: block.Hash, Login: login, Amount: amount}
+		}
+	}
+	return nil
+}
+
+func (a *MemoryArchive) WritePayment(payment *Payment) error {
+	a.Lock()
+	defer a.Unlock()
+
+	key := paymentKey{payment.TxHash, payment.Login}
+	if _, ok := a.payments[key]; !ok {
+		p := *payment
+		a.payments[key] = &p
+	}
+	return nil
+}
+
+func (a *MemoryArchive) GetBlocks(after *Cursor, limit int) ([]*Block, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	after = afterOrFirst(after)
+	blocks := []*Block{}
+	for _, b := range a.blocks {
+		if after.isAfter(b.Height, b.Nonce, "") {
+			block := *b
+			blocks = append(blocks, &block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].Height != blocks[j].Height {
+			return blocks[i].Height > blocks[j].Height
+		}
+		return blocks[i].Nonce > blocks[j].Nonce
+	})
+	if len(blocks) > limitOrMax(limit) {
+		blocks = blocks[:limitOrMax(limit)]
+	}
+	return blocks, nil
+}
+
+func (a *MemoryArchive) GetPayments(login string, after *Cursor, limit int) ([]*Payment, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	after = afterOrFirst(after)
+	payments := []*Payment{}
+	for _, p := range a.payments {
+		if (len(login) == 0 || p.Login == login) && after.isAfter(p.Timestamp, p.TxHash, p.Login) {
+			payment := *p
+			payments = append(payments, &payment)
+		}
+	}
+	sort.Slice(payments, func(i, j int) bool {
+		if payments[i].Timestamp != payments[j].Timestamp {
+			return payments[i].Timestamp > payments[j].Timestamp
+		}
+		if payments[i].TxHash != payments[j].TxHash {
+			return payments[i].TxHash > payments[j].TxHash
+		}
+		return payments[i].Login > payments[j].Login
+	})
+	if len(payments) > limitOrMax(limit) {
+		payments = payments[:limitOrMax(limit)]
+	}
+	return payments, nil
+}
+
+func (a *MemoryArchive) GetCredits(login string, after *Cursor, limit int) ([]*Credit, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	after = afterOrFirst(after)
+	credits := []*Credit{}
+	for _, c := range a.credits {
+		if c.Login == login && after.isAfter(c.Height, c.Hash, "") {
+			credit := *c
+			credits = append(credits, &credit)
+		}
+	}
+	sort.Slice(credits, func(i, j int) bool {
+		if credits[i].Height != credits[j].Height {
+			return credits[i].Height > credits[j].Height
+		}
+		return credits[i].Hash > credits[j].Hash
+	})
+	if len(credits) > limitOrMax(limit) {
+		credits = credits[:limitOrMax(limit)]
+	}
+	return credits, nil
+}
+
+func (a *MemoryArchive) Close() error {
+	return nil
+}
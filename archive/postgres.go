@@ -0,0 +1,225 @@
+package archive
+
+import (
+	"database/sql"
+	"net/url"
+
+	_ "github.com/lib/pq"
+
+	. "github.com/PowPool/dashpool/util"
+)
+
+// Schema versions, applied in order once each. Statements are idempotent themselves,
+// so a migration interrupted before its version is recorded can be applied again.
+var migrations = [][]string{
+	{
+		`CREATE TABLE IF NOT EXISTS blocks (
+			coin TEXT NOT NULL,
+			height BIGINT NOT NULL,
+			nonce TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			timestamp BIGINT NOT NULL,
+			difficulty BIGINT NOT NULL,
+			total_shares BIGINT NOT NULL,
+			reward BIGINT NOT NULL,
+			orphan BOOLEAN NOT NULL,
+			PRIMARY KEY (coin, height, nonce)
+		)`,
+		`CREATE TABLE IF NOT EXISTS credits (
+			coin TEXT NOT NULL,
+			height BIGINT NOT NULL,
+			hash TEXT NOT NULL,
+			login TEXT NOT NULL,
+			amount BIGINT NOT NULL,
+			PRIMARY KEY (coin, height, hash, login)
+		)`,
+		`CREATE INDEX IF NOT EXISTS credits_login ON credits (coin, login, height)`,
+		`CREATE TABLE IF NOT EXISTS payments (
+			coin TEXT NOT NULL,
+			tx_hash TEXT NOT NULL,
+			login TEXT NOT NULL,
+			amount BIGINT NOT NULL,
+			timestamp BIGINT NOT NULL,
+			PRIMARY KEY (coin, tx_hash, login)
+		)`,
+		`CREATE INDEX IF NOT EXISTS payments_timestamp ON payments (coin, timestamp)`,
+		`CREATE INDEX IF NOT EXISTS payments_login ON payments (coin, login, timestamp)`,
+	},
+	// Pages are keyed by rows of equal height or time too
+	{
+		`CREATE INDEX IF NOT EXISTS credits_login_page ON credits (coin, login, height, hash)`,
+		`CREATE INDEX IF NOT EXISTS payments_page ON payments (coin, timestamp, tx_hash, login)`,
+		`CREATE INDEX IF NOT EXISTS payments_login_page ON payments (coin, login, timestamp, tx_hash)`,
+		`DROP INDEX IF EXISTS credits_login`,
+		`DROP INDEX IF EXISTS payments_timestamp`,
+		`DROP INDEX IF EXISTS payments_login`,
+	},
+}
+
+// Any constant shared by pool nodes, so only one of them migrates schema at a time
+const migrationLock = 7426173
+
+type PostgresArchive struct {
+	db   *sql.DB
+	coin string
+}
+
+func NewPostgresArchive(cfg *Config, coin string) (*PostgresArchive, error) {
+	dsn := cfg.Url
+	if len(cfg.Password) > 0 {
+		u, err := url.Parse(cfg.Url)
+		if err != nil {
+			return nil, err
+		}
+		u.User = url.UserPassword(u.User.Username(), cfg.Password)
+		dsn = u.String()
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	a := &PostgresArchive{db: db, coin: coin}
+	if err := a.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Applies migrations newer than the recorded schema version
+func (a *PostgresArchive) Migrate() error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		for _, stmt := range migrations[i] {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			return err
+		}
+		Info.Printf("Migrated archive schema to version %v", i+1)
+	}
+	return tx.Commit()
+}
+
+func (a *PostgresArchive) WriteBlock(block *Block, credits map[string]int64) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO blocks (coin, height, nonce, hash, timestamp, difficulty, total_shares, reward, orphan)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT DO NOTHING`,
+		a.coin, block.Height, block.Nonce, block.Hash, block.Timestamp, block.Difficulty, block.TotalShares,
+		block.Reward, block.Orphan)
+	if err != nil {
+		return err
+	}
+	for login, amount := range credits {
+		_, err = tx.Exec(`INSERT INTO credits (coin, height, hash, login, amount) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING`, a.coin, block.Height, block.Hash, login, amount)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (a *PostgresArchive) WritePayment(payment *Payment) error {
+	_, err := a.db.Exec(`INSERT INTO payments (coin, tx_hash, login, amount, timestamp) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT DO NOTHING`, a.coin, payment.TxHash, payment.Login, payment.Amount, payment.Timestamp)
+	return err
+}
+
+func (a *PostgresArchive) GetBlocks(after *Cursor, limit int) ([]*Block, error) {
+	after = afterOrFirst(after)
+	rows, err := a.db.Query(`SELECT height, nonce, hash, timestamp, difficulty, total_shares, reward, orphan
+		FROM blocks WHERE coin = $1 AND (height, nonce) < ($2, $3) ORDER BY height DESC, nonce DESC LIMIT $4`,
+		a.coin, after.Value, after.Key, limitOrMax(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := []*Block{}
+	for rows.Next() {
+		b := &Block{}
+		err := rows.Scan(&b.Height, &b.Nonce, &b.Hash, &b.Timestamp, &b.Difficulty, &b.TotalShares, &b.Reward, &b.Orphan)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, rows.Err()
+}
+
+func (a *PostgresArchive) GetPayments(login string, after *Cursor, limit int) ([]*Payment, error) {
+	after = afterOrFirst(after)
+	rows, err := a.db.Query(`SELECT tx_hash, login, amount, timestamp FROM payments
+		WHERE coin = $1 AND ($2 = '' OR login = $2) AND (timestamp, tx_hash, login) < ($3, $4, $5)
+		ORDER BY timestamp DESC, tx_hash DESC, login DESC LIMIT $6`,
+		a.coin, login, after.Value, after.Key, after.Login, limitOrMax(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []*Payment{}
+	for rows.Next() {
+		p := &Payment{}
+		if err := rows.Scan(&p.TxHash, &p.Login, &p.Amount, &p.Timestamp); err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+func (a *PostgresArchive) GetCredits(login string, after *Cursor, limit int) ([]*Credit, error) {
+	after = afterOrFirst(after)
+	rows, err := a.db.Query(`SELECT height, hash, login, amount FROM credits
+		WHERE coin = $1 AND login = $2 AND (height, hash) < ($3, $4) ORDER BY height DESC, hash DESC LIMIT $5`,
+		a.coin, login, after.Value, after.Key, limitOrMax(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credits := []*Credit{}
+	for rows.Next() {
+		c := &Credit{}
+		if err := rows.Scan(&c.Height, &c.Hash, &c.Login, &c.Amount); err != nil {
+			return nil, err
+		}
+		credits = append(credits, c)
+	}
+	return credits, rows.Err()
+}
+
+func (a *PostgresArchive) Close() error {
+	return a.db.Close()
+}
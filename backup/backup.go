@@ -0,0 +1,293 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+// Export is JSON lines: header, one line per key and trailer with the number of keys
+// and SHA-256 of all preceding lines
+const (
+	Format  = "dashpool-export"
+	Version = 1
+)
+
+var ErrChecksum = errors.New("export checksum mismatch")
+
+type Header struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	Coin      string `json:"coin"`
+	Schema    int64  `json:"schema"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type Trailer struct {
+	Keys   int    `json:"keys"`
+	Sha256 string `json:"sha256"`
+}
+
+// Export which checksum is verified
+type Dump struct {
+	Header *Header
+	Keys   []*storage.KeyDump
+}
+
+type ImportOptions struct {
+	// Only keys and hash fields of this login are restored
+	Login  string
+	DryRun bool
+}
+
+// Keys relative to prefix, which were or would be written and deleted, and ledger
+// entries posted for balances of restored login
+type ImportResult struct {
+	DryRun   bool                  `json:"dryRun"`
+	Restored []string              `json:"restored"`
+	Removed  []string              `json:"removed"`
+	Ledger   []storage.LedgerEntry `json:"ledger"`
+}
+
+// Writes pool state of backend, pool should be stopped for a consistent export
+func Export(backend storage.Backend, coin string, w io.Writer) (*Trailer, error) {
+	schema, err := backend.GetSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	dumps, err := backend.DumpKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	enc := json.NewEncoder(io.MultiWriter(w, hash))
+	header := &Header{Format: Format, Version: Version, Coin: coin, Schema: schema, Timestamp: MakeTimestamp() / 1000}
+	if err := enc.Encode(header); err != nil {
+		return nil, err
+	}
+	for _, dump := range dumps {
+		if err := enc.Encode(dump); err != nil {
+			return nil, err
+		}
+	}
+	trailer := &Trailer{Keys: len(dumps), Sha256: hex.EncodeToString(hash.Sum(nil))}
+	return trailer, json.NewEncoder(w).Encode(trailer)
+}
+
+// Parses export, failing on checksum mismatch or truncation before anything is restored
+func Read(r io.Reader) (*Dump, error) {
+	var lines [][]byte
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(lines) < 2 {
+		return nil, errors.New("export is truncated")
+	}
+
+	trailer := &Trailer{}
+	if err := json.Unmarshal(lines[len(lines)-1], trailer); err != nil || len(trailer.Sha256) == 0 {
+		return nil, errors.New("export is truncated, trailer is missing")
+	}
+	hash := sha256.New()
+	for _, line := range lines[:len(lines)-1] {
+		hash.Write(line)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != trailer.Sha256 {
+		return nil, ErrChecksum
+	}
+
+	dump := &Dump{Header: &Header{}}
+	if err := json.Unmarshal(lines[0], dump.Header); err != nil {
+		return nil, err
+	}
+	if dump.Header.Format != Format || dump.Header.Version != Version {
+		return nil, fmt.Errorf("unsupported export format %v version %v", dump.Header.Format, dump.Header.Version)
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		key := &storage.KeyDump{}
+		if err := json.Unmarshal(line, key); err != nil {
+			return nil, err
+		}
+		dump.Keys = append(dump.Keys, key)
+	}
+	if len(dump.Keys) != trailer.Keys {
+		return nil, fmt.Errorf("export has %v keys, trailer counts %v", len(dump.Keys), trailer.Keys)
+	}
+	return dump, nil
+}
+
+// Restores pool state of export. Full restore replaces every key of pool state, keys missing
+// in export are deleted. Pool must be stopped.
+func Import(backend storage.Backend, coin string, dump *Dump, opts *ImportOptions) (*ImportResult, error) {
+	if dump.Header.Coin != coin {
+		return nil, fmt.Errorf("export of %v can't be imported into %v", dump.Header.Coin, coin)
+	}
+	if dump.Header.Schema != storage.SchemaVersion {
+		return nil, fmt.Errorf("export has schema version %v, migrate its source to %v first",
+			dump.Header.Schema, storage.SchemaVersion)
+	}
+	if err := backend.CheckSchema(); err != nil {
+		return nil, err
+	}
+	current, err := backend.DumpKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var restore []*storage.KeyDump
+	var remove []string
+	var entries []storage.LedgerEntry
+	if len(opts.Login) > 0 {
+		restore, remove = selectLogin(opts.Login, dump.Keys, current)
+		entries = balanceEntries(opts.Login, dump.Keys, current)
+	} else {
+		restore = dump.Keys
+		remove = missingKeys(dump.Keys, current)
+	}
+
+	result := &ImportResult{DryRun: opts.DryRun, Restored: []string{}, Removed: remove, Ledger: entries}
+	for _, key := range restore {
+		result.Restored = append(result.Restored, key.Key)
+	}
+	if result.Removed == nil {
+		result.Removed = []string{}
+	}
+	if result.Ledger == nil {
+		result.Ledger = []storage.LedgerEntry{}
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+	return result, backend.RestoreKeys(restore, remove, entries)
+}
+
+func indexDumps(dumps []*storage.KeyDump) map[string]*storage.KeyDump {
+	index := make(map[string]*storage.KeyDump)
+	for _, dump := range dumps {
+		index[dump.Key] = dump
+	}
+	return index
+}
+
+// Current keys which export does not have
+func missingKeys(dumps, current []*storage.KeyDump) []string {
+	exported := indexDumps(dumps)
+	var missing []string
+	for _, dump := range current {
+		if _, ok := exported[dump.Key]; !ok {
+			missing = append(missing, dump.Key)
+		}
+	}
+	return missing
+}
+
+// Keys of login are replaced as a whole, fields of login in round shares and credits hashes
+// are merged into current hashes. Pool wide keys, such as finances and ledger, are kept and
+// follow balances of login by ledger entries.
+func selectLogin(login string, dumps, current []*storage.KeyDump) ([]*storage.KeyDump, []string) {
+	exported := indexDumps(dumps)
+	existing := indexDumps(current)
+	names := make(map[string]struct{})
+	for name := range exported {
+		names[name] = struct{}{}
+	}
+	for name := range existing {
+		names[name] = struct{}{}
+	}
+
+	var restore []*storage.KeyDump
+	var remove []string
+	for name := range names {
+		from, to := exported[name], existing[name]
+		switch {
+		case name == "miners:"+login || name == "payments:"+login:
+			if from != nil {
+				restore = append(restore, from)
+			} else {
+				remove = append(remove, name)
+			}
+		case strings.HasPrefix(name, "shares:") || strings.HasPrefix(name, "credits:"):
+			if (from != nil && from.Type != "hash") || (to != nil && to.Type != "hash") {
+				continue
+			}
+			merged, changed := mergeField(login, from, to)
+			if !changed {
+				continue
+			}
+			if len(merged) == 0 {
+				remove = append(remove, name)
+			} else {
+				restore = append(restore, &storage.KeyDump{Key: name, Type: "hash", Hash: merged})
+			}
+		}
+	}
+	sort.Slice(restore, func(i, j int) bool {
+		return restore[i].Key < restore[j].Key
+	})
+	sort.Strings(remove)
+	return restore, remove
+}
+
+// Ledger entries for balances of login which restore changes, so that ledger and pool
+// finances follow them
+func balanceEntries(login string, dumps, current []*storage.KeyDump) []storage.LedgerEntry {
+	from, to := indexDumps(dumps)["miners:"+login], indexDumps(current)["miners:"+login]
+	var entries []storage.LedgerEntry
+	for _, field := range []string{"balance", "immature", "pending", "paid"} {
+		amount := hashInt(from, field) - hashInt(to, field)
+		if amount != 0 {
+			entries = append(entries, storage.RestoreEntry(login, field, amount))
+		}
+	}
+	return entries
+}
+
+func hashInt(dump *storage.KeyDump, field string) int64 {
+	if dump == nil || dump.Type != "hash" {
+		return 0
+	}
+	value, _ := strconv.ParseInt(dump.Hash[field], 10, 64)
+	return value
+}
+
+// Current hash with field of login taken from export
+func mergeField(login string, from, to *storage.KeyDump) (map[string]string, bool) {
+	merged := make(map[string]string)
+	if to != nil {
+		for field, value := range to.Hash {
+			merged[field] = value
+		}
+	}
+	old, had := merged[login]
+	value, ok := "", false
+	if from != nil {
+		value, ok = from.Hash[login]
+	}
+	if ok {
+		merged[login] = value
+	} else {
+		delete(merged, login)
+	}
+	return merged, had != ok || old != value
+}
@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"bytes"
+	"math/big"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+func TestMain(m *testing.M) {
+	InitLog(os.DevNull, os.DevNull, os.DevNull, os.DevNull, ERROR)
+	os.Exit(m.Run())
+}
+
+// Mines and matures one round, pays out one miner and leaves another round in progress
+func writeState(t *testing.T, backend storage.Backend) {
+	backend.WriteShare("x", "rig1", []string{"0x1", "0x0", "0x0"}, 100, 10, time.Hour)
+	backend.WriteShare("z", "rig1", []string{"0x2", "0x0", "0x0"}, 300, 10, time.Hour)
+	backend.WriteBlock("x", "rig1", []string{"0x3", "0x0", "0x0"}, 100, 500, 10, "0xb10c", 1000, 0, time.Hour)
+
+	candidates, _ := backend.GetCandidates(10)
+	if len(candidates) != 1 {
+		t.Fatalf("Must return candidate: %v", candidates)
+	}
+	rewards := map[string]int64{"x": 490, "z": 490}
+	candidates[0].Reward = big.NewInt(1000)
+	backend.WriteImmatureBlock(candidates[0], rewards)
+	immature, _ := backend.GetImmatureBlocks(10)
+	immature[0].Reward = big.NewInt(1000)
+	backend.WriteMaturedBlock(immature[0], rewards, 0)
+
+	backend.LockPayouts("x", 490)
+	backend.UpdateBalance("x", 490)
+	backend.WritePayment("x", "0xbeef", 490)
+	backend.WriteShare("z", "rig1", []string{"0x4", "0x0", "0x0"}, 50, 11, time.Hour)
+}
+
+func export(t *testing.T, backend storage.Backend) []byte {
+	var buf bytes.Buffer
+	trailer, err := Export(backend, "test", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trailer.Keys == 0 {
+		t.Fatal("Must export pool state")
+	}
+	return buf.Bytes()
+}
+
+func TestExportImport(t *testing.T) {
+	source := storage.NewMemoryBackend("test")
+	source.CheckSchema()
+	writeState(t, source)
+	data := export(t, source)
+
+	dump, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := storage.NewMemoryBackend("test")
+	// Stale key of target, which export does not have
+	target.WriteShare("y", "rig1", []string{"0x9", "0x0", "0x0"}, 10, 9, time.Hour)
+	result, err := Import(target, "test", dump, &ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Removed, []string{"miners:y"}) {
+		t.Errorf("Must remove keys missing in export: %v", result.Removed)
+	}
+	expected, _ := source.DumpKeys()
+	actual, _ := target.DumpKeys()
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Import must restore exported state:\n%v\n%v", expected, actual)
+	}
+	if report, _ := target.Reconcile(); !report.Balanced() {
+		t.Errorf("Restored ledger must be balanced: %+v", report)
+	}
+	if _, err := Import(target, "btc", dump, &ImportOptions{}); err == nil {
+		t.Error("Must not import export of another coin")
+	}
+}
+
+func TestReadVerifiesChecksum(t *testing.T) {
+	backend := storage.NewMemoryBackend("test")
+	backend.CheckSchema()
+	writeState(t, backend)
+	data := export(t, backend)
+
+	tampered := bytes.Replace(data, []byte(`"balance":"490"`), []byte(`"balance":"999"`), 1)
+	if bytes.Equal(tampered, data) {
+		t.Fatal("Export must hold balance of z")
+	}
+	if _, err := Read(bytes.NewReader(tampered)); err != ErrChecksum {
+		t.Errorf("Must detect modified export: %v", err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	truncated := strings.Join(lines[:len(lines)-2], "")
+	if _, err := Read(strings.NewReader(truncated)); err == nil {
+		t.Error("Must detect truncated export")
+	}
+}
+
+func TestImportLogin(t *testing.T) {
+	backend := storage.NewMemoryBackend("test")
+	backend.CheckSchema()
+	writeState(t, backend)
+	dump, err := Read(bytes.NewReader(export(t, backend)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bad run credits both miners
+	backend.WriteShare("x", "rig1", []string{"0x5", "0x0", "0x0"}, 70, 11, time.Hour)
+	for _, login := range []string{"x", "z"} {
+		backend.RollbackBalance(login, 100)
+	}
+	zBalance, _ := backend.GetBalance("z")
+
+	result, err := Import(backend, "test", dump, &ImportOptions{Login: "x", DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"miners:x", "payments:x", "shares:roundCurrent"}
+	if !reflect.DeepEqual(result.Restored, expected) || len(result.Removed) != 0 {
+		t.Errorf("Invalid selective restore: %+v", result)
+	}
+	entries := []storage.LedgerEntry{storage.RestoreEntry("x", "balance", -100), storage.RestoreEntry("x", "pending", 100)}
+	if !reflect.DeepEqual(result.Ledger, entries) {
+		t.Errorf("Must post restored balance to ledger: %+v", result.Ledger)
+	}
+	if balance, _ := backend.GetBalance("x"); balance != 100 {
+		t.Errorf("Dry run must not restore anything, balance %v", balance)
+	}
+
+	if _, err := Import(backend, "test", dump, &ImportOptions{Login: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := backend.GetBalance("x"); balance != 0 {
+		t.Errorf("Must restore balance of login, got %v", balance)
+	}
+	if balance, _ := backend.GetBalance("z"); balance != zBalance {
+		t.Errorf("Must not touch other miners, balance %v", balance)
+	}
+	if report, _ := backend.Reconcile(); !report.Balanced() {
+		t.Errorf("Ledger and finances must follow restored balance: %+v", report)
+	}
+	if stats, _ := backend.GetMinerStats("x"); stats["roundShares"] != int64(0) {
+		t.Errorf("Must restore round shares of login: %v", stats["roundShares"])
+	}
+	if stats, _ := backend.GetMinerStats("z"); stats["roundShares"] != int64(50) {
+		t.Errorf("Must keep round shares of other miners: %v", stats["roundShares"])
+	}
+}
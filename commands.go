@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/PowPool/dashpool/archive"
+	"github.com/PowPool/dashpool/backup"
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+// Maintenance commands, run as "dashpool <command> [config.json] [args...]"
+var commands = map[string]func(args []string){
+	"backfill":  backfillCommand,
+	"export":    exportCommand,
+	"import":    importCommand,
+	"inspect":   inspectCommand,
+	"migrate":   migrateCommand,
+	"reconcile": reconcileCommand,
+	"unhalt":    unhaltCommand,
+}
+
+// Loads config and connects to backend without starting any pool module
+func openBackend(args []string) storage.Backend {
+	configFileName := ""
+	if len(args) > 0 {
+		configFileName = args[0]
+	}
+	readConfig(&cfg, configFileName)
+
+	secPassBytes, err := readSecurityPass()
+	if err != nil {
+		log.Fatal("Read Security Password error: ", err.Error())
+	}
+	fmt.Println()
+	err = decryptPoolConfigure(&cfg, secPassBytes)
+	if err != nil {
+		log.Fatal("Decrypt Pool Configure error: ", err.Error())
+	}
+
+	backend := storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	_, err = backend.Check()
+	if err != nil {
+		log.Fatal("Can't establish connection to backend: ", err.Error())
+	}
+	return backend
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		log.Fatal("Error serializing output: ", err.Error())
+	}
+}
+
+// Proves that miner balances and pool finances equal the ledger sums: "dashpool reconcile [config.json] [-open]".
+// With -open, balances stored before ledger was kept are posted as opening entries first, once.
+func reconcileCommand(args []string) {
+	open := len(args) > 0 && args[len(args)-1] == "-open"
+	if open {
+		args = args[:len(args)-1]
+	}
+	backend := openBackend(args)
+	if open {
+		entries, err := backend.OpenLedger()
+		if err != nil {
+			log.Fatal("Failed to open ledger: ", err.Error())
+		}
+		printJSON(entries)
+		log.Printf("Ledger is opened with %v entries", len(entries))
+	}
+	report, err := backend.Reconcile()
+	if err != nil {
+		log.Fatal("Failed to reconcile ledger: ", err.Error())
+	}
+	printJSON(report)
+	if !report.Balanced() {
+		log.Fatalf("Ledger is NOT balanced: total %v, %v mismatches", report.Total, len(report.Mismatches))
+	}
+	log.Printf("Ledger is balanced, %v entries replayed", report.Entries)
+}
+
+// Resumes module halted on critical error: "dashpool unhalt [config.json] <module>",
+// without module lists halted modules
+func unhaltCommand(args []string) {
+	if len(args) == 0 || strings.HasSuffix(args[len(args)-1], ".json") {
+		backend := openBackend(args)
+		halts, err := backend.GetHalts()
+		if err != nil {
+			log.Fatal("Failed to get halted modules: ", err.Error())
+		}
+		printJSON(halts)
+		return
+	}
+	module := args[len(args)-1]
+	backend := openBackend(args[:len(args)-1])
+	state, err := backend.GetHalt(module)
+	if err != nil {
+		log.Fatal("Failed to get halt state: ", err.Error())
+	}
+	if state == nil {
+		log.Fatalf("Module %v is not halted", module)
+	}
+	log.Printf("Clearing halt of %v since %v: %v", module, time.Unix(state.Timestamp, 0), state.Reason)
+	_, err = backend.ClearHalt(module)
+	if err != nil {
+		log.Fatal("Failed to clear halt: ", err.Error())
+	}
+	log.Printf("Module %v will resume on its next run", module)
+}
+
+// Imports blocks, credits and payments history of backend into archive
+func backfillCommand(args []string) {
+	backend := openBackend(args)
+	if !cfg.Archive.Enabled {
+		log.Fatal("Archive is not enabled in config")
+	}
+	a, err := archive.New(&cfg.Archive, cfg.Coin)
+	if err != nil {
+		log.Fatal("Can't open archive: ", err.Error())
+	}
+	defer a.Close()
+
+	result, err := archive.Backfill(backend, a)
+	printJSON(result)
+	if err != nil {
+		log.Fatal("Failed to backfill archive: ", err.Error())
+	}
+	log.Printf("Archive is backfilled")
+}
+
+// Upgrades block and payment records to current schema: "dashpool migrate [config.json] [-dry-run]".
+// Pool must be stopped while it runs.
+func migrateCommand(args []string) {
+	dryRun := len(args) > 0 && args[len(args)-1] == "-dry-run"
+	if dryRun {
+		args = args[:len(args)-1]
+	}
+	backend := openBackend(args)
+	report, err := backend.MigrateSchema(dryRun)
+	printJSON(report)
+	if err != nil {
+		log.Fatal("Failed to migrate schema: ", err.Error())
+	}
+	if dryRun {
+		log.Printf("Dry run, schema is left at version %v", report.Version)
+		return
+	}
+	log.Printf("Schema is at version %v, %v records verified", report.Target, report.Verified)
+}
+
+// Writes balances, credits, blocks, round shares, payments, finances and ledger to JSON lines file:
+// "dashpool export [config.json] <file>". Pool should be stopped for a consistent export.
+func exportCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: dashpool export [config.json] <file>")
+	}
+	backend := openBackend(args[:len(args)-1])
+	f, err := os.OpenFile(args[len(args)-1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatal("Can't create export: ", err.Error())
+	}
+	trailer, err := backup.Export(backend, cfg.Coin, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatal("Failed to export pool state: ", err.Error())
+	}
+	log.Printf("Exported %v keys, sha256 %v", trailer.Keys, trailer.Sha256)
+}
+
+// Restores pool state from export: "dashpool import [-login <address>] [-dry-run] [config.json] <file>".
+// Pool must be stopped.
+func importCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	login := flags.String("login", "", "restore only keys, round shares and credits of this miner")
+	dryRun := flags.Bool("dry-run", false, "report keys to restore without writing them")
+	_ = flags.Parse(args)
+	args = flags.Args()
+	if len(args) == 0 {
+		log.Fatal("Usage: dashpool import [-login <address>] [-dry-run] [config.json] <file>")
+	}
+	if len(*login) > 0 && !IsValidDashAddress(*login) {
+		log.Fatal("Invalid login: ", *login)
+	}
+
+	f, err := os.Open(args[len(args)-1])
+	if err != nil {
+		log.Fatal("Can't open export: ", err.Error())
+	}
+	dump, err := backup.Read(f)
+	f.Close()
+	if err != nil {
+		log.Fatal("Can't read export: ", err.Error())
+	}
+	log.Printf("Export of %v taken at %v is verified, %v keys", dump.Header.Coin,
+		time.Unix(dump.Header.Timestamp, 0), len(dump.Keys))
+
+	backend := openBackend(args[:len(args)-1])
+	result, err := backup.Import(backend, cfg.Coin, dump, &backup.ImportOptions{Login: *login, DryRun: *dryRun})
+	if err != nil {
+		log.Fatal("Failed to import pool state: ", err.Error())
+	}
+	printJSON(result)
+	if result.DryRun {
+		log.Printf("Dry run, %v keys would be restored, %v removed, %v ledger entries posted",
+			len(result.Restored), len(result.Removed), len(result.Ledger))
+		return
+	}
+	log.Printf("%v keys restored, %v removed, %v ledger entries posted", len(result.Restored), len(result.Removed), len(result.Ledger))
+}
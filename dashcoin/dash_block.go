@@ -3,8 +3,11 @@ package dashcoin
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/mutalisk999/bitcoin-lib/src/bigint"
 	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"github.com/mutalisk999/txid_merkle_tree"
 	"io"
 )
 
@@ -75,6 +78,36 @@ func (b *BlockHeader) UnPack(reader io.Reader) error {
 	return nil
 }
 
+func (b BlockHeader) PackToHex() (string, error) {
+	bytesBuf := bytes.NewBuffer([]byte{})
+	bufWriter := io.Writer(bytesBuf)
+	err := b.Pack(bufWriter)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytesBuf.Bytes()), nil
+}
+
+type BlockHeaderPrintAble struct {
+	Version        int32
+	HashPrevBlock  string
+	HashMerkleRoot string
+	Time           uint32
+	Bits           string
+	Nonce          uint32
+}
+
+func (b BlockHeader) GetBlockHeaderPrintAble() BlockHeaderPrintAble {
+	var headerPrintAble BlockHeaderPrintAble
+	headerPrintAble.Version = b.Version
+	headerPrintAble.HashPrevBlock = b.HashPrevBlock.GetHex()
+	headerPrintAble.HashMerkleRoot = b.HashMerkleRoot.GetHex()
+	headerPrintAble.Time = b.Time
+	headerPrintAble.Bits = fmt.Sprintf("%08x", b.Bits)
+	headerPrintAble.Nonce = b.Nonce
+	return headerPrintAble
+}
+
 type Block struct {
 	Header BlockHeader
 	Vtx    []DashTransaction
@@ -145,3 +178,40 @@ func (b *Block) UnPackFromHex(hexStr string) error {
 	}
 	return nil
 }
+
+// Merkle root of the block transactions, compare with HashMerkleRoot of the header
+func (b Block) CalcMerkleRootHex() (string, error) {
+	if len(b.Vtx) == 0 {
+		return "", errors.New("block without transactions")
+	}
+	txIds := make([]string, len(b.Vtx))
+	for i, tx := range b.Vtx {
+		txId, err := tx.CalcTrxId()
+		if err != nil {
+			return "", err
+		}
+		txIds[i] = txId.GetHex()
+	}
+	return txid_merkle_tree.GetMerkleRootHexFromTxIdsWithCoinBase(txIds)
+}
+
+type TrxWithIdPrintAble struct {
+	TxId string
+	TrxPrintAble
+}
+
+type BlockPrintAble struct {
+	Header BlockHeaderPrintAble
+	Vtx    []TrxWithIdPrintAble
+}
+
+func (b Block) GetBlockPrintAble() BlockPrintAble {
+	var blockPrintAble BlockPrintAble
+	blockPrintAble.Header = b.Header.GetBlockHeaderPrintAble()
+	blockPrintAble.Vtx = make([]TrxWithIdPrintAble, len(b.Vtx))
+	for i := range b.Vtx {
+		txId, _ := b.Vtx[i].CalcTrxId()
+		blockPrintAble.Vtx[i] = TrxWithIdPrintAble{TxId: txId.GetHex(), TrxPrintAble: b.Vtx[i].GetTrxPrintAble()}
+	}
+	return blockPrintAble
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/PowPool/dashpool/rpc"
+	"github.com/PowPool/dashpool/util"
 	"github.com/mutalisk999/bitcoin-lib/src/base58"
 	"github.com/mutalisk999/bitcoin-lib/src/keyid"
 	"github.com/mutalisk999/bitcoin-lib/src/pubkey"
@@ -20,7 +22,16 @@ func GetCoinBaseScriptByPubKey(pubKeyHex string) ([]byte, error) {
 	if err != nil {
 		return nil, errors.New("invalid pubKeyHex")
 	}
-	if pubKey[0] != '\x02' && pubKey[0] != '\x03' {
+	// compressed 33 bytes with 02/03 prefix or uncompressed 65 bytes with 04 prefix
+	if len(pubKey) == pubkey.COMPRESSED_PUBLIC_KEY_SIZE {
+		if pubKey[0] != '\x02' && pubKey[0] != '\x03' {
+			return nil, errors.New("invalid pubKeyHex")
+		}
+	} else if len(pubKey) == pubkey.PUBLIC_KEY_SIZE {
+		if pubKey[0] != '\x04' {
+			return nil, errors.New("invalid pubKeyHex")
+		}
+	} else {
 		return nil, errors.New("invalid pubKeyHex")
 	}
 
@@ -60,7 +71,7 @@ func GetCoinBaseScriptByAddress(address string) ([]byte, error) {
 	bytesBuf := bytes.NewBuffer([]byte{})
 	bufWriter := io.Writer(bytesBuf)
 
-	if addrWithCheck[0] == byte(76) || addrWithCheck[0] == byte(140) {
+	if addrWithCheck[0] == ActiveParams.PubKeyHashAddrID {
 		// p2pkh
 		// mainnet: 76      'X'
 		// testnet: 140     'y'
@@ -89,7 +100,7 @@ func GetCoinBaseScriptByAddress(address string) ([]byte, error) {
 		if err != nil {
 			return nil, errors.New("pack byte err")
 		}
-	} else if addrWithCheck[0] == byte(16) || addrWithCheck[0] == byte(19) {
+	} else if addrWithCheck[0] == ActiveParams.ScriptHashAddrID {
 		// p2sh
 		// mainnet: 16   '7'
 		// testnet: 19   '8' or '9'
@@ -118,13 +129,29 @@ func GetCoinBaseScriptByAddress(address string) ([]byte, error) {
 }
 
 func GetCoinBaseScript(wallet string) ([]byte, error) {
-	if len(wallet) == 66 {
+	if len(wallet) == 2*pubkey.COMPRESSED_PUBLIC_KEY_SIZE || len(wallet) == 2*pubkey.PUBLIC_KEY_SIZE {
 		return GetCoinBaseScriptByPubKey(wallet)
 	} else {
 		return GetCoinBaseScriptByAddress(wallet)
 	}
 }
 
+// Script of the payee returned by getblocktemplate. dashd provides the script itself for every payee,
+// so it is used as is and the payee address is decoded only when the script is missing.
+func GetMasterNodeScript(masterNode rpc.MasterNode) ([]byte, error) {
+	if len(masterNode.Script) != 0 {
+		scriptBytes, err := hex.DecodeString(masterNode.Script)
+		if err != nil {
+			return nil, errors.New("invalid script hex")
+		}
+		return scriptBytes, nil
+	}
+	if len(masterNode.Payee) == 0 {
+		return nil, errors.New("payee without script and address")
+	}
+	return GetCoinBaseScript(masterNode.Payee)
+}
+
 func GetCoinBaseScriptHex(wallet string) (string, error) {
 	scriptHex, err := GetCoinBaseScript(wallet)
 	if err != nil {
@@ -178,6 +205,7 @@ type DashCoinBaseTransaction struct {
 	BlockHeight     uint32
 	RewardValue     int64
 	MasterNodeVouts []MasterNodeVout
+	SuperBlockVouts []MasterNodeVout
 	CBExtras        string
 	CBAuxFlag       []byte
 	ExtraPayload    []byte
@@ -245,14 +273,14 @@ func (t *DashCoinBaseTransaction) _generateCoinB() error {
 		return err
 	}
 
-	// vout count: 1 + len(t.MasterNodeVouts)
-	err = serialize.PackCompactSize(writer, uint64(1+len(t.MasterNodeVouts)))
+	// vout count: 1 + len(t.MasterNodeVouts) + len(t.SuperBlockVouts)
+	err = serialize.PackCompactSize(writer, uint64(1+len(t.MasterNodeVouts)+len(t.SuperBlockVouts)))
 	if err != nil {
 		return err
 	}
 
-	// pack master node vout
-	for _, MasterNodeVout := range t.MasterNodeVouts {
+	// pack master node vout, then superblock vout
+	for _, MasterNodeVout := range append(append([]MasterNodeVout{}, t.MasterNodeVouts...), t.SuperBlockVouts...) {
 		err = serialize.PackInt64(writer, MasterNodeVout.Amount)
 		if err != nil {
 			return err
@@ -298,7 +326,7 @@ func (t *DashCoinBaseTransaction) _generateCoinB() error {
 }
 
 func (t *DashCoinBaseTransaction) Initialize(cbWallet string, bTime uint32, height uint32, value int64, flags string,
-	cbPayload string, cbExtras string, masterNodes []rpc.MasterNode) error {
+	cbPayload string, cbExtras string, masterNodes []rpc.MasterNode, superBlocks []rpc.MasterNode) error {
 	t.BlockTime = bTime
 	t.BlockHeight = height
 	t.RewardValue = value
@@ -312,6 +340,19 @@ func (t *DashCoinBaseTransaction) Initialize(cbWallet string, bTime uint32, heig
 	if err != nil {
 		return errors.New("hex decode ExtraPayload error")
 	}
+	if len(payload) != 0 {
+		cbTxHeight, err := ParseCbTxHeight(payload)
+		if err != nil {
+			return err
+		}
+		if cbTxHeight != int32(height) {
+			return fmt.Errorf("CbTx height %v does not match template height %v", cbTxHeight, height)
+		}
+		// Payload goes to coinbase as is, CbTx version unknown yet must not stop the pool
+		if _, err := ParseCbTx(payload); err != nil {
+			util.Error.Printf("Unable to parse CbTx payload at height %v, using it as is: %v", height, err)
+		}
+	}
 	t.ExtraPayload = payload
 
 	bytes1 := PackNumber(int64(t.BlockHeight))
@@ -334,13 +375,23 @@ func (t *DashCoinBaseTransaction) Initialize(cbWallet string, bTime uint32, heig
 	for _, masterNode := range masterNodes {
 		var masterNodeVout MasterNodeVout
 		masterNodeVout.Amount = masterNode.Amount
-		masterNodeVout.VoutScript, err = GetCoinBaseScript(masterNode.Payee)
+		masterNodeVout.VoutScript, err = GetMasterNodeScript(masterNode)
 		if err != nil {
-			return errors.New("GetCoinBaseScript masterNode.Payee error")
+			return fmt.Errorf("GetMasterNodeScript error, payee %v: %v", masterNode.Payee, err)
 		}
 		t.MasterNodeVouts = append(t.MasterNodeVouts, masterNodeVout)
 	}
 
+	for _, superBlock := range superBlocks {
+		var superBlockVout MasterNodeVout
+		superBlockVout.Amount = superBlock.Amount
+		superBlockVout.VoutScript, err = GetMasterNodeScript(superBlock)
+		if err != nil {
+			return fmt.Errorf("GetMasterNodeScript error, superblock payee %v: %v", superBlock.Payee, err)
+		}
+		t.SuperBlockVouts = append(t.SuperBlockVouts, superBlockVout)
+	}
+
 	err = t._generateCoinB()
 	if err != nil {
 		return errors.New("_generateCoinB error")
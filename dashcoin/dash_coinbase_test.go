@@ -5,10 +5,18 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/PowPool/dashpool/rpc"
+	"github.com/PowPool/dashpool/util"
 	"io"
+	"os"
+	"strings"
 	"testing"
 )
 
+func TestMain(m *testing.M) {
+	util.InitLog(os.DevNull, os.DevNull, os.DevNull, os.DevNull, util.ERROR)
+	os.Exit(m.Run())
+}
+
 func TestGetCoinBaseScriptHex1(t *testing.T) {
 	scriptHex, _ := GetCoinBaseScriptHex("XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob")
 	fmt.Println("coinbaser script:", scriptHex)
@@ -38,7 +46,7 @@ func TestInitialize(t *testing.T) {
 	var cbtx DashCoinBaseTransaction
 	_ = cbtx.Initialize("XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", 1607055201, 1827, 18492529212, "",
 		"02002307000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000",
-		"dashpool", []rpc.MasterNode{})
+		"dashpool", []rpc.MasterNode{}, nil)
 
 	extraNonce1 := []byte{0x0, 0x0, 0x0, 0x0}
 	extraNonce2 := []byte{0x0, 0x0, 0x0, 0x0}
@@ -71,7 +79,7 @@ func TestRecoverToDashTransaction(t *testing.T) {
 	var cbtx DashCoinBaseTransaction
 	_ = cbtx.Initialize("XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", 1607055201, 1827, 18492529212, "",
 		"02002307000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000",
-		"dashpool", []rpc.MasterNode{})
+		"dashpool", []rpc.MasterNode{}, nil)
 
 	extraNonce1Hex := "00000000"
 	extraNonce2Hex := "00000000"
@@ -93,3 +101,179 @@ func TestRecoverToDashTransaction(t *testing.T) {
 	fmt.Println("trx type16:", trx.Type16)
 	fmt.Println("trx extrapayload:", trx.ExtraPayload)
 }
+
+// Mainnet genesis coinbase, pays to an uncompressed public key
+const mainnetGenesisCoinBaseHex = "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff6204ffff001d01044c5957697265642030392f4a616e2f3230313420546865204772616e64204578706572696d656e7420476f6573204c6976653a204f76657273746f636b2e636f6d204973204e6f7720416363657074696e6720426974636f696e73ffffffff0100f2052a010000004341040184710fa689ad5023690c80f3a49c8f13f8d45b8c857fbcbc8bc4a8e4d3eb4b10f4d4604fa08dce601aaf0f470216fe1b51850b4acf21b179c45070ac7b03a9ac00000000"
+
+// CbTx coinbase mined by dashd on a private chain at height 1826, pays to P2PKH
+const cbTxCoinBaseHex = "03000500010000000000000000000000000000000000000000000000000000000000000000ffffffff1f0222070414a3c05f08f8000001010000000d2f7374726174756d506f6f6c2f00000000013ca93d4e040000001976a914521dbb202daf1dec4d36181479508513d10d4cd088ac000000004602002207000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"
+
+const genesisPubKeyHex = "040184710fa689ad5023690c80f3a49c8f13f8d45b8c857fbcbc8bc4a8e4d3eb4b10f4d4604fa08dce601aaf0f470216fe1b51850b4acf21b179c45070ac7b03a9"
+
+func TestGetCoinBaseScriptTypes(t *testing.T) {
+	tests := []struct {
+		wallet    string
+		scriptHex string
+	}{
+		{"XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", "76a914521dbb202daf1dec4d36181479508513d10d4cd088ac"},
+		{"7mFVKKgyfRh6WokCP1UNvBEL2gCygwnACP", "a914ceaec48359e9d521a7c6fe5bceee7651b226824e87"},
+		{"034a452d21d26c60076a30bf6701666b30d57ac09c2ff07f34e52cdba13796645d", "21034a452d21d26c60076a30bf6701666b30d57ac09c2ff07f34e52cdba13796645dac"},
+		{genesisPubKeyHex, "41" + genesisPubKeyHex + "ac"},
+	}
+	for _, tt := range tests {
+		scriptHex, err := GetCoinBaseScriptHex(tt.wallet)
+		if err != nil {
+			t.Fatalf("GetCoinBaseScriptHex(%v): %v", tt.wallet, err)
+		}
+		if scriptHex != tt.scriptHex {
+			t.Errorf("GetCoinBaseScriptHex(%v) = %v, want %v", tt.wallet, scriptHex, tt.scriptHex)
+		}
+	}
+
+	// hybrid and malformed public keys
+	for _, wallet := range []string{"06" + genesisPubKeyHex[2:], "05" + tests[2].wallet[2:], ""} {
+		if _, err := GetCoinBaseScript(wallet); err == nil {
+			t.Errorf("GetCoinBaseScript(%v) must fail", wallet)
+		}
+	}
+}
+
+func TestGetMasterNodeScript(t *testing.T) {
+	tests := []struct {
+		masterNode rpc.MasterNode
+		scriptHex  string
+	}{
+		// script takes precedence over payee
+		{rpc.MasterNode{Payee: "XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", Script: "a914ceaec48359e9d521a7c6fe5bceee7651b226824e87"}, "a914ceaec48359e9d521a7c6fe5bceee7651b226824e87"},
+		{rpc.MasterNode{Payee: "XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob"}, "76a914521dbb202daf1dec4d36181479508513d10d4cd088ac"},
+		// platform credit pool payment has no payee address
+		{rpc.MasterNode{Script: "6a"}, "6a"},
+		{rpc.MasterNode{Payee: genesisPubKeyHex}, "41" + genesisPubKeyHex + "ac"},
+	}
+	for _, tt := range tests {
+		scriptBytes, err := GetMasterNodeScript(tt.masterNode)
+		if err != nil {
+			t.Fatalf("GetMasterNodeScript(%+v): %v", tt.masterNode, err)
+		}
+		if hex.EncodeToString(scriptBytes) != tt.scriptHex {
+			t.Errorf("GetMasterNodeScript(%+v) = %x, want %v", tt.masterNode, scriptBytes, tt.scriptHex)
+		}
+	}
+
+	for _, masterNode := range []rpc.MasterNode{{}, {Script: "zz"}, {Payee: "04abcd"}} {
+		if _, err := GetMasterNodeScript(masterNode); err == nil {
+			t.Errorf("GetMasterNodeScript(%+v) must fail", masterNode)
+		}
+	}
+}
+
+// Pool output rebuilt from the wallet matches the one of a mined coinbase
+func TestCoinBasePoolVout(t *testing.T) {
+	tests := []struct {
+		coinBaseHex string
+		cbWallet    string
+	}{
+		{mainnetGenesisCoinBaseHex, genesisPubKeyHex},
+		{cbTxCoinBaseHex, "XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob"},
+	}
+	for _, tt := range tests {
+		var orig DashTransaction
+		err := orig.UnPackFromHex(tt.coinBaseHex)
+		if err != nil {
+			t.Fatalf("UnPackFromHex: %v", err)
+		}
+		last := len(orig.Vout) - 1
+
+		var cbtx DashCoinBaseTransaction
+		err = cbtx.Initialize(tt.cbWallet, 1607055201, 1827, orig.Vout[last].Value, "", "", "dashpool", nil, nil)
+		if err != nil {
+			t.Fatalf("Initialize: %v", err)
+		}
+		trx, err := cbtx.RecoverToDashTransaction("00000000", "00000000")
+		if err != nil {
+			t.Fatalf("RecoverToDashTransaction: %v", err)
+		}
+		if len(trx.Vout) != 1 || trx.Vout[0].Value != orig.Vout[last].Value ||
+			!bytes.Equal(trx.Vout[0].ScriptPubKey.GetScriptBytes(), orig.Vout[last].ScriptPubKey.GetScriptBytes()) {
+			t.Errorf("pool vout = %+v, want %v %x", trx.Vout, orig.Vout[last].Value, orig.Vout[last].ScriptPubKey.GetScriptBytes())
+		}
+	}
+}
+
+// Payments of a template are serialized before the pool output, each one from script of
+// the template or from its payee when the script is missing
+func TestCoinBasePayments(t *testing.T) {
+	masterNodes := []rpc.MasterNode{
+		{Payee: "XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", Amount: 100000000},
+		// platform credit pool payment has no payee address
+		{Script: "6a", Amount: 50000},
+	}
+	superBlocks := []rpc.MasterNode{{Payee: "7mFVKKgyfRh6WokCP1UNvBEL2gCygwnACP", Amount: 200000000}}
+	payload := "02002307000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"
+
+	var cbtx DashCoinBaseTransaction
+	err := cbtx.Initialize("034a452d21d26c60076a30bf6701666b30d57ac09c2ff07f34e52cdba13796645d", 1607055201, 1827,
+		18492529212, "", payload, "dashpool", masterNodes, superBlocks)
+	if err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	expected := "0864617368706f6f6c" + // extras
+		"00000000" + // sequence
+		"04" + // vouts
+		"00e1f50500000000" + "19" + "76a914521dbb202daf1dec4d36181479508513d10d4cd088ac" +
+		"50c3000000000000" + "01" + "6a" +
+		"00c2eb0b00000000" + "17" + "a914ceaec48359e9d521a7c6fe5bceee7651b226824e87" +
+		"3c9a3d4e04000000" + "23" + "21034a452d21d26c60076a30bf6701666b30d57ac09c2ff07f34e52cdba13796645dac" +
+		"00000000" + // locktime
+		"46" + payload
+	if hex.EncodeToString(cbtx.CoinBaseTx2) != expected {
+		t.Errorf("coinb2 = %x\nwant %v", cbtx.CoinBaseTx2, expected)
+	}
+	if _, err := cbtx.RecoverToDashTransaction("00000000", "00000000"); err != nil {
+		t.Errorf("RecoverToDashTransaction: %v", err)
+	}
+}
+
+// Coinbases mined by other pools round trip through Initialize: the part after extranonce rebuilt
+// from template data of the block must match the mined one byte for byte
+func TestCoinBaseRoundTrip(t *testing.T) {
+	tests := []struct {
+		coinBaseHex string
+		cbWallet    string
+		height      uint32
+		cbExtras    string
+	}{
+		{cbTxCoinBaseHex, "XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", 1826, "/stratumPool/"},
+	}
+	for _, tt := range tests {
+		var orig DashTransaction
+		err := orig.UnPackFromHex(tt.coinBaseHex)
+		if err != nil {
+			t.Fatalf("UnPackFromHex: %v", err)
+		}
+		// outputs before the pool one are template payments, fed by script as getblocktemplate reports them
+		last := len(orig.Vout) - 1
+		var masterNodes []rpc.MasterNode
+		for _, vout := range orig.Vout[:last] {
+			masterNodes = append(masterNodes, rpc.MasterNode{
+				Script: hex.EncodeToString(vout.ScriptPubKey.GetScriptBytes()), Amount: vout.Value})
+		}
+
+		var cbtx DashCoinBaseTransaction
+		err = cbtx.Initialize(tt.cbWallet, 1607055201, tt.height, orig.Vout[last].Value, "",
+			hex.EncodeToString(orig.ExtraPayload.GetScriptBytes()), tt.cbExtras, masterNodes, nil)
+		if err != nil {
+			t.Fatalf("Initialize at height %v: %v", tt.height, err)
+		}
+		if !strings.HasSuffix(tt.coinBaseHex, hex.EncodeToString(cbtx.CoinBaseTx2)) {
+			t.Errorf("coinb2 at height %v = %x, not a suffix of mined coinbase", tt.height, cbtx.CoinBaseTx2)
+		}
+		trx, err := cbtx.RecoverToDashTransaction("00000000", "00000000")
+		if err != nil {
+			t.Fatalf("RecoverToDashTransaction: %v", err)
+		}
+		if trx.Version != orig.Version || trx.Type16 != orig.Type16 || len(trx.Vout) != len(orig.Vout) {
+			t.Errorf("coinbase at height %v rebuilt as %+v", tt.height, trx)
+		}
+	}
+}
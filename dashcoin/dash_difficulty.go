@@ -1,13 +1,17 @@
 package dashcoin
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"math/big"
 	"strconv"
+	"strings"
 )
 
 const (
-	GENESISNBITS = uint32(0x1d00ffff)
+	// Target of difficulty 1, the same on every network as in dashd GetDifficulty
+	DIFF1_NBITS = uint32(0x1d00ffff)
 )
 
 func NBits2Target(nBits uint32) *big.Int {
@@ -22,64 +26,152 @@ func NBits2Target(nBits uint32) *big.Int {
 	return nWord
 }
 
-func GetTargetWork(target *big.Int) (float64, error) {
-	targetMax := new(big.Int).Exp(big.NewInt(2), big.NewInt(int64(256)), nil)
+var pow256 = new(big.Int).Lsh(big.NewInt(1), 256)
 
-	targetMaxFloat, err := strconv.ParseFloat(targetMax.Text(10), 64)
-	if err != nil {
-		return 0.0, err
-	}
+// Highest target of 256 bit hash, easiest difficulty there is
+var maxTarget = new(big.Int).Sub(pow256, big.NewInt(1))
 
-	targetFloat, err := strconv.ParseFloat(target.Text(10), 64)
-	if err != nil {
-		return 0.0, err
+// Difficulty of a share or block, kept as its exact target so conversions do not lose precision.
+// Pool difficulty is expected number of hashes per share, 2^256/target, and is what shares are
+// weighted with. Stratum difficulty is relative to the difficulty 1 target and may be below 1.
+type Difficulty struct {
+	target *big.Int
+}
+
+// Target is clamped to [1, 2^256-1], so work of any difficulty is at least one hash
+func NewDifficultyFromTarget(target *big.Int) Difficulty {
+	if target.Sign() <= 0 {
+		target = big.NewInt(1)
+	} else if target.Cmp(maxTarget) > 0 {
+		target = maxTarget
 	}
+	return Difficulty{target: new(big.Int).Set(target)}
+}
 
-	return targetMaxFloat / targetFloat, nil
+func NewDifficultyFromNBits(nBits uint32) Difficulty {
+	return NewDifficultyFromTarget(NBits2Target(nBits))
 }
 
-func GetGenesisTargetWork() (float64, error) {
-	targetGenesis := NBits2Target(GENESISNBITS)
-	return GetTargetWork(targetGenesis)
+// Accepts target as returned by getblocktemplate, with or without 0x prefix
+func NewDifficultyFromTargetHex(targetHex string) (Difficulty, error) {
+	target, ok := new(big.Int).SetString(strings.TrimPrefix(targetHex, "0x"), 16)
+	if !ok || target.Sign() <= 0 || target.Cmp(pow256) >= 0 {
+		return Difficulty{}, errors.New("invalid target hex")
+	}
+	return NewDifficultyFromTarget(target), nil
 }
 
-func GetNBitsDiff(nBits uint32) float64 {
-	shift := (nBits >> 24) & 0xff
-	diff := float64(0xffff) / float64(nBits&0xffffff)
-	for shift < 29 {
-		diff *= 256.0
-		shift = shift + 1
+func NewDifficultyFromPoolDiff(diff int64) Difficulty {
+	if diff <= 0 {
+		diff = 1
+	}
+	return NewDifficultyFromTarget(new(big.Int).Div(pow256, big.NewInt(diff)))
+}
+
+func NewDifficultyFromStratumDiff(diff float64) (Difficulty, error) {
+	if diff <= 0 || math.IsInf(diff, 0) || math.IsNaN(diff) {
+		return Difficulty{}, errors.New("stratum difficulty must be positive")
 	}
-	for shift > 29 {
-		diff /= 256.0
-		shift = shift - 1
+	r := new(big.Rat).SetFloat64(diff)
+	target := new(big.Int).Mul(NBits2Target(DIFF1_NBITS), r.Denom())
+	return NewDifficultyFromTarget(target.Div(target, r.Num())), nil
+}
+
+func (d Difficulty) Target() *big.Int {
+	return new(big.Int).Set(d.target)
+}
+
+// 64 hex digits, as miners expect target
+func (d Difficulty) TargetHex() string {
+	return fmt.Sprintf("%064x", d.target)
+}
+
+// Expected number of hashes to find a hash meeting the target
+func (d Difficulty) Work() *big.Int {
+	return new(big.Int).Div(pow256, d.target)
+}
+
+// Work saturated to int64, which share accounting in backend uses
+func (d Difficulty) PoolDiff() int64 {
+	work := d.Work()
+	if !work.IsInt64() {
+		return math.MaxInt64
 	}
+	return work.Int64()
+}
+
+func (d Difficulty) StratumDiff() float64 {
+	diff, _ := new(big.Rat).SetFrac(NBits2Target(DIFF1_NBITS), d.target).Float64()
 	return diff
 }
 
-func GetTargetDiff(target *big.Int) (float64, error) {
-	targetGenesis := NBits2Target(GENESISNBITS)
+// Scales difficulty by factor, target is divided so higher factor means harder shares
+func (d Difficulty) Mul(factor float64) Difficulty {
+	r := new(big.Rat).SetFloat64(factor)
+	if r == nil || r.Sign() <= 0 {
+		return d
+	}
+	target := new(big.Int).Mul(d.target, r.Denom())
+	return NewDifficultyFromTarget(target.Div(target, r.Num()))
+}
 
-	targetGenesisFloat, err := strconv.ParseFloat(targetGenesis.Text(10), 64)
-	if err != nil {
-		return 0.0, err
+// Difficulty bounded by min and max
+func (d Difficulty) Clamp(min, max Difficulty) Difficulty {
+	if d.Cmp(min) < 0 {
+		return min
+	}
+	if d.Cmp(max) > 0 {
+		return max
 	}
+	return d
+}
 
-	targetFloat, err := strconv.ParseFloat(target.Text(10), 64)
-	if err != nil {
-		return 0.0, err
+func (d Difficulty) Cmp(other Difficulty) int {
+	// lower target is higher difficulty
+	return other.target.Cmp(d.target)
+}
+
+// Hash in hex as displayed by dashd meets the target
+func (d Difficulty) IsMetBy(hashHex string) bool {
+	hash, ok := new(big.Int).SetString(hashHex, 16)
+	return ok && hash.Cmp(d.target) <= 0
+}
+
+func (d Difficulty) String() string {
+	return strconv.FormatFloat(d.StratumDiff(), 'g', -1, 64)
+}
+
+func GetTargetWork(target *big.Int) (float64, error) {
+	if target.Sign() <= 0 {
+		return 0.0, errors.New("target must be positive")
 	}
+	work, _ := new(big.Rat).SetFrac(pow256, target).Float64()
+	return work, nil
+}
+
+func GetDiff1TargetWork() (float64, error) {
+	targetDiff1 := NBits2Target(DIFF1_NBITS)
+	return GetTargetWork(targetDiff1)
+}
+
+func GetNBitsDiff(nBits uint32) float64 {
+	return NewDifficultyFromNBits(nBits).StratumDiff()
+}
 
-	return targetGenesisFloat / targetFloat, nil
+func GetTargetDiff(target *big.Int) (float64, error) {
+	if target.Sign() <= 0 {
+		return 0.0, errors.New("target must be positive")
+	}
+	return NewDifficultyFromTarget(target).StratumDiff(), nil
 }
 
 func GetDiffWork(diff float64) (float64, error) {
-	genesisWork, err := GetGenesisTargetWork()
+	diff1Work, err := GetDiff1TargetWork()
 	if err != nil {
 		return 0.0, err
 	}
 
-	return genesisWork * diff, nil
+	return diff1Work * diff, nil
 }
 
 func GetHashRateByWork(work float64, secs int64, unit string) float64 {
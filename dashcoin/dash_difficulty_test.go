@@ -8,7 +8,7 @@ import (
 )
 
 func TestNBits2Target(t *testing.T) {
-	targetGenesis := NBits2Target(GENESISNBITS)
+	targetGenesis := NBits2Target(DIFF1_NBITS)
 	fmt.Println("base 10, targetGenesis:", targetGenesis.Text(10))
 	fmt.Printf("base 16, targetGenesis: %064s", targetGenesis.Text(16))
 }
@@ -19,13 +19,13 @@ func TestGetTargetWork(t *testing.T) {
 	fmt.Println("Genesis work:", work)
 }
 
-func TestGetGenesisTargetWork(t *testing.T) {
-	work, _ := GetGenesisTargetWork()
+func TestGetDiff1TargetWork(t *testing.T) {
+	work, _ := GetDiff1TargetWork()
 	fmt.Println("Genesis work:", work)
 }
 
 func TestGetNBitsDiff(t *testing.T) {
-	fmt.Println("Genesis diff:", GetNBitsDiff(GENESISNBITS))
+	fmt.Println("Genesis diff:", GetNBitsDiff(DIFF1_NBITS))
 }
 
 func TestGetTargetDiff(t *testing.T) {
@@ -52,3 +52,96 @@ func TestGetHashRateByNBits(t *testing.T) {
 	hashRate, _ := GetHashRateByNBits(0x170eb156, 600, "e")
 	fmt.Printf("hashrate: %f EHash/s", hashRate)
 }
+
+func TestDifficultyConversions(t *testing.T) {
+	diff1 := NewDifficultyFromNBits(DIFF1_NBITS)
+	if diff1.StratumDiff() != 1 || diff1.PoolDiff() != 4295032833 {
+		t.Errorf("difficulty 1: stratum %v, pool %v", diff1.StratumDiff(), diff1.PoolDiff())
+	}
+	if diff1.TargetHex() != "00000000ffff0000000000000000000000000000000000000000000000000000" {
+		t.Errorf("difficulty 1 target: %v", diff1.TargetHex())
+	}
+
+	fromHex, err := NewDifficultyFromTargetHex("0x00000000ffff0000000000000000000000000000000000000000000000000000")
+	if err != nil || fromHex.Cmp(diff1) != 0 {
+		t.Errorf("target hex: %v %v", fromHex, err)
+	}
+	if _, err := NewDifficultyFromTargetHex("zz"); err == nil {
+		t.Error("Must reject invalid target hex")
+	}
+
+	// pool difficulty survives round trip through target
+	for _, poolDiff := range []int64{1, 4295032833, 6000000000000, 1 << 62} {
+		if d := NewDifficultyFromPoolDiff(poolDiff); d.PoolDiff() != poolDiff {
+			t.Errorf("pool difficulty %v round trips to %v", poolDiff, d.PoolDiff())
+		}
+	}
+
+	// fractional stratum difficulty for small rigs
+	for _, stratumDiff := range []float64{0.001, 0.5, 1, 1397.0, 65536.25} {
+		d, err := NewDifficultyFromStratumDiff(stratumDiff)
+		if err != nil {
+			t.Fatalf("NewDifficultyFromStratumDiff(%v): %v", stratumDiff, err)
+		}
+		if math.Abs(d.StratumDiff()-stratumDiff)/stratumDiff > 1e-12 {
+			t.Errorf("stratum difficulty %v round trips to %v", stratumDiff, d.StratumDiff())
+		}
+	}
+	half, _ := NewDifficultyFromStratumDiff(0.5)
+	if half.PoolDiff() != 4295032833/2 {
+		t.Errorf("stratum difficulty 0.5 has pool difficulty %v", half.PoolDiff())
+	}
+	if half.Cmp(diff1) >= 0 || diff1.Mul(2).Cmp(diff1) <= 0 {
+		t.Error("Invalid difficulty ordering")
+	}
+	if _, err := NewDifficultyFromStratumDiff(0); err == nil {
+		t.Error("Must reject zero stratum difficulty")
+	}
+
+	if !diff1.IsMetBy("00000000fffeffffffffffffffffffffffffffffffffffffffffffffffffffff") ||
+		!diff1.IsMetBy(diff1.TargetHex()) ||
+		diff1.IsMetBy("00000000ffff0000000000000000000000000000000000000000000000000001") {
+		t.Error("Hash must meet target when not above it")
+	}
+}
+
+func TestGetTargetDiffExact(t *testing.T) {
+	// big integers are not rounded through float parsing
+	diff, _ := GetTargetDiff(NBits2Target(0x1b0404cb))
+	if math.Abs(diff-16307.420938523983) > 1e-9 {
+		t.Errorf("difficulty of 0x1b0404cb = %v", diff)
+	}
+	if GetNBitsDiff(0x1b0404cb) != diff {
+		t.Errorf("GetNBitsDiff = %v, want %v", GetNBitsDiff(0x1b0404cb), diff)
+	}
+}
+
+func TestDifficultyBounds(t *testing.T) {
+	// lowering difficulty stops at target 2^256-1, which still weighs one hash
+	d := NewDifficultyFromPoolDiff(1)
+	for i := 0; i < 100; i++ {
+		d = d.Mul(0.8)
+	}
+	if d.PoolDiff() != 1 || len(d.TargetHex()) != 64 {
+		t.Errorf("lowest difficulty: pool %v, target %v", d.PoolDiff(), d.TargetHex())
+	}
+	if NewDifficultyFromTarget(new(big.Int).Lsh(big.NewInt(1), 300)).Cmp(d) != 0 {
+		t.Error("Target above 2^256-1 must be clamped")
+	}
+
+	min, _ := NewDifficultyFromStratumDiff(0.5)
+	max, _ := NewDifficultyFromStratumDiff(64)
+	for _, test := range []struct {
+		diff     float64
+		expected Difficulty
+	}{{0.1, min}, {0.5, min}, {1000, max}} {
+		diff, _ := NewDifficultyFromStratumDiff(test.diff)
+		if clamped := diff.Clamp(min, max); clamped.Cmp(test.expected) != 0 {
+			t.Errorf("difficulty %v clamped to %v, want %v", test.diff, clamped, test.expected)
+		}
+	}
+	diff1 := NewDifficultyFromNBits(DIFF1_NBITS)
+	if diff1.Clamp(min, max).Cmp(diff1) != 0 {
+		t.Error("Difficulty within bounds must not change")
+	}
+}
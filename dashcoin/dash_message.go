@@ -0,0 +1,89 @@
+package dashcoin
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/mutalisk999/bitcoin-lib/src/base58"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
+	"io"
+)
+
+const (
+	// same magic as dashd strMessageMagic
+	MESSAGE_MAGIC          = "DarkCoin Signed Message:\n"
+	COMPACT_SIGNATURE_SIZE = 65
+)
+
+func GetMessageHash(message string) ([]byte, error) {
+	bytesBuf := bytes.NewBuffer([]byte{})
+	bufWriter := io.Writer(bytesBuf)
+
+	magic, err := PackString(MESSAGE_MAGIC)
+	if err != nil {
+		return nil, err
+	}
+	_, err = bufWriter.Write(magic)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := PackString(message)
+	if err != nil {
+		return nil, err
+	}
+	_, err = bufWriter.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+	return utility.Sha256(utility.Sha256(bytesBuf.Bytes())), nil
+}
+
+// Recovers public key from a base64 compact signature produced by "signmessage"
+// and returns hash160 of its serialized form
+func RecoverMessageKeyID(signatureBase64 string, message string) ([]byte, error) {
+	signature, err := base64.StdEncoding.DecodeString(signatureBase64)
+	if err != nil {
+		return nil, errors.New("invalid signature encoding")
+	}
+	if len(signature) != COMPACT_SIGNATURE_SIZE {
+		return nil, errors.New("invalid signature length")
+	}
+	hash, err := GetMessageHash(message)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, compressed, err := ecdsa.RecoverCompact(signature, hash)
+	if err != nil {
+		return nil, err
+	}
+	if compressed {
+		return utility.Hash160(pubKey.SerializeCompressed()), nil
+	}
+	return utility.Hash160(pubKey.SerializeUncompressed()), nil
+}
+
+// Verifies "signmessage" signature against a P2PKH address
+func VerifyMessage(address string, signatureBase64 string, message string) (bool, error) {
+	addrWithCheck, err := base58.Decode(address)
+	if err != nil {
+		return false, errors.New("invalid address")
+	}
+	if len(addrWithCheck) != 25 {
+		return false, errors.New("invalid address")
+	}
+	check1 := utility.Sha256(utility.Sha256(addrWithCheck[0:21]))[0:4]
+	check2 := addrWithCheck[21:25]
+	if bytes.Compare(check1, check2) != 0 {
+		return false, errors.New("invalid address")
+	}
+	if addrWithCheck[0] != ActiveParams.PubKeyHashAddrID {
+		return false, errors.New("only p2pkh address can sign message")
+	}
+
+	keyId, err := RecoverMessageKeyID(signatureBase64, message)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(keyId, addrWithCheck[1:21]), nil
+}
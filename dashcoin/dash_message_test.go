@@ -0,0 +1,51 @@
+package dashcoin
+
+import (
+	"encoding/base64"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/mutalisk999/bitcoin-lib/src/base58"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
+	"testing"
+)
+
+func p2pkhAddress(version byte, pubKey []byte) string {
+	payload := append([]byte{version}, utility.Hash160(pubKey)...)
+	check := utility.Sha256(utility.Sha256(payload))[0:4]
+	return base58.Encode(append(payload, check...))
+}
+
+func TestVerifyMessage(t *testing.T) {
+	key := secp256k1.PrivKeyFromBytes([]byte("dashpool test private key seed!!"))
+	message := "dash:XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob:100000000"
+	hash, _ := GetMessageHash(message)
+
+	for _, compressed := range []bool{true, false} {
+		pubKey := key.PubKey().SerializeUncompressed()
+		if compressed {
+			pubKey = key.PubKey().SerializeCompressed()
+		}
+		address := p2pkhAddress(76, pubKey)
+		signature := base64.StdEncoding.EncodeToString(ecdsa.SignCompact(key, hash, compressed))
+
+		ok, err := VerifyMessage(address, signature, message)
+		if err != nil || !ok {
+			t.Errorf("Must verify signature by %v: %v", address, err)
+		}
+		ok, _ = VerifyMessage(address, signature, message+"0")
+		if ok {
+			t.Error("Must not verify signature of another message")
+		}
+	}
+
+	other := p2pkhAddress(76, secp256k1.PrivKeyFromBytes([]byte("another dashpool test private key")).PubKey().SerializeCompressed())
+	signature := base64.StdEncoding.EncodeToString(ecdsa.SignCompact(key, hash, true))
+	ok, _ := VerifyMessage(other, signature, message)
+	if ok {
+		t.Error("Must not verify signature by another address")
+	}
+	_, err := VerifyMessage(other, "AAAA", message)
+	if err == nil {
+		t.Error("Must reject malformed signature")
+	}
+}
@@ -0,0 +1,109 @@
+package dashcoin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/PowPool/dashpool/util"
+)
+
+// Consensus and address parameters of a Dash network, mirrors chainparams.cpp of dashd
+type Params struct {
+	util.Network
+	// Chain name as reported by getblockchaininfo
+	Chain string
+	// Compact target of the genesis block, the lowest difficulty network accepts
+	GenesisBits uint32
+	// Confirmations required before coinbase output can be spent
+	CoinbaseMaturity int64
+
+	MasternodePaymentsStartBlock int64
+	SuperblockStartBlock         int64
+	SuperblockCycle              int64
+}
+
+var MainNetParams = Params{
+	Network:                      util.Network{Name: "mainnet", PubKeyHashAddrID: 76, ScriptHashAddrID: 16},
+	Chain:                        "main",
+	GenesisBits:                  0x1e0ffff0,
+	CoinbaseMaturity:             100,
+	MasternodePaymentsStartBlock: 100000,
+	SuperblockStartBlock:         614820,
+	SuperblockCycle:              16616,
+}
+
+var TestNetParams = Params{
+	Network:                      util.Network{Name: "testnet", PubKeyHashAddrID: 140, ScriptHashAddrID: 19},
+	Chain:                        "test",
+	GenesisBits:                  0x1e0ffff0,
+	CoinbaseMaturity:             100,
+	MasternodePaymentsStartBlock: 4010,
+	SuperblockStartBlock:         4200,
+	SuperblockCycle:              24,
+}
+
+var DevNetParams = Params{
+	Network:                      util.Network{Name: "devnet", PubKeyHashAddrID: 140, ScriptHashAddrID: 19},
+	Chain:                        "devnet",
+	GenesisBits:                  0x207fffff,
+	CoinbaseMaturity:             100,
+	MasternodePaymentsStartBlock: 4010,
+	SuperblockStartBlock:         4200,
+	SuperblockCycle:              24,
+}
+
+var RegTestParams = Params{
+	Network:                      util.Network{Name: "regtest", PubKeyHashAddrID: 140, ScriptHashAddrID: 19},
+	Chain:                        "regtest",
+	GenesisBits:                  0x207fffff,
+	CoinbaseMaturity:             100,
+	MasternodePaymentsStartBlock: 240,
+	SuperblockStartBlock:         1500,
+	SuperblockCycle:              10,
+}
+
+var networkParams = map[string]*Params{
+	MainNetParams.Name: &MainNetParams,
+	TestNetParams.Name: &TestNetParams,
+	DevNetParams.Name:  &DevNetParams,
+	RegTestParams.Name: &RegTestParams,
+}
+
+// Params of the network pool runs on
+var ActiveParams = &MainNetParams
+
+func GetParams(name string) (*Params, error) {
+	if len(name) == 0 {
+		return &MainNetParams, nil
+	}
+	params, ok := networkParams[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown network %v", name)
+	}
+	return params, nil
+}
+
+// Selects network on startup, address validation in util follows it
+func SelectParams(name string) error {
+	params, err := GetParams(name)
+	if err != nil {
+		return err
+	}
+	ActiveParams = params
+	util.SetNetwork(&params.Network)
+	return nil
+}
+
+// Devnets are reported as "devnet-<name>"
+func (p *Params) IsChain(chain string) bool {
+	return chain == p.Chain || strings.HasPrefix(chain, p.Chain+"-")
+}
+
+// Same as masternode_payments_started of getblocktemplate, payments begin after the start block
+func (p *Params) MasternodePaymentsStarted(height int64) bool {
+	return height > p.MasternodePaymentsStartBlock
+}
+
+func (p *Params) IsSuperblock(height int64) bool {
+	return height >= p.SuperblockStartBlock && height%p.SuperblockCycle == 0
+}
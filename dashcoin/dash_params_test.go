@@ -0,0 +1,50 @@
+package dashcoin
+
+import (
+	"testing"
+
+	"github.com/PowPool/dashpool/util"
+)
+
+func TestSelectParams(t *testing.T) {
+	defer SelectParams("mainnet")
+
+	if _, err := GetParams("moonnet"); err == nil {
+		t.Error("Must reject unknown network")
+	}
+	if params, _ := GetParams(""); params != &MainNetParams {
+		t.Error("Must default to mainnet")
+	}
+
+	mainnetAddress := "XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob"
+	if _, err := GetCoinBaseScriptByAddress(mainnetAddress); err != nil {
+		t.Errorf("Must build script for mainnet address: %v", err)
+	}
+
+	err := SelectParams("regtest")
+	if err != nil || ActiveParams != &RegTestParams {
+		t.Fatalf("Must select regtest: %v", err)
+	}
+	if util.CurrentNetwork().PubKeyHashAddrID != 140 || util.IsValidDashAddress(mainnetAddress) {
+		t.Error("Address validation must follow selected network")
+	}
+	if _, err := GetCoinBaseScriptByAddress(mainnetAddress); err == nil {
+		t.Error("Must not pay to address of another network")
+	}
+}
+
+func TestSuperblockSchedule(t *testing.T) {
+	params := &RegTestParams
+	if params.IsSuperblock(1490) || !params.IsSuperblock(1500) || params.IsSuperblock(1505) || !params.IsSuperblock(1510) {
+		t.Error("Superblocks must start at start block and repeat every cycle")
+	}
+	if MainNetParams.IsSuperblock(614820) || !MainNetParams.IsSuperblock(631408) {
+		t.Error("Mainnet superblocks must be multiples of cycle")
+	}
+	if params.MasternodePaymentsStarted(240) || !params.MasternodePaymentsStarted(241) {
+		t.Error("Invalid masternode payments start")
+	}
+	if !DevNetParams.IsChain("devnet-ci") || MainNetParams.IsChain("test") {
+		t.Error("Invalid chain matching")
+	}
+}
@@ -0,0 +1,733 @@
+package dashcoin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/script"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Payloads of special transactions, see DIP2 (special transactions), DIP3 (provider transactions),
+// DIP4 (coinbase payload) and DIP6 (quorum commitment)
+
+const (
+	CBTX_VERSION_MERKLE_ROOT_QUORUMS = 2
+	CBTX_VERSION_CLSIG_AND_BALANCE   = 3
+
+	PROTX_VERSION_BASIC_BLS = 2
+	PROTX_TYPE_EVO          = 1
+
+	BLS_PUBLIC_KEY_SIZE = 48
+	BLS_SIGNATURE_SIZE  = 96
+	KEY_ID_SIZE         = 20
+
+	// same limit as MAX_TX_EXTRA_PAYLOAD of dashd
+	MAX_SPECIAL_PAYLOAD_SIZE = 10000
+)
+
+// Serialize helpers take a short read for a value, payload reader must fail on truncated data instead
+type fullReader struct {
+	reader io.Reader
+}
+
+func (r fullReader) Read(p []byte) (int, error) {
+	return io.ReadFull(r.reader, p)
+}
+
+func unpackBytes(reader io.Reader, size int) ([]byte, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(reader, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func unpackVarBytes(reader io.Reader) ([]byte, error) {
+	size, err := serialize.UnPackCompactSize(reader)
+	if err != nil {
+		return nil, err
+	}
+	if size > MAX_SPECIAL_PAYLOAD_SIZE {
+		return nil, errors.New("var bytes too large")
+	}
+	return unpackBytes(reader, int(size))
+}
+
+// IPv6 (or IPv4 mapped) address followed by big endian port
+type Service struct {
+	IP   net.IP
+	Port uint16
+}
+
+func (s *Service) UnPack(reader io.Reader) error {
+	data, err := unpackBytes(reader, net.IPv6len+2)
+	if err != nil {
+		return err
+	}
+	s.IP = net.IP(data[0:net.IPv6len])
+	s.Port = binary.BigEndian.Uint16(data[net.IPv6len:])
+	return nil
+}
+
+func (s Service) String() string {
+	return net.JoinHostPort(s.IP.String(), strconv.Itoa(int(s.Port)))
+}
+
+// Dynamic bitset of quorum members, bit count followed by packed bits
+type BitSet []bool
+
+func (b *BitSet) UnPack(reader io.Reader) error {
+	size, err := serialize.UnPackCompactSize(reader)
+	if err != nil {
+		return err
+	}
+	if size > MAX_SPECIAL_PAYLOAD_SIZE {
+		return errors.New("bitset too large")
+	}
+	data, err := unpackBytes(reader, int(size+7)/8)
+	if err != nil {
+		return err
+	}
+	bits := make([]bool, size)
+	for i := range bits {
+		bits[i] = data[i/8]&(1<<uint(i%8)) != 0
+	}
+	*b = bits
+	return nil
+}
+
+func (b BitSet) Count() int {
+	count := 0
+	for _, bit := range b {
+		if bit {
+			count++
+		}
+	}
+	return count
+}
+
+// DIP4 coinbase payload
+type CbTx struct {
+	Version           uint16
+	Height            int32
+	MerkleRootMNList  bigint.Uint256
+	MerkleRootQuorums bigint.Uint256
+	BestCLHeightDiff  uint64
+	BestCLSignature   []byte
+	CreditPoolBalance int64
+}
+
+func (p *CbTx) UnPack(reader io.Reader) error {
+	var err error
+	p.Version, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	if p.Version == 0 {
+		return errors.New("invalid CbTx version")
+	}
+	p.Height, err = serialize.UnPackInt32(reader)
+	if err != nil {
+		return err
+	}
+	err = p.MerkleRootMNList.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	if p.Version < CBTX_VERSION_MERKLE_ROOT_QUORUMS {
+		return nil
+	}
+	err = p.MerkleRootQuorums.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	if p.Version < CBTX_VERSION_CLSIG_AND_BALANCE {
+		return nil
+	}
+	p.BestCLHeightDiff, err = serialize.UnPackCompactSize(reader)
+	if err != nil {
+		return err
+	}
+	p.BestCLSignature, err = unpackBytes(reader, BLS_SIGNATURE_SIZE)
+	if err != nil {
+		return err
+	}
+	p.CreditPoolBalance, err = serialize.UnPackInt64(reader)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+type CbTxPrintAble struct {
+	Version           uint16
+	Height            int32
+	MerkleRootMNList  string
+	MerkleRootQuorums string
+	BestCLHeightDiff  uint64
+	BestCLSignature   string
+	CreditPoolBalance int64
+}
+
+func (p CbTx) GetPrintAble() CbTxPrintAble {
+	var printAble CbTxPrintAble
+	printAble.Version = p.Version
+	printAble.Height = p.Height
+	printAble.MerkleRootMNList = p.MerkleRootMNList.GetHex()
+	if p.Version >= CBTX_VERSION_MERKLE_ROOT_QUORUMS {
+		printAble.MerkleRootQuorums = p.MerkleRootQuorums.GetHex()
+	}
+	printAble.BestCLHeightDiff = p.BestCLHeightDiff
+	printAble.BestCLSignature = hex.EncodeToString(p.BestCLSignature)
+	printAble.CreditPoolBalance = p.CreditPoolBalance
+	return printAble
+}
+
+// Fields present in ProRegTx and ProUpServTx of evonodes only
+type PlatformInfo struct {
+	PlatformNodeID   []byte
+	PlatformP2PPort  uint16
+	PlatformHTTPPort uint16
+}
+
+func (p *PlatformInfo) UnPack(reader io.Reader) error {
+	var err error
+	p.PlatformNodeID, err = unpackBytes(reader, KEY_ID_SIZE)
+	if err != nil {
+		return err
+	}
+	p.PlatformP2PPort, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	p.PlatformHTTPPort, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DIP3 masternode registration
+type ProRegTx struct {
+	Version            uint16
+	Type               uint16
+	Mode               uint16
+	CollateralOutpoint OutPoint
+	Addr               Service
+	KeyIDOwner         []byte
+	PubKeyOperator     []byte
+	KeyIDVoting        []byte
+	OperatorReward     uint16
+	ScriptPayout       script.Script
+	InputsHash         bigint.Uint256
+	Platform           PlatformInfo
+	Sig                []byte
+}
+
+func (p *ProRegTx) UnPack(reader io.Reader) error {
+	var err error
+	p.Version, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	if p.Version == 0 {
+		return errors.New("invalid ProRegTx version")
+	}
+	p.Type, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	p.Mode, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	err = p.CollateralOutpoint.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	err = p.Addr.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	p.KeyIDOwner, err = unpackBytes(reader, KEY_ID_SIZE)
+	if err != nil {
+		return err
+	}
+	p.PubKeyOperator, err = unpackBytes(reader, BLS_PUBLIC_KEY_SIZE)
+	if err != nil {
+		return err
+	}
+	p.KeyIDVoting, err = unpackBytes(reader, KEY_ID_SIZE)
+	if err != nil {
+		return err
+	}
+	p.OperatorReward, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	err = p.ScriptPayout.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	err = p.InputsHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	if p.Type == PROTX_TYPE_EVO {
+		err = p.Platform.UnPack(reader)
+		if err != nil {
+			return err
+		}
+	}
+	p.Sig, err = unpackVarBytes(reader)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+type ProRegTxPrintAble struct {
+	Version            uint16
+	Type               uint16
+	Mode               uint16
+	CollateralOutpoint OutPointPrintAble
+	Service            string
+	KeyIDOwner         string
+	PubKeyOperator     string
+	KeyIDVoting        string
+	OperatorReward     uint16
+	ScriptPayout       string
+	InputsHash         string
+	PlatformNodeID     string
+	PlatformP2PPort    uint16
+	PlatformHTTPPort   uint16
+}
+
+func (p ProRegTx) GetPrintAble() ProRegTxPrintAble {
+	var printAble ProRegTxPrintAble
+	printAble.Version = p.Version
+	printAble.Type = p.Type
+	printAble.Mode = p.Mode
+	printAble.CollateralOutpoint.Hash = p.CollateralOutpoint.Hash.GetHex()
+	printAble.CollateralOutpoint.N = p.CollateralOutpoint.N
+	printAble.Service = p.Addr.String()
+	printAble.KeyIDOwner = hex.EncodeToString(p.KeyIDOwner)
+	printAble.PubKeyOperator = hex.EncodeToString(p.PubKeyOperator)
+	printAble.KeyIDVoting = hex.EncodeToString(p.KeyIDVoting)
+	printAble.OperatorReward = p.OperatorReward
+	printAble.ScriptPayout = hex.EncodeToString(p.ScriptPayout.GetScriptBytes())
+	printAble.InputsHash = p.InputsHash.GetHex()
+	printAble.PlatformNodeID = hex.EncodeToString(p.Platform.PlatformNodeID)
+	printAble.PlatformP2PPort = p.Platform.PlatformP2PPort
+	printAble.PlatformHTTPPort = p.Platform.PlatformHTTPPort
+	return printAble
+}
+
+// DIP3 masternode service update, signed by operator
+type ProUpServTx struct {
+	Version              uint16
+	Type                 uint16
+	ProTxHash            bigint.Uint256
+	Addr                 Service
+	ScriptOperatorPayout script.Script
+	InputsHash           bigint.Uint256
+	Platform             PlatformInfo
+	Sig                  []byte
+}
+
+func (p *ProUpServTx) UnPack(reader io.Reader) error {
+	var err error
+	p.Version, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	if p.Version == 0 {
+		return errors.New("invalid ProUpServTx version")
+	}
+	if p.Version >= PROTX_VERSION_BASIC_BLS {
+		p.Type, err = serialize.UnPackUint16(reader)
+		if err != nil {
+			return err
+		}
+	}
+	err = p.ProTxHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	err = p.Addr.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	err = p.ScriptOperatorPayout.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	err = p.InputsHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	if p.Type == PROTX_TYPE_EVO {
+		err = p.Platform.UnPack(reader)
+		if err != nil {
+			return err
+		}
+	}
+	p.Sig, err = unpackBytes(reader, BLS_SIGNATURE_SIZE)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+type ProUpServTxPrintAble struct {
+	Version              uint16
+	Type                 uint16
+	ProTxHash            string
+	Service              string
+	ScriptOperatorPayout string
+	InputsHash           string
+	PlatformNodeID       string
+	PlatformP2PPort      uint16
+	PlatformHTTPPort     uint16
+}
+
+func (p ProUpServTx) GetPrintAble() ProUpServTxPrintAble {
+	var printAble ProUpServTxPrintAble
+	printAble.Version = p.Version
+	printAble.Type = p.Type
+	printAble.ProTxHash = p.ProTxHash.GetHex()
+	printAble.Service = p.Addr.String()
+	printAble.ScriptOperatorPayout = hex.EncodeToString(p.ScriptOperatorPayout.GetScriptBytes())
+	printAble.InputsHash = p.InputsHash.GetHex()
+	printAble.PlatformNodeID = hex.EncodeToString(p.Platform.PlatformNodeID)
+	printAble.PlatformP2PPort = p.Platform.PlatformP2PPort
+	printAble.PlatformHTTPPort = p.Platform.PlatformHTTPPort
+	return printAble
+}
+
+// DIP3 registrar update, signed by owner
+type ProUpRegTx struct {
+	Version        uint16
+	ProTxHash      bigint.Uint256
+	Mode           uint16
+	PubKeyOperator []byte
+	KeyIDVoting    []byte
+	ScriptPayout   script.Script
+	InputsHash     bigint.Uint256
+	Sig            []byte
+}
+
+func (p *ProUpRegTx) UnPack(reader io.Reader) error {
+	var err error
+	p.Version, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	if p.Version == 0 {
+		return errors.New("invalid ProUpRegTx version")
+	}
+	err = p.ProTxHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	p.Mode, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	p.PubKeyOperator, err = unpackBytes(reader, BLS_PUBLIC_KEY_SIZE)
+	if err != nil {
+		return err
+	}
+	p.KeyIDVoting, err = unpackBytes(reader, KEY_ID_SIZE)
+	if err != nil {
+		return err
+	}
+	err = p.ScriptPayout.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	err = p.InputsHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	p.Sig, err = unpackVarBytes(reader)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+type ProUpRegTxPrintAble struct {
+	Version        uint16
+	ProTxHash      string
+	Mode           uint16
+	PubKeyOperator string
+	KeyIDVoting    string
+	ScriptPayout   string
+	InputsHash     string
+}
+
+func (p ProUpRegTx) GetPrintAble() ProUpRegTxPrintAble {
+	var printAble ProUpRegTxPrintAble
+	printAble.Version = p.Version
+	printAble.ProTxHash = p.ProTxHash.GetHex()
+	printAble.Mode = p.Mode
+	printAble.PubKeyOperator = hex.EncodeToString(p.PubKeyOperator)
+	printAble.KeyIDVoting = hex.EncodeToString(p.KeyIDVoting)
+	printAble.ScriptPayout = hex.EncodeToString(p.ScriptPayout.GetScriptBytes())
+	printAble.InputsHash = p.InputsHash.GetHex()
+	return printAble
+}
+
+// DIP3 operator revocation
+type ProUpRevTx struct {
+	Version    uint16
+	ProTxHash  bigint.Uint256
+	Reason     uint16
+	InputsHash bigint.Uint256
+	Sig        []byte
+}
+
+func (p *ProUpRevTx) UnPack(reader io.Reader) error {
+	var err error
+	p.Version, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	if p.Version == 0 {
+		return errors.New("invalid ProUpRevTx version")
+	}
+	err = p.ProTxHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	p.Reason, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	err = p.InputsHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	p.Sig, err = unpackBytes(reader, BLS_SIGNATURE_SIZE)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+type ProUpRevTxPrintAble struct {
+	Version    uint16
+	ProTxHash  string
+	Reason     uint16
+	InputsHash string
+}
+
+func (p ProUpRevTx) GetPrintAble() ProUpRevTxPrintAble {
+	return ProUpRevTxPrintAble{Version: p.Version, ProTxHash: p.ProTxHash.GetHex(), Reason: p.Reason,
+		InputsHash: p.InputsHash.GetHex()}
+}
+
+const (
+	QC_VERSION_INDEXED           = 2
+	QC_VERSION_BASIC_BLS_INDEXED = 4
+)
+
+// DIP6 final commitment of a LLMQ
+type FinalCommitment struct {
+	Version         uint16
+	LLMQType        uint8
+	QuorumHash      bigint.Uint256
+	QuorumIndex     int16
+	Signers         BitSet
+	ValidMembers    BitSet
+	QuorumPublicKey []byte
+	QuorumVvecHash  bigint.Uint256
+	QuorumSig       []byte
+	MembersSig      []byte
+}
+
+func (c *FinalCommitment) UnPack(reader io.Reader) error {
+	var err error
+	c.Version, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	c.LLMQType, err = serialize.UnPackUint8(reader)
+	if err != nil {
+		return err
+	}
+	err = c.QuorumHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	if c.Version == QC_VERSION_INDEXED || c.Version == QC_VERSION_BASIC_BLS_INDEXED {
+		c.QuorumIndex, err = serialize.UnPackInt16(reader)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Signers.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	err = c.ValidMembers.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	c.QuorumPublicKey, err = unpackBytes(reader, BLS_PUBLIC_KEY_SIZE)
+	if err != nil {
+		return err
+	}
+	err = c.QuorumVvecHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	c.QuorumSig, err = unpackBytes(reader, BLS_SIGNATURE_SIZE)
+	if err != nil {
+		return err
+	}
+	c.MembersSig, err = unpackBytes(reader, BLS_SIGNATURE_SIZE)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DIP6 quorum commitment, mined in blocks only
+type QcTx struct {
+	Version    uint16
+	Height     uint32
+	Commitment FinalCommitment
+}
+
+func (p *QcTx) UnPack(reader io.Reader) error {
+	var err error
+	p.Version, err = serialize.UnPackUint16(reader)
+	if err != nil {
+		return err
+	}
+	if p.Version == 0 {
+		return errors.New("invalid QcTx version")
+	}
+	p.Height, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	return p.Commitment.UnPack(reader)
+}
+
+type QcTxPrintAble struct {
+	Version         uint16
+	Height          uint32
+	CommitmentVer   uint16
+	LLMQType        uint8
+	QuorumHash      string
+	QuorumIndex     int16
+	Signers         int
+	ValidMembers    int
+	QuorumPublicKey string
+	QuorumVvecHash  string
+}
+
+func (p QcTx) GetPrintAble() QcTxPrintAble {
+	var printAble QcTxPrintAble
+	printAble.Version = p.Version
+	printAble.Height = p.Height
+	printAble.CommitmentVer = p.Commitment.Version
+	printAble.LLMQType = p.Commitment.LLMQType
+	printAble.QuorumHash = p.Commitment.QuorumHash.GetHex()
+	printAble.QuorumIndex = p.Commitment.QuorumIndex
+	printAble.Signers = p.Commitment.Signers.Count()
+	printAble.ValidMembers = p.Commitment.ValidMembers.Count()
+	printAble.QuorumPublicKey = hex.EncodeToString(p.Commitment.QuorumPublicKey)
+	printAble.QuorumVvecHash = p.Commitment.QuorumVvecHash.GetHex()
+	return printAble
+}
+
+// Parses payload of special transaction by its type, returns *CbTx, *ProRegTx, *ProUpServTx,
+// *ProUpRegTx, *ProUpRevTx or *QcTx. Payload must be consumed completely.
+func ParseSpecialPayload(txType int16, payload []byte) (interface{}, error) {
+	var parsed interface {
+		UnPack(reader io.Reader) error
+	}
+	switch txType {
+	case TRANSACTION_PROVIDER_REGISTER:
+		parsed = new(ProRegTx)
+	case TRANSACTION_PROVIDER_UPDATE_SERVICE:
+		parsed = new(ProUpServTx)
+	case TRANSACTION_PROVIDER_UPDATE_REGISTRAR:
+		parsed = new(ProUpRegTx)
+	case TRANSACTION_PROVIDER_UPDATE_REVOKE:
+		parsed = new(ProUpRevTx)
+	case TRANSACTION_COINBASE:
+		parsed = new(CbTx)
+	case TRANSACTION_QUORUM_COMMITMENT:
+		parsed = new(QcTx)
+	default:
+		return nil, fmt.Errorf("unsupported special transaction type %v", txType)
+	}
+
+	reader := bytes.NewReader(payload)
+	err := parsed.UnPack(fullReader{reader})
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload of special transaction type %v: %v", txType, err)
+	}
+	if reader.Len() != 0 {
+		return nil, fmt.Errorf("invalid payload of special transaction type %v: %v trailing bytes", txType, reader.Len())
+	}
+	return parsed, nil
+}
+
+func getPayloadPrintAble(parsed interface{}) interface{} {
+	switch p := parsed.(type) {
+	case *CbTx:
+		return p.GetPrintAble()
+	case *ProRegTx:
+		return p.GetPrintAble()
+	case *ProUpServTx:
+		return p.GetPrintAble()
+	case *ProUpRegTx:
+		return p.GetPrintAble()
+	case *ProUpRevTx:
+		return p.GetPrintAble()
+	case *QcTx:
+		return p.GetPrintAble()
+	}
+	return nil
+}
+
+// Reads height of DIP4 coinbase payload, version and height lead every CbTx version so fields
+// added by later versions do not matter
+func ParseCbTxHeight(payload []byte) (int32, error) {
+	reader := fullReader{bytes.NewReader(payload)}
+	version, err := serialize.UnPackUint16(reader)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CbTx payload: %v", err)
+	}
+	if version == 0 {
+		return 0, errors.New("invalid CbTx version")
+	}
+	height, err := serialize.UnPackInt32(reader)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CbTx payload: %v", err)
+	}
+	return height, nil
+}
+
+// Parses DIP4 coinbase payload
+func ParseCbTx(payload []byte) (*CbTx, error) {
+	parsed, err := ParseSpecialPayload(TRANSACTION_COINBASE, payload)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.(*CbTx), nil
+}
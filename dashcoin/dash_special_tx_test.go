@@ -0,0 +1,136 @@
+package dashcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/PowPool/dashpool/rpc"
+)
+
+func TestParseCbTx(t *testing.T) {
+	var trx DashTransaction
+	_ = trx.UnPackFromHex(cbTxCoinBaseHex)
+	payload, err := trx.GetSpecialPayload()
+	if err != nil {
+		t.Fatalf("GetSpecialPayload: %v", err)
+	}
+	cbTx, ok := payload.(*CbTx)
+	if !ok {
+		t.Fatalf("payload = %T, want *CbTx", payload)
+	}
+	if cbTx.Version != 2 || cbTx.Height != 1826 {
+		t.Errorf("CbTx version %v height %v", cbTx.Version, cbTx.Height)
+	}
+
+	// version 3 adds best chainlock and credit pool balance
+	v3 := "0300" + "23070000" + strings.Repeat("11", 32) + strings.Repeat("22", 32) + "05" +
+		strings.Repeat("33", BLS_SIGNATURE_SIZE) + "00e1f50500000000"
+	payloadBytes, _ := hex.DecodeString(v3)
+	cbTx, err = ParseCbTx(payloadBytes)
+	if err != nil {
+		t.Fatalf("ParseCbTx v3: %v", err)
+	}
+	if cbTx.BestCLHeightDiff != 5 || len(cbTx.BestCLSignature) != BLS_SIGNATURE_SIZE || cbTx.CreditPoolBalance != 100000000 {
+		t.Errorf("CbTx v3 = %+v", cbTx)
+	}
+	if cbTx.GetPrintAble().MerkleRootQuorums != strings.Repeat("22", 32) {
+		t.Errorf("merkleRootQuorums = %v", cbTx.GetPrintAble().MerkleRootQuorums)
+	}
+
+	if _, err := ParseCbTx(payloadBytes[:len(payloadBytes)-1]); err == nil {
+		t.Error("Must reject truncated payload")
+	}
+	if _, err := ParseCbTx(append(payloadBytes, 0)); err == nil {
+		t.Error("Must reject trailing bytes")
+	}
+}
+
+func TestInitializeChecksCbTxHeight(t *testing.T) {
+	payload := "02002307000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"
+	var cbtx DashCoinBaseTransaction
+	err := cbtx.Initialize("XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", 1607055201, 1828, 18492529212, "", payload,
+		"dashpool", []rpc.MasterNode{}, nil)
+	if err == nil {
+		t.Error("Must reject CbTx of another height")
+	}
+	err = cbtx.Initialize("XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", 1607055201, 1827, 18492529212, "", payload,
+		"dashpool", []rpc.MasterNode{}, nil)
+	if err != nil {
+		t.Errorf("Initialize: %v", err)
+	}
+
+	// CbTx version with fields unknown yet is mined as is
+	future := "0400" + "23070000" + strings.Repeat("11", 100)
+	err = cbtx.Initialize("XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", 1607055201, 1827, 18492529212, "", future,
+		"dashpool", []rpc.MasterNode{}, nil)
+	if err != nil || hex.EncodeToString(cbtx.ExtraPayload) != future {
+		t.Errorf("Must keep payload of unknown CbTx version: %v", err)
+	}
+	for _, invalid := range []string{"0200230700", "0000" + "23070000"} {
+		err = cbtx.Initialize("XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", 1607055201, 1827, 18492529212, "", invalid,
+			"dashpool", []rpc.MasterNode{}, nil)
+		if err == nil {
+			t.Errorf("Must reject CbTx payload %v without height", invalid)
+		}
+	}
+}
+
+func TestParseProUpServTx(t *testing.T) {
+	// evonode service update of version 2
+	payload := "0200" + "0100" + strings.Repeat("aa", 32) +
+		"00000000000000000000ffff01020304" + "270f" + "00" + strings.Repeat("bb", 32) +
+		strings.Repeat("cc", KEY_ID_SIZE) + "5a69" + "b901" + strings.Repeat("dd", BLS_SIGNATURE_SIZE)
+	payloadBytes, _ := hex.DecodeString(payload)
+	parsed, err := ParseSpecialPayload(TRANSACTION_PROVIDER_UPDATE_SERVICE, payloadBytes)
+	if err != nil {
+		t.Fatalf("ParseSpecialPayload: %v", err)
+	}
+	tx := parsed.(*ProUpServTx)
+	printAble := tx.GetPrintAble()
+	if printAble.Service != "1.2.3.4:9999" || printAble.PlatformP2PPort != 26970 || printAble.PlatformHTTPPort != 441 {
+		t.Errorf("ProUpServTx = %+v", printAble)
+	}
+}
+
+func TestParseQcTx(t *testing.T) {
+	// indexed commitment of 10 members, 9 signed and 10 valid
+	payload := "0100" + "10270000" + "0200" + "67" + strings.Repeat("ee", 32) + "0300" +
+		"0a" + "ff01" + "0a" + "ff03" + strings.Repeat("01", BLS_PUBLIC_KEY_SIZE) + strings.Repeat("02", 32) +
+		strings.Repeat("03", BLS_SIGNATURE_SIZE) + strings.Repeat("04", BLS_SIGNATURE_SIZE)
+	payloadBytes, _ := hex.DecodeString(payload)
+	parsed, err := ParseSpecialPayload(TRANSACTION_QUORUM_COMMITMENT, payloadBytes)
+	if err != nil {
+		t.Fatalf("ParseSpecialPayload: %v", err)
+	}
+	printAble := parsed.(*QcTx).GetPrintAble()
+	if printAble.Height != 10000 || printAble.LLMQType != 0x67 || printAble.QuorumIndex != 3 ||
+		printAble.Signers != 9 || printAble.ValidMembers != 10 {
+		t.Errorf("QcTx = %+v", printAble)
+	}
+}
+
+func TestTrxPrintAblePayload(t *testing.T) {
+	var trx DashTransaction
+	_ = trx.UnPackFromHex(cbTxCoinBaseHex)
+	printAble := trx.GetTrxPrintAble()
+	cbTx, ok := printAble.Payload.(CbTxPrintAble)
+	if !ok || cbTx.Height != 1826 || printAble.PayloadError != "" {
+		t.Errorf("payload = %+v, error %v", printAble.Payload, printAble.PayloadError)
+	}
+
+	var normal DashTransaction
+	_ = normal.UnPack(bytes.NewReader(mustDecodeHex(mainnetGenesisCoinBaseHex)))
+	if normal.GetTrxPrintAble().Payload != nil {
+		t.Error("Normal transaction has no payload")
+	}
+}
+
+func mustDecodeHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
@@ -319,12 +319,22 @@ func (t *DashTransaction) UnPackFromHex(hexStr string) error {
 	return nil
 }
 
+// Returns parsed payload of special transaction, nil for normal transaction
+func (t *DashTransaction) GetSpecialPayload() (interface{}, error) {
+	if t.Version16 != 3 || t.Type16 == TRANSACTION_NORMAL {
+		return nil, nil
+	}
+	return ParseSpecialPayload(t.Type16, t.ExtraPayload.GetScriptBytes())
+}
+
 type TrxPrintAble struct {
 	Vin          []TxInPrintAble
 	Vout         []TxOutPrintAble
 	Version      int32
 	LockTime     uint32
 	ExtraPayload string
+	Payload      interface{} `json:",omitempty"`
+	PayloadError string      `json:",omitempty"`
 	Version16    int16
 	Type16       int16
 }
@@ -368,6 +378,12 @@ func (t *DashTransaction) GetTrxPrintAble() TrxPrintAble {
 	trxPrintAble.Version16 = t.Version16
 	trxPrintAble.Type16 = t.Type16
 	trxPrintAble.ExtraPayload = hex.EncodeToString(t.ExtraPayload.GetScriptBytes())
+	payload, err := t.GetSpecialPayload()
+	if err != nil {
+		trxPrintAble.PayloadError = err.Error()
+	} else if payload != nil {
+		trxPrintAble.Payload = getPayloadPrintAble(payload)
+	}
 
 	return trxPrintAble
 }
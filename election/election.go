@@ -0,0 +1,107 @@
+package election
+
+import (
+	"sync"
+	"time"
+
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+// Lease shared by singleton jobs: block unlocker, payouts and stats purge
+const Role = "jobs"
+
+type Config struct {
+	Enabled  bool   `json:"enabled"`
+	LeaseTTL string `json:"leaseTtl"`
+}
+
+// Elects one node of the cluster to run singleton jobs. Lease is renewed three times
+// per TTL, so when leader dies another node takes over within TTL.
+type Elector struct {
+	sync.RWMutex
+	config     *Config
+	backend    storage.Backend
+	holder     string
+	ttl        time.Duration
+	token      int64
+	validUntil time.Time
+}
+
+func NewElector(cfg *Config, backend storage.Backend, holder string) *Elector {
+	e := &Elector{config: cfg, backend: backend, holder: holder}
+	e.ttl = MustParseDuration(cfg.LeaseTTL)
+	return e
+}
+
+func (e *Elector) Start() {
+	renewIntv := e.ttl / 3
+	renewTimer := time.NewTimer(renewIntv)
+	Info.Printf("Set leader lease TTL to %v for %v", e.ttl, e.holder)
+
+	e.campaign()
+
+	go func() {
+		for {
+			select {
+			case <-renewTimer.C:
+				e.campaign()
+				renewTimer.Reset(renewIntv)
+			}
+		}
+	}()
+}
+
+func (e *Elector) campaign() {
+	start := time.Now()
+	token, err := e.backend.AcquireLease(Role, e.holder, e.ttl)
+	if err != nil {
+		// Keep leading until local lease expires, backend may be back before that
+		Error.Printf("Failed to renew leader lease: %v", err)
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	if token == 0 {
+		if e.token != 0 {
+			Error.Printf("Lost leadership, token %v", e.token)
+		}
+		e.token = 0
+		return
+	}
+	if token != e.token {
+		Info.Printf("Elected as leader with token %v", token)
+	}
+	e.token = token
+	// Stop acting as leader well before lease expires in backend
+	e.validUntil = start.Add(e.ttl * 2 / 3)
+}
+
+// Elector is optional, without it every node is leader
+func (e *Elector) IsLeader() bool {
+	return e.Token() != 0
+}
+
+// Returns fencing token of the current lease or zero if node is not a leader
+func (e *Elector) Token() int64 {
+	if e == nil {
+		return 1
+	}
+	e.RLock()
+	defer e.RUnlock()
+
+	if e.token == 0 || time.Now().After(e.validUntil) {
+		return 0
+	}
+	return e.token
+}
+
+// Returns backend which rejects writes once this node is not a leader anymore
+func (e *Elector) Fence(backend storage.Backend) storage.Backend {
+	if e == nil {
+		return backend
+	}
+	return backend.Fenced(Role, e.Token)
+}
@@ -3,12 +3,19 @@ module github.com/PowPool/dashpool
 go 1.17
 
 require (
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1
 	github.com/ethereum/go-ethereum v1.12.1
-	github.com/garyburd/redigo v1.6.2 // indirect
 	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.10.9
 	github.com/mutalisk999/bitcoin-lib v0.0.0-20201203080325-81caed73682f
 	github.com/mutalisk999/txid_merkle_tree v0.0.0-20201224034958-6ecbd0cbe5ee
+	github.com/redis/go-redis/v9 v9.17.2
 	golang.org/x/crypto v0.9.0
-	gopkg.in/bsm/ratelimit.v1 v1.0.0-20160220154919-db14e161995a // indirect
-	gopkg.in/redis.v3 v3.6.4
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	golang.org/x/term v0.8.0 // indirect
 )
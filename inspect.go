@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/PowPool/dashpool/dashcoin"
+	"github.com/PowPool/dashpool/proxy"
+	. "github.com/PowPool/dashpool/util"
+)
+
+const inspectUsage = `Usage:
+  dashpool inspect block <raw block hex | - >
+  dashpool inspect tx <raw transaction hex | - >
+  dashpool inspect share -coinb1 <hex> -enonce1 <hex> -enonce2 <hex> -coinb2 <hex> -ntime <hex> -nonce <hex>
+      -version <n> -prevhash <hex> -nbits <hex> -target <hex> | -diff <stratum difficulty> [-branch <hex,hex,...>]
+  dashpool inspect sharelog <share.log> [jobId|nonce]`
+
+// Offline tools for disputed shares and orphaned blocks, nothing is read from backend or upstream
+func inspectCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal(inspectUsage)
+	}
+	// helpers in proxy log through util loggers
+	InitLog(os.DevNull, os.DevNull, os.DevNull, os.DevNull, ERROR)
+
+	switch args[0] {
+	case "block":
+		inspectBlock(args[1:])
+	case "tx":
+		inspectTx(args[1:])
+	case "share":
+		inspectShare(args[1:])
+	case "sharelog":
+		inspectShareLog(args[1:])
+	default:
+		log.Fatal(inspectUsage)
+	}
+}
+
+// Hex is taken from argument or from stdin when argument is "-"
+func readHexArg(args []string) string {
+	if len(args) == 0 {
+		log.Fatal(inspectUsage)
+	}
+	if args[0] != "-" {
+		return strings.TrimSpace(args[0])
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal("Failed to read stdin: ", err.Error())
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func inspectBlock(args []string) {
+	var block dashcoin.Block
+	err := block.UnPackFromHex(readHexArg(args))
+	if err != nil {
+		log.Fatal("Failed to decode block: ", err.Error())
+	}
+	hash, err := proxy.CalcX11HeaderHash(&block.Header)
+	if err != nil {
+		log.Fatal("Failed to hash block header: ", err.Error())
+	}
+	merkleRoot, err := block.CalcMerkleRootHex()
+	if err != nil {
+		log.Fatal("Failed to calculate merkle root: ", err.Error())
+	}
+	printJSON(map[string]interface{}{
+		"hash":             hash,
+		"merkleRoot":       merkleRoot,
+		"merkleRootValid":  merkleRoot == block.Header.HashMerkleRoot.GetHex(),
+		"meetsBlockTarget": dashcoin.NewDifficultyFromNBits(block.Header.Bits).IsMetBy(hash),
+		"block":            block.GetBlockPrintAble(),
+	})
+}
+
+func inspectTx(args []string) {
+	var trx dashcoin.DashTransaction
+	err := trx.UnPackFromHex(readHexArg(args))
+	if err != nil {
+		log.Fatal("Failed to decode transaction: ", err.Error())
+	}
+	trxId, err := trx.CalcTrxId()
+	if err != nil {
+		log.Fatal("Failed to calculate transaction id: ", err.Error())
+	}
+	printJSON(dashcoin.TrxWithIdPrintAble{TxId: trxId.GetHex(), TrxPrintAble: trx.GetTrxPrintAble()})
+}
+
+func inspectShare(args []string) {
+	var record proxy.ShareRecord
+	var branch string
+	var diff float64
+	flags := flag.NewFlagSet("inspect share", flag.ExitOnError)
+	flags.StringVar(&record.CoinBase1, "coinb1", "", "coinbase part 1")
+	flags.StringVar(&record.ExtraNonce1, "enonce1", "", "extra nonce 1")
+	flags.StringVar(&record.ExtraNonce2, "enonce2", "", "extra nonce 2")
+	flags.StringVar(&record.CoinBase2, "coinb2", "", "coinbase part 2")
+	flags.StringVar(&record.NTime, "ntime", "", "ntime as submitted")
+	flags.StringVar(&record.Nonce, "nonce", "", "nonce as submitted")
+	flags.StringVar(&record.PrevHash, "prevhash", "", "previous block hash")
+	flags.StringVar(&record.NBits, "nbits", "", "network target in compact form")
+	flags.StringVar(&record.Target, "target", "", "share target")
+	flags.Float64Var(&diff, "diff", 0, "share stratum difficulty, instead of target")
+	flags.StringVar(&branch, "branch", "", "comma separated merkle branch")
+	version := flags.Uint("version", 0, "block version")
+	_ = flags.Parse(args)
+
+	record.Version = uint32(*version)
+	if len(branch) > 0 {
+		record.MerkleBranch = strings.Split(branch, ",")
+	}
+	if diff > 0 {
+		d, err := dashcoin.NewDifficultyFromStratumDiff(diff)
+		if err != nil {
+			log.Fatal("Invalid difficulty: ", err.Error())
+		}
+		record.Target = d.TargetHex()
+	}
+	if len(record.Target) == 0 {
+		// check the share against the network target only
+		nBits, err := strconv.ParseUint(record.NBits, 16, 32)
+		if err != nil {
+			log.Fatal("Invalid nbits: ", err.Error())
+		}
+		record.Target = dashcoin.NewDifficultyFromNBits(uint32(nBits)).TargetHex()
+	}
+	verifyShareRecord(&record)
+}
+
+func verifyShareRecord(record *proxy.ShareRecord) {
+	result, err := proxy.VerifyShare(record)
+	if err != nil {
+		log.Fatal("Failed to verify share: ", err.Error())
+	}
+	printJSON(result)
+}
+
+// Verifies every share record of share log, or the one matching job id or nonce. Submitted blocks
+// are reconstructed to raw hex, ready for submitblock.
+func inspectShareLog(args []string) {
+	if len(args) == 0 {
+		log.Fatal(inspectUsage)
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		log.Fatal("Failed to open share log: ", err.Error())
+	}
+	defer file.Close()
+
+	filter := ""
+	if len(args) > 1 {
+		filter = args[1]
+	}
+
+	found := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		record, err := proxy.ParseShareLogLine(scanner.Text())
+		if err != nil {
+			log.Printf("Line %v: malformed share record: %v", lineNo, err)
+			continue
+		}
+		if record == nil || (filter != "" && record.JobId != filter && record.Nonce != filter) {
+			continue
+		}
+		found++
+
+		result, err := proxy.VerifyShare(record)
+		if err != nil {
+			log.Printf("Line %v: failed to verify share: %v", lineNo, err)
+			continue
+		}
+		entry := map[string]interface{}{"line": lineNo, "record": record, "verification": result}
+		if len(record.Txs) > 0 || result.MeetsBlockTarget {
+			rawBlockHex, err := proxy.ReconstructBlockHex(record)
+			if err != nil {
+				log.Printf("Line %v: failed to reconstruct block: %v", lineNo, err)
+			} else {
+				entry["block"] = rawBlockHex
+			}
+		}
+		printJSON(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal("Failed to read share log: ", err.Error())
+	}
+	if found == 0 {
+		log.Fatal("No share records found")
+	}
+}
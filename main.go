@@ -10,6 +10,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
@@ -17,6 +18,9 @@ import (
 	//"github.com/yvasiyarov/gorelic"
 
 	"github.com/PowPool/dashpool/api"
+	"github.com/PowPool/dashpool/archive"
+	"github.com/PowPool/dashpool/dashcoin"
+	"github.com/PowPool/dashpool/election"
 	"github.com/PowPool/dashpool/payouts"
 	"github.com/PowPool/dashpool/proxy"
 	"github.com/PowPool/dashpool/storage"
@@ -32,27 +36,30 @@ var (
 )
 
 var cfg proxy.Config
-var backend *storage.RedisClient
+var backend storage.Backend
+var archiver archive.Archive
+var elector *election.Elector
 
-func startProxy() {
+func startProxy(started chan<- *proxy.ProxyServer) {
 	s := proxy.NewProxy(&cfg, backend)
+	started <- s
 	s.Start()
 }
 
 func startApi() {
-	s := api.NewApiServer(&cfg.Api, backend)
+	s := api.NewApiServer(&cfg.Api, backend, archiver, elector)
 	s.Start()
 }
 
 func startBlockUnlocker() {
-	u := payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend)
+	u := payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend, archiver, cfg.UpstreamCoinBase, elector)
 	u.Start()
 }
 
-//func startPayoutsProcessor() {
-//	u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
-//	u.Start()
-//}
+func startPayoutsProcessor() {
+	u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend, archiver, elector)
+	u.Start()
+}
 
 // this function is for performance profile
 //func startNewrelic() {
@@ -65,10 +72,9 @@ func startBlockUnlocker() {
 //	}
 //}
 
-func readConfig(cfg *proxy.Config) {
-	configFileName := "config.json"
-	if len(os.Args) > 1 {
-		configFileName = os.Args[1]
+func readConfig(cfg *proxy.Config, configFileName string) {
+	if len(configFileName) == 0 {
+		configFileName = "config.json"
 	}
 	configFileName, _ = filepath.Abs(configFileName)
 	log.Printf("Loading config: %v", configFileName)
@@ -82,6 +88,11 @@ func readConfig(cfg *proxy.Config) {
 	if err := jsonParser.Decode(&cfg); err != nil {
 		log.Fatal("Config error: ", err.Error())
 	}
+	cfg.Api.MinThreshold = cfg.Payouts.MinThreshold
+	if err := dashcoin.SelectParams(cfg.Network); err != nil {
+		log.Fatal("Config error: ", err.Error())
+	}
+	log.Printf("Running on %v network", dashcoin.ActiveParams.Name)
 }
 
 func readSecurityPass() ([]byte, error) {
@@ -112,8 +123,8 @@ func decryptPoolConfigure(cfg *proxy.Config, passBytes []byte) error {
 	}
 	cfg.UpstreamCoinBase = string(b)
 	// check address
-	if !IsValidDashAddress(cfg.UpstreamCoinBase) {
-		return errors.New("decryptPoolConfigure: IsValidDashAddress")
+	if !IsValidDashWallet(cfg.UpstreamCoinBase) {
+		return errors.New("decryptPoolConfigure: upstream coinbase is not a valid address or public key of " + dashcoin.ActiveParams.Name)
 	}
 
 	b, err = Ae64Decode(cfg.Redis.PasswordEncrypted, passBytes)
@@ -122,6 +133,14 @@ func decryptPoolConfigure(cfg *proxy.Config, passBytes []byte) error {
 	}
 	cfg.Redis.Password = string(b)
 
+	if len(cfg.Archive.PasswordEncrypted) > 0 {
+		b, err = Ae64Decode(cfg.Archive.PasswordEncrypted, passBytes)
+		if err != nil {
+			return err
+		}
+		cfg.Archive.Password = string(b)
+	}
+
 	return nil
 }
 
@@ -177,7 +196,11 @@ func OptionParse() {
 
 func main() {
 	OptionParse()
-	readConfig(&cfg)
+	if command, ok := commands[flag.Arg(0)]; ok {
+		command(flag.Args()[1:])
+		return
+	}
+	readConfig(&cfg, flag.Arg(0))
 	//rand.Seed(time.Now().UnixNano())
 
 	// init log file
@@ -220,6 +243,19 @@ func main() {
 		Error.Printf("Can't establish connection to backend: %v", err)
 	} else {
 		Error.Printf("Backend check reply: %v", pong)
+		if err := backend.CheckSchema(); err != nil {
+			Error.Fatal("Can't use backend dataset: ", err.Error())
+		}
+	}
+
+	archiver, err = archive.New(&cfg.Archive, cfg.Coin)
+	if err != nil {
+		Error.Fatal("Can't open archive: ", err.Error())
+	}
+
+	if cfg.Election.Enabled {
+		elector = election.NewElector(&cfg.Election, backend, cfg.Name)
+		elector.Start()
 	}
 
 	defer func() {
@@ -228,8 +264,9 @@ func main() {
 		}
 	}()
 
+	proxyStarted := make(chan *proxy.ProxyServer, 1)
 	if cfg.Proxy.Enabled {
-		go startProxy()
+		go startProxy(proxyStarted)
 	}
 	if cfg.Api.Enabled {
 		go startApi()
@@ -237,9 +274,16 @@ func main() {
 	if cfg.BlockUnlocker.Enabled {
 		go startBlockUnlocker()
 	}
-	//if cfg.Payouts.Enabled {
-	//	go startPayoutsProcessor()
-	//}
-	quit := make(chan bool)
-	<-quit
+	if cfg.Payouts.Enabled {
+		go startPayoutsProcessor()
+	}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+	Info.Printf("Received %v, shutting down", sig)
+	select {
+	case s := <-proxyStarted:
+		s.Close()
+	default:
+	}
 }
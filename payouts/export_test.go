@@ -0,0 +1,10 @@
+package payouts
+
+// Unlocker passes for tests of package payouts_test, which may import packages importing payouts
+func (u *BlockUnlocker) UnlockPendingBlocks() {
+	u.unlockPendingBlocks()
+}
+
+func (u *BlockUnlocker) UnlockAndCreditMiners() {
+	u.unlockAndCreditMiners()
+}
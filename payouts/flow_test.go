@@ -0,0 +1,84 @@
+package payouts_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/PowPool/dashpool/dashcoin"
+	"github.com/PowPool/dashpool/payouts"
+	"github.com/PowPool/dashpool/proxy"
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+const (
+	poolAddress = "XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob"
+	blockHash   = "000000000000001a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192"
+)
+
+// Node which has the block of the pool at height 10 and tip at height 20
+func fakeDaemon(t *testing.T) *httptest.Server {
+	script, err := dashcoin.GetCoinBaseScriptHex(poolAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var result interface{}
+		switch req.Method {
+		case "getblocktemplate":
+			result = map[string]interface{}{"height": 21}
+		case "getblockhash":
+			result = blockHash
+		case "getblock":
+			result = map[string]interface{}{"height": 10, "hash": blockHash, "nonce": 1, "tx": []interface{}{
+				map[string]interface{}{"txid": "cb", "vout": []interface{}{
+					map[string]interface{}{"scriptPubKey": map[string]interface{}{"hex": script}},
+				}},
+			}}
+		default:
+			t.Errorf("Unexpected call of %v", req.Method)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 0, "result": result})
+	}))
+}
+
+// Shares accepted by proxy are credited by unlocker through the same backend
+func TestSharesToCredits(t *testing.T) {
+	backend := storage.NewMemoryBackend("test")
+	backend.CheckSchema()
+
+	w := proxy.NewShareWriter(&proxy.ShareWriterConfig{FlushInterval: "1h"}, "node1", backend, time.Hour)
+	now := MakeTimestamp()
+	w.Enqueue(&storage.ShareData{Login: "x", Id: "rig1", Diff: 200, Ms: now})
+	w.Enqueue(&storage.ShareData{Login: "z", Id: "rig1", Diff: 100, Ms: now})
+	exist, err := w.WriteBlock("x", "rig1", []string{"00000001", "00010000", "00000000"}, 100, 500, 10, blockHash, 1000, 0)
+	if exist || err != nil {
+		t.Fatalf("Must write block: %v, %v", exist, err)
+	}
+
+	daemon := fakeDaemon(t)
+	defer daemon.Close()
+	cfg := &payouts.UnlockerConfig{Depth: 5, ImmatureDepth: 1, Interval: "1m", Daemon: daemon.URL, Timeout: "5s"}
+	u := payouts.NewBlockUnlocker(cfg, backend, nil, poolAddress, nil)
+
+	u.UnlockPendingBlocks()
+	if immature, _ := backend.GetImmatureBlocks(20); len(immature) != 1 || immature[0].Hash != blockHash {
+		t.Fatalf("Candidate must become immature: %v", immature)
+	}
+	u.UnlockAndCreditMiners()
+	for login, expected := range map[string]int64{"x": 750, "z": 250} {
+		if balance, _ := backend.GetBalance(login); balance != expected {
+			t.Errorf("Balance of %v must be %v, got %v", login, expected, balance)
+		}
+	}
+	if report, _ := backend.Reconcile(); !report.Balanced() {
+		t.Errorf("Credits must be balanced in ledger: %+v", report)
+	}
+}
@@ -1,10 +1,16 @@
 package payouts
 
 import (
+	"fmt"
+	"os"
+	"strconv"
 	"time"
 
+	"github.com/PowPool/dashpool/archive"
+	"github.com/PowPool/dashpool/election"
 	"github.com/PowPool/dashpool/rpc"
 	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
 )
 
 const txCheckInterval = 5 * time.Second
@@ -15,282 +21,308 @@ type PayoutsConfig struct {
 	Interval     string `json:"interval"`
 	Daemon       string `json:"daemon"`
 	Timeout      string `json:"timeout"`
-	Address      string `json:"address"`
-	Gas          string `json:"gas"`
-	GasPrice     string `json:"gasPrice"`
-	AutoGas      bool   `json:"autoGas"`
-	// In Shannon
+	// In Satoshi
 	Threshold int64 `json:"threshold"`
-	BgSave    bool  `json:"bgsave"`
+	// Lowest threshold miners are allowed to set for themselves, in Satoshi
+	MinThreshold int64 `json:"minThreshold"`
+	BgSave       bool  `json:"bgsave"`
 }
 
-//func (c PayoutsConfig) GasHex() string {
-//	x := String2Big(c.Gas)
-//	return hexutil.EncodeBig(x)
-//}
-//
-//func (c PayoutsConfig) GasPriceHex() string {
-//	x := String2Big(c.GasPrice)
-//	return hexutil.EncodeBig(x)
-//}
-
 type PayoutsProcessor struct {
 	config   *PayoutsConfig
-	backend  *storage.RedisClient
+	backend  storage.Backend
+	archive  archive.Archive
+	elector  *election.Elector
 	rpc      *rpc.RPCClient
 	halt     bool
 	lastFail error
 }
 
-//func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
-//	u := &PayoutsProcessor{config: cfg, backend: backend}
-//	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout)
-//	return u
-//}
-
-//func (p *PayoutsProcessor) Start() {
-//	Info.Println("Starting payouts")
-//
-//	if p.mustResolvePayout() {
-//		Info.Println("Running with env RESOLVE_PAYOUT=1, now trying to resolve locked payouts")
-//		p.resolvePayouts()
-//		Info.Println("Now you have to restart payouts module with RESOLVE_PAYOUT=0 for normal run")
-//		return
-//	}
-//
-//	intv := MustParseDuration(p.config.Interval)
-//	timer := time.NewTimer(intv)
-//	Info.Printf("Set payouts interval to %v", intv)
-//
-//	payments := p.backend.GetPendingPayments()
-//	if len(payments) > 0 {
-//		Error.Printf("Previous payout failed, you have to resolve it. List of failed payments:\n %v", formatPendingPayments(payments))
-//		return
-//	}
-//
-//	locked, err := p.backend.IsPayoutsLocked()
-//	if err != nil {
-//		Error.Println("Unable to start payouts:", err)
-//		return
-//	}
-//	if locked {
-//		Error.Println("Unable to start payouts because they are locked")
-//		return
-//	}
-//
-//	// Immediately process payouts after start
-//	p.process()
-//	timer.Reset(intv)
-//
-//	go func() {
-//		for {
-//			select {
-//			case <-timer.C:
-//				p.process()
-//				timer.Reset(intv)
-//			}
-//		}
-//	}()
-//}
-
-//func (p *PayoutsProcessor) process() {
-//	if p.halt {
-//		Info.Println("Payments suspended due to last critical error:", p.lastFail)
-//		return
-//	}
-//	mustPay := 0
-//	minersPaid := 0
-//	totalAmount := big.NewInt(0)
-//	payees, err := p.backend.GetPayees()
-//	if err != nil {
-//		Error.Println("Error while retrieving payees from backend:", err)
-//		return
-//	}
-//
-//	for _, login := range payees {
-//		amount, _ := p.backend.GetBalance(login)
-//		amountInShannon := big.NewInt(amount)
-//
-//		// Shannon^2 = Wei
-//		amountInWei := new(big.Int).Mul(amountInShannon, Shannon)
-//
-//		if !p.reachedThreshold(amountInShannon) {
-//			continue
-//		}
-//		mustPay++
-//
-//		// Require active peers before processing
-//		if !p.checkPeers() {
-//			break
-//		}
-//		// Require unlocked account
-//		if !p.isUnlockedAccount() {
-//			break
-//		}
-//
-//		// Check if we have enough funds
-//		poolBalance, err := p.rpc.GetBalance(p.config.Address)
-//		if err != nil {
-//			p.halt = true
-//			p.lastFail = err
-//			break
-//		}
-//		if poolBalance.Cmp(amountInWei) < 0 {
-//			err := fmt.Errorf("Not enough balance for payment, need %s Wei, pool has %s Wei",
-//				amountInWei.String(), poolBalance.String())
-//			p.halt = true
-//			p.lastFail = err
-//			break
-//		}
-//
-//		// Lock payments for current payout
-//		err = p.backend.LockPayouts(login, amount)
-//		if err != nil {
-//			Error.Printf("Failed to lock payment for %s: %v", login, err)
-//			p.halt = true
-//			p.lastFail = err
-//			break
-//		}
-//		Info.Printf("Locked payment for %s, %v Shannon", login, amount)
-//
-//		// Debit miner's balance and update stats
-//		err = p.backend.UpdateBalance(login, amount)
-//		if err != nil {
-//			Error.Printf("Failed to update balance for %s, %v Shannon: %v", login, amount, err)
-//			p.halt = true
-//			p.lastFail = err
-//			break
-//		}
-//
-//		value := hexutil.EncodeBig(amountInWei)
-//		txHash, err := p.rpc.SendTransaction(p.config.Address, login, p.config.GasHex(), p.config.GasPriceHex(), value, p.config.AutoGas)
-//		if err != nil {
-//			Error.Printf("Failed to send payment to %s, %v Shannon: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
-//				login, amount, err, login)
-//			p.halt = true
-//			p.lastFail = err
-//			break
-//		}
-//
-//		// Log transaction hash
-//		err = p.backend.WritePayment(login, txHash, amount)
-//		if err != nil {
-//			Error.Printf("Failed to log payment data for %s, %v Shannon, tx: %s: %v", login, amount, txHash, err)
-//			p.halt = true
-//			p.lastFail = err
-//			break
-//		}
-//
-//		minersPaid++
-//		totalAmount.Add(totalAmount, big.NewInt(amount))
-//		Info.Printf("Paid %v Shannon to %v, TxHash: %v", amount, login, txHash)
-//
-//		// Wait for TX confirmation before further payouts
-//		for {
-//			Info.Printf("Waiting for tx confirmation: %v", txHash)
-//			time.Sleep(txCheckInterval)
-//			receipt, err := p.rpc.GetTxReceipt(txHash)
-//			if err != nil {
-//				Error.Printf("Failed to get tx receipt for %v: %v", txHash, err)
-//				continue
-//			}
-//			// Tx has been mined
-//			if receipt != nil && receipt.Confirmed() {
-//				if receipt.Successful() {
-//					Info.Printf("Payout tx successful for %s: %s", login, txHash)
-//				} else {
-//					Error.Printf("Payout tx failed for %s: %s. Address contract throws on incoming tx.", login, txHash)
-//				}
-//				break
-//			}
-//		}
-//	}
-//
-//	if mustPay > 0 {
-//		Info.Printf("Paid total %v Shannon to %v of %v payees", totalAmount, minersPaid, mustPay)
-//	} else {
-//		Error.Println("No payees that have reached payout threshold")
-//	}
-//
-//	// Save redis state to disk
-//	if minersPaid > 0 && p.config.BgSave {
-//		p.bgSave()
-//	}
-//}
-
-//func (p PayoutsProcessor) isUnlockedAccount() bool {
-//	_, err := p.rpc.Sign(p.config.Address, "0x0")
-//	if err != nil {
-//		Error.Println("Unable to process payouts:", err)
-//		return false
-//	}
-//	return true
-//}
-
-//func (p PayoutsProcessor) checkPeers() bool {
-//	n, err := p.rpc.GetPeerCount()
-//	if err != nil {
-//		Error.Println("Unable to start payouts, failed to retrieve number of peers from node:", err)
-//		return false
-//	}
-//	if n < p.config.RequirePeers {
-//		Error.Println("Unable to start payouts, number of peers on a node is less than required", p.config.RequirePeers)
-//		return false
-//	}
-//	return true
-//}
-
-//func (p PayoutsProcessor) reachedThreshold(amount *big.Int) bool {
-//	return big.NewInt(p.config.Threshold).Cmp(amount) < 0
-//}
-//
-//func formatPendingPayments(list []*storage.PendingPayment) string {
-//	var s string
-//	for _, v := range list {
-//		s += fmt.Sprintf("\tAddress: %s, Amount: %v Shannon, %v\n", v.Address, v.Amount, time.Unix(v.Timestamp, 0))
-//	}
-//	return s
-//}
-//
-//func (p PayoutsProcessor) bgSave() {
-//	result, err := p.backend.BgSave()
-//	if err != nil {
-//		Error.Println("Failed to perform BGSAVE on backend:", err)
-//		return
-//	}
-//	Info.Println("Saving backend state to disk:", result)
-//}
-//
-//func (p PayoutsProcessor) resolvePayouts() {
-//	payments := p.backend.GetPendingPayments()
-//
-//	if len(payments) > 0 {
-//		Info.Printf("Will credit back following balances:\n%s", formatPendingPayments(payments))
-//
-//		for _, v := range payments {
-//			err := p.backend.RollbackBalance(v.Address, v.Amount)
-//			if err != nil {
-//				Error.Printf("Failed to credit %v Shannon back to %s, error is: %v", v.Amount, v.Address, err)
-//				return
-//			}
-//			Info.Printf("Credited %v Shannon back to %s", v.Amount, v.Address)
-//		}
-//		err := p.backend.UnlockPayouts()
-//		if err != nil {
-//			Error.Println("Failed to unlock payouts:", err)
-//			return
-//		}
-//	} else {
-//		Error.Println("No pending payments to resolve")
-//	}
-//
-//	if p.config.BgSave {
-//		p.bgSave()
-//	}
-//	Info.Println("Payouts unlocked")
-//}
-//
-//func (p PayoutsProcessor) mustResolvePayout() bool {
-//	v, _ := strconv.ParseBool(os.Getenv("RESOLVE_PAYOUT"))
-//	return v
-//}
+func NewPayoutsProcessor(cfg *PayoutsConfig, backend storage.Backend, archive archive.Archive, elector *election.Elector) *PayoutsProcessor {
+	u := &PayoutsProcessor{config: cfg, backend: elector.Fence(backend), archive: archive, elector: elector}
+	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout)
+	return u
+}
+
+func (p *PayoutsProcessor) Start() {
+	Info.Println("Starting payouts")
+
+	if p.mustResolvePayout() {
+		Info.Println("Running with env RESOLVE_PAYOUT=1, now trying to resolve locked payouts")
+		p.resolvePayouts()
+		Info.Println("Now you have to restart payouts module with RESOLVE_PAYOUT=0 for normal run")
+		return
+	}
+
+	intv := MustParseDuration(p.config.Interval)
+	timer := time.NewTimer(intv)
+	Info.Printf("Set payouts interval to %v", intv)
+
+	// Immediately process payouts after start
+	p.process()
+	timer.Reset(intv)
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				p.process()
+				timer.Reset(intv)
+			}
+		}
+	}()
+}
+
+func (p *PayoutsProcessor) process() {
+	if p.halt {
+		Info.Println("Payments suspended due to last critical error:", p.lastFail)
+		return
+	}
+	if !p.elector.IsLeader() {
+		Info.Println("Skipping payouts, this node is not a leader")
+		return
+	}
+	// Checked by leader on every round, lock may be left by a leader which failed over
+	payments := p.backend.GetPendingPayments()
+	if len(payments) > 0 {
+		Error.Printf("Previous payout failed, you have to resolve it. List of failed payments:\n %v", formatPendingPayments(payments))
+		return
+	}
+	locked, err := p.backend.IsPayoutsLocked()
+	if err != nil {
+		Error.Println("Skipping payouts:", err)
+		return
+	}
+	if locked {
+		Error.Println("Skipping payouts because they are locked")
+		return
+	}
+
+	mustPay := 0
+	minersPaid := 0
+	totalAmount := int64(0)
+	payees, err := p.backend.GetPayees()
+	if err != nil {
+		Error.Println("Error while retrieving payees from backend:", err)
+		return
+	}
+
+	for _, login := range payees {
+		amount, _ := p.backend.GetBalance(login)
+		settings, err := p.backend.GetMinerSettings(login)
+		if err != nil {
+			Error.Printf("Failed to get payout settings for %s: %v", login, err)
+			continue
+		}
+
+		if !p.reachedThreshold(amount, settings) {
+			continue
+		}
+		mustPay++
+
+		address := login
+		if len(settings.PayoutAddress) > 0 {
+			address = settings.PayoutAddress
+		}
+
+		// Require active peers before processing
+		if !p.checkPeers() {
+			break
+		}
+		// Require unlocked wallet
+		if !p.isUnlockedWallet() {
+			break
+		}
+
+		// Check if we have enough funds
+		poolBalance, err := p.rpc.GetBalance()
+		if err != nil {
+			p.halt = true
+			p.lastFail = err
+			break
+		}
+		if poolBalance < amount {
+			err := fmt.Errorf("Not enough balance for payment, need %v Satoshi, pool has %v Satoshi",
+				amount, poolBalance)
+			p.halt = true
+			p.lastFail = err
+			break
+		}
+
+		// Lock payments for current payout
+		err = p.backend.LockPayouts(login, amount)
+		if err == storage.ErrFenced {
+			Info.Println("Payouts interrupted:", err)
+			break
+		}
+		if err != nil {
+			Error.Printf("Failed to lock payment for %s: %v", login, err)
+			p.halt = true
+			p.lastFail = err
+			break
+		}
+		Info.Printf("Locked payment for %s, %v Satoshi", login, amount)
+
+		// Debit miner's balance and update stats
+		err = p.backend.UpdateBalance(login, amount)
+		if err != nil {
+			Error.Printf("Failed to update balance for %s, %v Satoshi: %v", login, amount, err)
+			p.halt = true
+			p.lastFail = err
+			break
+		}
+
+		txHash, err := p.rpc.SendToAddress(address, amount)
+		if err != nil {
+			Error.Printf("Failed to send payment to %s, %v Satoshi: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
+				address, amount, err, address)
+			p.halt = true
+			p.lastFail = err
+			break
+		}
+
+		// Log transaction hash
+		err = p.backend.WritePayment(login, txHash, amount)
+		if err != nil {
+			Error.Printf("Failed to log payment data for %s, %v Satoshi, tx: %s: %v", login, amount, txHash, err)
+			p.halt = true
+			p.lastFail = err
+			break
+		}
+		p.archivePayment(login, txHash, amount)
+
+		minersPaid++
+		totalAmount += amount
+		Info.Printf("Paid %v Satoshi to %v (%v), TxHash: %v", amount, login, address, txHash)
+
+		// Wait for TX confirmation before further payouts
+		for {
+			Info.Printf("Waiting for tx confirmation: %v", txHash)
+			time.Sleep(txCheckInterval)
+			tx, err := p.rpc.GetTransaction(txHash)
+			if err != nil {
+				Error.Printf("Failed to get tx for %v: %v", txHash, err)
+				continue
+			}
+			if tx != nil && tx.Confirmed() {
+				Info.Printf("Payout tx successful for %s: %s", login, txHash)
+				break
+			}
+		}
+	}
+
+	if mustPay > 0 {
+		Info.Printf("Paid total %v Satoshi to %v of %v payees", totalAmount, minersPaid, mustPay)
+	} else {
+		Error.Println("No payees that have reached payout threshold")
+	}
+
+	// Save redis state to disk
+	if minersPaid > 0 && p.config.BgSave {
+		p.bgSave()
+	}
+}
+
+// Payment is already in backend, archive failures are fixed by "dashpool backfill"
+func (p *PayoutsProcessor) archivePayment(login, txHash string, amount int64) {
+	if p.archive == nil {
+		return
+	}
+	payment := &archive.Payment{TxHash: txHash, Login: login, Amount: amount, Timestamp: MakeTimestamp() / 1000}
+	err := p.archive.WritePayment(payment)
+	if err != nil {
+		Error.Printf("Failed to archive payment to %s, tx: %s, run backfill to import it: %v", login, txHash, err)
+	}
+}
+
+func (p PayoutsProcessor) isUnlockedWallet() bool {
+	info, err := p.rpc.GetWalletInfo()
+	if err != nil {
+		Error.Println("Unable to process payouts:", err)
+		return false
+	}
+	if !info.Unlocked() {
+		Error.Println("Unable to process payouts, wallet is locked")
+		return false
+	}
+	return true
+}
+
+func (p PayoutsProcessor) checkPeers() bool {
+	n, err := p.rpc.GetConnectionCount()
+	if err != nil {
+		Error.Println("Unable to start payouts, failed to retrieve number of peers from node:", err)
+		return false
+	}
+	if n < p.config.RequirePeers {
+		Error.Println("Unable to start payouts, number of peers on a node is less than required", p.config.RequirePeers)
+		return false
+	}
+	return true
+}
+
+// Miner's own threshold takes precedence, but never goes below pool minimum
+func (p PayoutsProcessor) thresholdFor(settings *storage.MinerSettings) int64 {
+	if settings == nil || settings.Threshold <= 0 {
+		return p.config.Threshold
+	}
+	if settings.Threshold < p.config.MinThreshold {
+		return p.config.MinThreshold
+	}
+	return settings.Threshold
+}
+
+func (p PayoutsProcessor) reachedThreshold(amount int64, settings *storage.MinerSettings) bool {
+	return amount > 0 && p.thresholdFor(settings) < amount
+}
+
+func formatPendingPayments(list []*storage.PendingPayment) string {
+	var s string
+	for _, v := range list {
+		s += fmt.Sprintf("\tAddress: %s, Amount: %v Satoshi, %v\n", v.Address, v.Amount, time.Unix(v.Timestamp, 0))
+	}
+	return s
+}
+
+func (p PayoutsProcessor) bgSave() {
+	result, err := p.backend.BgSave()
+	if err != nil {
+		Error.Println("Failed to perform BGSAVE on backend:", err)
+		return
+	}
+	Info.Println("Saving backend state to disk:", result)
+}
+
+func (p PayoutsProcessor) resolvePayouts() {
+	payments := p.backend.GetPendingPayments()
+
+	if len(payments) > 0 {
+		Info.Printf("Will credit back following balances:\n%s", formatPendingPayments(payments))
+
+		for _, v := range payments {
+			err := p.backend.RollbackBalance(v.Address, v.Amount)
+			if err != nil {
+				Error.Printf("Failed to credit %v Satoshi back to %s, error is: %v", v.Amount, v.Address, err)
+				return
+			}
+			Info.Printf("Credited %v Satoshi back to %s", v.Amount, v.Address)
+		}
+		err := p.backend.UnlockPayouts()
+		if err != nil {
+			Error.Println("Failed to unlock payouts:", err)
+			return
+		}
+	} else {
+		Error.Println("No pending payments to resolve")
+	}
+
+	if p.config.BgSave {
+		p.bgSave()
+	}
+	Info.Println("Payouts unlocked")
+}
+
+func (p PayoutsProcessor) mustResolvePayout() bool {
+	v, _ := strconv.ParseBool(os.Getenv("RESOLVE_PAYOUT"))
+	return v
+}
@@ -0,0 +1,58 @@
+package payouts
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/PowPool/dashpool/storage"
+)
+
+func TestThresholdFor(t *testing.T) {
+	p := PayoutsProcessor{config: &PayoutsConfig{Threshold: 500000000, MinThreshold: 10000000}}
+
+	if v := p.thresholdFor(&storage.MinerSettings{}); v != 500000000 {
+		t.Errorf("Must use pool threshold by default: %v", v)
+	}
+	if v := p.thresholdFor(&storage.MinerSettings{Threshold: 20000000}); v != 20000000 {
+		t.Errorf("Must honour miner threshold: %v", v)
+	}
+	if v := p.thresholdFor(&storage.MinerSettings{Threshold: 1}); v != 10000000 {
+		t.Errorf("Must not go below pool minimum: %v", v)
+	}
+	if p.reachedThreshold(20000000, &storage.MinerSettings{Threshold: 20000000}) {
+		t.Error("Must pay only above threshold")
+	}
+	if !p.reachedThreshold(20000001, &storage.MinerSettings{Threshold: 20000000}) {
+		t.Error("Must pay above miner threshold")
+	}
+}
+
+// Payouts left locked by another leader are skipped by the round, not for good
+func TestProcessSkipsLockedPayouts(t *testing.T) {
+	var calls int32
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 0, "result": 0})
+	}))
+	defer daemon.Close()
+
+	backend := storage.NewMemoryBackend("test")
+	backend.RollbackBalance("x", 1000)
+	cfg := &PayoutsConfig{Interval: "1h", Daemon: daemon.URL, Timeout: "5s", Threshold: 100, RequirePeers: 1}
+	p := NewPayoutsProcessor(cfg, backend, nil, nil)
+
+	backend.LockPayouts("y", 500)
+	p.process()
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Error("Must skip round while payouts are locked")
+	}
+
+	backend.UnlockPayouts()
+	p.process()
+	if atomic.LoadInt32(&calls) == 0 {
+		t.Error("Must process payouts once lock is released")
+	}
+}
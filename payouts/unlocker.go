@@ -1,12 +1,17 @@
 package payouts
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/PowPool/dashpool/archive"
+	"github.com/PowPool/dashpool/dashcoin"
+	"github.com/PowPool/dashpool/election"
 	"github.com/PowPool/dashpool/rpc"
 	"github.com/PowPool/dashpool/storage"
 	. "github.com/PowPool/dashpool/util"
@@ -21,10 +26,13 @@ type UnlockerConfig struct {
 	ImmatureDepth  int64   `json:"immatureDepth"`
 	KeepTxFees     bool    `json:"keepTxFees"`
 	Interval       string  `json:"interval"`
+	MaxBackoff     string  `json:"maxBackoff"`
 	Daemon         string  `json:"daemon"`
 	Timeout        string  `json:"timeout"`
 }
 
+const haltModule = "unlocker"
+
 //const minDepth = 16
 //const byzantiumHardForkHeight = 4370000
 //const istanbulHardForkHeight = 7080000
@@ -39,50 +47,188 @@ const donationAccount = ""
 
 type BlockUnlocker struct {
 	config   *UnlockerConfig
-	backend  *storage.RedisClient
+	backend  storage.Backend
+	archive  archive.Archive
+	elector  *election.Elector
 	rpc      *rpc.RPCClient
 	halt     bool
 	lastFail error
+	// Halt is stored in backend, so clearing it there resumes unlocking
+	haltStored bool
+	// Consecutive transient failures and time of the next attempt
+	failures   int
+	retryAt    time.Time
+	interval   time.Duration
+	maxBackoff time.Duration
+	// Script of the upstream coinbase wallet which our blocks must pay to
+	coinBaseScript string
 }
 
-func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockUnlocker {
+func NewBlockUnlocker(cfg *UnlockerConfig, backend storage.Backend, archive archive.Archive, coinBase string,
+	elector *election.Elector) *BlockUnlocker {
 	if len(cfg.PoolFeeAddress) != 0 && !IsValidDashAddress(cfg.PoolFeeAddress) {
 		Error.Fatalln("Invalid poolFeeAddress", cfg.PoolFeeAddress)
 	}
+	if cfg.Depth < dashcoin.ActiveParams.CoinbaseMaturity {
+		Error.Printf("Block maturity depth %v is below coinbase maturity %v of %v, miners may be credited with unspendable coins",
+			cfg.Depth, dashcoin.ActiveParams.CoinbaseMaturity, dashcoin.ActiveParams.Name)
+	}
+	coinBaseScript, err := dashcoin.GetCoinBaseScriptHex(coinBase)
+	if err != nil {
+		Error.Fatalln("Invalid upstream coinbase", coinBase)
+	}
 	//if cfg.Depth < minDepth*2 {
 	//	Error.Fatalf("Block maturity depth can't be < %v, your depth is %v", minDepth*2, cfg.Depth)
 	//}
 	//if cfg.ImmatureDepth < minDepth {
 	//	Error.Fatalf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
 	//}
-	u := &BlockUnlocker{config: cfg, backend: backend}
+	u := &BlockUnlocker{config: cfg, backend: elector.Fence(backend), archive: archive, elector: elector,
+		coinBaseScript: coinBaseScript}
 	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Timeout)
 	return u
 }
 
 func (u *BlockUnlocker) Start() {
 	Info.Println("Starting block unlocker")
-	intv := MustParseDuration(u.config.Interval)
-	timer := time.NewTimer(intv)
-	Info.Printf("Set block unlock interval to %v", intv)
+	u.interval = MustParseDuration(u.config.Interval)
+	timer := time.NewTimer(u.interval)
+	Info.Printf("Set block unlock interval to %v", u.interval)
+
+	u.maxBackoff = 16 * u.interval
+	if len(u.config.MaxBackoff) > 0 {
+		u.maxBackoff = MustParseDuration(u.config.MaxBackoff)
+	}
+	Info.Printf("Set block unlock max backoff to %v", u.maxBackoff)
 
 	// Immediately unlock after start
-	u.unlockPendingBlocks()
-	u.unlockAndCreditMiners()
-	timer.Reset(intv)
+	u.run()
+	timer.Reset(u.interval)
 
 	go func() {
 		for {
 			select {
 			case <-timer.C:
-				u.unlockPendingBlocks()
-				u.unlockAndCreditMiners()
-				timer.Reset(intv)
+				u.run()
+				timer.Reset(u.interval)
 			}
 		}
 	}()
 }
 
+func (u *BlockUnlocker) run() {
+	if !u.elector.IsLeader() {
+		Info.Println("Skipping block unlocking, this node is not a leader")
+		return
+	}
+	if !u.ready() {
+		return
+	}
+	failures := u.failures
+	u.unlockPendingBlocks()
+	if u.halt || u.failures != failures {
+		return
+	}
+	u.unlockAndCreditMiners()
+	if u.halt || u.failures != failures {
+		return
+	}
+	if failures > 0 {
+		Info.Printf("Unlocker recovered after %v failures", failures)
+	}
+	u.failures = 0
+}
+
+// Error which means stored data can't be trusted anymore, unlocker halts until it is reviewed
+type criticalError struct {
+	error
+}
+
+func (e *criticalError) Unwrap() error {
+	return e.error
+}
+
+func critical(err error) error {
+	return &criticalError{err}
+}
+
+// Critical errors halt unlocker, others postpone the next attempt with exponential backoff
+func (u *BlockUnlocker) fail(err error) {
+	// Another node took over, nothing was written
+	if errors.Is(err, storage.ErrFenced) {
+		Info.Println("Unlocking interrupted:", err)
+		return
+	}
+	var c *criticalError
+	if errors.As(err, &c) {
+		u.suspend(err)
+		return
+	}
+	u.failures++
+	backoff := u.interval
+	for i := 1; i < u.failures && backoff < u.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > u.maxBackoff {
+		backoff = u.maxBackoff
+	}
+	u.retryAt = time.Now().Add(backoff)
+	u.lastFail = err
+	Error.Printf("Unlocking failed %v times, will retry in %v: %v", u.failures, backoff, err)
+}
+
+func (u *BlockUnlocker) suspend(err error) {
+	u.halt = true
+	u.lastFail = err
+	Error.Println("Unlocking halted due to critical error, review it and run \"dashpool unhalt unlocker\":", err)
+	BlockLog.Println("Unlocking halted due to critical error:", err)
+	u.storeHalt()
+}
+
+func (u *BlockUnlocker) storeHalt() {
+	err := u.backend.WriteHalt(haltModule, u.lastFail.Error())
+	if err != nil {
+		Error.Printf("Failed to store unlocker halt in backend: %v", err)
+		return
+	}
+	u.haltStored = true
+}
+
+// Unlocking is allowed unless it is halted in backend or postponed after failure
+func (u *BlockUnlocker) ready() bool {
+	if u.halt && !u.haltStored {
+		u.storeHalt()
+		Info.Println("Unlocking suspended due to last critical error:", u.lastFail)
+		return false
+	}
+	state, err := u.backend.GetHalt(haltModule)
+	if err != nil {
+		Error.Printf("Failed to get unlocker state from backend: %v", err)
+		return false
+	}
+	if state != nil {
+		if !u.halt {
+			u.halt = true
+			u.haltStored = true
+			u.lastFail = errors.New(state.Reason)
+		}
+		Info.Println("Unlocking suspended due to last critical error:", state.Reason)
+		return false
+	}
+	if u.halt {
+		Info.Println("Unlocking halt has been cleared, resuming after:", u.lastFail)
+		u.halt = false
+		u.haltStored = false
+		u.lastFail = nil
+		u.failures = 0
+	}
+	if u.failures > 0 && time.Now().Before(u.retryAt) {
+		Info.Printf("Unlocking postponed until %v due to last error: %v", u.retryAt.Format(time.RFC3339), u.lastFail)
+		return false
+	}
+	return true
+}
+
 type UnlockResult struct {
 	maturedBlocks  []*storage.BlockData
 	orphanedBlocks []*storage.BlockData
@@ -94,7 +240,7 @@ type UnlockResult struct {
 func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*UnlockResult, error) {
 	result := &UnlockResult{}
 
-	// Data row is: "nonce:enonce1:enonce2:timestamp:diff:totalShares:coinBaseValue:blkTotalFee"
+	// Data row is: "nonce:enonce1:enonce2:timestamp:diff:totalShares:coinBaseValue:blkTotalFee:blockHash"
 	for _, candidate := range candidates {
 		blockHash, err := u.rpc.GetBlockHashByHeight(candidate.Height)
 		if err != nil {
@@ -107,16 +253,17 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 			Error.Printf("Error while retrieving block %v from node: %v", blockHash, err)
 			return nil, err
 		}
+		if block == nil {
+			return nil, fmt.Errorf("Error while retrieving block %v from node: empty reply", blockHash)
+		}
 
-		blockNonceHex := fmt.Sprintf("%08x", block.Nonce)
-		if len(candidate.Nonce) > 0 && strings.EqualFold(candidate.Nonce, blockNonceHex) {
+		reason := u.matchCandidate(block, candidate)
+		if len(reason) == 0 {
 			result.blocks++
 
 			err = u.handleBlock(block, candidate)
 			if err != nil {
-				u.halt = true
-				u.lastFail = err
-				return nil, err
+				return nil, critical(err)
 			}
 			result.maturedBlocks = append(result.maturedBlocks, candidate)
 			Info.Printf("Mature block %v with %v tx, hash: %v", candidate.Height, len(block.Transactions), candidate.Hash[0:10])
@@ -124,12 +271,39 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 			result.orphans++
 			candidate.Orphan = true
 			result.orphanedBlocks = append(result.orphanedBlocks, candidate)
-			Info.Printf("Orphaned block %v:%v", candidate.RoundHeight, candidate.Nonce)
+			Info.Printf("Orphaned block %v:%v, reason: %v", candidate.RoundHeight, candidate.Nonce, reason)
+			BlockLog.Printf("Orphaned block %v:%v, reason: %v", candidate.RoundHeight, candidate.Nonce, reason)
 		}
 	}
 	return result, nil
 }
 
+// Returns the reason why block in the main chain is not our candidate, empty if it is
+func (u *BlockUnlocker) matchCandidate(block *rpc.GetBlockReply, candidate *storage.BlockData) string {
+	if len(candidate.Hash) > 0 {
+		if !strings.EqualFold(candidate.Hash, block.Hash) {
+			return fmt.Sprintf("block %v at height %v does not match submitted %v", block.Hash, candidate.Height, candidate.Hash)
+		}
+	} else {
+		// Candidates submitted before block hash was stored can only be matched by nonce
+		blockNonceHex := fmt.Sprintf("%08x", block.Nonce)
+		if len(candidate.Nonce) == 0 || !strings.EqualFold(candidate.Nonce, blockNonceHex) {
+			return fmt.Sprintf("nonce %v of block %v does not match submitted %v", blockNonceHex, block.Hash, candidate.Nonce)
+		}
+	}
+
+	if len(block.Transactions) == 0 {
+		return fmt.Sprintf("block %v has no coinbase transaction", block.Hash)
+	}
+	coinBaseTx := block.Transactions[0]
+	for _, vout := range coinBaseTx.Vout {
+		if strings.EqualFold(vout.ScriptPubKey.Hex, u.coinBaseScript) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("coinbase %v of block %v does not pay to pool script %v", coinBaseTx.TxId, block.Hash, u.coinBaseScript)
+}
+
 func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage.BlockData) error {
 	reward := new(big.Int).Set(candidate.CoinBaseValue)
 	// Add TX fees
@@ -148,15 +322,9 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 }
 
 func (u *BlockUnlocker) unlockPendingBlocks() {
-	if u.halt {
-		Info.Println("Unlocking suspended due to last critical error:", u.lastFail)
-		return
-	}
-
 	current, err := u.rpc.GetPendingBlock()
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.fail(err)
 		Error.Printf("Unable to get current blockchain height from node: %v", err)
 		return
 	}
@@ -164,8 +332,7 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 
 	candidates, err := u.backend.GetCandidates(currentHeight - u.config.ImmatureDepth)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.fail(err)
 		Error.Printf("Failed to get block candidates from backend: %v", err)
 		return
 	}
@@ -177,8 +344,7 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 
 	result, err := u.unlockCandidates(candidates)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.fail(err)
 		Error.Printf("Failed to unlock blocks: %v", err)
 		return
 	}
@@ -186,8 +352,7 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 
 	err = u.backend.WritePendingOrphans(result.orphanedBlocks)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.fail(critical(err))
 		Error.Printf("Failed to insert orphaned blocks into backend: %v", err)
 		return
 	} else {
@@ -199,20 +364,19 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 	totalPoolProfit := new(big.Rat)
 
 	for _, block := range result.maturedBlocks {
-		revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewards(block)
+		revenue, minersProfit, poolProfit, roundRewards, _, err := u.calculateRewards(block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.fail(err)
 			Error.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
 		err = u.backend.WriteImmatureBlock(block, roundRewards)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.fail(critical(err))
 			Error.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
+		u.archiveBlock(block, roundRewards)
 		totalRevenue.Add(totalRevenue, revenue)
 		totalMinersProfit.Add(totalMinersProfit, minersProfit)
 		totalPoolProfit.Add(totalPoolProfit, poolProfit)
@@ -240,15 +404,9 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 }
 
 func (u *BlockUnlocker) unlockAndCreditMiners() {
-	if u.halt {
-		Info.Println("Unlocking suspended due to last critical error:", u.lastFail)
-		return
-	}
-
 	current, err := u.rpc.GetPendingBlock()
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.fail(err)
 		Error.Printf("Unable to get current blockchain height from node: %v", err)
 		return
 	}
@@ -256,8 +414,7 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 
 	immature, err := u.backend.GetImmatureBlocks(currentHeight - u.config.Depth)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.fail(err)
 		Error.Printf("Failed to get block candidates from backend: %v", err)
 		return
 	}
@@ -269,8 +426,7 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 
 	result, err := u.unlockCandidates(immature)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.fail(err)
 		Error.Printf("Failed to unlock blocks: %v", err)
 		return
 	}
@@ -279,11 +435,11 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 	for _, block := range result.orphanedBlocks {
 		err = u.backend.WriteOrphan(block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.fail(critical(err))
 			Error.Printf("Failed to insert orphaned block into backend: %v", err)
 			return
 		}
+		u.archiveBlock(block, nil)
 	}
 	Info.Printf("Inserted %v orphaned blocks to backend", result.orphans)
 
@@ -292,17 +448,15 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 	totalPoolProfit := new(big.Rat)
 
 	for _, block := range result.maturedBlocks {
-		revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewards(block)
+		revenue, minersProfit, poolProfit, roundRewards, residual, err := u.calculateRewards(block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.fail(err)
 			Error.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
-		err = u.backend.WriteMaturedBlock(block, roundRewards)
+		err = u.backend.WriteMaturedBlock(block, roundRewards, residual)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.fail(critical(err))
 			Error.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
@@ -332,21 +486,34 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 	)
 }
 
-func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, error) {
-	revenue := new(big.Rat).SetInt(block.Reward)
-	minersProfit, poolProfit := chargeFee(revenue, u.config.PoolFee)
+// Backend stays the source of truth, rounds archive failed to take are imported by "dashpool backfill"
+func (u *BlockUnlocker) archiveBlock(block *storage.BlockData, credits map[string]int64) {
+	if u.archive == nil {
+		return
+	}
+	err := u.archive.WriteBlock(archive.NewBlock(block), credits)
+	if err != nil {
+		Error.Printf("Failed to archive round %v, run backfill to import it: %v", block.RoundKey(), err)
+	}
+}
+
+func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, int64, error) {
+	revenue := new(big.Int).Set(block.Reward)
+	minersProfit, poolProfit := chargeFeeInt(revenue, u.config.PoolFee)
 
 	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, 0, err
 	}
 
-	rewards := calculateRewardsForShares(shares, block.TotalShares, minersProfit)
+	rewards, residual := calculateRewardsForShares(shares, block.TotalShares, minersProfit)
+
+	// Rounding dust which could not be assigned to any miner stays with the pool
+	poolProfit.Add(poolProfit, big.NewInt(residual))
 
 	if block.ExtraReward != nil {
-		extraReward := new(big.Rat).SetInt(block.ExtraReward)
-		poolProfit.Add(poolProfit, extraReward)
-		revenue.Add(revenue, extraReward)
+		poolProfit.Add(poolProfit, block.ExtraReward)
+		revenue.Add(revenue, block.ExtraReward)
 	}
 
 	if u.config.Donate {
@@ -356,30 +523,80 @@ func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *b
 		//rewards[login] += weiToShannonInt64(donation)
 	}
 
+	credited := big.NewInt(0)
+	for _, amount := range rewards {
+		credited.Add(credited, big.NewInt(amount))
+	}
+	if new(big.Int).Add(credited, poolProfit).Cmp(revenue) != 0 {
+		return nil, nil, nil, nil, 0, critical(fmt.Errorf("credits %v plus pool fee %v do not match revenue %v for round %v",
+			credited, poolProfit, revenue, block.RoundKey()))
+	}
+
 	if len(u.config.PoolFeeAddress) != 0 {
-		address := strings.ToLower(u.config.PoolFeeAddress)
-		value, _ := strconv.ParseInt(poolProfit.FloatString(0), 10, 64)
-		rewards[address] += value
+		rewards[u.config.PoolFeeAddress] += poolProfit.Int64()
 	}
 
-	return revenue, minersProfit, poolProfit, rewards, nil
+	return new(big.Rat).SetInt(revenue), new(big.Rat).SetInt(minersProfit), new(big.Rat).SetInt(poolProfit), rewards, residual, nil
 }
 
-func calculateRewardsForShares(shares map[string]int64, total int64, reward *big.Rat) map[string]int64 {
+// Splits reward between miners proportionally to their shares using the largest remainder method.
+// Every login gets the integer part of its quota, leftover satoshis go one by one to the logins
+// with the largest fractional parts, ties are broken by login to keep the result deterministic.
+// Returns rewards and the residual which could not be assigned, it is non-zero only when shares
+// do not sum up to total.
+func calculateRewardsForShares(shares map[string]int64, total int64, reward *big.Int) (map[string]int64, int64) {
 	rewards := make(map[string]int64)
+	if total <= 0 || len(shares) == 0 {
+		return rewards, reward.Int64()
+	}
+
+	type quota struct {
+		login     string
+		remainder *big.Int
+	}
+	quotas := make([]quota, 0, len(shares))
+	denominator := big.NewInt(total)
+	distributed := big.NewInt(0)
+	sumShares := big.NewInt(0)
 
 	for login, n := range shares {
-		percent := big.NewRat(n, total)
-		workerReward := new(big.Rat).Mul(reward, percent)
-		value, _ := strconv.ParseInt(workerReward.FloatString(0), 10, 64)
-		rewards[login] += value
+		value, remainder := new(big.Int).QuoRem(new(big.Int).Mul(reward, big.NewInt(n)), denominator, new(big.Int))
+		rewards[login] = value.Int64()
+		distributed.Add(distributed, value)
+		sumShares.Add(sumShares, big.NewInt(n))
+		quotas = append(quotas, quota{login: login, remainder: remainder})
 	}
-	return rewards
+
+	sort.Slice(quotas, func(i, j int) bool {
+		if c := quotas[i].remainder.Cmp(quotas[j].remainder); c != 0 {
+			return c > 0
+		}
+		return quotas[i].login < quotas[j].login
+	})
+
+	// Whole satoshis covered by the shares we have, the rest is residual
+	covered := new(big.Int).Quo(new(big.Int).Mul(reward, sumShares), denominator)
+	leftover := new(big.Int).Sub(covered, distributed).Int64()
+	for i := int64(0); i < leftover && i < int64(len(quotas)); i++ {
+		rewards[quotas[i].login]++
+	}
+
+	residual := new(big.Int).Sub(reward, covered).Int64()
+	return rewards, residual
 }
 
 // Returns new value after fee deduction and fee value.
 func chargeFee(value *big.Rat, fee float64) (*big.Rat, *big.Rat) {
-	feePercent := new(big.Rat).SetFloat64(fee / 100)
+	feePercent, _ := new(big.Rat).SetString(strconv.FormatFloat(fee, 'f', -1, 64))
+	feePercent.Quo(feePercent, big.NewRat(100, 1))
 	feeValue := new(big.Rat).Mul(value, feePercent)
 	return new(big.Rat).Sub(value, feeValue), feeValue
 }
+
+// Same as chargeFee but in whole satoshis, fractional part of the fee is rounded down
+// in favour of miners so value after deduction plus fee always equals original value.
+func chargeFeeInt(value *big.Int, fee float64) (*big.Int, *big.Int) {
+	_, feeRat := chargeFee(new(big.Rat).SetInt(value), fee)
+	feeValue := new(big.Int).Quo(feeRat.Num(), feeRat.Denom())
+	return new(big.Int).Sub(value, feeValue), feeValue
+}
@@ -1,24 +1,36 @@
 package payouts
 
 import (
+	"errors"
+	"fmt"
 	"math/big"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/PowPool/dashpool/rpc"
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
 )
 
 func TestMain(m *testing.M) {
+	InitLog(os.DevNull, os.DevNull, os.DevNull, os.DevNull, ERROR)
 	os.Exit(m.Run())
 }
 
 func TestCalculateRewards(t *testing.T) {
-	blockReward, _ := new(big.Rat).SetString("5000000000000000000")
+	blockReward := big.NewInt(5000000000)
 	shares := map[string]int64{"0x0": 1000000, "0x1": 20000, "0x2": 5000, "0x3": 10, "0x4": 1}
 	expectedRewards := map[string]int64{"0x0": 4877996431, "0x1": 97559929, "0x2": 24389982, "0x3": 48780, "0x4": 4878}
 	totalShares := int64(1025011)
 
-	rewards := calculateRewardsForShares(shares, totalShares, blockReward)
+	rewards, residual := calculateRewardsForShares(shares, totalShares, blockReward)
 	expectedTotalAmount := int64(5000000000)
 
+	if residual != 0 {
+		t.Errorf("Residual must be zero when shares add up to total: %v", residual)
+	}
+
 	totalAmount := int64(0)
 	for login, amount := range rewards {
 		totalAmount += amount
@@ -32,6 +44,39 @@ func TestCalculateRewards(t *testing.T) {
 	}
 }
 
+func TestCalculateRewardsResidual(t *testing.T) {
+	blockReward := big.NewInt(1000)
+	shares := map[string]int64{"a": 1, "b": 1, "c": 1}
+	expectedRewards := map[string]int64{"a": 250, "b": 250, "c": 250}
+
+	rewards, residual := calculateRewardsForShares(shares, 4, blockReward)
+	for login, amount := range rewards {
+		if expectedRewards[login] != amount {
+			t.Errorf("Amount for %v must be equal to %v vs %v", login, expectedRewards[login], amount)
+		}
+	}
+	if residual != 250 {
+		t.Errorf("Residual must be equal to reward of missing shares: 250 vs %v", residual)
+	}
+
+	rewards, residual = calculateRewardsForShares(shares, 3, big.NewInt(100))
+	if rewards["a"] != 34 || rewards["b"] != 33 || rewards["c"] != 33 || residual != 0 {
+		t.Errorf("Remainder must be assigned deterministically: %v, residual %v", rewards, residual)
+	}
+}
+
+func TestChargeFeeInt(t *testing.T) {
+	value := big.NewInt(1234567891)
+	newValue, fee := chargeFeeInt(value, 1.1)
+
+	if fee.Int64() != 13580246 {
+		t.Errorf("Must round fee down: %v", fee)
+	}
+	if new(big.Int).Add(newValue, fee).Cmp(value) != 0 {
+		t.Error("Value after deduction plus fee must be equal to original value")
+	}
+}
+
 func TestChargeFee(t *testing.T) {
 	orig, _ := new(big.Rat).SetString("5000000000000000000")
 	value, _ := new(big.Rat).SetString("5000000000000000000")
@@ -49,3 +94,63 @@ func TestChargeFee(t *testing.T) {
 		t.Error("Must charge fee")
 	}
 }
+
+func TestMatchCandidate(t *testing.T) {
+	u := &BlockUnlocker{coinBaseScript: "76a914f6a6d7b4a8d5b1d1c3e1c4fbc1e0a2a4c6b7d8e988ac"}
+	block := &rpc.GetBlockReply{
+		Height: 100,
+		Hash:   "00000000000000123abc",
+		Nonce:  0x1234abcd,
+		Transactions: []rpc.Tx{{
+			TxId: "cb",
+			Vout: []rpc.Vout{
+				{ScriptPubKey: rpc.ScriptPubKey{Hex: "76a914000000000000000000000000000000000000000088ac"}},
+				{ScriptPubKey: rpc.ScriptPubKey{Hex: u.coinBaseScript}},
+			},
+		}},
+	}
+
+	candidate := &storage.BlockData{Height: 100, Nonce: "1234abcd", Hash: "00000000000000123ABC"}
+	if reason := u.matchCandidate(block, candidate); len(reason) > 0 {
+		t.Errorf("Block must match candidate by hash: %v", reason)
+	}
+	candidate.Hash = "00000000000000456def"
+	if reason := u.matchCandidate(block, candidate); len(reason) == 0 {
+		t.Error("Block with same nonce but different hash must be orphan")
+	}
+
+	legacy := &storage.BlockData{Height: 100, Nonce: "1234abcd"}
+	if reason := u.matchCandidate(block, legacy); len(reason) > 0 {
+		t.Errorf("Candidate without hash must match by nonce: %v", reason)
+	}
+
+	candidate.Hash = block.Hash
+	block.Transactions[0].Vout = block.Transactions[0].Vout[:1]
+	if reason := u.matchCandidate(block, candidate); len(reason) == 0 {
+		t.Error("Block which coinbase does not pay to pool must be orphan")
+	}
+}
+
+func TestFailBackoff(t *testing.T) {
+	u := &BlockUnlocker{interval: time.Minute, maxBackoff: 5 * time.Minute}
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+
+	for i, backoff := range expected {
+		u.fail(errors.New("connection refused"))
+		if u.halt {
+			t.Fatal("Transient error must not halt unlocker")
+		}
+		if u.failures != i+1 {
+			t.Errorf("Must count failures: %v vs %v", i+1, u.failures)
+		}
+		delay := time.Until(u.retryAt)
+		if delay > backoff || delay < backoff-time.Second {
+			t.Errorf("Retry after %v failures must be in %v, got %v", u.failures, backoff, delay)
+		}
+	}
+
+	var c *criticalError
+	if !errors.As(fmt.Errorf("round 1: %w", critical(errors.New("mismatch"))), &c) {
+		t.Error("Must recognize wrapped critical error")
+	}
+}
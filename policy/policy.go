@@ -60,10 +60,10 @@ type PolicyServer struct {
 	timeout    int64
 	blacklist  []string
 	whitelist  []string
-	storage    *storage.RedisClient
+	storage    storage.Backend
 }
 
-func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
+func Start(cfg *Config, storage storage.Backend) *PolicyServer {
 	s := &PolicyServer{config: cfg, startedAt: MakeTimestamp()}
 	grace := MustParseDuration(cfg.Limits.Grace)
 	s.grace = int64(grace / time.Millisecond)
@@ -1,19 +1,22 @@
 package proxy
 
 import (
-	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/PowPool/dashpool/dashcoin"
 	"github.com/PowPool/dashpool/rpc"
 	. "github.com/PowPool/dashpool/util"
 	"github.com/mutalisk999/bitcoin-lib/src/utility"
 	"github.com/mutalisk999/txid_merkle_tree"
-	"io"
-	"math/big"
 	"strconv"
 	"sync"
+	"time"
 )
 
+// Used when proxy ntimeWindow is not set, dashd rejects blocks more than 2h in the future
+const defaultNTimeWindow = 2 * time.Hour
+
 type BlockTemplateJob struct {
 	BlkTplJobId    string
 	BlkTplJobTime  uint32
@@ -32,7 +35,10 @@ type BlockTemplate struct {
 	PrevHash       string
 	NBits          uint32
 	Target         string
-	Difficulty     *big.Int
+	Difficulty     dashcoin.Difficulty
+	MinTime        uint32
+	MaxTime        uint32
+	Mutable        []string
 	BlockTplJobMap map[string]BlockTemplateJob
 	TxDetailMap    map[string]string
 	updateTime     int64
@@ -41,7 +47,7 @@ type BlockTemplate struct {
 }
 
 type Block struct {
-	difficulty   *big.Int
+	difficulty   dashcoin.Difficulty
 	coinBase1    string
 	coinBase2    string
 	extraNonce1  string
@@ -77,17 +83,26 @@ func (s *ProxyServer) fetchBlockTemplate() {
 
 	var newTpl BlockTemplate
 	if t == nil || t.PrevHash != blkTplReply.PreviousBlockHash {
-		nBits, err := strconv.ParseInt(blkTplReply.Bits, 16, 32)
+		nBits, err := strconv.ParseUint(blkTplReply.Bits, 16, 32)
 		if err != nil {
 			Error.Printf("Error while ParseInt nBits on %s: %s", rpcClient.Name, err)
 			return
 		}
+		if dashcoin.NBits2Target(uint32(nBits)).Cmp(dashcoin.NBits2Target(dashcoin.ActiveParams.GenesisBits)) > 0 {
+			Error.Printf("Invalid block template on %s, target of bits %s is above %s limit", rpcClient.Name,
+				blkTplReply.Bits, dashcoin.ActiveParams.Name)
+			return
+		}
 		newTpl.Version = blkTplReply.Version
 		newTpl.Height = blkTplReply.Height
 		newTpl.PrevHash = blkTplReply.PreviousBlockHash
 		newTpl.NBits = uint32(nBits)
 		newTpl.Target = blkTplReply.Target
-		newTpl.Difficulty = TargetHexToDiff(blkTplReply.Target)
+		newTpl.Difficulty, err = dashcoin.NewDifficultyFromTargetHex(blkTplReply.Target)
+		if err != nil {
+			Error.Printf("Invalid block template target %s on %s: %s", blkTplReply.Target, rpcClient.Name, err)
+			return
+		}
 		newTpl.BlockTplJobMap = make(map[string]BlockTemplateJob)
 		newTpl.TxDetailMap = make(map[string]string)
 		newTpl.updateTime = MakeTimestamp() / 1000
@@ -98,13 +113,17 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		newTpl.PrevHash = t.PrevHash
 		newTpl.NBits = t.NBits
 		newTpl.Target = t.Target
-		newTpl.Difficulty = TargetHexToDiff(blkTplReply.Target)
+		newTpl.Difficulty = t.Difficulty
 		newTpl.BlockTplJobMap = t.BlockTplJobMap
 		newTpl.TxDetailMap = t.TxDetailMap
 		newTpl.updateTime = MakeTimestamp() / 1000
 		newTpl.newBlkTpl = false
 	}
 
+	newTpl.MinTime = blkTplReply.MinTime
+	newTpl.MaxTime = blkTplReply.MaxTime
+	newTpl.Mutable = blkTplReply.Mutable
+
 	var newTplJob BlockTemplateJob
 	newTplJob.BlkTplJobTime = blkTplReply.CurTime
 	for _, tx := range blkTplReply.Transactions {
@@ -116,10 +135,20 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		return
 	}
 
+	err = checkTemplatePayments(blkTplReply)
+	if err != nil {
+		Error.Printf("Invalid block template on %s: %s", rpcClient.Name, err)
+		return
+	}
+
+	// coinbasevalue covers every coinbase output, pool gets what is left after required payments
 	coinBaseReward := blkTplReply.CoinBaseValue
 	for _, masterNode := range blkTplReply.MasterNodes {
 		coinBaseReward -= masterNode.Amount
 	}
+	for _, superBlock := range blkTplReply.SuperBlocks {
+		coinBaseReward -= superBlock.Amount
+	}
 
 	if coinBaseReward <= 0 {
 		Error.Printf("Invalid block template, coinBaseReward <= 0")
@@ -128,7 +157,8 @@ func (s *ProxyServer) fetchBlockTemplate() {
 
 	var coinBaseTx dashcoin.DashCoinBaseTransaction
 	err = coinBaseTx.Initialize(s.config.UpstreamCoinBase, newTplJob.BlkTplJobTime, newTpl.Height, coinBaseReward,
-		blkTplReply.CoinBaseAux.Flags, blkTplReply.CoinbasePayload, s.config.CoinBaseExtraData, blkTplReply.MasterNodes)
+		blkTplReply.CoinBaseAux.Flags, blkTplReply.CoinbasePayload, s.config.CoinBaseExtraData, blkTplReply.MasterNodes,
+		blkTplReply.SuperBlocks)
 	if err != nil {
 		Error.Printf("Error while initialize coinbase transaction on %s: %s", rpcClient.Name, err)
 		return
@@ -167,91 +197,35 @@ func (s *ProxyServer) fetchPendingBlock() (*rpc.GetBlockTemplateReplyPart, error
 	return reply, nil
 }
 
-func ConstructRawDashBlockHex(block *Block, tplJob *BlockTemplateJob, tpl *BlockTemplate) (string, error) {
-	bytes1, err := hex.DecodeString(block.coinBase1)
-	if err != nil {
-		Error.Println("ConstructRawDashBlockHex: hex decode coinBase1 error")
-		return "", err
-	}
-	bytes2, err := hex.DecodeString(block.extraNonce1)
-	if err != nil {
-		Error.Println("ConstructRawDashBlockHex: hex decode extraNonce1 error")
-		return "", err
-	}
-	bytes3, err := hex.DecodeString(block.extraNonce2)
-	if err != nil {
-		Error.Println("ConstructRawDashBlockHex: hex decode extraNonce2 error")
-		return "", err
-	}
-	bytes4, err := hex.DecodeString(block.coinBase2)
-	if err != nil {
-		Error.Println("ConstructRawDashBlockHex: hex decode coinBase2 error")
-		return "", err
-	}
-
-	// construct coin base transaction
-	bytesCoinBaseTx := append(append(append(append([]byte{}, bytes1...), bytes2...), bytes3...), bytes4...)
-	bytesBuf := bytes.NewBuffer(bytesCoinBaseTx)
-	bufReader := io.Reader(bytesBuf)
-	var cbTrx dashcoin.DashTransaction
-	err = cbTrx.UnPack(bufReader)
-	if err != nil {
-		Error.Println("ConstructRawDashBlockHex: unpack coinBase transaction error")
-		return "", err
-	}
-
-	// get coin base transaction id
-	cbTrxId, err := cbTrx.CalcTrxId()
-	if err != nil {
-		Error.Println("ConstructRawDashBlockHex: CalcTrxId error")
-		return "", err
+// Raw transactions of the job in block order, without coinbase
+func getJobRawTransactions(tplJob *BlockTemplateJob, tpl *BlockTemplate) ([]string, error) {
+	rawTrxs := make([]string, 0, len(tplJob.TxIdList))
+	for _, trxId := range tplJob.TxIdList {
+		rawTrxHex, ok := tpl.TxDetailMap[trxId]
+		if !ok {
+			return nil, fmt.Errorf("get TxDetailMap key [%s] error", trxId)
+		}
+		rawTrxs = append(rawTrxs, rawTrxHex)
 	}
+	return rawTrxs, nil
+}
 
-	// get merkle root hash
-	merkleRootHex, err := txid_merkle_tree.GetMerkleRootHexFromCoinBaseAndMerkleBranch(cbTrxId.GetHex(), block.merkleBranch)
+func ConstructRawDashBlockHex(block *Block, rawTrxs []string) (string, error) {
+	blockHeader, cbTrx, err := buildBlockHeader(block)
 	if err != nil {
-		Error.Println("ConstructRawDashBlockHex: GetMerkleRootHexFromCoinBaseAndMerkleBranch error")
+		Error.Printf("ConstructRawDashBlockHex: %v", err)
 		return "", err
 	}
 
-	// construct block header
 	var dashBlock dashcoin.Block
-	dashBlock.Header.Version = int32(block.nVersion)
-	err = dashBlock.Header.HashPrevBlock.SetHex(block.prevHash)
-	if err != nil {
-		Error.Println("ConstructRawDashBlockHex: HashPrevBlock SetHex error")
-		return "", err
-	}
-	err = dashBlock.Header.HashMerkleRoot.SetHex(merkleRootHex)
-	if err != nil {
-		Error.Println("ConstructRawDashBlockHex: HashMerkleRoot SetHex error")
-		return "", err
-	}
-	nTime, err := strconv.ParseUint(block.sTime, 16, 32)
-	if err != nil {
-		Error.Println("ConstructRawDashBlockHex: ParseUint sTime error")
-		return "", err
-	}
-	dashBlock.Header.Time = uint32(nTime)
-	dashBlock.Header.Bits = block.nBits
-	nNonce, err := strconv.ParseUint(block.sNonce, 16, 32)
-	if err != nil {
-		Error.Println("ConstructRawDashBlockHex: ParseUint sNonce error")
-		return "", err
-	}
-	dashBlock.Header.Nonce = uint32(nNonce)
+	dashBlock.Header = blockHeader
 
 	// add transactions
 	// add coin base transaction
 	dashBlock.Vtx = append(dashBlock.Vtx, cbTrx)
 
 	// add other transaction
-	for _, trxId := range tplJob.TxIdList {
-		rawTrxHex, ok := tpl.TxDetailMap[trxId]
-		if !ok {
-			Error.Printf("ConstructRawDashBlockHex: get TxDetailMap key [%s] error", trxId)
-			return "", err
-		}
+	for _, rawTrxHex := range rawTrxs {
 		var trx dashcoin.DashTransaction
 		err = trx.UnPackFromHex(rawTrxHex)
 		if err != nil {
@@ -269,3 +243,61 @@ func ConstructRawDashBlockHex(block *Block, tplJob *BlockTemplateJob, tpl *Block
 
 	return rawBlockHex, nil
 }
+
+// Block missing a required payment is rejected by dashd, so such template is not worth mining
+func checkTemplatePayments(reply *rpc.GetBlockTemplateReplyPart) error {
+	if reply.MasterNodePaymentsStarted != dashcoin.ActiveParams.MasternodePaymentsStarted(int64(reply.Height)) {
+		return fmt.Errorf("masternode payments started %v at height %v, expected otherwise on %v",
+			reply.MasterNodePaymentsStarted, reply.Height, dashcoin.ActiveParams.Name)
+	}
+	if reply.MasterNodePaymentsStarted && reply.MasterNodePaymentsEnforced && len(reply.MasterNodes) == 0 {
+		return errors.New("masternode payments are enforced but no payee in template")
+	}
+	if len(reply.SuperBlocks) == 0 {
+		return nil
+	}
+	if !reply.SuperBlocksStarted || !reply.SuperBlocksEnabled {
+		return errors.New("superblock payments while superblocks are not active")
+	}
+	if !dashcoin.ActiveParams.IsSuperblock(int64(reply.Height)) {
+		return fmt.Errorf("superblock payments at height %v which is not a superblock on %v",
+			reply.Height, dashcoin.ActiveParams.Name)
+	}
+	for _, superBlock := range reply.SuperBlocks {
+		if superBlock.Amount <= 0 {
+			return fmt.Errorf("invalid superblock payment of %v to %v", superBlock.Amount, superBlock.Payee)
+		}
+	}
+	return nil
+}
+
+// Share ntime must be accepted by dashd if share turns out to be a block: not below mintime of the template,
+// within window of the job time and only moved in directions allowed by template mutable
+func (t *BlockTemplate) checkNTime(job *BlockTemplateJob, nTimeHex string, window time.Duration) RejectReason {
+	nTime, err := strconv.ParseUint(nTimeHex, 16, 32)
+	if err != nil {
+		return RejectMalformed
+	}
+
+	canIncrease, canDecrease := len(t.Mutable) == 0, len(t.Mutable) == 0
+	for _, m := range t.Mutable {
+		switch m {
+		case "time":
+			canIncrease, canDecrease = true, true
+		case "time/increment":
+			canIncrease = true
+		case "time/decrement":
+			canDecrease = true
+		}
+	}
+
+	jobTime := int64(job.BlkTplJobTime)
+	windowSec := int64(window / time.Second)
+	if int64(nTime) < int64(t.MinTime) || int64(nTime) < jobTime-windowSec || (!canDecrease && int64(nTime) < jobTime) {
+		return RejectNTimeTooOld
+	}
+	if int64(nTime) > jobTime+windowSec || (t.MaxTime > 0 && uint32(nTime) > t.MaxTime) || (!canIncrease && int64(nTime) > jobTime) {
+		return RejectNTimeTooNew
+	}
+	return RejectNone
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/PowPool/dashpool/dashcoin"
+	"github.com/PowPool/dashpool/rpc"
+	"github.com/PowPool/dashpool/storage"
+)
+
+func TestCheckNTime(t *testing.T) {
+	const jobTime = 0x5f000000
+	window := 2 * time.Hour
+	job := &BlockTemplateJob{BlkTplJobTime: jobTime}
+
+	for _, test := range []struct {
+		name    string
+		minTime uint32
+		maxTime uint32
+		mutable []string
+		nTime   string
+		reason  RejectReason
+	}{
+		{"job time", jobTime - 100, 0, []string{"time"}, fmt.Sprintf("%08x", jobTime), RejectNone},
+		{"malformed", 0, 0, nil, "xyz", RejectMalformed},
+		{"below mintime", jobTime - 100, 0, []string{"time"}, fmt.Sprintf("%08x", jobTime-101), RejectNTimeTooOld},
+		{"at mintime", jobTime - 100, 0, []string{"time"}, fmt.Sprintf("%08x", jobTime-100), RejectNone},
+		{"window start", 0, 0, []string{"time"}, fmt.Sprintf("%08x", jobTime-7200), RejectNone},
+		{"before window", 0, 0, []string{"time"}, fmt.Sprintf("%08x", jobTime-7201), RejectNTimeTooOld},
+		{"window end", 0, 0, []string{"time"}, fmt.Sprintf("%08x", jobTime+7200), RejectNone},
+		{"after window", 0, 0, []string{"time"}, fmt.Sprintf("%08x", jobTime+7201), RejectNTimeTooNew},
+		{"at maxtime", 0, jobTime + 60, []string{"time"}, fmt.Sprintf("%08x", jobTime+60), RejectNone},
+		{"above maxtime", 0, jobTime + 60, []string{"time"}, fmt.Sprintf("%08x", jobTime+61), RejectNTimeTooNew},
+		{"no mutable earlier", 0, 0, nil, fmt.Sprintf("%08x", jobTime-1), RejectNone},
+		{"no mutable later", 0, 0, nil, fmt.Sprintf("%08x", jobTime+1), RejectNone},
+		{"increment later", 0, 0, []string{"time/increment"}, fmt.Sprintf("%08x", jobTime+1), RejectNone},
+		{"increment earlier", 0, 0, []string{"time/increment"}, fmt.Sprintf("%08x", jobTime-1), RejectNTimeTooOld},
+		{"decrement earlier", 0, 0, []string{"time/decrement"}, fmt.Sprintf("%08x", jobTime-1), RejectNone},
+		{"decrement later", 0, 0, []string{"time/decrement"}, fmt.Sprintf("%08x", jobTime+1), RejectNTimeTooNew},
+		{"other mutable later", 0, 0, []string{"transactions"}, fmt.Sprintf("%08x", jobTime+1), RejectNTimeTooNew},
+		{"other mutable at job time", 0, 0, []string{"transactions"}, fmt.Sprintf("%08x", jobTime), RejectNone},
+	} {
+		tpl := &BlockTemplate{MinTime: test.minTime, MaxTime: test.maxTime, Mutable: test.mutable}
+		if reason := tpl.checkNTime(job, test.nTime, window); reason != test.reason {
+			t.Errorf("%v: ntime %v must be %v, got %v", test.name, test.nTime, test.reason, reason)
+		}
+	}
+}
+
+func TestNTimeRejectReply(t *testing.T) {
+	// Share ntime of submitRequest is 5f000000, which is before the window of the job
+	tpl := &BlockTemplate{Mutable: []string{"time"}, BlockTplJobMap: map[string]BlockTemplateJob{
+		"job1": {BlkTplJobId: "job1", BlkTplJobTime: 0x5f000000 + 3*3600},
+	}}
+	s := newTestProxy(storage.NewMemoryBackend("test"), tpl)
+	var buf bytes.Buffer
+	cs := newTestSession(s, &buf)
+
+	if err := cs.handleTCPMessage(s, submitRequest("job1")); err != nil {
+		t.Fatalf("Rejected share must not close session: %v", err)
+	}
+	var reply struct {
+		Error ErrorReply `json:"error"`
+	}
+	json.Unmarshal(buf.Bytes(), &reply)
+	if reply.Error.Code != 20 || reply.Error.Message != "Ntime out of range" {
+		t.Errorf("Must reject ntime with stratum code 20: %v", buf.String())
+	}
+	for reason, code := range map[RejectReason]int{RejectNTimeTooOld: 20, RejectNTimeTooNew: 20} {
+		if reply := reason.ErrorReply(); reply.Code != code || reply.Message != "Ntime out of range" {
+			t.Errorf("Invalid reply of %v: %+v", reason, reply)
+		}
+	}
+}
+
+func TestCheckTemplatePayments(t *testing.T) {
+	payee := rpc.MasterNode{Payee: "yTs1pUbvH7cWRqQoFgvbGEvTcrQNM5jUk5", Amount: 100000}
+	reply := &rpc.GetBlockTemplateReplyPart{Height: 100000}
+	if err := checkTemplatePayments(reply); err != nil {
+		t.Errorf("Must accept template before masternode payments: %v", err)
+	}
+	reply.MasterNodePaymentsStarted = true
+	if err := checkTemplatePayments(reply); err == nil {
+		t.Error("Must reject masternode payments before start block of network")
+	}
+
+	reply = &rpc.GetBlockTemplateReplyPart{Height: 100001, MasterNodePaymentsStarted: true, MasterNodePaymentsEnforced: true}
+	if err := checkTemplatePayments(reply); err == nil {
+		t.Error("Must reject enforced masternode payments without payee")
+	}
+	reply.MasterNodes = []rpc.MasterNode{payee}
+	if err := checkTemplatePayments(reply); err != nil {
+		t.Errorf("Must accept masternode payment: %v", err)
+	}
+	reply.MasterNodePaymentsStarted = false
+	if err := checkTemplatePayments(reply); err == nil {
+		t.Error("Must reject template not paying masternodes after start block of network")
+	}
+
+	height := 38 * dashcoin.MainNetParams.SuperblockCycle
+	reply = &rpc.GetBlockTemplateReplyPart{Height: uint32(height), MasterNodePaymentsStarted: true, MasterNodes: []rpc.MasterNode{payee},
+		SuperBlocks: []rpc.MasterNode{payee}, SuperBlocksStarted: true, SuperBlocksEnabled: true}
+	if err := checkTemplatePayments(reply); err != nil {
+		t.Errorf("Must accept superblock payment: %v", err)
+	}
+	reply.Height++
+	if err := checkTemplatePayments(reply); err == nil {
+		t.Error("Must reject superblock payment off superblock height")
+	}
+}
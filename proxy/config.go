@@ -2,28 +2,33 @@ package proxy
 
 import (
 	"github.com/PowPool/dashpool/api"
+	"github.com/PowPool/dashpool/archive"
+	"github.com/PowPool/dashpool/election"
 	"github.com/PowPool/dashpool/payouts"
 	"github.com/PowPool/dashpool/policy"
 	"github.com/PowPool/dashpool/storage"
 )
 
 type Config struct {
-	Name                      string        `json:"-"`
-	Id                        uint16        `json:"-"`
-	NodeIp                    string        `json:"-"`
-	Log                       Log           `json:"log"`
-	Cluster                   []ClusterNode `json:"cluster"`
-	Proxy                     Proxy         `json:"proxy"`
-	Api                       api.ApiConfig `json:"api"`
-	Upstream                  []Upstream    `json:"upstream"`
-	UpstreamCheckInterval     string        `json:"upstreamCheckInterval"`
-	UpstreamCoinBaseEncrypted string        `json:"upstreamCoinBaseEncrypted"`
-	UpstreamCoinBase          string        `json:"-"`
+	Name                      string          `json:"-"`
+	Id                        uint16          `json:"-"`
+	NodeIp                    string          `json:"-"`
+	Log                       Log             `json:"log"`
+	Cluster                   []ClusterNode   `json:"cluster"`
+	Election                  election.Config `json:"election"`
+	Proxy                     Proxy           `json:"proxy"`
+	Api                       api.ApiConfig   `json:"api"`
+	Upstream                  []Upstream      `json:"upstream"`
+	UpstreamCheckInterval     string          `json:"upstreamCheckInterval"`
+	UpstreamCoinBaseEncrypted string          `json:"upstreamCoinBaseEncrypted"`
+	UpstreamCoinBase          string          `json:"-"`
 
 	Threads int `json:"threads"`
 
-	Coin  string         `json:"coin"`
-	Redis storage.Config `json:"redis"`
+	Coin    string         `json:"coin"`
+	Network string         `json:"network"`
+	Redis   storage.Config `json:"redis"`
+	Archive archive.Config `json:"archive"`
 
 	BlockUnlocker payouts.UnlockerConfig `json:"unlocker"`
 	Payouts       payouts.PayoutsConfig  `json:"payouts"`
@@ -45,18 +50,23 @@ type Proxy struct {
 	BlockRefreshInterval  string `json:"blockRefreshInterval"`
 	BlockTemplateInterval string `json:"blockTemplateInterval"`
 
-	Difficulty          int64  `json:"difficulty"`
-	StateUpdateInterval string `json:"stateUpdateInterval"`
-	HashrateExpiration  string `json:"hashrateExpiration"`
+	// Pool difficulty of shares in hashes, stratumDifficulty takes precedence when set
+	Difficulty          int64   `json:"difficulty"`
+	StratumDifficulty   float64 `json:"stratumDifficulty"`
+	StateUpdateInterval string  `json:"stateUpdateInterval"`
+	HashrateExpiration  string  `json:"hashrateExpiration"`
+	// Allowed distance of share ntime from job time, 2h when not set
+	NTimeWindow string `json:"ntimeWindow"`
 
 	Policy policy.Config `json:"policy"`
 
 	MaxFails    int64 `json:"maxFails"`
 	HealthCheck bool  `json:"healthCheck"`
 
-	Stratum      Stratum      `json:"stratum"`
-	WalletNotify WalletNotify `json:"walletNotify"`
-	DiffAdjust   DiffAdjust   `json:"diffAdjust"`
+	Stratum      Stratum           `json:"stratum"`
+	ShareWriter  ShareWriterConfig `json:"shareWriter"`
+	WalletNotify WalletNotify      `json:"walletNotify"`
+	DiffAdjust   DiffAdjust        `json:"diffAdjust"`
 }
 
 type Stratum struct {
@@ -75,6 +85,9 @@ type DiffAdjust struct {
 	Enabled          bool   `json:"enabled"`
 	AdjustInv        string `json:"adjustInv"`
 	ExpectShareCount int64  `json:"expectShareCount"`
+	// Stratum difficulty adjustment stays within, not bounded when 0
+	MinDifficulty float64 `json:"minDifficulty"`
+	MaxDifficulty float64 `json:"maxDifficulty"`
 }
 
 type Upstream struct {
@@ -8,6 +8,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	//"github.com/PowPool/dashpool/rpc"
 	. "github.com/PowPool/dashpool/util"
@@ -19,9 +20,9 @@ var workerPattern = regexp.MustCompile("^[0-9a-zA-Z-_\x2e]{1,64}$")
 
 // Stratum
 func (s *ProxyServer) handleSubscribeRPC(cs *Session) (interface{}, *ErrorReply) {
-	cs.target = s.target
-	// at first time, target is the same with targetNextJob
-	cs.targetNextJob = s.target
+	cs.difficulty = s.difficulty
+	// at first time, difficulty is the same with difficultyNextJob
+	cs.difficultyNextJob = s.difficulty
 	s.registerSession(cs)
 	Info.Printf("Stratum miner connected from %v", cs.ip)
 
@@ -64,56 +65,68 @@ func (s *ProxyServer) handleAuthorizeRPC(cs *Session, params []string) (bool, *E
 }
 
 // Stratum
-func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, params []string) (bool, *ErrorReply) {
+func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, params []string) (bool, *ErrorReply, bool) {
 	s.sessionsMu.RLock()
 	_, ok := s.sessions[cs]
 	s.sessionsMu.RUnlock()
 
 	if !ok {
-		return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
+		return false, &ErrorReply{Code: 25, Message: "Not subscribed"}, true
 	}
 	return s.handleSubmitRPC(cs, params)
 }
 
-func (s *ProxyServer) handleSubmitRPC(cs *Session, params []string) (bool, *ErrorReply) {
+// Last result tells whether the session must be closed after the reply. Rejected shares are routine
+// after every new job, so they close it only once share policy fails.
+func (s *ProxyServer) handleSubmitRPC(cs *Session, params []string) (bool, *ErrorReply, bool) {
+	if !cs.isAuth {
+		Error.Printf("Unauthorized share from %s", cs.ip)
+		return false, RejectUnauthorized.ErrorReply(), true
+	}
+
 	if len(params) != 5 {
 		s.policy.ApplyMalformedPolicy(cs.ip)
 		Error.Printf("Malformed params from %s@%s %v", cs.login, cs.ip, params)
-		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
+		return false, &ErrorReply{Code: -1, Message: "Invalid params"}, true
+	}
+
+	shareDiff := cs.shareDifficulty(params[1])
+
+	// worker name must be the one authorized on this session
+	if strings.Split(strings.Trim(params[0], " \t\r\n"), ".")[0] != cs.login {
+		Error.Printf("Share for foreign worker %s from %s.%s@%s", params[0], cs.login, cs.id, cs.ip)
+		s.writeRejectReason(cs.login, cs.id, shareDiff, RejectUnauthorized)
+		return false, RejectUnauthorized.ErrorReply(), true
 	}
 
 	if !noncePattern.MatchString(params[2]) || !noncePattern.MatchString(params[3]) || !noncePattern.MatchString(params[4]) {
 		s.policy.ApplyMalformedPolicy(cs.ip)
 		Error.Printf("Malformed PoW result from %s@%s %v", cs.login, cs.ip, params)
-		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
+		s.writeRejectReason(cs.login, cs.id, shareDiff, RejectMalformed)
+		return false, RejectMalformed.ErrorReply(), true
 	}
 	t := s.currentBlockTemplate()
-	exist, validShare := s.processShare(cs.login, cs.id, cs.extraNonce1, cs.ip, TargetHexToDiff(cs.target).Int64(), t, params)
-	ok := s.policy.ApplySharePolicy(cs.ip, !exist && validShare)
-
-	if exist {
-		Error.Printf("Duplicate share from %s@%s %v", cs.login, cs.ip, params)
-		ShareLog.Printf("Duplicate share from %s@%s %v", cs.login, cs.ip, params)
-		return false, &ErrorReply{Code: 22, Message: "Duplicate share"}
-	}
-
-	if !validShare {
-		Error.Printf("Invalid share from %s.%s@%s", cs.login, cs.id, cs.ip)
-		ShareLog.Printf("Invalid share from %s.%s@%s", cs.login, cs.id, cs.ip)
-		// Bad shares limit reached, return error and close
-		if !ok {
-			return false, &ErrorReply{Code: 23, Message: "Invalid share"}
+	reason, record := s.processShare(cs.login, cs.id, cs.extraNonce1, cs.ip, shareDiff, t, params)
+	ok := s.policy.ApplySharePolicy(cs.ip, reason == RejectNone)
+
+	if reason != RejectNone {
+		Error.Printf("Rejected share (%v) from %s.%s@%s %v", reason, cs.login, cs.id, cs.ip, params)
+		if record != nil {
+			ShareLog.Printf("Rejected share (%v) from %s.%s@%s %v", reason, cs.login, cs.id, cs.ip, record)
+		} else {
+			ShareLog.Printf("Rejected share (%v) from %s.%s@%s %v", reason, cs.login, cs.id, cs.ip, params)
 		}
-		return false, nil
+		return false, reason.ErrorReply(), !ok
 	}
 	Info.Printf("Valid share from %s.%s@%s", cs.login, cs.id, cs.ip)
 	ShareLog.Printf("Valid share from %s.%s@%s", cs.login, cs.id, cs.ip)
+	atomic.AddInt64(&cs.shareCountInv, 1)
 
 	if !ok {
-		return true, &ErrorReply{Code: -1, Message: "High rate of invalid shares"}
+		return true, &ErrorReply{Code: -1, Message: "High rate of invalid shares"}, true
 	}
 
-	return true, nil
+	return true, nil, false
 }
 
 //func (s *ProxyServer) handleGetBlockByNumberRPC() *rpc.GetBlockReplyPart {
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PowPool/dashpool/dashcoin"
+	"github.com/PowPool/dashpool/policy"
+	"github.com/PowPool/dashpool/storage"
+)
+
+// Proxy without upstreams and listeners, serving the given template
+func newTestProxy(backend storage.Backend, t *BlockTemplate) *ProxyServer {
+	policyConfig := &policy.Config{
+		Banning:         policy.Banning{InvalidPercent: 30, CheckThreshold: 4, MalformedLimit: 5},
+		Limits:          policy.Limits{Grace: "1m"},
+		ResetInterval:   "1h",
+		RefreshInterval: "1h",
+	}
+	s := &ProxyServer{config: &Config{}, backend: backend, policy: policy.Start(policyConfig, backend)}
+	s.difficulty = dashcoin.NewDifficultyFromPoolDiff(1)
+	s.minDifficulty, s.maxDifficulty, _ = diffAdjustBounds(&s.config.Proxy.DiffAdjust)
+	s.nTimeWindow = defaultNTimeWindow
+	s.shareWriter = NewShareWriter(&ShareWriterConfig{FlushInterval: "1h"}, "test", backend, time.Hour)
+	s.sessions = make(map[*Session]struct{})
+	s.blockTemplate.Store(t)
+	return s
+}
+
+// Authorized session writing its replies to buf
+func newTestSession(s *ProxyServer, buf *bytes.Buffer) *Session {
+	cs := &Session{ip: "127.0.0.1", enc: json.NewEncoder(buf), login: "x", id: "rig1", isAuth: true,
+		extraNonce1: "00010000", difficulty: s.difficulty, difficultyNextJob: s.difficulty}
+	s.registerSession(cs)
+	return cs
+}
+
+func submitRequest(jobId string) *StratumReq {
+	params, _ := json.Marshal([]string{"x.rig1", jobId, "00000000", "5f000000", "00000001"})
+	return &StratumReq{JSONRpcReq{Id: json.RawMessage("1"), Method: "mining.submit", Params: params}}
+}
+
+func TestRejectedShareKeepsSession(t *testing.T) {
+	s := newTestProxy(storage.NewMemoryBackend("test"), &BlockTemplate{BlockTplJobMap: map[string]BlockTemplateJob{}})
+	var buf bytes.Buffer
+	cs := newTestSession(s, &buf)
+
+	// Stale shares are rejected with their reason until share policy fails at its check threshold
+	for i := 1; i <= 4; i++ {
+		buf.Reset()
+		err := cs.handleTCPMessage(s, submitRequest("stale"))
+		var reply struct {
+			Error ErrorReply `json:"error"`
+		}
+		json.Unmarshal(buf.Bytes(), &reply)
+		if reply.Error != *RejectJobNotFound.ErrorReply() {
+			t.Errorf("Share %v must be rejected with its reason: %v", i, buf.String())
+		}
+		if i < 4 && err != nil {
+			t.Errorf("Rejected share %v must not close session: %v", i, err)
+		}
+		if i == 4 && err == nil {
+			t.Error("Session must be closed once share policy fails")
+		}
+	}
+}
+
+func TestVarDiffAppliesWithNextJob(t *testing.T) {
+	s := newTestProxy(storage.NewMemoryBackend("test"), &BlockTemplate{BlockTplJobMap: map[string]BlockTemplateJob{}})
+	s.config.Proxy.DiffAdjust.ExpectShareCount = 10
+	s.difficulty = dashcoin.NewDifficultyFromNBits(dashcoin.DIFF1_NBITS)
+	var buf bytes.Buffer
+	cs := newTestSession(s, &buf)
+	initial := cs.shareDifficulty("job1")
+
+	// No shares since the last adjustment
+	s.UpdateAllSessionDiff()
+	if cs.shareDifficulty("job1").Cmp(initial) != 0 {
+		t.Error("Difficulty must not change before the next job")
+	}
+	cs.pushNewJob([]interface{}{"job1"})
+	lower := initial.Mul(0.8)
+	if cs.shareDifficulty("job1").Cmp(lower) != 0 {
+		t.Errorf("Lower difficulty must apply with the next job: %v", cs.shareDifficulty("job1"))
+	}
+	dec := json.NewDecoder(&buf)
+	for _, method := range []string{"mining.set_difficulty", "mining.notify"} {
+		var message JSONPushMessage
+		if err := dec.Decode(&message); err != nil || message.Method != method {
+			t.Fatalf("Must push %v: %+v, %v", method, message, err)
+		}
+		if params := message.Params.([]interface{}); method == "mining.set_difficulty" && params[0] != lower.StratumDiff() {
+			t.Errorf("Must push adjusted difficulty: %v", params)
+		}
+	}
+
+	// Adjustment starts from the current difficulty
+	atomic.StoreInt64(&cs.shareCountInv, 25)
+	s.UpdateAllSessionDiff()
+	cs.pushNewJob([]interface{}{"job2"})
+	if cs.shareDifficulty("job2").Cmp(lower.Mul(1.2)) != 0 {
+		t.Errorf("Higher difficulty must apply with the next job: %v", cs.shareDifficulty("job2"))
+	}
+	if atomic.LoadInt64(&cs.shareCountInv) != 0 {
+		t.Error("Share count must be reset by adjustment")
+	}
+
+	// Shares in flight for the earlier job keep difficulty it was pushed with
+	if cs.shareDifficulty("job1").Cmp(lower) != 0 {
+		t.Errorf("Earlier job must keep its difficulty: %v", cs.shareDifficulty("job1"))
+	}
+
+	// Clean jobs drop difficulty of earlier jobs
+	cs.pushNewJob([]interface{}{"job3", true})
+	if cs.shareDifficulty("job1").Cmp(lower.Mul(1.2)) != 0 || len(cs.jobDifficulty) != 1 {
+		t.Errorf("Clean jobs must reset job difficulty: %v", cs.jobDifficulty)
+	}
+
+	// Job without adjustment pushes no difficulty
+	buf.Reset()
+	cs.pushNewJob([]interface{}{"job4"})
+	var message JSONPushMessage
+	if json.NewDecoder(&buf).Decode(&message); message.Method != "mining.notify" {
+		t.Errorf("Must push job only: %+v", message)
+	}
+}
+
+func TestVarDiffBounds(t *testing.T) {
+	s := newTestProxy(storage.NewMemoryBackend("test"), &BlockTemplate{BlockTplJobMap: map[string]BlockTemplateJob{}})
+	s.config.Proxy.DiffAdjust = DiffAdjust{ExpectShareCount: 10, MinDifficulty: 0.5, MaxDifficulty: 1}
+	s.minDifficulty, s.maxDifficulty, _ = diffAdjustBounds(&s.config.Proxy.DiffAdjust)
+	var buf bytes.Buffer
+	cs := newTestSession(s, &buf)
+	cs.difficulty, _ = dashcoin.NewDifficultyFromStratumDiff(0.55)
+
+	// Idle session is lowered down to min difficulty only
+	for i := 0; i < 5; i++ {
+		s.UpdateAllSessionDiff()
+		cs.pushNewJob([]interface{}{"job1"})
+	}
+	if cs.shareDifficulty("job1").Cmp(s.minDifficulty) != 0 {
+		t.Errorf("Difficulty must stop at min: %v", cs.shareDifficulty("job1"))
+	}
+	for i := 0; i < 5; i++ {
+		atomic.StoreInt64(&cs.shareCountInv, 25)
+		s.UpdateAllSessionDiff()
+		cs.pushNewJob([]interface{}{"job2"})
+	}
+	if cs.shareDifficulty("job2").Cmp(s.maxDifficulty) != 0 {
+		t.Errorf("Difficulty must stop at max: %v", cs.shareDifficulty("job2"))
+	}
+
+	if _, _, err := diffAdjustBounds(&DiffAdjust{MinDifficulty: 2, MaxDifficulty: 1}); err == nil {
+		t.Error("Must reject min difficulty above max")
+	}
+}
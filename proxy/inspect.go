@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/PowPool/dashpool/dashcoin"
+)
+
+// Everything needed to rebuild a share, written to share log for rejected shares and submitted blocks,
+// so disputes and orphans can be checked later with "dashpool inspect"
+type ShareRecord struct {
+	Login        string   `json:"login"`
+	Id           string   `json:"id"`
+	Height       uint32   `json:"height"`
+	JobId        string   `json:"jobId"`
+	CoinBase1    string   `json:"coinb1"`
+	ExtraNonce1  string   `json:"enonce1"`
+	ExtraNonce2  string   `json:"enonce2"`
+	CoinBase2    string   `json:"coinb2"`
+	MerkleBranch []string `json:"branch"`
+	Version      uint32   `json:"version"`
+	PrevHash     string   `json:"prevHash"`
+	NTime        string   `json:"ntime"`
+	NBits        string   `json:"nbits"`
+	Nonce        string   `json:"nonce"`
+	Target       string   `json:"target"`
+	// Raw transactions without coinbase, for submitted blocks only
+	Txs []string `json:"txs,omitempty"`
+}
+
+func newShareRecord(login, id, jobId string, height uint32, share *Block) *ShareRecord {
+	return &ShareRecord{
+		Login:        login,
+		Id:           id,
+		Height:       height,
+		JobId:        jobId,
+		CoinBase1:    share.coinBase1,
+		ExtraNonce1:  share.extraNonce1,
+		ExtraNonce2:  share.extraNonce2,
+		CoinBase2:    share.coinBase2,
+		MerkleBranch: share.merkleBranch,
+		Version:      share.nVersion,
+		PrevHash:     share.prevHash,
+		NTime:        share.sTime,
+		NBits:        fmt.Sprintf("%08x", share.nBits),
+		Nonce:        share.sNonce,
+		Target:       share.difficulty.TargetHex(),
+	}
+}
+
+func (r *ShareRecord) String() string {
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+func (r *ShareRecord) block() (*Block, error) {
+	nBits, err := strconv.ParseUint(r.NBits, 16, 32)
+	if err != nil {
+		return nil, errors.New("invalid nbits")
+	}
+	diff, err := dashcoin.NewDifficultyFromTargetHex(r.Target)
+	if err != nil {
+		return nil, err
+	}
+	return &Block{
+		difficulty:   diff,
+		coinBase1:    r.CoinBase1,
+		coinBase2:    r.CoinBase2,
+		extraNonce1:  r.ExtraNonce1,
+		extraNonce2:  r.ExtraNonce2,
+		merkleBranch: r.MerkleBranch,
+		nVersion:     r.Version,
+		prevHash:     r.PrevHash,
+		sTime:        r.NTime,
+		nBits:        uint32(nBits),
+		sNonce:       r.Nonce,
+	}, nil
+}
+
+type ShareVerification struct {
+	Hash             string                        `json:"hash"`
+	MerkleRoot       string                        `json:"merkleRoot"`
+	CoinBaseTxId     string                        `json:"coinbaseTxId"`
+	Header           string                        `json:"header"`
+	HashDifficulty   float64                       `json:"hashDifficulty"`
+	ShareDifficulty  float64                       `json:"shareDifficulty"`
+	MeetsShareTarget bool                          `json:"meetsShareTarget"`
+	MeetsBlockTarget bool                          `json:"meetsBlockTarget"`
+	CoinBase         dashcoin.TrxPrintAble         `json:"coinbase"`
+	HeaderFields     dashcoin.BlockHeaderPrintAble `json:"headerFields"`
+}
+
+// Rebuilds the header of the share and checks its X11 hash against share and network targets
+func VerifyShare(r *ShareRecord) (*ShareVerification, error) {
+	share, err := r.block()
+	if err != nil {
+		return nil, err
+	}
+	blockHeader, cbTrx, err := buildBlockHeader(share)
+	if err != nil {
+		return nil, err
+	}
+	hashHex, err := CalcX11HeaderHash(&blockHeader)
+	if err != nil {
+		return nil, err
+	}
+	headerHex, err := blockHeader.PackToHex()
+	if err != nil {
+		return nil, err
+	}
+	cbTrxId, err := cbTrx.CalcTrxId()
+	if err != nil {
+		return nil, err
+	}
+	hash, ok := new(big.Int).SetString(hashHex, 16)
+	if !ok {
+		return nil, errors.New("invalid hash hex")
+	}
+	hashDiff := dashcoin.NewDifficultyFromTarget(hash)
+
+	result := &ShareVerification{
+		Hash:             hashHex,
+		MerkleRoot:       blockHeader.HashMerkleRoot.GetHex(),
+		CoinBaseTxId:     cbTrxId.GetHex(),
+		Header:           headerHex,
+		HashDifficulty:   hashDiff.StratumDiff(),
+		ShareDifficulty:  share.difficulty.StratumDiff(),
+		MeetsShareTarget: share.difficulty.IsMetBy(hashHex),
+		MeetsBlockTarget: dashcoin.NewDifficultyFromNBits(share.nBits).IsMetBy(hashHex),
+		CoinBase:         cbTrx.GetTrxPrintAble(),
+		HeaderFields:     blockHeader.GetBlockHeaderPrintAble(),
+	}
+	return result, nil
+}
+
+// Rebuilds raw block exactly as it was submitted to upstream
+func ReconstructBlockHex(r *ShareRecord) (string, error) {
+	if len(r.Txs) == 0 && len(r.MerkleBranch) != 0 {
+		return "", errors.New("share record has no transactions, it was not submitted as block")
+	}
+	share, err := r.block()
+	if err != nil {
+		return "", err
+	}
+	return ConstructRawDashBlockHex(share, r.Txs)
+}
+
+// Extracts share record from share log line, returns nil for lines without one
+func ParseShareLogLine(line string) (*ShareRecord, error) {
+	i := strings.Index(line, "{")
+	if i < 0 {
+		return nil, nil
+	}
+	var record ShareRecord
+	err := json.Unmarshal([]byte(line[i:]), &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
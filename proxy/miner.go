@@ -3,17 +3,19 @@ package proxy
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"github.com/PowPool/dashpool/dashcoin"
 	"github.com/PowPool/dashpool/goX11"
+	"github.com/PowPool/dashpool/storage"
 	. "github.com/PowPool/dashpool/util"
 	"github.com/mutalisk999/bitcoin-lib/src/blob"
 	"github.com/mutalisk999/txid_merkle_tree"
 	"io"
-	"math/big"
 	"strconv"
 )
 
-func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int64, t *BlockTemplate, params []string) (bool, bool) {
+// Low difficulty shares come with their record, which share log keeps for "dashpool inspect"
+func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff dashcoin.Difficulty, t *BlockTemplate, params []string) (RejectReason, *ShareRecord) {
 	tplJobId := params[1]
 	eNonce2Hex := params[2]
 	nTimeHex := params[3]
@@ -22,20 +24,19 @@ func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int6
 	h, ok := t.BlockTplJobMap[tplJobId]
 	if !ok {
 		Error.Printf("Stale share from %v.%v@%v", login, id, ip)
-		ShareLog.Printf("Stale share from %v.%v@%v", login, id, ip)
-
-		ms := MakeTimestamp()
-		ts := ms / 1000
+		s.writeRejectReason(login, id, shareDiff, RejectJobNotFound)
+		return RejectJobNotFound, nil
+	}
 
-		err := s.backend.WriteInvalidShare(ms, ts, login, id, shareDiff)
-		if err != nil {
-			Error.Println("Failed to insert invalid share data into backend:", err)
-		}
-		return false, false
+	if reason := t.checkNTime(&h, nTimeHex, s.nTimeWindow); reason != RejectNone {
+		Error.Printf("Share with ntime %v out of range from %v.%v@%v, job time %08x, mintime %08x",
+			nTimeHex, login, id, ip, h.BlkTplJobTime, t.MinTime)
+		s.writeRejectReason(login, id, shareDiff, reason)
+		return reason, nil
 	}
 
 	share := Block{
-		difficulty:   big.NewInt(shareDiff),
+		difficulty:   shareDiff,
 		coinBase1:    h.CoinBase1,
 		coinBase2:    h.CoinBase2,
 		extraNonce1:  eNonce1,
@@ -62,23 +63,41 @@ func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int6
 		sNonce:       nonceHex,
 	}
 
-	if !X11HashVerify(&share) {
-		ms := MakeTimestamp()
-		ts := ms / 1000
-
-		err := s.backend.WriteRejectShare(ms, ts, login, id, shareDiff)
-		if err != nil {
-			Error.Println("Failed to insert reject share data into backend:", err)
-		}
-		return false, false
+	hashHex, err := CalcX11BlockHash(&share)
+	if err != nil {
+		Error.Printf("Malformed share from %v.%v@%v: %v", login, id, ip, err)
+		s.writeRejectReason(login, id, shareDiff, RejectMalformed)
+		return RejectMalformed, nil
+	}
+	if !shareDiff.IsMetBy(hashHex) {
+		s.writeRejectReason(login, id, shareDiff, RejectLowDifficulty)
+		return RejectLowDifficulty, newShareRecord(login, id, tplJobId, t.Height, &share)
 	}
 
 	paramIn := []string{nonceHex, eNonce1, eNonce2Hex}
-	if X11HashVerify(&block) {
+	if t.Difficulty.IsMetBy(hashHex) {
+		if s.shareWriter.IsDuplicate(t.Height, tplJobId, paramIn) {
+			s.writeRejectReason(login, id, shareDiff, RejectDuplicate)
+			return RejectDuplicate, nil
+		}
 		// construct new block
-		rawBlockHex, err := ConstructRawDashBlockHex(&block, &h, t)
+		rawTrxs, err := getJobRawTransactions(&h, t)
 		if err != nil {
-			return false, false
+			Error.Printf("Failed to construct block at height %v: %v", t.Height, err)
+			return RejectOther, nil
+		}
+		rawBlockHex, err := ConstructRawDashBlockHex(&block, rawTrxs)
+		if err != nil {
+			return RejectOther, nil
+		}
+		record := newShareRecord(login, id, tplJobId, t.Height, &share)
+		record.Txs = rawTrxs
+		ShareLog.Printf("Submitting block %v", record)
+		// keep hash of the submitted block, unlocker matches candidates by it
+		blockHash, err := CalcX11BlockHash(&block)
+		if err != nil {
+			Error.Printf("Failed to calculate hash of block at height %v: %v", t.Height, err)
+			return RejectOther, nil
 		}
 		err = s.rpc().SubmitBlock([]interface{}{rawBlockHex})
 		if err != nil {
@@ -86,67 +105,110 @@ func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int6
 			BlockLog.Printf("Block submission failure at height %v for %v: %v", t.Height, t.PrevHash, err)
 		} else {
 			s.fetchBlockTemplate()
-			exist, err := s.backend.WriteBlock(login, id, paramIn, shareDiff, t.Difficulty.Int64(), uint64(t.Height),
-				h.CoinBaseValue, h.JobTxsFeeTotal, s.hashrateExpiration)
+			exist, err := s.shareWriter.WriteBlock(login, id, paramIn, shareDiff.PoolDiff(), t.Difficulty.PoolDiff(), uint64(t.Height),
+				blockHash, h.CoinBaseValue, h.JobTxsFeeTotal)
 			if exist {
-				ms := MakeTimestamp()
-				ts := ms / 1000
-
-				err := s.backend.WriteInvalidShare(ms, ts, login, id, shareDiff)
-				if err != nil {
-					Error.Println("Failed to insert invalid share data into backend:", err)
-				}
-				return true, false
+				s.writeRejectReason(login, id, shareDiff, RejectDuplicate)
+				return RejectDuplicate, nil
 			}
 			if err != nil {
 				Error.Println("Failed to insert block candidate into backend:", err)
 				BlockLog.Println("Failed to insert block candidate into backend:", err)
 			} else {
-				Info.Printf("Inserted block %v to backend", t.Height)
-				BlockLog.Printf("Inserted block %v to backend", t.Height)
+				Info.Printf("Inserted block %v to backend, hash: %v", t.Height, blockHash)
+				BlockLog.Printf("Inserted block %v to backend, hash: %v", t.Height, blockHash)
 			}
 			Info.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
 			BlockLog.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
 		}
 	} else {
-		exist, err := s.backend.WriteShare(login, id, paramIn, shareDiff, uint64(t.Height), s.hashrateExpiration)
-		if exist {
-			ms := MakeTimestamp()
-			ts := ms / 1000
-
-			err := s.backend.WriteInvalidShare(ms, ts, login, id, shareDiff)
-			if err != nil {
-				Error.Println("Failed to insert invalid share data into backend:", err)
-			}
-			return true, false
+		if s.shareWriter.IsDuplicate(t.Height, tplJobId, paramIn) {
+			s.writeRejectReason(login, id, shareDiff, RejectDuplicate)
+			return RejectDuplicate, nil
 		}
+		s.shareWriter.Enqueue(&storage.ShareData{Login: login, Id: id, Diff: shareDiff.PoolDiff(), Ms: MakeTimestamp()})
+	}
+	return RejectNone, nil
+}
+
+// Counts rejected share by reason, shares under share target also go to reject hashrate
+func (s *ProxyServer) writeRejectReason(login, id string, shareDiff dashcoin.Difficulty, reason RejectReason) {
+	ms := MakeTimestamp()
+	ts := ms / 1000
+
+	if reason == RejectLowDifficulty {
+		err := s.backend.WriteRejectShare(ms, ts, login, id, shareDiff.PoolDiff(), reason.String())
 		if err != nil {
-			Error.Println("Failed to insert share data into backend:", err)
+			Error.Println("Failed to insert reject share data into backend:", err)
 		}
+		return
+	}
+	err := s.backend.WriteInvalidShare(ms, ts, login, id, shareDiff.PoolDiff(), reason.String())
+	if err != nil {
+		Error.Println("Failed to insert invalid share data into backend:", err)
 	}
-	return false, true
 }
 
 func X11HashVerify(block *Block) bool {
-	bytes1, err := hex.DecodeString(block.coinBase1)
+	hashHex, err := CalcX11BlockHash(block)
 	if err != nil {
-		Error.Println("X11HashVerify: hex decode coinBase1 error")
+		Error.Println("X11HashVerify:", err)
 		return false
 	}
+
+	return block.difficulty.IsMetBy(hashHex)
+}
+
+// Builds block header from the share and returns its X11 hash, which is the block hash
+func CalcX11BlockHash(block *Block) (string, error) {
+	blockHeader, _, err := buildBlockHeader(block)
+	if err != nil {
+		return "", err
+	}
+	return CalcX11HeaderHash(&blockHeader)
+}
+
+func CalcX11HeaderHash(blockHeader *dashcoin.BlockHeader) (string, error) {
+	bytesBuf := bytes.NewBuffer([]byte{})
+	bufWriter := io.Writer(bytesBuf)
+	err := blockHeader.Pack(bufWriter)
+	if err != nil {
+		return "", errors.New("blockHeader Pack error")
+	}
+
+	Debug.Printf("blockHeader Hex: %s", hex.EncodeToString(bytesBuf.Bytes()))
+
+	// calc block header hash
+	bytesRes := goX11.CalcX11Hash(bytesBuf.Bytes())
+	var res blob.Baseblob
+	res.SetData(bytesRes)
+	resHex := res.GetHex()
+
+	Debug.Printf("Target Hex: %064s", resHex)
+
+	return resHex, nil
+}
+
+// Assembles coinbase transaction of the share and block header committing to it
+func buildBlockHeader(block *Block) (dashcoin.BlockHeader, dashcoin.DashTransaction, error) {
+	var blockHeader dashcoin.BlockHeader
+	var cbTrx dashcoin.DashTransaction
+
+	bytes1, err := hex.DecodeString(block.coinBase1)
+	if err != nil {
+		return blockHeader, cbTrx, errors.New("hex decode coinBase1 error")
+	}
 	bytes2, err := hex.DecodeString(block.extraNonce1)
 	if err != nil {
-		Error.Println("X11HashVerify: hex decode extraNonce1 error")
-		return false
+		return blockHeader, cbTrx, errors.New("hex decode extraNonce1 error")
 	}
 	bytes3, err := hex.DecodeString(block.extraNonce2)
 	if err != nil {
-		Error.Println("X11HashVerify: hex decode extraNonce2 error")
-		return false
+		return blockHeader, cbTrx, errors.New("hex decode extraNonce2 error")
 	}
 	bytes4, err := hex.DecodeString(block.coinBase2)
 	if err != nil {
-		Error.Println("X11HashVerify: hex decode coinBase2 error")
-		return false
+		return blockHeader, cbTrx, errors.New("hex decode coinBase2 error")
 	}
 
 	Debug.Printf("block.coinBase1: %s", block.coinBase1)
@@ -158,18 +220,15 @@ func X11HashVerify(block *Block) bool {
 	bytesCoinBaseTx := append(append(append(append([]byte{}, bytes1...), bytes2...), bytes3...), bytes4...)
 	bytesBuf := bytes.NewBuffer(bytesCoinBaseTx)
 	bufReader := io.Reader(bytesBuf)
-	var cbTrx dashcoin.DashTransaction
 	err = cbTrx.UnPack(bufReader)
 	if err != nil {
-		Error.Println("X11HashVerify: unpack coinBase transaction error")
-		return false
+		return blockHeader, cbTrx, errors.New("unpack coinBase transaction error")
 	}
 
 	// get coin base transaction id
 	cbTrxId, err := cbTrx.CalcTrxId()
 	if err != nil {
-		Error.Println("X11HashVerify: CalcTrxId error")
-		return false
+		return blockHeader, cbTrx, errors.New("CalcTrxId error")
 	}
 
 	Debug.Printf("coinBase trx id: %s", cbTrxId.GetHex())
@@ -178,47 +237,33 @@ func X11HashVerify(block *Block) bool {
 	// get merkle root hash
 	merkleRootHex, err := txid_merkle_tree.GetMerkleRootHexFromCoinBaseAndMerkleBranch(cbTrxId.GetHex(), block.merkleBranch)
 	if err != nil {
-		Error.Println("X11HashVerify: GetMerkleRootHexFromCoinBaseAndMerkleBranch error")
-		return false
+		return blockHeader, cbTrx, errors.New("GetMerkleRootHexFromCoinBaseAndMerkleBranch error")
 	}
 
 	Debug.Printf("merkleRootHex: %s", merkleRootHex)
 
 	// construct block header
-	var blockHeader dashcoin.BlockHeader
 	blockHeader.Version = int32(block.nVersion)
 	err = blockHeader.HashPrevBlock.SetHex(block.prevHash)
 	if err != nil {
-		Error.Println("X11HashVerify: HashPrevBlock SetHex error")
-		return false
+		return blockHeader, cbTrx, errors.New("HashPrevBlock SetHex error")
 	}
 	err = blockHeader.HashMerkleRoot.SetHex(merkleRootHex)
 	if err != nil {
-		Error.Println("X11HashVerify: HashMerkleRoot SetHex error")
-		return false
+		return blockHeader, cbTrx, errors.New("HashMerkleRoot SetHex error")
 	}
 	nTime, err := strconv.ParseUint(block.sTime, 16, 32)
 	if err != nil {
-		Error.Println("X11HashVerify: ParseUint sTime error")
-		return false
+		return blockHeader, cbTrx, errors.New("ParseUint sTime error")
 	}
 	blockHeader.Time = uint32(nTime)
 	blockHeader.Bits = block.nBits
 	nNonce, err := strconv.ParseUint(block.sNonce, 16, 32)
 	if err != nil {
-		Error.Println("X11HashVerify: ParseUint sNonce error")
-		return false
+		return blockHeader, cbTrx, errors.New("ParseUint sNonce error")
 	}
 	blockHeader.Nonce = uint32(nNonce)
 
-	bytesBuf = bytes.NewBuffer([]byte{})
-	bufWriter := io.Writer(bytesBuf)
-	err = blockHeader.Pack(bufWriter)
-	if err != nil {
-		Error.Println("X11HashVerify: blockHeader Pack error")
-		return false
-	}
-
 	Debug.Printf("blockHeader.Version: %d", blockHeader.Version)
 	Debug.Printf("blockHeader.HashPrevBlock: %s", blockHeader.HashPrevBlock.GetHex())
 	Debug.Printf("blockHeader.HashMerkleRoot: %s", blockHeader.HashMerkleRoot.GetHex())
@@ -226,21 +271,5 @@ func X11HashVerify(block *Block) bool {
 	Debug.Printf("blockHeader.Bits: %d", blockHeader.Bits)
 	Debug.Printf("blockHeader.Nonce: %d", blockHeader.Nonce)
 
-	Debug.Printf("blockHeader Hex: %s", hex.EncodeToString(bytesBuf.Bytes()))
-
-	// calc block header hash
-	bytesRes := goX11.CalcX11Hash(bytesBuf.Bytes())
-	var res blob.Baseblob
-	res.SetData(bytesRes)
-	resHex := res.GetHex()
-
-	Debug.Printf("Target Hex: %064s", resHex)
-
-	hashDiff := TargetHexToDiff(resHex)
-
-	if hashDiff.Cmp(block.difficulty) > 0 {
-		return true
-	} else {
-		return false
-	}
+	return blockHeader, cbTrx, nil
 }
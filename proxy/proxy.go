@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"strings"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"github.com/PowPool/dashpool/dashcoin"
 	"github.com/PowPool/dashpool/policy"
 	"github.com/PowPool/dashpool/rpc"
 	"github.com/PowPool/dashpool/storage"
@@ -24,10 +26,14 @@ type ProxyServer struct {
 	blockTemplate      atomic.Value
 	upstream           int32
 	upstreams          []*rpc.RPCClient
-	backend            *storage.RedisClient
-	target             string
+	backend            storage.Backend
+	difficulty         dashcoin.Difficulty
+	minDifficulty      dashcoin.Difficulty
+	maxDifficulty      dashcoin.Difficulty
 	policy             *policy.PolicyServer
 	hashrateExpiration time.Duration
+	nTimeWindow        time.Duration
+	shareWriter        *ShareWriter
 	failsCount         int64
 
 	// Stratum
@@ -49,9 +55,15 @@ type Session struct {
 	id    string
 
 	//lastShareTime int64
-	target string
-
-	targetNextJob string
+	// Difficulty shares are validated and weighted with, guarded by session lock
+	difficulty dashcoin.Difficulty
+
+	// Adjusted difficulty, which becomes current one when the next job is pushed
+	difficultyNextJob dashcoin.Difficulty
+	// Difficulty each job was pushed with, shares of the job are validated and weighted with it.
+	// Reset with clean jobs as the template job map is.
+	jobDifficulty map[string]dashcoin.Difficulty
+	// Valid shares since the last adjustment
 	shareCountInv int64
 
 	// Session tag
@@ -64,7 +76,7 @@ type Session struct {
 	isAuth bool
 }
 
-func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
+func NewProxy(cfg *Config, backend storage.Backend) *ProxyServer {
 	if len(cfg.Name) == 0 {
 		Error.Fatal("You must set instance name")
 	}
@@ -72,7 +84,27 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 
 	proxy := &ProxyServer{config: cfg, backend: backend, policy: policyServer}
 	proxy.upstreamsStates = make([]bool, 0)
-	proxy.target = GetTargetHex(cfg.Proxy.Difficulty)
+	proxy.difficulty = dashcoin.NewDifficultyFromPoolDiff(cfg.Proxy.Difficulty)
+	if cfg.Proxy.StratumDifficulty > 0 {
+		diff, err := dashcoin.NewDifficultyFromStratumDiff(cfg.Proxy.StratumDifficulty)
+		if err != nil {
+			Error.Fatalf("Invalid stratum difficulty: %v", err)
+		}
+		proxy.difficulty = diff
+	}
+	Info.Printf("Set share difficulty to %v (pool difficulty %v)", proxy.difficulty, proxy.difficulty.PoolDiff())
+	minDiff, maxDiff, err := diffAdjustBounds(&cfg.Proxy.DiffAdjust)
+	if err != nil {
+		Error.Fatalf("Invalid difficulty adjustment bounds: %v", err)
+	}
+	proxy.minDifficulty, proxy.maxDifficulty = minDiff, maxDiff
+
+	proxy.hashrateExpiration = MustParseDuration(cfg.Proxy.HashrateExpiration)
+	proxy.nTimeWindow = defaultNTimeWindow
+	if len(cfg.Proxy.NTimeWindow) > 0 {
+		proxy.nTimeWindow = MustParseDuration(cfg.Proxy.NTimeWindow)
+	}
+	proxy.shareWriter = NewShareWriter(&cfg.Proxy.ShareWriter, cfg.Name, backend, proxy.hashrateExpiration)
 
 	proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
 	for i, v := range cfg.Upstream {
@@ -80,6 +112,7 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 		Info.Printf("Upstream: %s => %s", v.Name, v.Url)
 	}
 	Info.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
+	proxy.checkUpstreamsChain()
 
 	if cfg.Proxy.Stratum.Enabled {
 		proxy.sessions = make(map[*Session]struct{})
@@ -104,8 +137,6 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 
 	proxy.fetchBlockTemplate()
 
-	proxy.hashrateExpiration = MustParseDuration(cfg.Proxy.HashrateExpiration)
-
 	refreshIntv := MustParseDuration(cfg.Proxy.BlockRefreshInterval)
 	refreshTimer := time.NewTimer(refreshIntv)
 	Info.Printf("Set block refresh every %v", refreshIntv)
@@ -137,12 +168,19 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	}()
 
 	go func() {
+		var lastStats ShareWriterStats
 		for {
 			select {
 			case <-stateUpdateTimer.C:
+				stats := proxy.shareWriter.Stats()
+				if stats.Stalled > lastStats.Stalled || stats.Failed > lastStats.Failed || stats.Spooled > 0 {
+					Error.Printf("Share writer is behind backend: %+v", stats)
+				}
+				lastStats = stats
+
 				t := proxy.currentBlockTemplate()
 				if t != nil {
-					err := backend.WriteNodeState(cfg.Name, t.Height, t.Difficulty)
+					err := backend.WriteNodeState(cfg.Name, t.Height, t.Difficulty.Work(), stats.Spooled)
 					if err != nil {
 						Info.Printf("Failed to write node state to backend: %v", err)
 						proxy.markSick()
@@ -177,8 +215,8 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 func (s *ProxyServer) Start() {
 	Info.Printf("Starting proxy on %v", s.config.Proxy.Listen)
 	r := mux.NewRouter()
-	r.Handle("/{login:0x[0-9a-fA-F]{40}}/{id:[0-9a-zA-Z-_]{1,64}}", s)
-	r.Handle("/{login:0x[0-9a-fA-F]{40}}", s)
+	r.Handle("/{login:"+AddressRoutePattern+"}/{id:[0-9a-zA-Z-_]{1,64}}", s)
+	r.Handle("/{login:"+AddressRoutePattern+"}", s)
 	srv := &http.Server{
 		Addr:           s.config.Proxy.Listen,
 		Handler:        r,
@@ -190,11 +228,37 @@ func (s *ProxyServer) Start() {
 	}
 }
 
+// Disconnects stratum sessions and writes shares queued so far, process should exit after it
+func (s *ProxyServer) Close() {
+	s.sessionsMu.RLock()
+	for cs := range s.sessions {
+		if cs.conn != nil {
+			cs.conn.Close()
+		}
+	}
+	s.sessionsMu.RUnlock()
+	s.shareWriter.Close()
+}
+
 func (s *ProxyServer) rpc() *rpc.RPCClient {
 	i := atomic.LoadInt32(&s.upstream)
 	return s.upstreams[i]
 }
 
+// Refuses to mine on upstreams of another network, addresses and templates would not match
+func (s *ProxyServer) checkUpstreamsChain() {
+	for _, v := range s.upstreams {
+		info, err := v.GetBlockchainInfo()
+		if err != nil {
+			Error.Printf("Unable to check chain of upstream %s: %v", v.Name, err)
+			continue
+		}
+		if !dashcoin.ActiveParams.IsChain(info.Chain) {
+			Error.Fatalf("Upstream %s is on %s chain, pool is configured for %s", v.Name, info.Chain, dashcoin.ActiveParams.Name)
+		}
+	}
+}
+
 func (s *ProxyServer) checkUpstreams(coinBase string) {
 	candidate := int32(0)
 	backup := false
@@ -260,24 +324,46 @@ func (s *ProxyServer) DumpAllSessionNames() map[string]struct{} {
 	return l
 }
 
+// Bounds of difficulty adjustment, unset ones allow any difficulty
+func diffAdjustBounds(cfg *DiffAdjust) (dashcoin.Difficulty, dashcoin.Difficulty, error) {
+	minDiff := dashcoin.NewDifficultyFromPoolDiff(1)
+	maxDiff := dashcoin.NewDifficultyFromTarget(big.NewInt(1))
+	var err error
+	if cfg.MinDifficulty > 0 {
+		if minDiff, err = dashcoin.NewDifficultyFromStratumDiff(cfg.MinDifficulty); err != nil {
+			return minDiff, maxDiff, err
+		}
+	}
+	if cfg.MaxDifficulty > 0 {
+		if maxDiff, err = dashcoin.NewDifficultyFromStratumDiff(cfg.MaxDifficulty); err != nil {
+			return minDiff, maxDiff, err
+		}
+	}
+	if minDiff.Cmp(maxDiff) > 0 {
+		return minDiff, maxDiff, fmt.Errorf("min difficulty %v is above max difficulty %v", minDiff, maxDiff)
+	}
+	return minDiff, maxDiff, nil
+}
+
+// Adjusts difficulty of every session by its share count since the last adjustment within configured bounds,
+// sessions switch to it with the next job
 func (s *ProxyServer) UpdateAllSessionDiff() {
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
 
 	for k, _ := range s.sessions {
-		if k.shareCountInv > s.config.Proxy.DiffAdjust.ExpectShareCount*2 {
+		count := atomic.SwapInt64(&k.shareCountInv, 0)
+		k.Lock()
+		if count > s.config.Proxy.DiffAdjust.ExpectShareCount*2 {
 			// difficulty up
-			diff := TargetHexToDiff(k.target).Int64()
-			diff = int64(float64(diff) * 1.2)
-			k.targetNextJob = GetTargetHex(diff)
-			Info.Printf("Address: [%s], Name: : [%s], Target From [%s] Up to [%s]", k.login, k.id, k.target, k.targetNextJob)
-		} else if k.shareCountInv < s.config.Proxy.DiffAdjust.ExpectShareCount/2 {
+			k.difficultyNextJob = k.difficulty.Mul(1.2).Clamp(s.minDifficulty, s.maxDifficulty)
+			Info.Printf("Address: [%s], Name: : [%s], Difficulty From [%v] Up to [%v]", k.login, k.id, k.difficulty, k.difficultyNextJob)
+		} else if count < s.config.Proxy.DiffAdjust.ExpectShareCount/2 {
 			// difficulty down
-			diff := TargetHexToDiff(k.target).Int64()
-			diff = int64(float64(diff) * 0.8)
-			k.target = GetTargetHex(diff)
-			Info.Printf("Address: [%s], Name: : [%s], Target From [%s] Down to [%s]", k.login, k.id, k.target, k.targetNextJob)
+			k.difficultyNextJob = k.difficulty.Mul(0.8).Clamp(s.minDifficulty, s.maxDifficulty)
+			Info.Printf("Address: [%s], Name: : [%s], Difficulty From [%v] Down to [%v]", k.login, k.id, k.difficulty, k.difficultyNextJob)
 		}
+		k.Unlock()
 	}
 }
 
@@ -325,7 +411,7 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 	}
 
 	vars := mux.Vars(r)
-	login := strings.ToLower(vars["login"])
+	login := vars["login"]
 
 	if !IsValidDashAddress(login) {
 		errReply := &ErrorReply{Code: -1, Message: "Invalid login"}
@@ -349,7 +435,7 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 				s.policy.ApplyMalformedPolicy(cs.ip)
 				break
 			}
-			reply, errReply := s.handleSubmitRPC(cs, params)
+			reply, errReply, _ := s.handleSubmitRPC(cs, params)
 			if errReply != nil {
 				_ = cs.sendError(req.Id, errReply)
 				break
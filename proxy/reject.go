@@ -0,0 +1,59 @@
+package proxy
+
+// Why a submitted share was not accepted, carried from validation to the stratum error and backend counters
+type RejectReason int
+
+const (
+	RejectNone RejectReason = iota
+	RejectOther
+	RejectMalformed
+	RejectJobNotFound
+	RejectDuplicate
+	RejectLowDifficulty
+	RejectUnauthorized
+	RejectNTimeTooOld
+	RejectNTimeTooNew
+)
+
+var rejectReasonNames = map[RejectReason]string{
+	RejectNone:          "none",
+	RejectOther:         "other",
+	RejectMalformed:     "malformed",
+	RejectJobNotFound:   "jobNotFound",
+	RejectDuplicate:     "duplicate",
+	RejectLowDifficulty: "lowDifficulty",
+	RejectUnauthorized:  "unauthorized",
+	RejectNTimeTooOld:   "ntimeTooOld",
+	RejectNTimeTooNew:   "ntimeTooNew",
+}
+
+// Stratum error codes, 20 is "Other/Unknown"
+var rejectReasonCodes = map[RejectReason]int{
+	RejectOther:         20,
+	RejectMalformed:     20,
+	RejectJobNotFound:   21,
+	RejectDuplicate:     22,
+	RejectLowDifficulty: 23,
+	RejectUnauthorized:  24,
+	RejectNTimeTooOld:   20,
+	RejectNTimeTooNew:   20,
+}
+
+var rejectReasonMessages = map[RejectReason]string{
+	RejectOther:         "Other/Unknown",
+	RejectMalformed:     "Malformed PoW result",
+	RejectJobNotFound:   "Job not found",
+	RejectDuplicate:     "Duplicate share",
+	RejectLowDifficulty: "Low difficulty share",
+	RejectUnauthorized:  "Unauthorized worker",
+	RejectNTimeTooOld:   "Ntime out of range",
+	RejectNTimeTooNew:   "Ntime out of range",
+}
+
+func (r RejectReason) String() string {
+	return rejectReasonNames[r]
+}
+
+func (r RejectReason) ErrorReply() *ErrorReply {
+	return &ErrorReply{Code: rejectReasonCodes[r], Message: rejectReasonMessages[r]}
+}
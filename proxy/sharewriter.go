@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+const (
+	defaultShareQueueSize     = 10000
+	defaultShareBatchSize     = 500
+	defaultShareFlushInterval = time.Second
+	// Failed batch is kept and retried on next flush, dropped after that many attempts
+	maxShareWriteAttempts = 3
+	// Same window as duplicate PoW check of backend
+	shareDedupHeights = 3
+)
+
+type ShareWriterConfig struct {
+	QueueSize     int         `json:"queueSize"`
+	BatchSize     int         `json:"batchSize"`
+	FlushInterval string      `json:"flushInterval"`
+	Spool         SpoolConfig `json:"spool"`
+}
+
+type ShareWriterStats struct {
+	Queued   int   `json:"queued"`
+	Enqueued int64 `json:"enqueued"`
+	Written  int64 `json:"written"`
+	Stalled  int64 `json:"stalled"`
+	Failed   int64 `json:"failed"`
+	Dropped  int64 `json:"dropped"`
+	Spooled  int64 `json:"spooled"`
+}
+
+type jobShares struct {
+	height uint32
+	pow    map[string]struct{}
+}
+
+// Valid shares are checked for duplicates in memory and written to backend in batches by a single
+// goroutine, so share latency does not depend on backend round trips. Extra nonce 1 includes proxy id,
+// so shares of other proxies can not collide with local ones. Blocks are written synchronously,
+// after all shares queued before them, so round shares stay complete. With spool enabled, batches
+// backend fails to write are saved on disk and replayed before queued shares once it recovers. Found
+// block does not wait for the replay, spooled shares replayed after it count to the next round.
+type ShareWriter struct {
+	backend   storage.Backend
+	spool     *ShareSpool
+	window    time.Duration
+	queue     chan *storage.ShareData
+	kick      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closed    int32
+	batchSize int
+	interval  time.Duration
+
+	writeMu  sync.Mutex
+	pending  []*storage.ShareData
+	attempts int
+
+	seenMu sync.Mutex
+	seen   map[string]*jobShares
+
+	enqueued int64
+	written  int64
+	stalled  int64
+	failed   int64
+	dropped  int64
+}
+
+func NewShareWriter(cfg *ShareWriterConfig, node string, backend storage.Backend, window time.Duration) *ShareWriter {
+	w := &ShareWriter{
+		backend:   backend,
+		window:    window,
+		kick:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		batchSize: defaultShareBatchSize,
+		interval:  defaultShareFlushInterval,
+		seen:      make(map[string]*jobShares),
+	}
+	queueSize := defaultShareQueueSize
+	if cfg.QueueSize > 0 {
+		queueSize = cfg.QueueSize
+	}
+	if cfg.BatchSize > 0 {
+		w.batchSize = cfg.BatchSize
+	}
+	if len(cfg.FlushInterval) > 0 {
+		w.interval = MustParseDuration(cfg.FlushInterval)
+	}
+	w.queue = make(chan *storage.ShareData, queueSize)
+	Info.Printf("Share writer queue %v, batch %v, flush every %v", queueSize, w.batchSize, w.interval)
+
+	if cfg.Spool.Enabled {
+		spool, err := NewShareSpool(&cfg.Spool, node, backend, window, w.batchSize)
+		if err != nil {
+			Error.Fatalf("Failed to open share spool: %v", err)
+		}
+		w.spool = spool
+	}
+
+	go w.run()
+	return w
+}
+
+func (w *ShareWriter) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	defer close(w.done)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.kick:
+		case <-w.stop:
+			return
+		}
+		w.writeMu.Lock()
+		w.flush()
+		w.writeMu.Unlock()
+	}
+}
+
+// Stops writer and writes every queued share, or spools it when backend is down. Shares enqueued
+// afterwards are dropped, so sessions must be closed before.
+func (w *ShareWriter) Close() {
+	if !atomic.CompareAndSwapInt32(&w.closed, 0, 1) {
+		return
+	}
+	close(w.stop)
+	<-w.done
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	// Failed batch is dropped after its last attempt, so this ends even if backend is down
+	for len(w.pending) > 0 || len(w.queue) > 0 {
+		w.flush()
+	}
+	if w.spool != nil {
+		w.spool.close()
+	}
+	stats := w.Stats()
+	Info.Printf("Share writer closed, %v shares written, %v spooled, %v dropped", stats.Written, stats.Spooled, stats.Dropped)
+}
+
+// Returns true if the same PoW was already submitted for the job, otherwise remembers it
+func (w *ShareWriter) IsDuplicate(height uint32, jobId string, params []string) bool {
+	w.seenMu.Lock()
+	defer w.seenMu.Unlock()
+
+	job, ok := w.seen[jobId]
+	if !ok {
+		for id, j := range w.seen {
+			if j.height+shareDedupHeights < height {
+				delete(w.seen, id)
+			}
+		}
+		job = &jobShares{height: height, pow: make(map[string]struct{})}
+		w.seen[jobId] = job
+	}
+	key := strings.Join(params, ":")
+	if _, ok := job.pow[key]; ok {
+		return true
+	}
+	job.pow[key] = struct{}{}
+	return false
+}
+
+// Blocks while queue is full, which is counted as a stall
+func (w *ShareWriter) Enqueue(share *storage.ShareData) {
+	if atomic.LoadInt32(&w.closed) != 0 {
+		atomic.AddInt64(&w.dropped, 1)
+		return
+	}
+	atomic.AddInt64(&w.enqueued, 1)
+	select {
+	case w.queue <- share:
+	default:
+		atomic.AddInt64(&w.stalled, 1)
+		w.queue <- share
+	}
+	if len(w.queue) >= w.batchSize {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Writes all shares queued so far, then the block. Spool backlog is replayed by the writer
+// afterwards, so a long backlog never delays the candidate.
+func (w *ShareWriter) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64,
+	blockHash string, coinBaseValue int64, blkTotalFee int64) (bool, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	w.drain()
+	exist, err := w.backend.WriteBlock(login, id, params, diff, roundDiff, height, blockHash, coinBaseValue, blkTotalFee, w.window)
+	if w.spooled() > 0 {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+	return exist, err
+}
+
+// Replays spool and drains queue, must be called with writeMu held
+func (w *ShareWriter) flush() {
+	// Spooled shares go first, new ones are spooled after them if backend is still down
+	if w.spool != nil && w.spool.Pending() > 0 {
+		if err := w.spool.Replay(); err != nil {
+			Error.Printf("Failed to replay share spool: %v", err)
+		}
+	}
+	w.drain()
+}
+
+// Drains queue in batches, must be called with writeMu held
+func (w *ShareWriter) drain() {
+	for {
+	fill:
+		for len(w.pending) < w.batchSize {
+			select {
+			case share := <-w.queue:
+				w.pending = append(w.pending, share)
+			default:
+				break fill
+			}
+		}
+		if len(w.pending) == 0 {
+			return
+		}
+
+		err := w.backend.WriteShares(w.pending, w.window)
+		if err == nil {
+			atomic.AddInt64(&w.written, int64(len(w.pending)))
+		} else {
+			atomic.AddInt64(&w.failed, 1)
+			if w.spool != nil {
+				spoolErr := w.spool.Append(w.pending)
+				if spoolErr == nil {
+					Error.Printf("Spooled %v shares after failed write into backend: %v", len(w.pending), err)
+					w.pending = nil
+					continue
+				}
+				Error.Printf("Failed to spool %v shares: %v", len(w.pending), spoolErr)
+			}
+			w.attempts++
+			if w.attempts < maxShareWriteAttempts {
+				Error.Printf("Failed to write %v shares into backend, will retry: %v", len(w.pending), err)
+				return
+			}
+			Error.Printf("Dropped %v shares after %v failed writes into backend: %v", len(w.pending), w.attempts, err)
+			atomic.AddInt64(&w.dropped, int64(len(w.pending)))
+		}
+		w.pending = nil
+		w.attempts = 0
+	}
+}
+
+func (w *ShareWriter) Stats() ShareWriterStats {
+	return ShareWriterStats{
+		Queued:   len(w.queue),
+		Enqueued: atomic.LoadInt64(&w.enqueued),
+		Written:  atomic.LoadInt64(&w.written),
+		Stalled:  atomic.LoadInt64(&w.stalled),
+		Failed:   atomic.LoadInt64(&w.failed),
+		Dropped:  atomic.LoadInt64(&w.dropped),
+		Spooled:  w.spooled(),
+	}
+}
+
+func (w *ShareWriter) spooled() int64 {
+	if w.spool == nil {
+		return 0
+	}
+	return w.spool.Pending()
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+func TestMain(m *testing.M) {
+	InitLog(os.DevNull, os.DevNull, os.DevNull, os.DevNull, ERROR)
+	os.Exit(m.Run())
+}
+
+func TestShareWriterDuplicates(t *testing.T) {
+	w := NewShareWriter(&ShareWriterConfig{}, "test", storage.NewMemoryBackend("test"), time.Hour)
+
+	if w.IsDuplicate(10, "job1", []string{"00000001", "00010000", "00000000"}) {
+		t.Error("First share must not be duplicate")
+	}
+	if !w.IsDuplicate(10, "job1", []string{"00000001", "00010000", "00000000"}) {
+		t.Error("Same share of the same job must be duplicate")
+	}
+	if w.IsDuplicate(10, "job2", []string{"00000001", "00010000", "00000000"}) {
+		t.Error("Same nonces of another job must not be duplicate")
+	}
+
+	w.IsDuplicate(20, "job3", []string{"00000001", "00010000", "00000000"})
+	if _, ok := w.seen["job1"]; ok {
+		t.Error("Jobs of old heights must be forgotten")
+	}
+}
+
+func TestShareWriterBatches(t *testing.T) {
+	backend := storage.NewMemoryBackend("test")
+	w := NewShareWriter(&ShareWriterConfig{BatchSize: 2, FlushInterval: "1h"}, "test", backend, time.Hour)
+
+	for i := 0; i < 5; i++ {
+		w.Enqueue(&storage.ShareData{Login: "x", Id: "rig1", Diff: 10, Ms: MakeTimestamp()})
+	}
+	// block must include all shares queued before it in its round
+	exist, err := w.WriteBlock("x", "rig1", []string{"00000001", "00010000", "00000000"}, 10, 100, 10, "0x0", 1000, 0)
+	if exist || err != nil {
+		t.Fatalf("Must write block: %v, %v", exist, err)
+	}
+	shares, _ := backend.GetRoundShares(10, "00000001")
+	if shares["x"] != 60 {
+		t.Errorf("Round must include queued shares: %v", shares)
+	}
+
+	stats := w.Stats()
+	if stats.Enqueued != 5 || stats.Written != 5 || stats.Queued != 0 || stats.Dropped != 0 {
+		t.Errorf("Invalid stats: %+v", stats)
+	}
+}
+
+func TestShareWriterClose(t *testing.T) {
+	backend := storage.NewMemoryBackend("test")
+	w := NewShareWriter(&ShareWriterConfig{BatchSize: 2, FlushInterval: "1h"}, "test", backend, time.Hour)
+	for i := 0; i < 3; i++ {
+		w.Enqueue(&storage.ShareData{Login: "x", Id: "rig1", Diff: 10, Ms: MakeTimestamp()})
+	}
+	w.Close()
+	w.Enqueue(&storage.ShareData{Login: "x", Id: "rig1", Diff: 10, Ms: MakeTimestamp()})
+	if stats := w.Stats(); stats.Written != 3 || stats.Queued != 0 || stats.Dropped != 1 {
+		t.Errorf("Queued shares must be written on close and later ones dropped: %+v", stats)
+	}
+
+	// Shares backend fails to write on close are left in spool for the next start
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+	down := &flakyBackend{Backend: backend, down: true}
+	cfg := &ShareWriterConfig{FlushInterval: "1h", Spool: SpoolConfig{Enabled: true, Dir: dir}}
+	w = NewShareWriter(cfg, "test", down, time.Hour)
+	for i := 0; i < 3; i++ {
+		w.Enqueue(&storage.ShareData{Login: "x", Id: "rig1", Diff: 10, Ms: MakeTimestamp()})
+	}
+	w.Close()
+	if stats := w.Stats(); stats.Spooled != 3 || stats.Dropped != 0 {
+		t.Errorf("Shares must be spooled on close: %+v", stats)
+	}
+	if w = NewShareWriter(cfg, "test", down, time.Hour); w.Stats().Spooled != 3 {
+		t.Errorf("Restarted writer must find spooled shares: %+v", w.Stats())
+	}
+}
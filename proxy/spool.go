@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+const (
+	defaultSpoolDir         = "spool"
+	defaultSpoolSegmentSize = 4 * 1024 * 1024
+	defaultSpoolMaxSize     = 256 * 1024 * 1024
+	// Record is payload length and CRC32 of payload followed by JSON encoded share
+	spoolHeaderSize = 8
+	spoolSuffix     = ".spool"
+)
+
+var errSpoolFull = errors.New("share spool is full")
+
+type SpoolConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Dir         string `json:"dir"`
+	SegmentSize int64  `json:"segmentSize"`
+	MaxSize     int64  `json:"maxSize"`
+}
+
+// Write-ahead log of shares which failed to persist into backend. Segments are append-only files named
+// after node and creation time, so they are never reused. Each segment is replayed in batches written
+// together with replayed offset, so a share is written exactly once even if replay is interrupted.
+// Not safe for concurrent use, share writer calls it with its write lock held.
+type ShareSpool struct {
+	node        string
+	dir         string
+	segmentSize int64
+	maxSize     int64
+	batchSize   int
+	backend     storage.Backend
+	window      time.Duration
+	// Matches segments of this node only, node names may prefix each other in a shared dir
+	segmentPattern *regexp.Regexp
+
+	active     *os.File
+	activeName string
+	activeSize int64
+	size       int64
+	spooled    int64
+}
+
+func NewShareSpool(cfg *SpoolConfig, node string, backend storage.Backend, window time.Duration, batchSize int) (*ShareSpool, error) {
+	s := &ShareSpool{
+		node:        node,
+		dir:         cfg.Dir,
+		segmentSize: cfg.SegmentSize,
+		maxSize:     cfg.MaxSize,
+		batchSize:   batchSize,
+		backend:     backend,
+		window:      window,
+	}
+	s.segmentPattern = regexp.MustCompile("^" + regexp.QuoteMeta(node) + "-[0-9]{20}" + regexp.QuoteMeta(spoolSuffix) + "$")
+	if len(s.dir) == 0 {
+		s.dir = defaultSpoolDir
+	}
+	if s.segmentSize <= 0 {
+		s.segmentSize = defaultSpoolSegmentSize
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = defaultSpoolMaxSize
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, segment))
+		if err != nil {
+			return nil, err
+		}
+		records, _, _ := readSpoolRecords(data)
+		s.size += int64(len(data))
+		s.spooled += int64(len(records))
+	}
+	Info.Printf("Share spool in %s has %v unflushed shares in %v segments", s.dir, s.spooled, len(segments))
+	return s, nil
+}
+
+// Number of shares on disk which are not replayed into backend yet
+func (s *ShareSpool) Pending() int64 {
+	return atomic.LoadInt64(&s.spooled)
+}
+
+// Appends shares to active segment and syncs it to disk
+func (s *ShareSpool) Append(shares []*storage.ShareData) error {
+	var buf []byte
+	for _, share := range shares {
+		payload, err := json.Marshal(share)
+		if err != nil {
+			return err
+		}
+		header := make([]byte, spoolHeaderSize)
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+		buf = append(buf, header...)
+		buf = append(buf, payload...)
+	}
+	if s.size+int64(len(buf)) > s.maxSize {
+		return errSpoolFull
+	}
+	if s.active == nil || s.activeSize >= s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	_, err := s.active.Write(buf)
+	if err == nil {
+		err = s.active.Sync()
+	}
+	if err != nil {
+		// Do not leave partial records behind
+		s.active.Truncate(s.activeSize)
+		return err
+	}
+	s.activeSize += int64(len(buf))
+	s.size += int64(len(buf))
+	atomic.AddInt64(&s.spooled, int64(len(shares)))
+	return nil
+}
+
+// Closes active segment and starts a new one
+func (s *ShareSpool) rotate() error {
+	s.close()
+	name := fmt.Sprintf("%s-%020d%s", s.node, time.Now().UnixNano(), spoolSuffix)
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.active = f
+	s.activeName = name
+	s.activeSize = 0
+	return nil
+}
+
+func (s *ShareSpool) close() {
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+		s.activeName = ""
+		s.activeSize = 0
+	}
+}
+
+// Segment file names of this node, oldest first
+func (s *ShareSpool) segments() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, f := range files {
+		name := f.Name()
+		if !f.IsDir() && s.segmentPattern.MatchString(name) {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Writes all spooled shares into backend, oldest first. Stops at first backend error,
+// so the rest is replayed on next attempt in the same order.
+func (s *ShareSpool) Replay() error {
+	if s.Pending() == 0 && s.size == 0 {
+		return nil
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := s.replaySegment(segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShareSpool) replaySegment(segment string) error {
+	path := filepath.Join(s.dir, segment)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	offset, err := s.backend.GetSpoolOffset(s.node, segment)
+	if err != nil {
+		return err
+	}
+
+	records, offsets, err := readSpoolRecords(data)
+	if err != nil {
+		Error.Printf("Spool segment %s is corrupted, dropping it after %v shares: %v", segment, len(records), err)
+	}
+	var batch []*storage.ShareData
+	for i, share := range records {
+		if offsets[i] <= offset {
+			// Written before replay was interrupted
+			atomic.AddInt64(&s.spooled, -1)
+			continue
+		}
+		batch = append(batch, share)
+		if len(batch) == s.batchSize || i == len(records)-1 {
+			err := s.backend.WriteSpooledShares(s.node, segment, offsets[i], batch, s.window)
+			if err != nil {
+				return err
+			}
+			atomic.AddInt64(&s.spooled, -int64(len(batch)))
+			batch = nil
+		}
+	}
+
+	// Active segment is closed only once replayed, so failed replays keep appending to it
+	if segment == s.activeName {
+		s.close()
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	s.size -= int64(len(data))
+	Info.Printf("Replayed %v shares from spool segment %s", len(records), segment)
+
+	// Offset is removed only after the segment, stale offset is harmless as names are never reused
+	if err := s.backend.DeleteSpoolOffset(s.node, segment); err != nil {
+		Error.Printf("Failed to delete offset of spool segment %s: %v", segment, err)
+	}
+	return nil
+}
+
+// Decodes records of a segment along with offset each one ends at. Truncated or corrupted
+// record is reported as error along with all valid records before it.
+func readSpoolRecords(data []byte) ([]*storage.ShareData, []int64, error) {
+	var records []*storage.ShareData
+	var offsets []int64
+	pos := 0
+	for pos < len(data) {
+		if len(data)-pos < spoolHeaderSize {
+			return records, offsets, fmt.Errorf("truncated header at offset %v", pos)
+		}
+		size := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		sum := binary.BigEndian.Uint32(data[pos+4 : pos+8])
+		start := pos + spoolHeaderSize
+		if size > len(data)-start {
+			return records, offsets, fmt.Errorf("truncated record at offset %v", pos)
+		}
+		payload := data[start : start+size]
+		if crc32.ChecksumIEEE(payload) != sum {
+			return records, offsets, fmt.Errorf("checksum mismatch at offset %v", pos)
+		}
+		var share storage.ShareData
+		if err := json.Unmarshal(payload, &share); err != nil {
+			return records, offsets, fmt.Errorf("malformed record at offset %v: %v", pos, err)
+		}
+		pos = start + size
+		records = append(records, &share)
+		offsets = append(offsets, int64(pos))
+	}
+	return records, offsets, nil
+}
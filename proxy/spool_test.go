@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PowPool/dashpool/storage"
+	. "github.com/PowPool/dashpool/util"
+)
+
+// Memory backend which fails share writes while down or after given number of spooled batches
+type flakyBackend struct {
+	storage.Backend
+	down          bool
+	spooledWrites int
+}
+
+var errBackendDown = errors.New("backend is down")
+
+func (b *flakyBackend) WriteShares(shares []*storage.ShareData, window time.Duration) error {
+	if b.down {
+		return errBackendDown
+	}
+	return b.Backend.WriteShares(shares, window)
+}
+
+func (b *flakyBackend) WriteSpooledShares(node, segment string, offset int64, shares []*storage.ShareData, window time.Duration) error {
+	if b.down || b.spooledWrites == 0 {
+		return errBackendDown
+	}
+	b.spooledWrites--
+	return b.Backend.WriteSpooledShares(node, segment, offset, shares, window)
+}
+
+func TestShareSpoolReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	backend := &flakyBackend{Backend: storage.NewMemoryBackend("test"), down: true}
+	cfg := &ShareWriterConfig{BatchSize: 2, FlushInterval: "1h", Spool: SpoolConfig{Enabled: true, Dir: dir}}
+	w := NewShareWriter(cfg, "test", backend, time.Hour)
+
+	for i := 0; i < 5; i++ {
+		w.Enqueue(&storage.ShareData{Login: "x", Id: "rig1", Diff: 10, Ms: MakeTimestamp()})
+	}
+	w.writeMu.Lock()
+	w.flush()
+	w.writeMu.Unlock()
+	if stats := w.Stats(); stats.Spooled != 5 || stats.Dropped != 0 {
+		t.Fatalf("Shares must be spooled: %+v", stats)
+	}
+
+	// Replay is interrupted after first batch, then resumed by a restarted node
+	backend.down = false
+	backend.spooledWrites = 1
+	w.writeMu.Lock()
+	w.flush()
+	w.writeMu.Unlock()
+	if spooled := w.Stats().Spooled; spooled != 3 {
+		t.Errorf("Only first batch must be replayed, %v spooled", spooled)
+	}
+	w.spool.close()
+
+	backend.spooledWrites = 10
+	w = NewShareWriter(cfg, "test", backend, time.Hour)
+	if spooled := w.Stats().Spooled; spooled != 5 {
+		t.Errorf("Restarted spool must count all shares on disk, %v spooled", spooled)
+	}
+	w.writeMu.Lock()
+	w.flush()
+	w.writeMu.Unlock()
+	exist, err := w.WriteBlock("x", "rig1", []string{"00000001", "00010000", "00000000"}, 10, 100, 10, "0x0", 1000, 0)
+	if exist || err != nil {
+		t.Fatalf("Must write block: %v, %v", exist, err)
+	}
+	shares, _ := backend.GetRoundShares(10, "00000001")
+	if shares["x"] != 60 {
+		t.Errorf("Every spooled share must be written exactly once: %v", shares)
+	}
+	if spooled := w.Stats().Spooled; spooled != 0 {
+		t.Errorf("Spool must be empty, %v spooled", spooled)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix)); len(files) != 0 {
+		t.Errorf("Replayed segments must be removed: %v", files)
+	}
+}
+
+func TestShareSpoolOutage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	backend := &flakyBackend{Backend: storage.NewMemoryBackend("test"), down: true}
+	cfg := &ShareWriterConfig{BatchSize: 2, FlushInterval: "1h", Spool: SpoolConfig{Enabled: true, Dir: dir}}
+	w := NewShareWriter(cfg, "test", backend, time.Hour)
+
+	// Failed replays keep appending to the same segment
+	for i := 0; i < 5; i++ {
+		w.Enqueue(&storage.ShareData{Login: "x", Id: "rig1", Diff: 10, Ms: MakeTimestamp()})
+		w.writeMu.Lock()
+		w.flush()
+		w.writeMu.Unlock()
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix)); len(files) != 1 {
+		t.Errorf("Outage must not rotate spool segment on every flush: %v", files)
+	}
+
+	// Block is written before spool backlog, which is replayed by the next flush
+	backend.down = false
+	backend.spooledWrites = 10
+	w.Enqueue(&storage.ShareData{Login: "z", Id: "rig1", Diff: 20, Ms: MakeTimestamp()})
+	exist, err := w.WriteBlock("x", "rig1", []string{"00000001", "00010000", "00000000"}, 10, 100, 10, "0x0", 1000, 0)
+	if exist || err != nil {
+		t.Fatalf("Must write block: %v, %v", exist, err)
+	}
+	round, _ := backend.GetRoundShares(10, "00000001")
+	if round["z"] != 20 || round["x"] != 10 {
+		t.Errorf("Queued shares must be written before the block and spool backlog after it: %v", round)
+	}
+	w.writeMu.Lock()
+	w.flush()
+	active := w.spool.active
+	w.writeMu.Unlock()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix)); len(files) != 0 || w.Stats().Spooled != 0 {
+		t.Errorf("Spool must be replayed: %v, %v spooled", files, w.Stats().Spooled)
+	}
+	if active != nil {
+		t.Error("Replayed active segment must be closed")
+	}
+}
+
+func TestShareSpoolCorruptedRecords(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	backend := storage.NewMemoryBackend("test")
+	spool, err := NewShareSpool(&SpoolConfig{Dir: dir}, "test", backend, time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares := []*storage.ShareData{{Login: "x", Id: "rig1", Diff: 10, Ms: 1}, {Login: "z", Id: "rig1", Diff: 20, Ms: 2}}
+	if err := spool.Append(shares); err != nil {
+		t.Fatal(err)
+	}
+	// Crash in the middle of the second record
+	spool.active.Truncate(spool.activeSize - 3)
+	spool.close()
+
+	spool, _ = NewShareSpool(&SpoolConfig{Dir: dir}, "test", backend, time.Hour, 10)
+	if spool.Pending() != 1 {
+		t.Errorf("Only valid records must be counted, %v pending", spool.Pending())
+	}
+	if err := spool.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	backend.WriteBlock("x", "rig1", []string{"00000001", "00010000", "00000000"}, 0, 100, 10, "0x0", 1000, 0, time.Hour)
+	round, _ := backend.GetRoundShares(10, "00000001")
+	if spool.Pending() != 0 || round["x"] != 10 || len(round) != 1 {
+		t.Errorf("Only valid record must be replayed: %v", round)
+	}
+
+	if err := spool.Append(shares); err != nil {
+		t.Fatal(err)
+	}
+	full, _ := NewShareSpool(&SpoolConfig{Dir: dir, MaxSize: 10}, "test", backend, time.Hour, 10)
+	if err := full.Append(shares); err != errSpoolFull {
+		t.Errorf("Spool must respect size limit: %v", err)
+	}
+}
+
+// Nodes sharing spool dir replay their own segments only, though node names prefix each other
+func TestShareSpoolNodeSegments(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	backend := storage.NewMemoryBackend("test")
+	other, _ := NewShareSpool(&SpoolConfig{Dir: dir}, "eu-2", backend, time.Hour, 10)
+	if err := other.Append([]*storage.ShareData{{Login: "x", Id: "rig1", Diff: 10, Ms: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	other.close()
+	ioutil.WriteFile(filepath.Join(dir, "eu-backup.spool"), []byte{}, 0600)
+
+	spool, _ := NewShareSpool(&SpoolConfig{Dir: dir}, "eu", backend, time.Hour, 10)
+	segments, _ := spool.segments()
+	if spool.Pending() != 0 || len(segments) != 0 {
+		t.Errorf("Must not pick up segments of other nodes: %v", segments)
+	}
+	if other, _ = NewShareSpool(&SpoolConfig{Dir: dir}, "eu-2", backend, time.Hour, 10); other.Pending() != 1 {
+		t.Errorf("Node must keep its own segment, %v pending", other.Pending())
+	}
+}
@@ -165,7 +165,10 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 
 		Debug.Printf("mining.submit, Param: %v", params)
 
-		reply, errReply := s.handleTCPSubmitRPC(cs, params)
+		reply, errReply, closeConn := s.handleTCPSubmitRPC(cs, params)
+		if errReply != nil && !closeConn {
+			return cs.sendTCPReject(req.Id, errReply)
+		}
 		if errReply != nil {
 			return cs.sendTCPError(req.Id, errReply)
 		}
@@ -194,37 +197,61 @@ func (cs *Session) sendTCPResult(id json.RawMessage, result interface{}) error {
 func (cs *Session) setDifficulty() error {
 	cs.Lock()
 	defer cs.Unlock()
-	genesisWork, err := dashcoin.GetGenesisTargetWork()
-	if err != nil {
-		return err
-	}
-
-	diff := TargetHexToDiff(cs.targetNextJob).Int64()
-	setDiff := float64(diff) / genesisWork
+	setDiff := cs.difficultyNextJob.StratumDiff()
 
 	message := JSONPushMessage{Id: nil, Method: "mining.set_difficulty", Params: []interface{}{setDiff}}
 	return cs.enc.Encode(&message)
 }
 
+// Pushes job, preceded by adjusted difficulty which shares of this and later jobs are validated with
 func (cs *Session) pushNewJob(params []interface{}) error {
 	cs.Lock()
 	defer cs.Unlock()
+	if cs.difficultyNextJob.Cmp(cs.difficulty) != 0 {
+		setDiff := JSONPushMessage{Id: nil, Method: "mining.set_difficulty", Params: []interface{}{cs.difficultyNextJob.StratumDiff()}}
+		if err := cs.enc.Encode(&setDiff); err != nil {
+			return err
+		}
+		cs.difficulty = cs.difficultyNextJob
+	}
+	if clean, _ := params[len(params)-1].(bool); clean || cs.jobDifficulty == nil {
+		cs.jobDifficulty = make(map[string]dashcoin.Difficulty)
+	}
+	if jobId, ok := params[0].(string); ok {
+		cs.jobDifficulty[jobId] = cs.difficulty
+	}
 	message := JSONPushMessage{Id: nil, Method: "mining.notify", Params: params}
 	return cs.enc.Encode(&message)
 }
 
-func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
+// Difficulty the job was pushed with, shares of jobs this session was not sent get the current one
+func (cs *Session) shareDifficulty(jobId string) dashcoin.Difficulty {
 	cs.Lock()
 	defer cs.Unlock()
+	if diff, ok := cs.jobDifficulty[jobId]; ok {
+		return diff
+	}
+	return cs.difficulty
+}
 
-	message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
-	err := cs.enc.Encode(&message)
+// Sends error reply and closes the session
+func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
+	err := cs.sendTCPReject(id, reply)
 	if err != nil {
 		return err
 	}
 	return errors.New(reply.Message)
 }
 
+// Sends error reply keeping the session
+func (cs *Session) sendTCPReject(id json.RawMessage, reply *ErrorReply) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
+	return cs.enc.Encode(&message)
+}
+
 func (s *ProxyServer) setDeadline(conn *net.TCPConn) {
 	_ = conn.SetDeadline(time.Now().Add(s.timeout))
 }
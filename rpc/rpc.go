@@ -38,6 +38,7 @@ type BlockTplTransaction struct {
 	Fee  int64  `json:"fee"`
 }
 
+// Coinbase payment required by getblocktemplate, used for masternode and superblock payees
 type MasterNode struct {
 	Payee  string `json:"payee"`
 	Script string `json:"script"`
@@ -51,11 +52,46 @@ type GetBlockTemplateReplyPart struct {
 	CoinBaseAux       CoinBaseAux           `json:"coinbaseaux"`
 	CoinBaseValue     int64                 `json:"coinbasevalue"`
 	CurTime           uint32                `json:"curtime"`
+	MinTime           uint32                `json:"mintime"`
+	MaxTime           uint32                `json:"maxtime"` // not reported by dashd, zero means no limit
+	Mutable           []string              `json:"mutable"`
 	Bits              string                `json:"bits"`
 	Target            string                `json:"target"`
 	Height            uint32                `json:"height"`
 	CoinbasePayload   string                `json:"coinbase_payload"`
 	MasterNodes       []MasterNode          `json:"masternode"`
+	SuperBlocks       []MasterNode          `json:"superblock"` // governance payments, on superblock heights only
+
+	MasterNodePaymentsStarted  bool `json:"masternode_payments_started"`
+	MasterNodePaymentsEnforced bool `json:"masternode_payments_enforced"`
+	SuperBlocksStarted         bool `json:"superblocks_started"`
+	SuperBlocksEnabled         bool `json:"superblocks_enabled"`
+}
+
+type GetBlockchainInfoReply struct {
+	Chain  string `json:"chain"`
+	Blocks int64  `json:"blocks"`
+}
+
+type GetWalletInfoReply struct {
+	Balance       float64 `json:"balance"`
+	UnlockedUntil *int64  `json:"unlocked_until"`
+}
+
+// Unencrypted wallets do not report unlocked_until at all
+func (r *GetWalletInfoReply) Unlocked() bool {
+	return r.UnlockedUntil == nil || *r.UnlockedUntil > 0
+}
+
+type GetTransactionReply struct {
+	TxId          string `json:"txid"`
+	Confirmations int64  `json:"confirmations"`
+	BlockHash     string `json:"blockhash"`
+	InstantLock   bool   `json:"instantlock"`
+}
+
+func (r *GetTransactionReply) Confirmed() bool {
+	return r.Confirmations > 0 || r.InstantLock
 }
 
 const receiptStatusSuccessful = "0x1"
@@ -91,9 +127,16 @@ type Vin struct {
 }
 
 type Vout struct {
-	Value    float64 `json:"value"`
-	ValueSat int64   `json:"valueSat"`
-	N        uint32  `json:"n"`
+	Value        float64      `json:"value"`
+	ValueSat     int64        `json:"valueSat"`
+	N            uint32       `json:"n"`
+	ScriptPubKey ScriptPubKey `json:"scriptPubKey"`
+}
+
+type ScriptPubKey struct {
+	Hex       string   `json:"hex"`
+	Type      string   `json:"type"`
+	Addresses []string `json:"addresses"`
 }
 
 type JSONRpcResp struct {
@@ -121,6 +164,16 @@ func (r *RPCClient) GetPrevBlockHash() (string, error) {
 	return reply, err
 }
 
+func (r *RPCClient) GetBlockchainInfo() (*GetBlockchainInfoReply, error) {
+	rpcResp, err := r.doPost(r.Url, "getblockchaininfo", []string{})
+	if err != nil {
+		return nil, err
+	}
+	var reply *GetBlockchainInfoReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
 func (r *RPCClient) GetPendingBlock() (*GetBlockTemplateReplyPart, error) {
 	rpcResp, err := r.doPost(r.Url, "getblocktemplate", []string{})
 	if err != nil {
@@ -175,6 +228,65 @@ func (r *RPCClient) SubmitBlock(params []interface{}) error {
 	return nil
 }
 
+func (r *RPCClient) GetConnectionCount() (int64, error) {
+	rpcResp, err := r.doPost(r.Url, "getconnectioncount", []string{})
+	if err != nil {
+		return 0, err
+	}
+	var reply int64
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Returns wallet balance in Satoshi
+func (r *RPCClient) GetBalance() (int64, error) {
+	rpcResp, err := r.doPost(r.Url, "getbalance", []string{})
+	if err != nil {
+		return 0, err
+	}
+	var reply json.Number
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return 0, err
+	}
+	return ParseCoinAmount(reply.String())
+}
+
+func (r *RPCClient) GetWalletInfo() (*GetWalletInfoReply, error) {
+	rpcResp, err := r.doPost(r.Url, "getwalletinfo", []string{})
+	if err != nil {
+		return nil, err
+	}
+	var reply *GetWalletInfoReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Amount is in Satoshi, returns transaction id
+func (r *RPCClient) SendToAddress(address string, amount int64) (string, error) {
+	params := []interface{}{address, json.Number(FormatCoinAmount(amount))}
+	rpcResp, err := r.doPost(r.Url, "sendtoaddress", params)
+	if err != nil {
+		return "", err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+func (r *RPCClient) GetTransaction(txId string) (*GetTransactionReply, error) {
+	rpcResp, err := r.doPost(r.Url, "gettransaction", []string{txId})
+	if err != nil {
+		return nil, err
+	}
+	if rpcResp.Result != nil {
+		var reply *GetTransactionReply
+		err = json.Unmarshal(*rpcResp.Result, &reply)
+		return reply, err
+	}
+	return nil, nil
+}
+
 func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSONRpcResp, error) {
 	jsonReq := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": 0}
 	data, err := json.Marshal(jsonReq)
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"math/big"
+	"time"
+)
+
+// Everything pool modules need from storage, implemented by RedisClient and MemoryBackend
+type Backend interface {
+	Check() (string, error)
+	BgSave() (string, error)
+
+	// Policy
+	GetBlacklist() ([]string, error)
+	GetWhitelist() ([]string, error)
+
+	// Node state
+	WriteNodeState(id string, height uint32, diff *big.Int, spooledShares int64) error
+	GetNodeStates() ([]map[string]interface{}, error)
+
+	// Shares and blocks, params identify PoW and are checked for duplicates
+	WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error)
+	WriteShares(shares []*ShareData, window time.Duration) error
+	GetSpoolOffset(node, segment string) (int64, error)
+	WriteSpooledShares(node, segment string, offset int64, shares []*ShareData, window time.Duration) error
+	DeleteSpoolOffset(node, segment string) error
+	WriteInvalidShare(ms, ts int64, login, id string, diff int64, reason string) error
+	WriteRejectShare(ms, ts int64, login, id string, diff int64, reason string) error
+	WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64,
+		blockHash string, coinBaseValue int64, blkTotalFee int64, window time.Duration) (bool, error)
+	GetCandidates(maxHeight int64) ([]*BlockData, error)
+	GetImmatureBlocks(maxHeight int64) ([]*BlockData, error)
+	GetRoundShares(height int64, nonce string) (map[string]int64, error)
+
+	// Credits
+	WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error
+	WriteMaturedBlock(block *BlockData, roundRewards map[string]int64, residual int64) error
+	WriteOrphan(block *BlockData) error
+	WritePendingOrphans(blocks []*BlockData) error
+
+	// Payments
+	GetPayees() ([]string, error)
+	GetBalance(login string) (int64, error)
+	GetMinerSettings(login string) (*MinerSettings, error)
+	WriteMinerSettings(login string, settings *MinerSettings) error
+	LockPayouts(login string, amount int64) error
+	UnlockPayouts() error
+	IsPayoutsLocked() (bool, error)
+	GetPendingPayments() []*PendingPayment
+	UpdateBalance(login string, amount int64) error
+	RollbackBalance(login string, amount int64) error
+	WritePayment(login, txHash string, amount int64) error
+
+	// History, newest first
+	GetMaturedBlocks(start, stop int64) ([]*BlockData, error)
+	GetRoundCredits(height int64, hash string) (map[string]int64, error)
+	GetPayments(start, stop int64) ([]map[string]interface{}, error)
+	// Filtered pages, next cursor is empty on the last page
+	GetBlocksPage(kind string, q *HistoryQuery) ([]*BlockData, string, error)
+	GetPaymentsPage(q *HistoryQuery) ([]map[string]interface{}, string, error)
+
+	// Ledger
+	GetLedgerEntries(start, stop int64) ([]*LedgerEntry, error)
+	Reconcile() (*LedgerReport, error)
+	OpenLedger() ([]LedgerEntry, error)
+
+	// Stats
+	IsMinerExists(login string) (bool, error)
+	GetMinerStats(login string) (map[string]interface{}, error)
+	FlushStaleStats(window, largeWindow time.Duration) (int64, error)
+	CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error)
+	CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error)
+	CollectLuckStats(windows []int) (map[string]interface{}, error)
+
+	// Hashrate history
+	WriteCharts(window time.Duration) (int64, error)
+	GetChart(res *ChartResolution, login, id string, from, to int64) ([]ChartPoint, error)
+	FlushStaleCharts() (int64, error)
+
+	// Schema of block and payment records
+	GetSchemaVersion() (int64, error)
+	CheckSchema() error
+	MigrateSchema(dryRun bool) (*SchemaReport, error)
+
+	// Backup of pool state, keys are relative to prefix
+	DumpKeys() ([]*KeyDump, error)
+	RestoreKeys(dumps []*KeyDump, remove []string, entries []LedgerEntry) error
+
+	// Halts
+	WriteHalt(module, reason string) error
+	GetHalt(module string) (*HaltState, error)
+	GetHalts() (map[string]*HaltState, error)
+	ClearHalt(module string) (bool, error)
+
+	// Leader election, fenced backend rejects singleton writes with ErrFenced once leadership is lost
+	AcquireLease(role, holder string, ttl time.Duration) (int64, error)
+	ReleaseLease(role, holder string) error
+	GetLeader(role string) (string, int64, error)
+	Fenced(role string, token func() int64) Backend
+}
+
+var _ Backend = (*RedisClient)(nil)
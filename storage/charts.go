@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	. "github.com/PowPool/dashpool/util"
+)
+
+type ChartResolution struct {
+	Name      string
+	Bucket    time.Duration
+	Retention time.Duration
+}
+
+// Hashrate history is written at the first resolution, coarser buckets must be its multiples
+var ChartResolutions = []*ChartResolution{
+	{Name: "10m", Bucket: 10 * time.Minute, Retention: 30 * 24 * time.Hour},
+	{Name: "1h", Bucket: time.Hour, Retention: 365 * 24 * time.Hour},
+}
+
+// Bucket is closed a bit later than it ends, so shares written in batches are counted
+const chartsDelay = time.Minute
+
+type ChartPoint struct {
+	Timestamp int64 `json:"timestamp"`
+	Hashrate  int64 `json:"hashrate"`
+}
+
+func GetChartResolution(name string) *ChartResolution {
+	for _, res := range ChartResolutions {
+		if res.Name == name {
+			return res
+		}
+	}
+	return nil
+}
+
+// Series of the pool, a login or a worker of the login
+func chartSeries(login, id string) string {
+	if len(login) == 0 {
+		return "pool"
+	}
+	if len(id) == 0 {
+		return join("miner", login)
+	}
+	return join("worker", login, id)
+}
+
+// Completed buckets of the finest resolution not written yet. Raw hashrate is kept for window only,
+// so buckets which started before that are skipped.
+func chartRange(now, lastBucket int64, window time.Duration) (int64, int64) {
+	bucket := int64(ChartResolutions[0].Bucket / time.Second)
+	to := (now - int64(chartsDelay/time.Second)) / bucket * bucket
+	from := (now - int64(window/time.Second) + bucket - 1) / bucket * bucket
+	if lastBucket > from {
+		from = lastBucket
+	}
+	return from, to
+}
+
+// Samples hashrate of completed buckets into the history of the pool, miners and workers.
+// Returns the number of buckets written. Each bucket is written once, so only the leader should call it.
+func (r *RedisClient) WriteCharts(window time.Duration) (int64, error) {
+	lastKey := r.formatKey("charts")
+	var written int64
+	err := r.watch(func(tx redis.Cmdable) error {
+		lastBucket, err := tx.Get(ctx, lastKey).Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		from, to := chartRange(MakeTimestamp()/1000, lastBucket, window)
+		if from >= to {
+			return nil
+		}
+		// Raw hashrate is not on the slot of charts, so it is read by the client
+		raw, err := r.client.ZRangeByScoreWithScores(ctx, r.formatKey("hashrate"), &redis.ZRangeBy{
+			Min: strconv.FormatInt(from, 10),
+			Max: fmt.Sprint("(", to),
+		}).Result()
+		if err != nil {
+			return err
+		}
+		sums := convertChartShares(raw)
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for bucket, series := range sums {
+				for name, sum := range series {
+					for _, res := range ChartResolutions {
+						pipe.HIncrBy(ctx, r.formatKey("charts", res.Name, name), chartBucket(bucket, res), sum)
+					}
+				}
+			}
+			pipe.Set(ctx, lastKey, strconv.FormatInt(to, 10), 0)
+			return nil
+		})
+		if err == nil {
+			written = (to - from) / int64(ChartResolutions[0].Bucket/time.Second)
+		}
+		return err
+	}, lastKey)
+	if err != nil {
+		return 0, r.fencedErr(err)
+	}
+	return written, nil
+}
+
+// Hashrate of the pool, a login or its worker in buckets of resolution starting within [from, to)
+func (r *RedisClient) GetChart(res *ChartResolution, login, id string, from, to int64) ([]ChartPoint, error) {
+	cmd := r.client.HGetAll(ctx, r.formatKey("charts", res.Name, chartSeries(login, id)))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertChartPoints(res, cmd.Val(), from, to), nil
+}
+
+// Removes buckets older than retention of their resolution
+func (r *RedisClient) FlushStaleCharts() (int64, error) {
+	now := MakeTimestamp() / 1000
+	total := int64(0)
+
+	keys, err := r.scanKeys(r.formatKey("charts", "*"))
+	if err != nil {
+		return total, err
+	}
+	for _, key := range keys {
+		res := GetChartResolution(strings.Split(key, ":")[2])
+		if res == nil {
+			continue
+		}
+		buckets, err := r.client.HKeys(ctx, key).Result()
+		if err != nil {
+			return total, err
+		}
+		stale := staleChartBuckets(res, buckets, now)
+		if len(stale) == 0 {
+			continue
+		}
+		n, err := r.client.HDel(ctx, key, stale...).Result()
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Start of the bucket of resolution, which holds the bucket of the finest one
+func chartBucket(bucket int64, res *ChartResolution) string {
+	size := int64(res.Bucket / time.Second)
+	return strconv.FormatInt(bucket/size*size, 10)
+}
+
+func staleChartBuckets(res *ChartResolution, buckets []string, now int64) []string {
+	var stale []string
+	min := now - int64(res.Retention/time.Second)
+	for _, bucket := range buckets {
+		ts, _ := strconv.ParseInt(bucket, 10, 64)
+		if ts < min {
+			stale = append(stale, bucket)
+		}
+	}
+	return stale
+}
+
+// Sums share difficulty of raw hashrate entries by bucket of the finest resolution and series
+// TS => diff, login, id, ms
+func convertChartShares(raw []redis.Z) map[int64]map[string]int64 {
+	size := int64(ChartResolutions[0].Bucket / time.Second)
+	sums := make(map[int64]map[string]int64)
+
+	for _, v := range raw {
+		parts := strings.Split(v.Member.(string), ":")
+		share, _ := strconv.ParseInt(parts[0], 10, 64)
+		login, id := parts[1], parts[2]
+		bucket := int64(v.Score) / size * size
+		series, ok := sums[bucket]
+		if !ok {
+			series = make(map[string]int64)
+			sums[bucket] = series
+		}
+		series[chartSeries("", "")] += share
+		series[chartSeries(login, "")] += share
+		series[chartSeries(login, id)] += share
+	}
+	return sums
+}
+
+// Hashrate of every bucket within [from, to), buckets without shares have zero hashrate
+func convertChartPoints(res *ChartResolution, raw map[string]string, from, to int64) []ChartPoint {
+	size := int64(res.Bucket / time.Second)
+	sums := make(map[int64]int64)
+	for k, v := range raw {
+		bucket, _ := strconv.ParseInt(k, 10, 64)
+		sums[bucket], _ = strconv.ParseInt(v, 10, 64)
+	}
+
+	points := []ChartPoint{}
+	for bucket := (from + size - 1) / size * size; bucket < to; bucket += size {
+		points = append(points, ChartPoint{Timestamp: bucket, Hashrate: sums[bucket] / size})
+	}
+	return points
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+
+	. "github.com/PowPool/dashpool/util"
+)
+
+// Pool state kept in backups, by first segment of key. Hashrates, charts, stats and
+// node states are rebuilt by running pool.
+var dumpedKeys = map[string]bool{
+	"miners":   true,
+	"finances": true,
+	"credits":  true,
+	"blocks":   true,
+	"shares":   true,
+	"payments": true,
+	"ledger":   true,
+}
+
+func isDumpedKey(name string) bool {
+	return dumpedKeys[strings.SplitN(name, ":", 2)[0]]
+}
+
+// Contents of key, which name is relative to prefix. Type tells which of the values is set.
+type KeyDump struct {
+	Key    string            `json:"key"`
+	Type   string            `json:"type"`
+	Hash   map[string]string `json:"hash,omitempty"`
+	ZSet   []ZMember         `json:"zset,omitempty"`
+	List   []string          `json:"list,omitempty"`
+	String string            `json:"string,omitempty"`
+}
+
+type ZMember struct {
+	Score  float64 `json:"score"`
+	Member string  `json:"member"`
+}
+
+func sortDumps(dumps []*KeyDump) {
+	sort.Slice(dumps, func(i, j int) bool {
+		return dumps[i].Key < dumps[j].Key
+	})
+}
+
+// Pool state keys sorted by name. Keys are read one by one, so pool should be stopped for a consistent dump.
+func (r *RedisClient) DumpKeys() ([]*KeyDump, error) {
+	var dumps []*KeyDump
+	// Pool state may be kept under hash tagged prefix, so every kind of it is scanned by its own key
+	for kind := range dumpedKeys {
+		keys, err := r.scanKeys(r.formatKey(kind) + "*")
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			name := r.keyName(key)
+			if !isDumpedKey(name) {
+				continue
+			}
+			dump, err := r.dumpKey(key, name)
+			if err != nil {
+				return nil, err
+			}
+			if dump != nil {
+				dumps = append(dumps, dump)
+			}
+		}
+	}
+	sortDumps(dumps)
+	return dumps, nil
+}
+
+// Nil when key is gone meanwhile
+func (r *RedisClient) dumpKey(key, name string) (*KeyDump, error) {
+	kind, err := r.client.Type(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	dump := &KeyDump{Key: name, Type: kind}
+	switch kind {
+	case "none":
+		return nil, nil
+	case "string":
+		dump.String, err = r.client.Get(ctx, key).Result()
+	case "hash":
+		dump.Hash, err = r.client.HGetAll(ctx, key).Result()
+	case "list":
+		dump.List, err = r.client.LRange(ctx, key, 0, -1).Result()
+	case "zset":
+		var raw []redis.Z
+		raw, err = r.client.ZRangeWithScores(ctx, key, 0, -1).Result()
+		for _, v := range raw {
+			dump.ZSet = append(dump.ZSet, ZMember{Score: v.Score, Member: v.Member.(string)})
+		}
+	default:
+		return nil, fmt.Errorf("key %v has unsupported type %v", name, kind)
+	}
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// Restore never touches keys which are not pool state
+func checkRestore(dumps []*KeyDump, remove []string) error {
+	for _, dump := range dumps {
+		if !isDumpedKey(dump.Key) {
+			return fmt.Errorf("key %v is not pool state", dump.Key)
+		}
+		switch dump.Type {
+		case "string", "hash", "list", "zset":
+		default:
+			return fmt.Errorf("key %v has unsupported type %v", dump.Key, dump.Type)
+		}
+	}
+	for _, name := range remove {
+		if !isDumpedKey(name) {
+			return fmt.Errorf("key %v is not pool state", name)
+		}
+	}
+	return nil
+}
+
+// Replaces keys with dumped contents and deletes removed keys in one transaction, along with
+// ledger entries for balances it changes and matching change of pool finances
+func (r *RedisClient) RestoreKeys(dumps []*KeyDump, remove []string, entries []LedgerEntry) error {
+	if err := checkRestore(dumps, remove); err != nil {
+		return err
+	}
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		for _, name := range remove {
+			tx.Del(ctx, r.formatKey(name))
+		}
+		for _, dump := range dumps {
+			key := r.formatKey(dump.Key)
+			tx.Del(ctx, key)
+			switch dump.Type {
+			case "string":
+				tx.Set(ctx, key, dump.String, 0)
+			case "hash":
+				if len(dump.Hash) > 0 {
+					tx.HSet(ctx, key, dump.Hash)
+				}
+			case "list":
+				if len(dump.List) > 0 {
+					tx.RPush(ctx, key, dump.List)
+				}
+			case "zset":
+				members := make([]redis.Z, len(dump.ZSet))
+				for i, v := range dump.ZSet {
+					members[i] = redis.Z{Score: v.Score, Member: v.Member}
+				}
+				if len(members) > 0 {
+					tx.ZAdd(ctx, key, members...)
+				}
+			}
+		}
+		r.writeLedger(tx, MakeTimestamp(), entries...)
+		for field, delta := range financesDeltas(entries) {
+			if delta != 0 {
+				tx.HIncrBy(ctx, r.formatKey("finances"), field, delta)
+			}
+		}
+		return nil
+	})
+	return err
+}
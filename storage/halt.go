@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+
+	. "github.com/PowPool/dashpool/util"
+)
+
+// Recorded when a module stops on a critical error, it stays stopped until the record is cleared
+type HaltState struct {
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func (r *RedisClient) WriteHalt(module, reason string) error {
+	state := HaltState{Reason: reason, Timestamp: MakeTimestamp() / 1000}
+	data, _ := json.Marshal(&state)
+	return r.client.HSet(ctx, r.formatKey("halts"), module, string(data)).Err()
+}
+
+// Returns nil if module is not halted
+func (r *RedisClient) GetHalt(module string) (*HaltState, error) {
+	data, err := r.client.HGet(ctx, r.formatKey("halts"), module).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := HaltState{}
+	err = json.Unmarshal([]byte(data), &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (r *RedisClient) GetHalts() (map[string]*HaltState, error) {
+	rows, err := r.client.HGetAll(ctx, r.formatKey("halts")).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]*HaltState)
+	for module, data := range rows {
+		state := HaltState{}
+		err = json.Unmarshal([]byte(data), &state)
+		if err != nil {
+			return nil, err
+		}
+		result[module] = &state
+	}
+	return result, nil
+}
+
+// Returns false if module was not halted
+func (r *RedisClient) ClearHalt(module string) (bool, error) {
+	n, err := r.client.HDel(ctx, r.formatKey("halts"), module).Result()
+	return n > 0, err
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Kinds of blocks in history, orphans are kept among matured blocks
+const (
+	BlocksCandidates = "candidates"
+	BlocksImmature   = "immature"
+	BlocksMatured    = "matured"
+	BlocksOrphans    = "orphans"
+)
+
+// Entries of sorted set read at once while looking for entries that match, and chunks
+// read for one page at most, so that a filter which rarely matches can't scan the whole set
+const (
+	historyChunk     = 500
+	historyMaxChunks = 20
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Filter of blocks and payments history, zero values match anything. Heights are inclusive,
+// time range is [From, To). Login is finder of blocks or payee of payments.
+type HistoryQuery struct {
+	Login     string
+	MinHeight int64
+	MaxHeight int64
+	From      int64
+	To        int64
+	// Next cursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+func IsBlocksKind(kind string) bool {
+	switch kind {
+	case BlocksCandidates, BlocksImmature, BlocksMatured, BlocksOrphans:
+		return true
+	}
+	return false
+}
+
+// Last entry of a page, next page starts right after it
+type historyCursor struct {
+	score  float64
+	member string
+}
+
+func encodeCursor(v redis.Z) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(join(v.Score, v.Member.(string))))
+}
+
+func decodeCursor(cursor string) (*historyCursor, error) {
+	if len(cursor) == 0 {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	score, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &historyCursor{score: float64(score), member: parts[1]}, nil
+}
+
+// Score bounds of zero filter values
+func scoreRange(min, max int64) (float64, float64) {
+	lo, hi := math.Inf(-1), math.Inf(1)
+	if min > 0 {
+		lo = float64(min)
+	}
+	if max > 0 {
+		hi = float64(max)
+	}
+	return lo, hi
+}
+
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "+inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', 0, 64)
+}
+
+// Walks sorted set from max score down to min, fetching it in chunks, until limit of entries
+// which match is collected. Entries of equal score come in reverse order of members, like in Redis.
+// Next cursor is set when page is full, so there may be more entries. Scan stops after historyMaxChunks
+// chunks with a partial page, which next cursor continues from the last scanned entry.
+func pageHistory(fetch func(min, max float64, offset, count int64) ([]redis.Z, error), min, max float64,
+	cursor string, limit int, match func(member string) bool) ([]redis.Z, string, error) {
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if after != nil && after.score < max {
+		max = after.score
+	}
+
+	var rows []redis.Z
+	for chunks := 0; len(rows) < limit; chunks++ {
+		chunk, err := fetch(min, max, int64(chunks*historyChunk), historyChunk)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, v := range chunk {
+			member := v.Member.(string)
+			if after != nil && v.Score == after.score && member >= after.member {
+				continue
+			}
+			if match(member) {
+				rows = append(rows, v)
+				if len(rows) == limit {
+					break
+				}
+			}
+		}
+		if len(chunk) < historyChunk {
+			break
+		}
+		if chunks+1 == historyMaxChunks && len(rows) < limit {
+			return rows, encodeCursor(chunk[len(chunk)-1]), nil
+		}
+	}
+	next := ""
+	if len(rows) == limit && limit > 0 {
+		next = encodeCursor(rows[limit-1])
+	}
+	return rows, next, nil
+}
+
+// Key, score range and filter of blocks of kind
+func blocksHistory(kind string, q *HistoryQuery) (string, float64, float64, func(string) bool) {
+	min, max := scoreRange(q.MinHeight, q.MaxHeight)
+	decode := decodeBlock
+	key := kind
+	switch kind {
+	case BlocksCandidates:
+		decode = decodeCandidate
+	case BlocksOrphans:
+		key = BlocksMatured
+	}
+	match := func(member string) bool {
+		block, err := decode(member)
+		if err != nil {
+			return false
+		}
+		if len(q.Login) > 0 && block.Finder != q.Login {
+			return false
+		}
+		if (q.From > 0 && block.Timestamp < q.From) || (q.To > 0 && block.Timestamp >= q.To) {
+			return false
+		}
+		switch kind {
+		case BlocksMatured:
+			return !block.Orphan
+		case BlocksOrphans:
+			return block.Orphan
+		}
+		return true
+	}
+	return key, min, max, match
+}
+
+// Key and score range of payments, payments of login are kept under their own key
+func paymentsHistory(q *HistoryQuery) (string, float64, float64) {
+	min, max := scoreRange(q.From, q.To-1)
+	if len(q.Login) > 0 {
+		return q.Login, min, max
+	}
+	return "all", min, max
+}
+
+func matchAll(string) bool {
+	return true
+}
+
+// Blocks of kind newest first
+func (r *RedisClient) GetBlocksPage(kind string, q *HistoryQuery) ([]*BlockData, string, error) {
+	key, min, max, match := blocksHistory(kind, q)
+	rows, next, err := pageHistory(r.fetchHistory(r.formatKey("blocks", key)), min, max, q.Cursor, q.Limit, match)
+	if err != nil {
+		return nil, "", err
+	}
+	if kind == BlocksCandidates {
+		return convertCandidateResults(rows), next, nil
+	}
+	return convertBlockResults(rows), next, nil
+}
+
+// Payments of the pool or of login newest first
+func (r *RedisClient) GetPaymentsPage(q *HistoryQuery) ([]map[string]interface{}, string, error) {
+	key, min, max := paymentsHistory(q)
+	rows, next, err := pageHistory(r.fetchHistory(r.formatKey("payments", key)), min, max, q.Cursor, q.Limit, matchAll)
+	if err != nil {
+		return nil, "", err
+	}
+	return convertPaymentsResults(rows), next, nil
+}
+
+func (r *RedisClient) fetchHistory(key string) func(min, max float64, offset, count int64) ([]redis.Z, error) {
+	return func(min, max float64, offset, count int64) ([]redis.Z, error) {
+		option := &redis.ZRangeBy{Min: formatScore(min), Max: formatScore(max), Offset: offset, Count: count}
+		return r.client.ZRevRangeByScoreWithScores(ctx, key, option).Result()
+	}
+}
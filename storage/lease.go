@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Returned by fenced writes once a newer leader has been elected
+var ErrFenced = errors.New("leadership lost, write rejected by fencing token")
+
+// Lease key holds "holder:token". Token counter is incremented on every new acquisition only,
+// so renewals do not touch it and it can be watched by fenced transactions.
+var acquireLeaseScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current then
+	local holder, token = string.match(current, '^(.*):(%d+)$')
+	if holder == ARGV[1] then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+		return tonumber(token)
+	end
+	return 0
+end
+local token = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[1] .. ':' .. token, 'PX', ARGV[2])
+return token
+`)
+
+var releaseLeaseScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current and string.match(current, '^(.*):%d+$') == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+type fence struct {
+	key   string
+	token func() int64
+}
+
+func (r *RedisClient) leaseKeys(role string) []string {
+	return []string{r.formatKey("leader", role), r.formatKey("leader", role, "token")}
+}
+
+// Acquires or renews lease, returns fencing token or zero if lease is held by someone else
+func (r *RedisClient) AcquireLease(role, holder string, ttl time.Duration) (int64, error) {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	result, err := acquireLeaseScript.Run(ctx, r.client, r.leaseKeys(role), holder, ms).Result()
+	if err != nil {
+		return 0, err
+	}
+	token, _ := result.(int64)
+	return token, nil
+}
+
+func (r *RedisClient) ReleaseLease(role, holder string) error {
+	return releaseLeaseScript.Run(ctx, r.client, r.leaseKeys(role), holder).Err()
+}
+
+// Returns current lease holder and its token, empty holder if there is no leader
+func (r *RedisClient) GetLeader(role string) (string, int64, error) {
+	current, err := r.client.Get(ctx, r.formatKey("leader", role)).Result()
+	if err == redis.Nil {
+		return "", 0, nil
+	} else if err != nil {
+		return "", 0, err
+	}
+	i := strings.LastIndex(current, ":")
+	token, _ := strconv.ParseInt(current[i+1:], 10, 64)
+	return current[:i], token, nil
+}
+
+// Returns client which rejects writes of singleton jobs with ErrFenced unless token
+// currently held by the caller is the latest one issued for the role
+func (r *RedisClient) Fenced(role string, token func() int64) Backend {
+	fenced := *r
+	fenced.fence = &fence{key: r.leaseKeys(role)[1], token: token}
+	return &fenced
+}
+
+// Runs fn with transaction watching given keys. On fenced client it also watches the token counter,
+// so transaction is discarded if leadership changes before it is executed. Without keys to watch
+// fn gets the client itself.
+func (r *RedisClient) watch(fn func(tx redis.Cmdable) error, keys ...string) error {
+	if r.fence == nil {
+		if len(keys) == 0 {
+			return fn(r.client)
+		}
+		return r.client.Watch(ctx, func(tx *redis.Tx) error {
+			return fn(tx)
+		}, keys...)
+	}
+	return r.client.Watch(ctx, func(tx *redis.Tx) error {
+		token, err := tx.Get(ctx, r.fence.key).Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if token == 0 || token != r.fence.token() {
+			return ErrFenced
+		}
+		return fn(tx)
+	}, append(keys, r.fence.key)...)
+}
+
+// Transaction discarded by a change of watched keys is reported as ErrFenced when the cause is a new leader
+func (r *RedisClient) fencedErr(err error) error {
+	if err != redis.TxFailedErr || r.fence == nil {
+		return err
+	}
+	token, _ := r.client.Get(ctx, r.fence.key).Int64()
+	if token != r.fence.token() {
+		return ErrFenced
+	}
+	return err
+}
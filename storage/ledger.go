@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+
+	. "github.com/PowPool/dashpool/util"
+)
+
+// Ledger entry kinds
+const (
+	LedgerImmature         = "immature"
+	LedgerImmatureReversal = "immatureReversal"
+	LedgerCredit           = "credit"
+	LedgerFee              = "fee"
+	LedgerPayout           = "payout"
+	LedgerPaid             = "paid"
+	LedgerRollback         = "rollback"
+	LedgerOpening          = "opening"
+	LedgerRestore          = "restore"
+)
+
+// Pool side accounts, miner accounts are "miner:<login>:<field>"
+const (
+	AccountPoolImmature = "pool:immature"
+	AccountPoolMined    = "pool:mined"
+	AccountPoolFee      = "pool:fee"
+	// Balances stored before ledger was kept
+	AccountPoolOpening = "pool:opening"
+	// Balances changed by restore of a single miner
+	AccountPoolRestore = "pool:restore"
+)
+
+var ErrLedgerOpened = errors.New("ledger is already opened")
+
+// Every movement of funds is an immutable entry which moves Amount from
+// Debit account to Credit account, so all accounts always sum up to zero.
+type LedgerEntry struct {
+	Timestamp int64  `json:"timestamp"`
+	Kind      string `json:"kind"`
+	Debit     string `json:"debit"`
+	Credit    string `json:"credit"`
+	Amount    int64  `json:"amount"`
+	Ref       string `json:"ref"`
+}
+
+type LedgerMismatch struct {
+	Account string `json:"account"`
+	Ledger  int64  `json:"ledger"`
+	Stored  int64  `json:"stored"`
+}
+
+type LedgerReport struct {
+	Entries    int64            `json:"entries"`
+	Accounts   map[string]int64 `json:"accounts"`
+	Total      int64            `json:"total"`
+	Mismatches []LedgerMismatch `json:"mismatches"`
+}
+
+// Ledger is consistent when it nets to zero and every stored balance matches it
+func (l *LedgerReport) Balanced() bool {
+	return l.Total == 0 && len(l.Mismatches) == 0
+}
+
+func MinerAccount(login, field string) string {
+	return join("miner", login, field)
+}
+
+// Part of pool finances not attributed to any miner, which is only posted on opening
+func FinancesAccount(field string) string {
+	return join("finances", field)
+}
+
+// Moves amount from opening account to account, or back when it is negative
+func openingEntry(account string, amount int64) LedgerEntry {
+	entry := LedgerEntry{Kind: LedgerOpening, Debit: AccountPoolOpening, Credit: account, Amount: amount, Ref: "opening"}
+	if amount < 0 {
+		entry.Debit, entry.Credit, entry.Amount = account, AccountPoolOpening, -amount
+	}
+	return entry
+}
+
+// Moves amount from restore account to miner account, or back when it is negative
+func RestoreEntry(login, field string, amount int64) LedgerEntry {
+	entry := LedgerEntry{Kind: LedgerRestore, Debit: AccountPoolRestore, Credit: MinerAccount(login, field), Amount: amount, Ref: login}
+	if amount < 0 {
+		entry.Debit, entry.Credit, entry.Amount = entry.Credit, AccountPoolRestore, -amount
+	}
+	return entry
+}
+
+// Changes of pool finances which keep them the sum of miner accounts moved by entries
+func financesDeltas(entries []LedgerEntry) map[string]int64 {
+	deltas := make(map[string]int64)
+	for _, entry := range entries {
+		if parts := strings.Split(entry.Debit, ":"); parts[0] == "miner" && len(parts) == 3 {
+			deltas[parts[2]] -= entry.Amount
+		}
+		if parts := strings.Split(entry.Credit, ":"); parts[0] == "miner" && len(parts) == 3 {
+			deltas[parts[2]] += entry.Amount
+		}
+	}
+	return deltas
+}
+
+// Entries which bring ledger to balances and finances stored before it was kept, so that
+// reconcile of a pool which ran without ledger proves movements from then on
+func openingEntries(report *LedgerReport) ([]LedgerEntry, error) {
+	if report.Total != 0 {
+		return nil, fmt.Errorf("ledger nets to %v instead of zero", report.Total)
+	}
+	var entries []LedgerEntry
+	// Difference of stored finances and the sum of miner accounts after opening
+	finances := make(map[string]int64)
+	for _, m := range report.Mismatches {
+		parts := strings.Split(m.Account, ":")
+		switch {
+		case parts[0] == "miner" && len(parts) == 3:
+			entries = append(entries, openingEntry(m.Account, m.Stored-m.Ledger))
+			finances[parts[2]] -= m.Stored - m.Ledger
+		case parts[0] == "finances" && len(parts) == 2:
+			finances[parts[1]] += m.Stored - m.Ledger
+		default:
+			return nil, fmt.Errorf("running sum %v does not match ledger", m.Account)
+		}
+	}
+	fields := make([]string, 0, len(finances))
+	for field := range finances {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if finances[field] != 0 {
+			entries = append(entries, openingEntry(FinancesAccount(field), finances[field]))
+		}
+	}
+	return entries, nil
+}
+
+// Posts opening entries once, pool must be stopped meanwhile
+func (r *RedisClient) OpenLedger() ([]LedgerEntry, error) {
+	opened, err := r.client.Exists(ctx, r.formatKey("ledger", "opened")).Result()
+	if err != nil {
+		return nil, err
+	}
+	if opened > 0 {
+		return nil, ErrLedgerOpened
+	}
+	report, err := r.Reconcile()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := openingEntries(report)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		ms := MakeTimestamp()
+		r.writeLedger(tx, ms, entries...)
+		tx.Set(ctx, r.formatKey("ledger", "opened"), strconv.FormatInt(ms, 10), 0)
+		return nil
+	})
+	return entries, err
+}
+
+func (r *RedisClient) writeLedger(tx redis.Pipeliner, ts int64, entries ...LedgerEntry) {
+	for _, entry := range entries {
+		if entry.Amount == 0 {
+			continue
+		}
+		entry.Timestamp = ts
+		data, _ := json.Marshal(&entry)
+		tx.RPush(ctx, r.formatKey("ledger"), string(data))
+		tx.HIncrBy(ctx, r.formatKey("ledger", "accounts"), entry.Debit, entry.Amount*-1)
+		tx.HIncrBy(ctx, r.formatKey("ledger", "accounts"), entry.Credit, entry.Amount)
+	}
+}
+
+func (r *RedisClient) GetLedgerEntries(start, stop int64) ([]*LedgerEntry, error) {
+	rows, err := r.client.LRange(ctx, r.formatKey("ledger"), start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	var result []*LedgerEntry
+	for _, row := range rows {
+		entry := LedgerEntry{}
+		err = json.Unmarshal([]byte(row), &entry)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &entry)
+	}
+	return result, nil
+}
+
+// Backend data needed to reconcile ledger
+type ledgerSource interface {
+	GetLedgerEntries(start, stop int64) ([]*LedgerEntry, error)
+	GetPayees() ([]string, error)
+	getHash(args ...interface{}) (map[string]string, error)
+}
+
+// Replays whole ledger and compares resulting sums with running account sums,
+// balance fields of every miner and pool finances.
+func (r *RedisClient) Reconcile() (*LedgerReport, error) {
+	return reconcile(r)
+}
+
+func (r *RedisClient) getHash(args ...interface{}) (map[string]string, error) {
+	return r.client.HGetAll(ctx, r.formatKey(args...)).Result()
+}
+
+func reconcile(r ledgerSource) (*LedgerReport, error) {
+	const pageSize = 1000
+	report := &LedgerReport{Accounts: make(map[string]int64)}
+
+	for start := int64(0); ; start += pageSize {
+		entries, err := r.GetLedgerEntries(start, start+pageSize-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			report.Accounts[entry.Debit] -= entry.Amount
+			report.Accounts[entry.Credit] += entry.Amount
+		}
+		report.Entries += int64(len(entries))
+		if len(entries) < pageSize {
+			break
+		}
+	}
+	for _, amount := range report.Accounts {
+		report.Total += amount
+	}
+
+	// Running sums maintained along with every entry
+	running, err := r.getHash("ledger", "accounts")
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]int64)
+	for account, v := range running {
+		stored["ledger:"+account], _ = strconv.ParseInt(v, 10, 64)
+	}
+	expected := make(map[string]int64)
+	for account, amount := range report.Accounts {
+		expected["ledger:"+account] = amount
+	}
+
+	// Miner balances and pool finances as seen by the rest of the pool
+	logins, err := r.GetPayees()
+	if err != nil {
+		return nil, err
+	}
+	fields := []string{"balance", "immature", "pending", "paid"}
+	for _, login := range logins {
+		miner, err := r.getHash("miners", login)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range fields {
+			stored[MinerAccount(login, field)], _ = strconv.ParseInt(miner[field], 10, 64)
+		}
+	}
+	finances, err := r.getHash("finances")
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		stored[join("finances", field)], _ = strconv.ParseInt(finances[field], 10, 64)
+	}
+	for account, amount := range report.Accounts {
+		parts := strings.Split(account, ":")
+		if parts[0] == "miner" && len(parts) == 3 {
+			expected[account] = amount
+			expected[join("finances", parts[2])] += amount
+		}
+		if parts[0] == "finances" && len(parts) == 2 {
+			expected[account] += amount
+		}
+	}
+
+	accounts := make(map[string]struct{})
+	for account := range stored {
+		accounts[account] = struct{}{}
+	}
+	for account := range expected {
+		accounts[account] = struct{}{}
+	}
+	sorted := make([]string, 0, len(accounts))
+	for account := range accounts {
+		sorted = append(sorted, account)
+	}
+	sort.Strings(sorted)
+	for _, account := range sorted {
+		if stored[account] != expected[account] {
+			report.Mismatches = append(report.Mismatches, LedgerMismatch{Account: account, Ledger: expected[account], Stored: stored[account]})
+		}
+	}
+	return report, nil
+}
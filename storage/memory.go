@@ -0,0 +1,1066 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	. "github.com/PowPool/dashpool/util"
+)
+
+// Thread-safe backend keeping everything in process memory, with the same key layout and
+// semantics as RedisClient. Meant for tests and single node setups, nothing is persisted.
+type MemoryBackend struct {
+	store  *memoryStore
+	prefix string
+	fence  *fence
+}
+
+var _ Backend = (*MemoryBackend)(nil)
+
+func NewMemoryBackend(prefix string) *MemoryBackend {
+	return &MemoryBackend{store: newMemoryStore(), prefix: prefix}
+}
+
+func (m *MemoryBackend) formatKey(args ...interface{}) string {
+	return join(m.prefix, join(args...))
+}
+
+func (m *MemoryBackend) formatRound(height int64, nonce string) string {
+	return m.formatKey("shares", "round"+strconv.FormatInt(height, 10), nonce)
+}
+
+// Fenced writes are accepted only while caller holds the latest token issued for the role
+func (m *MemoryBackend) checkFence() error {
+	if m.fence == nil {
+		return nil
+	}
+	v, _ := m.store.get(m.fence.key)
+	token, _ := strconv.ParseInt(v, 10, 64)
+	if token == 0 || token != m.fence.token() {
+		return ErrFenced
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Check() (string, error) {
+	return "PONG", nil
+}
+
+// Nothing to save
+func (m *MemoryBackend) BgSave() (string, error) {
+	return "OK", nil
+}
+
+func (m *MemoryBackend) GetBlacklist() ([]string, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return m.store.sMembers(m.formatKey("blacklist")), nil
+}
+
+func (m *MemoryBackend) GetWhitelist() ([]string, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return m.store.sMembers(m.formatKey("whitelist")), nil
+}
+
+func (m *MemoryBackend) WriteNodeState(id string, height uint32, diff *big.Int, spooledShares int64) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	now := MakeTimestamp() / 1000
+
+	m.store.hSet(m.formatKey("nodes"), join(id, "name"), id)
+	m.store.hSet(m.formatKey("nodes"), join(id, "height"), strconv.FormatUint(uint64(height), 10))
+	m.store.hSet(m.formatKey("nodes"), join(id, "difficulty"), diff.String())
+	m.store.hSet(m.formatKey("nodes"), join(id, "lastBeat"), strconv.FormatInt(now, 10))
+	m.store.hSet(m.formatKey("nodes"), join(id, "spooledShares"), strconv.FormatInt(spooledShares, 10))
+	return nil
+}
+
+func (m *MemoryBackend) GetNodeStates() ([]map[string]interface{}, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return convertNodeStates(m.store.hGetAll(m.formatKey("nodes"))), nil
+}
+
+func (m *MemoryBackend) checkPoWExist(height uint64, params []string) bool {
+	m.store.zRemBelow(m.formatKey("pow"), float64(height-3))
+	return !m.store.zAdd(m.formatKey("pow"), float64(height), strings.Join(params, ":"))
+}
+
+func (m *MemoryBackend) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	if m.checkPoWExist(height, params) {
+		return true, nil
+	}
+
+	ms := MakeTimestamp()
+	ts := ms / 1000
+
+	m.writeShare(ms, ts, login, id, diff, window)
+	m.store.hIncrBy(m.formatKey("stats"), "roundShares", diff)
+	return false, nil
+}
+
+// Writes a batch of shares at once, shares must be checked for duplicates by caller
+func (m *MemoryBackend) WriteShares(shares []*ShareData, window time.Duration) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	for _, share := range shares {
+		m.writeShare(share.Ms, share.Ms/1000, share.Login, share.Id, share.Diff, window)
+		m.store.hIncrBy(m.formatKey("stats"), "roundShares", share.Diff)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) GetSpoolOffset(node, segment string) (int64, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	v, ok := m.store.hGet(m.formatKey("spool", node), segment)
+	if !ok {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func (m *MemoryBackend) WriteSpooledShares(node, segment string, offset int64, shares []*ShareData, window time.Duration) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	for _, share := range shares {
+		m.writeShare(share.Ms, share.Ms/1000, share.Login, share.Id, share.Diff, window)
+		m.store.hIncrBy(m.formatKey("stats"), "roundShares", share.Diff)
+	}
+	m.store.hSet(m.formatKey("spool", node), segment, strconv.FormatInt(offset, 10))
+	return nil
+}
+
+func (m *MemoryBackend) DeleteSpoolOffset(node, segment string) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	m.store.hDel(m.formatKey("spool", node), segment)
+	return nil
+}
+
+func (m *MemoryBackend) WriteInvalidShare(ms, ts int64, login, id string, diff int64, reason string) error {
+	return m.writeRejectedShare("invalidhashrate", ms, ts, login, id, diff, reason)
+}
+
+func (m *MemoryBackend) WriteRejectShare(ms, ts int64, login, id string, diff int64, reason string) error {
+	return m.writeRejectedShare("rejecthashrate", ms, ts, login, id, diff, reason)
+}
+
+func (m *MemoryBackend) writeRejectedShare(key string, ms, ts int64, login, id string, diff int64, reason string) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	m.store.zAdd(m.formatKey(key), float64(ts), join(diff, login, id, ms))
+	m.store.hIncrBy(m.formatKey("rejects", login), join(id, reason), 1)
+	return nil
+}
+
+func (m *MemoryBackend) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64,
+	blockHash string, coinBaseValue int64, blkTotalFee int64, window time.Duration) (bool, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	if m.checkPoWExist(height, params) {
+		return true, nil
+	}
+
+	ms := MakeTimestamp()
+	ts := ms / 1000
+
+	m.writeShare(ms, ts, login, id, diff, window)
+	m.store.hSet(m.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
+	m.store.hDel(m.formatKey("stats"), "roundShares")
+	m.store.zIncrBy(m.formatKey("finders"), 1, login)
+	m.store.hIncrBy(m.formatKey("miners", login), "blocksFound", 1)
+	err := m.store.rename(m.formatKey("shares", "roundCurrent"), m.formatRound(int64(height), params[0]))
+	if err != nil {
+		return false, err
+	}
+
+	totalShares := int64(0)
+	for _, v := range m.store.hGetAll(m.formatRound(int64(height), params[0])) {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		totalShares += n
+	}
+	s := candidateRecord(login, params, ts, roundDiff, totalShares, coinBaseValue, blkTotalFee, blockHash)
+	m.store.zAdd(m.formatKey("blocks", "candidates"), float64(height), s)
+	return false, nil
+}
+
+func (m *MemoryBackend) writeShare(ms, ts int64, login, id string, diff int64, expire time.Duration) {
+	m.store.hIncrBy(m.formatKey("shares", "roundCurrent"), login, diff)
+	m.store.zAdd(m.formatKey("hashrate"), float64(ts), join(diff, login, id, ms))
+	m.store.zAdd(m.formatKey("hashrate", login), float64(ts), join(diff, id, ms))
+	m.store.expire(m.formatKey("hashrate", login), expire)
+	m.store.hSet(m.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
+}
+
+func (m *MemoryBackend) GetCandidates(maxHeight int64) ([]*BlockData, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return convertCandidateResults(m.store.zRangeByScore(m.formatKey("blocks", "candidates"), 0, float64(maxHeight))), nil
+}
+
+func (m *MemoryBackend) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return convertBlockResults(m.store.zRangeByScore(m.formatKey("blocks", "immature"), 0, float64(maxHeight))), nil
+}
+
+func (m *MemoryBackend) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	result := make(map[string]int64)
+	for login, v := range m.store.hGetAll(m.formatRound(height, nonce)) {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		result[login] = n
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) GetPayees() ([]string, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	var result []string
+	for _, key := range m.store.keys(m.formatKey("miners") + ":") {
+		result = append(result, strings.Split(key, ":")[2])
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) GetBalance(login string) (int64, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	v, ok := m.store.hGet(m.formatKey("miners", login), "balance")
+	if !ok {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func (m *MemoryBackend) GetMinerSettings(login string) (*MinerSettings, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	miner := m.store.hGetAll(m.formatKey("miners", login))
+	settings := &MinerSettings{}
+	settings.Threshold, _ = strconv.ParseInt(miner["payoutThreshold"], 10, 64)
+	settings.Email = miner["email"]
+	settings.PayoutAddress = miner["payoutAddress"]
+	settings.UpdatedAt, _ = strconv.ParseInt(miner["settingsUpdatedAt"], 10, 64)
+	return settings, nil
+}
+
+// Overwrites miner settings unless they were updated by a later request, empty values reset setting
+// to pool defaults
+func (m *MemoryBackend) WriteMinerSettings(login string, settings *MinerSettings) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	key := m.formatKey("miners", login)
+	if v, ok := m.store.hGet(key, "settingsUpdatedAt"); ok {
+		updatedAt, _ := strconv.ParseInt(v, 10, 64)
+		if settings.UpdatedAt <= updatedAt {
+			return ErrStaleSettings
+		}
+	}
+
+	if settings.Threshold > 0 {
+		m.store.hSet(key, "payoutThreshold", strconv.FormatInt(settings.Threshold, 10))
+	} else {
+		m.store.hDel(key, "payoutThreshold")
+	}
+	if len(settings.Email) > 0 {
+		m.store.hSet(key, "email", settings.Email)
+	} else {
+		m.store.hDel(key, "email")
+	}
+	if len(settings.PayoutAddress) > 0 {
+		m.store.hSet(key, "payoutAddress", settings.PayoutAddress)
+	} else {
+		m.store.hDel(key, "payoutAddress")
+	}
+	m.store.hSet(key, "settingsUpdatedAt", strconv.FormatInt(settings.UpdatedAt, 10))
+	return nil
+}
+
+func (m *MemoryBackend) LockPayouts(login string, amount int64) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	if err := m.checkFence(); err != nil {
+		return err
+	}
+	key := m.formatKey("payments", "lock")
+	if m.store.exists(key) {
+		return fmt.Errorf("Unable to acquire lock '%s'", key)
+	}
+	m.store.set(key, join(login, amount), 0)
+	return nil
+}
+
+func (m *MemoryBackend) UnlockPayouts() error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	m.store.del(m.formatKey("payments", "lock"))
+	return nil
+}
+
+func (m *MemoryBackend) IsPayoutsLocked() (bool, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	_, ok := m.store.get(m.formatKey("payments", "lock"))
+	return ok, nil
+}
+
+func (m *MemoryBackend) GetPendingPayments() []*PendingPayment {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	var result []*PendingPayment
+	for _, v := range m.store.zRevRange(m.formatKey("payments", "pending"), 0, -1) {
+		// timestamp -> "address:amount"
+		payment := PendingPayment{}
+		payment.Timestamp = int64(v.Score)
+		fields := strings.Split(v.Member.(string), ":")
+		payment.Address = fields[0]
+		payment.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
+		result = append(result, &payment)
+	}
+	return result
+}
+
+// Deduct miner's balance for payment
+func (m *MemoryBackend) UpdateBalance(login string, amount int64) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	if err := m.checkFence(); err != nil {
+		return err
+	}
+	ts := MakeTimestamp() / 1000
+
+	m.store.hIncrBy(m.formatKey("miners", login), "balance", (amount * -1))
+	m.store.hIncrBy(m.formatKey("miners", login), "pending", amount)
+	m.store.hIncrBy(m.formatKey("finances"), "balance", (amount * -1))
+	m.store.hIncrBy(m.formatKey("finances"), "pending", amount)
+	m.store.zAdd(m.formatKey("payments", "pending"), float64(ts), join(login, amount))
+	m.writeLedger(MakeTimestamp(), LedgerEntry{Kind: LedgerPayout, Debit: MinerAccount(login, "balance"),
+		Credit: MinerAccount(login, "pending"), Amount: amount, Ref: join("pending", ts)})
+	return nil
+}
+
+func (m *MemoryBackend) RollbackBalance(login string, amount int64) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	ms := MakeTimestamp()
+
+	m.store.hIncrBy(m.formatKey("miners", login), "balance", amount)
+	m.store.hIncrBy(m.formatKey("miners", login), "pending", (amount * -1))
+	m.store.hIncrBy(m.formatKey("finances"), "balance", amount)
+	m.store.hIncrBy(m.formatKey("finances"), "pending", (amount * -1))
+	m.store.zRem(m.formatKey("payments", "pending"), join(login, amount))
+	m.writeLedger(ms, LedgerEntry{Kind: LedgerRollback, Debit: MinerAccount(login, "pending"),
+		Credit: MinerAccount(login, "balance"), Amount: amount, Ref: join("rollback", ms/1000)})
+	return nil
+}
+
+func (m *MemoryBackend) WritePayment(login, txHash string, amount int64) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	ts := MakeTimestamp() / 1000
+
+	m.store.hIncrBy(m.formatKey("miners", login), "pending", (amount * -1))
+	m.store.hIncrBy(m.formatKey("miners", login), "paid", amount)
+	m.store.hIncrBy(m.formatKey("finances"), "pending", (amount * -1))
+	m.store.hIncrBy(m.formatKey("finances"), "paid", amount)
+	m.store.zAdd(m.formatKey("payments", "all"), float64(ts), paymentMember(txHash, login, amount))
+	m.store.zAdd(m.formatKey("payments", login), float64(ts), paymentMember(txHash, "", amount))
+	m.store.zRem(m.formatKey("payments", "pending"), join(login, amount))
+	m.store.del(m.formatKey("payments", "lock"))
+	m.writeLedger(MakeTimestamp(), LedgerEntry{Kind: LedgerPaid, Debit: MinerAccount(login, "pending"),
+		Credit: MinerAccount(login, "paid"), Amount: amount, Ref: txHash})
+	return nil
+}
+
+func (m *MemoryBackend) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	if err := m.checkFence(); err != nil {
+		return err
+	}
+	ms := MakeTimestamp()
+	ref := join(block.Height, block.Hash)
+
+	// like in a Redis transaction, failed rename does not stop the rest
+	err := m.writeImmatureBlock(block)
+	total := int64(0)
+	for login, amount := range roundRewards {
+		total += amount
+		m.store.hIncrBy(m.formatKey("miners", login), "immature", amount)
+		m.store.hSetNX(m.formatKey("credits", "immature", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+		m.writeLedger(ms, LedgerEntry{Kind: LedgerImmature, Debit: AccountPoolImmature,
+			Credit: MinerAccount(login, "immature"), Amount: amount, Ref: ref})
+	}
+	m.store.hIncrBy(m.formatKey("finances"), "immature", total)
+	return err
+}
+
+func (m *MemoryBackend) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64, residual int64) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	if err := m.checkFence(); err != nil {
+		return err
+	}
+	creditKey := m.formatKey("credits", "immature", block.RoundHeight, block.Hash)
+	// Must decrement immatures using existing log entry
+	immatureCredits := m.store.hGetAll(creditKey)
+
+	ms := MakeTimestamp()
+	ts := ms / 1000
+	value := join(block.Hash, ts, block.Reward)
+	ref := join(block.Height, block.Hash)
+
+	m.writeMaturedBlock(block)
+	m.store.zAdd(m.formatKey("credits", "all"), float64(block.Height), value)
+
+	// Decrement immature balances
+	totalImmature := int64(0)
+	for login, amountString := range immatureCredits {
+		amount, _ := strconv.ParseInt(amountString, 10, 64)
+		totalImmature += amount
+		m.store.hIncrBy(m.formatKey("miners", login), "immature", (amount * -1))
+		m.writeLedger(ms, LedgerEntry{Kind: LedgerImmatureReversal, Debit: MinerAccount(login, "immature"),
+			Credit: AccountPoolImmature, Amount: amount, Ref: ref})
+	}
+
+	// Increment balances
+	total := int64(0)
+	for login, amount := range roundRewards {
+		total += amount
+		m.store.hIncrBy(m.formatKey("miners", login), "balance", amount)
+		m.store.hSetNX(m.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+		m.writeLedger(ms, LedgerEntry{Kind: LedgerCredit, Debit: AccountPoolMined,
+			Credit: MinerAccount(login, "balance"), Amount: amount, Ref: ref})
+	}
+	// Whatever was mined and not credited to miners is kept by the pool
+	m.writeLedger(ms, LedgerEntry{Kind: LedgerFee, Debit: AccountPoolMined,
+		Credit: AccountPoolFee, Amount: block.RevenueInSatoshi() - total, Ref: ref})
+	m.store.del(creditKey)
+	m.store.hIncrBy(m.formatKey("finances"), "balance", total)
+	m.store.hIncrBy(m.formatKey("finances"), "immature", (totalImmature * -1))
+	m.store.hSet(m.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
+	m.store.hSet(m.formatKey("finances"), "lastCreditHash", block.Hash)
+	m.store.hIncrBy(m.formatKey("finances"), "totalMined", block.RewardInSatoshi())
+	// Rounding dust kept by the pool, so that credits plus fees always add up to totalMined
+	if residual != 0 {
+		m.store.hIncrBy(m.formatKey("finances"), "residual", residual)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) WriteOrphan(block *BlockData) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	if err := m.checkFence(); err != nil {
+		return err
+	}
+	creditKey := m.formatKey("credits", "immature", block.RoundHeight, block.Hash)
+	// Must decrement immatures using existing log entry
+	immatureCredits := m.store.hGetAll(creditKey)
+
+	ms := MakeTimestamp()
+	ref := join(block.Height, block.Hash)
+
+	m.writeMaturedBlock(block)
+
+	// Decrement immature balances
+	totalImmature := int64(0)
+	for login, amountString := range immatureCredits {
+		amount, _ := strconv.ParseInt(amountString, 10, 64)
+		totalImmature += amount
+		m.store.hIncrBy(m.formatKey("miners", login), "immature", (amount * -1))
+		m.writeLedger(ms, LedgerEntry{Kind: LedgerImmatureReversal, Debit: MinerAccount(login, "immature"),
+			Credit: AccountPoolImmature, Amount: amount, Ref: ref})
+	}
+	m.store.del(creditKey)
+	m.store.hIncrBy(m.formatKey("finances"), "immature", (totalImmature * -1))
+	return nil
+}
+
+func (m *MemoryBackend) WritePendingOrphans(blocks []*BlockData) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	if err := m.checkFence(); err != nil {
+		return err
+	}
+	var err error
+	for _, block := range blocks {
+		if e := m.writeImmatureBlock(block); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (m *MemoryBackend) writeImmatureBlock(block *BlockData) error {
+	var err error
+	if block.Height != block.RoundHeight {
+		err = m.store.rename(m.formatRound(block.RoundHeight, block.Nonce), m.formatRound(block.Height, block.Nonce))
+	}
+	m.store.zRem(m.formatKey("blocks", "candidates"), block.candidateKey)
+	m.store.zAdd(m.formatKey("blocks", "immature"), float64(block.Height), block.key())
+	return err
+}
+
+func (m *MemoryBackend) writeMaturedBlock(block *BlockData) {
+	m.store.zRem(m.formatKey("blocks", "immature"), block.immatureKey)
+	m.store.zAdd(m.formatKey("blocks", "matured"), float64(block.Height), block.key())
+}
+
+func (m *MemoryBackend) writeLedger(ts int64, entries ...LedgerEntry) {
+	for _, entry := range entries {
+		if entry.Amount == 0 {
+			continue
+		}
+		entry.Timestamp = ts
+		data, _ := json.Marshal(&entry)
+		m.store.rPush(m.formatKey("ledger"), string(data))
+		m.store.hIncrBy(m.formatKey("ledger", "accounts"), entry.Debit, entry.Amount*-1)
+		m.store.hIncrBy(m.formatKey("ledger", "accounts"), entry.Credit, entry.Amount)
+	}
+}
+
+func (m *MemoryBackend) GetLedgerEntries(start, stop int64) ([]*LedgerEntry, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	var result []*LedgerEntry
+	for _, row := range m.store.lRange(m.formatKey("ledger"), start, stop) {
+		entry := LedgerEntry{}
+		err := json.Unmarshal([]byte(row), &entry)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &entry)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) Reconcile() (*LedgerReport, error) {
+	return reconcile(m)
+}
+
+func (m *MemoryBackend) OpenLedger() ([]LedgerEntry, error) {
+	m.store.Lock()
+	opened := m.store.exists(m.formatKey("ledger", "opened"))
+	m.store.Unlock()
+	if opened {
+		return nil, ErrLedgerOpened
+	}
+	report, err := m.Reconcile()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := openingEntries(report)
+	if err != nil {
+		return nil, err
+	}
+
+	m.store.Lock()
+	defer m.store.Unlock()
+	ms := MakeTimestamp()
+	m.writeLedger(ms, entries...)
+	m.store.set(m.formatKey("ledger", "opened"), strconv.FormatInt(ms, 10), 0)
+	return entries, nil
+}
+
+func (m *MemoryBackend) getHash(args ...interface{}) (map[string]string, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return m.store.hGetAll(m.formatKey(args...)), nil
+}
+
+func (m *MemoryBackend) GetMaturedBlocks(start, stop int64) ([]*BlockData, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return convertBlockResults(m.store.zRevRange(m.formatKey("blocks", "matured"), start, stop)), nil
+}
+
+func (m *MemoryBackend) GetRoundCredits(height int64, hash string) (map[string]int64, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return convertCredits(m.store.hGetAll(m.formatKey("credits", height, hash))), nil
+}
+
+func (m *MemoryBackend) GetPayments(start, stop int64) ([]map[string]interface{}, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return convertPaymentsResults(m.store.zRevRange(m.formatKey("payments", "all"), start, stop)), nil
+}
+
+func (m *MemoryBackend) GetBlocksPage(kind string, q *HistoryQuery) ([]*BlockData, string, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	key, min, max, match := blocksHistory(kind, q)
+	rows, next, err := pageHistory(m.fetchHistory(m.formatKey("blocks", key)), min, max, q.Cursor, q.Limit, match)
+	if err != nil {
+		return nil, "", err
+	}
+	if kind == BlocksCandidates {
+		return convertCandidateResults(rows), next, nil
+	}
+	return convertBlockResults(rows), next, nil
+}
+
+func (m *MemoryBackend) GetPaymentsPage(q *HistoryQuery) ([]map[string]interface{}, string, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	key, min, max := paymentsHistory(q)
+	rows, next, err := pageHistory(m.fetchHistory(m.formatKey("payments", key)), min, max, q.Cursor, q.Limit, matchAll)
+	if err != nil {
+		return nil, "", err
+	}
+	return convertPaymentsResults(rows), next, nil
+}
+
+func (m *MemoryBackend) fetchHistory(key string) func(min, max float64, offset, count int64) ([]redis.Z, error) {
+	return func(min, max float64, offset, count int64) ([]redis.Z, error) {
+		return m.store.zRevRangeByScore(key, min, max, offset, count), nil
+	}
+}
+
+func (m *MemoryBackend) IsMinerExists(login string) (bool, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return m.store.exists(m.formatKey("miners", login)), nil
+}
+
+func (m *MemoryBackend) GetMinerStats(login string) (map[string]interface{}, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	stats := make(map[string]interface{})
+	result := m.store.hGetAll(m.formatKey("miners", login))
+	// Contact details are private
+	delete(result, "email")
+	stats["stats"] = convertStringMap(result)
+	stats["paymentsTotal"] = m.store.zCard(m.formatKey("payments", login))
+	v, _ := m.store.hGet(m.formatKey("shares", "roundCurrent"), login)
+	roundShares, _ := strconv.ParseInt(v, 10, 64)
+	stats["roundShares"] = roundShares
+	return stats, nil
+}
+
+func (m *MemoryBackend) FlushStaleStats(window, largeWindow time.Duration) (int64, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	now := MakeTimestamp() / 1000
+	max := float64(now - int64(window/time.Second))
+	total := m.store.zRemBelow(m.formatKey("hashrate"), max)
+	total += m.store.zRemBelow(m.formatKey("invalidhashrate"), max)
+	total += m.store.zRemBelow(m.formatKey("rejecthashrate"), max)
+
+	max = float64(now - int64(largeWindow/time.Second))
+	for _, key := range m.store.keys(m.formatKey("hashrate") + ":") {
+		login := strings.Split(key, ":")[2]
+		total += m.store.zRemBelow(m.formatKey("hashrate", login), max)
+	}
+	return total, nil
+}
+
+func (m *MemoryBackend) WriteCharts(window time.Duration) (int64, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	if err := m.checkFence(); err != nil {
+		return 0, err
+	}
+	lastKey := m.formatKey("charts")
+	v, _ := m.store.get(lastKey)
+	lastBucket, _ := strconv.ParseInt(v, 10, 64)
+	from, to := chartRange(MakeTimestamp()/1000, lastBucket, window)
+	if from >= to {
+		return 0, nil
+	}
+	// Scores are whole seconds, so the last one below to is to-1
+	raw := m.store.zRangeByScore(m.formatKey("hashrate"), float64(from), float64(to-1))
+	for bucket, series := range convertChartShares(raw) {
+		for name, sum := range series {
+			for _, res := range ChartResolutions {
+				m.store.hIncrBy(m.formatKey("charts", res.Name, name), chartBucket(bucket, res), sum)
+			}
+		}
+	}
+	m.store.set(lastKey, strconv.FormatInt(to, 10), 0)
+	return (to - from) / int64(ChartResolutions[0].Bucket/time.Second), nil
+}
+
+func (m *MemoryBackend) GetChart(res *ChartResolution, login, id string, from, to int64) ([]ChartPoint, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return convertChartPoints(res, m.store.hGetAll(m.formatKey("charts", res.Name, chartSeries(login, id))), from, to), nil
+}
+
+func (m *MemoryBackend) FlushStaleCharts() (int64, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	now := MakeTimestamp() / 1000
+	total := int64(0)
+	for _, key := range m.store.keys(m.formatKey("charts") + ":") {
+		res := GetChartResolution(strings.Split(key, ":")[2])
+		if res == nil {
+			continue
+		}
+		var buckets []string
+		for bucket := range m.store.hGetAll(key) {
+			buckets = append(buckets, bucket)
+		}
+		for _, bucket := range staleChartBuckets(res, buckets, now) {
+			m.store.hDel(key, bucket)
+			total++
+		}
+	}
+	return total, nil
+}
+
+func (m *MemoryBackend) CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	window := int64(smallWindow / time.Second)
+	stats := make(map[string]interface{})
+
+	now := MakeTimestamp() / 1000
+
+	m.store.zRemBelow(m.formatKey("hashrate"), float64(now-window))
+
+	stats["stats"] = convertStringMap(m.store.hGetAll(m.formatKey("stats")))
+	stats["candidates"] = convertCandidateResults(m.store.zRevRange(m.formatKey("blocks", "candidates"), 0, -1))
+	stats["candidatesTotal"] = m.store.zCard(m.formatKey("blocks", "candidates"))
+
+	stats["immature"] = convertBlockResults(m.store.zRevRange(m.formatKey("blocks", "immature"), 0, -1))
+	stats["immatureTotal"] = m.store.zCard(m.formatKey("blocks", "immature"))
+
+	stats["matured"] = convertBlockResults(m.store.zRevRange(m.formatKey("blocks", "matured"), 0, maxBlocks-1))
+	stats["maturedTotal"] = m.store.zCard(m.formatKey("blocks", "matured"))
+
+	stats["payments"] = convertPaymentsResults(m.store.zRevRange(m.formatKey("payments", "all"), 0, maxPayments-1))
+	stats["paymentsTotal"] = m.store.zCard(m.formatKey("payments", "all"))
+
+	totalHashrate, miners := convertMinersStats(window, m.store.zRange(m.formatKey("hashrate")))
+	stats["miners"] = miners
+	stats["minersTotal"] = len(miners)
+	stats["hashrate"] = totalHashrate
+	return stats, nil
+}
+
+func (m *MemoryBackend) CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	smallWindow := int64(sWindow / time.Second)
+	largeWindow := int64(lWindow / time.Second)
+
+	now := MakeTimestamp() / 1000
+
+	m.store.zRemBelow(m.formatKey("hashrate", login), float64(now-largeWindow))
+	return convertWorkersResults(now, smallWindow, largeWindow, m.store.zRange(m.formatKey("hashrate", login)),
+		m.store.hGetAll(m.formatKey("rejects", login))), nil
+}
+
+func (m *MemoryBackend) CollectLuckStats(windows []int) (map[string]interface{}, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	max := int64(windows[len(windows)-1])
+	blocks := convertBlockResults(m.store.zRevRange(m.formatKey("blocks", "immature"), 0, -1),
+		m.store.zRevRange(m.formatKey("blocks", "matured"), 0, max-1))
+	return convertLuckResults(windows, blocks), nil
+}
+
+func (m *MemoryBackend) GetSchemaVersion() (int64, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return parseSchemaVersion(m.store.get(m.formatKey("schema")))
+}
+
+func (m *MemoryBackend) CheckSchema() error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	version, err := parseSchemaVersion(m.store.get(m.formatKey("schema")))
+	if err != nil {
+		return err
+	}
+	stamp, err := checkSchemaVersion(version, len(m.recordKeys()) == 0)
+	if err != nil || !stamp {
+		return err
+	}
+	m.store.set(m.formatKey("schema"), strconv.Itoa(SchemaVersion), 0)
+	return nil
+}
+
+func (m *MemoryBackend) recordKeys() map[string]recordKind {
+	keys := make(map[string]recordKind)
+	for _, key := range []string{m.formatKey("blocks", "candidates"), m.formatKey("blocks", "immature"),
+		m.formatKey("blocks", "matured"), m.formatKey("payments", "all")} {
+		if m.store.exists(key) {
+			keys[key] = blockKind(key)
+		}
+	}
+	for _, key := range m.store.keys(m.formatKey("payments") + ":") {
+		if isPaymentRecordsKey(key) {
+			keys[key] = paymentRecords
+		}
+	}
+	return keys
+}
+
+func (m *MemoryBackend) MigrateSchema(dryRun bool) (*SchemaReport, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	version, err := parseSchemaVersion(m.store.get(m.formatKey("schema")))
+	if err != nil {
+		return nil, err
+	}
+	report := newSchemaReport(version, dryRun)
+	if version > SchemaVersion {
+		_, err := checkSchemaVersion(version, false)
+		return report, err
+	}
+	for key, kind := range m.recordKeys() {
+		raw := m.store.zRange(key)
+		upgrades, err := upgradeMembers(kind, raw)
+		if err != nil {
+			return report, fmt.Errorf("%v: %v", key, err)
+		}
+		report.Upgraded[strings.TrimPrefix(key, m.prefix+":")] = int64(len(upgrades))
+		if dryRun {
+			continue
+		}
+		for member, z := range upgrades {
+			m.store.zRem(key, member)
+			m.store.zAdd(key, z.Score, z.Member.(string))
+		}
+		migrated := m.store.zRange(key)
+		if err := verifyMembers(raw, migrated); err != nil {
+			return report, fmt.Errorf("%v: %v", key, err)
+		}
+		report.Verified += int64(len(migrated))
+	}
+	if !dryRun {
+		m.store.set(m.formatKey("schema"), strconv.Itoa(SchemaVersion), 0)
+	}
+	return report, nil
+}
+
+func (m *MemoryBackend) DumpKeys() ([]*KeyDump, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	var dumps []*KeyDump
+	for _, key := range m.store.keys(m.prefix + ":") {
+		name := strings.TrimPrefix(key, m.prefix+":")
+		if !isDumpedKey(name) {
+			continue
+		}
+		dump := &KeyDump{Key: name, Type: m.store.keyType(key)}
+		switch dump.Type {
+		case "string":
+			dump.String, _ = m.store.get(key)
+		case "hash":
+			dump.Hash = m.store.hGetAll(key)
+		case "list":
+			dump.List = m.store.lRange(key, 0, -1)
+		case "zset":
+			for _, v := range m.store.zRange(key) {
+				dump.ZSet = append(dump.ZSet, ZMember{Score: v.Score, Member: v.Member.(string)})
+			}
+		default:
+			return nil, fmt.Errorf("key %v has unsupported type %v", name, dump.Type)
+		}
+		dumps = append(dumps, dump)
+	}
+	sortDumps(dumps)
+	return dumps, nil
+}
+
+func (m *MemoryBackend) RestoreKeys(dumps []*KeyDump, remove []string, entries []LedgerEntry) error {
+	if err := checkRestore(dumps, remove); err != nil {
+		return err
+	}
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	for _, name := range remove {
+		m.store.del(m.formatKey(name))
+	}
+	for _, dump := range dumps {
+		key := m.formatKey(dump.Key)
+		m.store.del(key)
+		switch dump.Type {
+		case "string":
+			m.store.set(key, dump.String, 0)
+		case "hash":
+			for field, value := range dump.Hash {
+				m.store.hSet(key, field, value)
+			}
+		case "list":
+			for _, value := range dump.List {
+				m.store.rPush(key, value)
+			}
+		case "zset":
+			for _, v := range dump.ZSet {
+				m.store.zAdd(key, v.Score, v.Member)
+			}
+		}
+	}
+	m.writeLedger(MakeTimestamp(), entries...)
+	for field, delta := range financesDeltas(entries) {
+		if delta != 0 {
+			m.store.hIncrBy(m.formatKey("finances"), field, delta)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) WriteHalt(module, reason string) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	state := HaltState{Reason: reason, Timestamp: MakeTimestamp() / 1000}
+	data, _ := json.Marshal(&state)
+	m.store.hSet(m.formatKey("halts"), module, string(data))
+	return nil
+}
+
+// Returns nil if module is not halted
+func (m *MemoryBackend) GetHalt(module string) (*HaltState, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	data, ok := m.store.hGet(m.formatKey("halts"), module)
+	if !ok {
+		return nil, nil
+	}
+	state := HaltState{}
+	err := json.Unmarshal([]byte(data), &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (m *MemoryBackend) GetHalts() (map[string]*HaltState, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	result := make(map[string]*HaltState)
+	for module, data := range m.store.hGetAll(m.formatKey("halts")) {
+		state := HaltState{}
+		err := json.Unmarshal([]byte(data), &state)
+		if err != nil {
+			return nil, err
+		}
+		result[module] = &state
+	}
+	return result, nil
+}
+
+// Returns false if module was not halted
+func (m *MemoryBackend) ClearHalt(module string) (bool, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+	return m.store.hDel(m.formatKey("halts"), module), nil
+}
+
+func (m *MemoryBackend) leaseKeys(role string) []string {
+	return []string{m.formatKey("leader", role), m.formatKey("leader", role, "token")}
+}
+
+// Acquires or renews lease, returns fencing token or zero if lease is held by someone else
+func (m *MemoryBackend) AcquireLease(role, holder string, ttl time.Duration) (int64, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	keys := m.leaseKeys(role)
+	current, ok := m.store.get(keys[0])
+	if ok {
+		i := strings.LastIndex(current, ":")
+		if current[:i] == holder {
+			m.store.expire(keys[0], ttl)
+			token, _ := strconv.ParseInt(current[i+1:], 10, 64)
+			return token, nil
+		}
+		return 0, nil
+	}
+	token := m.store.incr(keys[1])
+	m.store.set(keys[0], join(holder, token), ttl)
+	return token, nil
+}
+
+func (m *MemoryBackend) ReleaseLease(role, holder string) error {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	key := m.leaseKeys(role)[0]
+	current, ok := m.store.get(key)
+	if ok && current[:strings.LastIndex(current, ":")] == holder {
+		m.store.del(key)
+	}
+	return nil
+}
+
+// Returns current lease holder and its token, empty holder if there is no leader
+func (m *MemoryBackend) GetLeader(role string) (string, int64, error) {
+	m.store.Lock()
+	defer m.store.Unlock()
+
+	current, ok := m.store.get(m.leaseKeys(role)[0])
+	if !ok {
+		return "", 0, nil
+	}
+	i := strings.LastIndex(current, ":")
+	token, _ := strconv.ParseInt(current[i+1:], 10, 64)
+	return current[:i], token, nil
+}
+
+// Returns backend which rejects writes of singleton jobs with ErrFenced unless token
+// currently held by the caller is the latest one issued for the role
+func (m *MemoryBackend) Fenced(role string, token func() int64) Backend {
+	fenced := *m
+	fenced.fence = &fence{key: m.leaseKeys(role)[1], token: token}
+	return &fenced
+}
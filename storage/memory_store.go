@@ -0,0 +1,406 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var errNoSuchKey = errors.New("ERR no such key")
+
+// Minimal Redis-like keyspace of strings, hashes, sorted sets, lists and sets. Like in Redis,
+// every key holds one value, emptied collections are removed and keys may expire.
+// Callers must hold the lock.
+type memoryStore struct {
+	sync.Mutex
+	strs    map[string]string
+	hashes  map[string]map[string]string
+	zsets   map[string]map[string]float64
+	lists   map[string][]string
+	sets    map[string]map[string]struct{}
+	expires map[string]time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		strs:    make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		zsets:   make(map[string]map[string]float64),
+		lists:   make(map[string][]string),
+		sets:    make(map[string]map[string]struct{}),
+		expires: make(map[string]time.Time),
+	}
+}
+
+// Drops key if its TTL has passed
+func (m *memoryStore) purge(key string) {
+	if t, ok := m.expires[key]; ok && !time.Now().Before(t) {
+		m.del(key)
+	}
+}
+
+func (m *memoryStore) exists(key string) bool {
+	m.purge(key)
+	if _, ok := m.strs[key]; ok {
+		return true
+	}
+	if _, ok := m.hashes[key]; ok {
+		return true
+	}
+	if _, ok := m.zsets[key]; ok {
+		return true
+	}
+	if _, ok := m.lists[key]; ok {
+		return true
+	}
+	_, ok := m.sets[key]
+	return ok
+}
+
+// Type name of key as Redis TYPE replies
+func (m *memoryStore) keyType(key string) string {
+	m.purge(key)
+	if _, ok := m.strs[key]; ok {
+		return "string"
+	}
+	if _, ok := m.hashes[key]; ok {
+		return "hash"
+	}
+	if _, ok := m.zsets[key]; ok {
+		return "zset"
+	}
+	if _, ok := m.lists[key]; ok {
+		return "list"
+	}
+	if _, ok := m.sets[key]; ok {
+		return "set"
+	}
+	return "none"
+}
+
+func (m *memoryStore) del(key string) bool {
+	existed := false
+	if _, ok := m.strs[key]; ok {
+		delete(m.strs, key)
+		existed = true
+	}
+	if _, ok := m.hashes[key]; ok {
+		delete(m.hashes, key)
+		existed = true
+	}
+	if _, ok := m.zsets[key]; ok {
+		delete(m.zsets, key)
+		existed = true
+	}
+	if _, ok := m.lists[key]; ok {
+		delete(m.lists, key)
+		existed = true
+	}
+	if _, ok := m.sets[key]; ok {
+		delete(m.sets, key)
+		existed = true
+	}
+	delete(m.expires, key)
+	return existed
+}
+
+// Non-positive TTL deletes key as Redis EXPIRE does
+func (m *memoryStore) expire(key string, ttl time.Duration) {
+	if !m.exists(key) {
+		return
+	}
+	if ttl <= 0 {
+		m.del(key)
+		return
+	}
+	m.expires[key] = time.Now().Add(ttl)
+}
+
+// Moves value along with its TTL, overwriting destination
+func (m *memoryStore) rename(from, to string) error {
+	if !m.exists(from) {
+		return errNoSuchKey
+	}
+	if from == to {
+		return nil
+	}
+	m.del(to)
+	if v, ok := m.strs[from]; ok {
+		m.strs[to] = v
+	}
+	if v, ok := m.hashes[from]; ok {
+		m.hashes[to] = v
+	}
+	if v, ok := m.zsets[from]; ok {
+		m.zsets[to] = v
+	}
+	if v, ok := m.lists[from]; ok {
+		m.lists[to] = v
+	}
+	if v, ok := m.sets[from]; ok {
+		m.sets[to] = v
+	}
+	if t, ok := m.expires[from]; ok {
+		m.expires[to] = t
+	}
+	m.del(from)
+	return nil
+}
+
+// Live keys starting with prefix
+func (m *memoryStore) keys(prefix string) []string {
+	seen := make(map[string]struct{})
+	collect := func(key string) {
+		if strings.HasPrefix(key, prefix) {
+			seen[key] = struct{}{}
+		}
+	}
+	for key := range m.strs {
+		collect(key)
+	}
+	for key := range m.hashes {
+		collect(key)
+	}
+	for key := range m.zsets {
+		collect(key)
+	}
+	for key := range m.lists {
+		collect(key)
+	}
+	for key := range m.sets {
+		collect(key)
+	}
+	var result []string
+	for key := range seen {
+		if m.exists(key) {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (m *memoryStore) get(key string) (string, bool) {
+	m.purge(key)
+	v, ok := m.strs[key]
+	return v, ok
+}
+
+// Zero TTL keeps value forever
+func (m *memoryStore) set(key, value string, ttl time.Duration) {
+	m.del(key)
+	m.strs[key] = value
+	if ttl > 0 {
+		m.expires[key] = time.Now().Add(ttl)
+	}
+}
+
+func (m *memoryStore) incr(key string) int64 {
+	v, _ := m.get(key)
+	n, _ := strconv.ParseInt(v, 10, 64)
+	n++
+	m.strs[key] = strconv.FormatInt(n, 10)
+	return n
+}
+
+func (m *memoryStore) hash(key string, create bool) map[string]string {
+	m.purge(key)
+	h, ok := m.hashes[key]
+	if !ok && create {
+		h = make(map[string]string)
+		m.hashes[key] = h
+	}
+	return h
+}
+
+func (m *memoryStore) hGet(key, field string) (string, bool) {
+	v, ok := m.hash(key, false)[field]
+	return v, ok
+}
+
+func (m *memoryStore) hGetAll(key string) map[string]string {
+	result := make(map[string]string)
+	for k, v := range m.hash(key, false) {
+		result[k] = v
+	}
+	return result
+}
+
+func (m *memoryStore) hSet(key, field, value string) {
+	m.hash(key, true)[field] = value
+}
+
+func (m *memoryStore) hSetNX(key, field, value string) {
+	h := m.hash(key, true)
+	if _, ok := h[field]; !ok {
+		h[field] = value
+	}
+}
+
+func (m *memoryStore) hDel(key, field string) bool {
+	h := m.hash(key, false)
+	if _, ok := h[field]; !ok {
+		return false
+	}
+	delete(h, field)
+	if len(h) == 0 {
+		m.del(key)
+	}
+	return true
+}
+
+func (m *memoryStore) hIncrBy(key, field string, n int64) int64 {
+	h := m.hash(key, true)
+	v, _ := strconv.ParseInt(h[field], 10, 64)
+	v += n
+	h[field] = strconv.FormatInt(v, 10)
+	return v
+}
+
+func (m *memoryStore) zset(key string, create bool) map[string]float64 {
+	m.purge(key)
+	z, ok := m.zsets[key]
+	if !ok && create {
+		z = make(map[string]float64)
+		m.zsets[key] = z
+	}
+	return z
+}
+
+// Returns false if member was already there, its score is updated anyway
+func (m *memoryStore) zAdd(key string, score float64, member string) bool {
+	z := m.zset(key, true)
+	_, ok := z[member]
+	z[member] = score
+	return !ok
+}
+
+func (m *memoryStore) zIncrBy(key string, n float64, member string) {
+	m.zset(key, true)[member] += n
+}
+
+func (m *memoryStore) zRem(key, member string) {
+	z := m.zset(key, false)
+	delete(z, member)
+	if z != nil && len(z) == 0 {
+		m.del(key)
+	}
+}
+
+func (m *memoryStore) zCard(key string) int64 {
+	return int64(len(m.zset(key, false)))
+}
+
+// Members ordered by score then member, as Redis orders them
+func (m *memoryStore) zRange(key string) []redis.Z {
+	var result []redis.Z
+	for member, score := range m.zset(key, false) {
+		result = append(result, redis.Z{Score: score, Member: member})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score < result[j].Score
+		}
+		return result[i].Member.(string) < result[j].Member.(string)
+	})
+	return result
+}
+
+func (m *memoryStore) zRevRange(key string, start, stop int64) []redis.Z {
+	all := m.zRange(key)
+	for i, j := 0, len(all)-1; i < j; i, j = i+1, j-1 {
+		all[i], all[j] = all[j], all[i]
+	}
+	lo, hi := indexRange(int64(len(all)), start, stop)
+	return all[lo:hi]
+}
+
+// Members within [min, max] by descending score, count of zero returns all of them
+func (m *memoryStore) zRevRangeByScore(key string, min, max float64, offset, count int64) []redis.Z {
+	var result []redis.Z
+	for _, v := range m.zRevRange(key, 0, -1) {
+		if v.Score >= min && v.Score <= max {
+			result = append(result, v)
+		}
+	}
+	if offset >= int64(len(result)) {
+		return nil
+	}
+	result = result[offset:]
+	if count > 0 && count < int64(len(result)) {
+		result = result[:count]
+	}
+	return result
+}
+
+func (m *memoryStore) zRangeByScore(key string, min, max float64) []redis.Z {
+	var result []redis.Z
+	for _, z := range m.zRange(key) {
+		if z.Score >= min && z.Score <= max {
+			result = append(result, z)
+		}
+	}
+	return result
+}
+
+// Removes members scored below max, which is ZREMRANGEBYSCORE key -inf (max
+func (m *memoryStore) zRemBelow(key string, max float64) int64 {
+	z := m.zset(key, false)
+	n := int64(0)
+	for member, score := range z {
+		if score < max {
+			delete(z, member)
+			n++
+		}
+	}
+	if z != nil && len(z) == 0 {
+		m.del(key)
+	}
+	return n
+}
+
+func (m *memoryStore) rPush(key, value string) {
+	m.purge(key)
+	m.lists[key] = append(m.lists[key], value)
+}
+
+func (m *memoryStore) lRange(key string, start, stop int64) []string {
+	m.purge(key)
+	l := m.lists[key]
+	lo, hi := indexRange(int64(len(l)), start, stop)
+	return append([]string{}, l[lo:hi]...)
+}
+
+func (m *memoryStore) sMembers(key string) []string {
+	m.purge(key)
+	result := []string{}
+	for member := range m.sets[key] {
+		result = append(result, member)
+	}
+	return result
+}
+
+// Converts inclusive Redis start/stop indexes, negative ones counting from the end, to slice bounds
+func indexRange(n, start, stop int64) (int64, int64) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop + 1
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryWriteShareCheckExist(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+
+	exist, _ := m.WriteShare("x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1008, time.Hour)
+	if exist {
+		t.Error("PoW must not exist")
+	}
+	exist, _ = m.WriteShare("x", "x", []string{"0x0", "0x1", "0x0"}, 10, 1008, time.Hour)
+	if exist {
+		t.Error("PoW must not exist")
+	}
+	exist, _ = m.WriteShare("z", "x", []string{"0x0", "0x0", "0x0"}, 100, 1010, time.Hour)
+	if !exist {
+		t.Error("PoW must exist")
+	}
+	exist, _ = m.WriteShare("x", "x", []string{"0x0", "0x0", "0x0"}, 100, 1025, time.Hour)
+	if exist {
+		t.Error("PoW must not exist once it is out of window")
+	}
+	exist, _ = m.WriteBlock("x", "x", []string{"0x0", "0x0", "0x0"}, 100, 1000, 1025, "0x1", 1000, 0, time.Hour)
+	if !exist {
+		t.Error("Block with existing PoW must be rejected")
+	}
+}
+
+func TestMemoryLeaseAndFencing(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+
+	token1, _ := m.AcquireLease("jobs", "pool1", time.Minute)
+	if token1 == 0 {
+		t.Fatal("Must acquire free lease")
+	}
+	if token, _ := m.AcquireLease("jobs", "pool2", time.Minute); token != 0 {
+		t.Error("Must not acquire lease held by another node")
+	}
+
+	current := token1
+	fenced := m.Fenced("jobs", func() int64 { return current })
+	if err := fenced.LockPayouts("x", 100); err != nil {
+		t.Errorf("Leader must be able to write: %v", err)
+	}
+	fenced.UnlockPayouts()
+
+	m.ReleaseLease("jobs", "pool1")
+	token2, _ := m.AcquireLease("jobs", "pool2", time.Millisecond)
+	if token2 <= token1 {
+		t.Errorf("New leader must get greater token: %v vs %v", token2, token1)
+	}
+	if err := fenced.LockPayouts("x", 100); err != ErrFenced {
+		t.Errorf("Stale leader must be fenced: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if holder, _, _ := m.GetLeader("jobs"); holder != "" {
+		t.Errorf("Lease must expire, held by %v", holder)
+	}
+}
+
+type backendSnapshot struct {
+	Candidates  []*BlockData
+	Immature    []*BlockData
+	RoundShares map[string]int64
+	Balances    map[string]int64
+	Pending     []string
+	Locked      bool
+	Ledger      map[string]int64
+	Balanced    bool
+	Rejects     interface{}
+	MinerStats  interface{}
+	Luck        map[string]interface{}
+}
+
+// Runs the same round of mining, crediting and payments and collects what modules would read back
+func runBackendScenario(t *testing.T, b Backend) *backendSnapshot {
+	snapshot := &backendSnapshot{Balances: make(map[string]int64)}
+
+	b.WriteShare("x", "rig1", []string{"0x1", "0x0", "0x0"}, 100, 10, time.Hour)
+	b.WriteShare("z", "rig1", []string{"0x2", "0x0", "0x0"}, 300, 10, time.Hour)
+	b.WriteInvalidShare(1000, 1, "x", "rig1", 100, "duplicate")
+	b.WriteRejectShare(1000, 1, "x", "rig2", 100, "lowDifficulty")
+	exist, err := b.WriteBlock("x", "rig1", []string{"0x3", "0x0", "0x0"}, 100, 500, 10, "0xb10c", 1000, 0, time.Hour)
+	if exist || err != nil {
+		t.Fatalf("Must write block: %v, %v", exist, err)
+	}
+
+	candidates, _ := b.GetCandidates(10)
+	if len(candidates) != 1 {
+		t.Fatalf("Must return candidate: %v", candidates)
+	}
+	snapshot.Candidates = candidates
+	block := candidates[0]
+	block.Height = 11
+	block.Reward = big.NewInt(1000)
+	block.ExtraReward = big.NewInt(0)
+	snapshot.RoundShares, _ = b.GetRoundShares(10, "0x3")
+	rewards := map[string]int64{"x": 490, "z": 490}
+	b.WriteImmatureBlock(block, rewards)
+	snapshot.Immature, _ = b.GetImmatureBlocks(11)
+	snapshot.RoundShares, _ = b.GetRoundShares(11, "0x3")
+
+	immature, _ := b.GetImmatureBlocks(11)
+	immature[0].Reward = big.NewInt(1000)
+	immature[0].RoundHeight = 11
+	b.WriteMaturedBlock(immature[0], rewards, 0)
+
+	b.LockPayouts("x", 490)
+	b.UpdateBalance("x", 490)
+	b.WritePayment("x", "0xbeef", 490)
+	b.UpdateBalance("z", 490)
+	for _, p := range b.GetPendingPayments() {
+		snapshot.Pending = append(snapshot.Pending, join(p.Address, p.Amount))
+	}
+	b.RollbackBalance("z", 490)
+	snapshot.Locked, _ = b.IsPayoutsLocked()
+
+	for _, login := range []string{"x", "z"} {
+		snapshot.Balances[login], _ = b.GetBalance(login)
+	}
+	report, err := b.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Ledger = report.Accounts
+	snapshot.Balanced = report.Balanced()
+
+	workers, _ := b.CollectWorkersStats(time.Minute, time.Hour, "x")
+	snapshot.Rejects = workers["rejects"]
+	stats, _ := b.GetMinerStats("x")
+	minerStats := stats["stats"].(map[string]interface{})
+	delete(minerStats, "lastShare")
+	snapshot.MinerStats = minerStats
+	snapshot.Luck, _ = b.CollectLuckStats([]int{1, 10})
+
+	for _, blocks := range [][]*BlockData{snapshot.Candidates, snapshot.Immature} {
+		for _, block := range blocks {
+			block.Timestamp = 0
+			block.candidateKey = ""
+			block.immatureKey = ""
+		}
+	}
+	return snapshot
+}
+
+func TestMemoryMatchesRedis(t *testing.T) {
+	reset()
+
+	expected := runBackendScenario(t, r)
+	actual := runBackendScenario(t, NewMemoryBackend(prefix))
+
+	if !expected.Balanced || !actual.Balanced {
+		t.Error("Ledger must be balanced")
+	}
+	if actual.Balances["z"] != 490 || actual.RoundShares["x"] != 200 || len(actual.Immature) != 1 {
+		t.Errorf("Unexpected scenario result: %+v", actual)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Memory backend must behave like Redis:\n%+v\n%+v", expected, actual)
+	}
+}
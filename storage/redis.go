@@ -1,28 +1,70 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/big"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"gopkg.in/redis.v3"
+	"github.com/redis/go-redis/v9"
 
 	. "github.com/PowPool/dashpool/util"
 )
 
 type Config struct {
-	Endpoint          string `json:"endpoint"`
-	PasswordEncrypted string `json:"passwordEncrypted"`
-	Password          string `json:"-"`
-	Database          int64  `json:"database"`
-	PoolSize          int    `json:"poolSize"`
+	Endpoint string `json:"endpoint"`
+	// Master is discovered through Sentinels instead of endpoint when set
+	Sentinel SentinelConfig `json:"sentinel"`
+	// Redis Cluster is used through these nodes instead of endpoint when set
+	Cluster           ClusterConfig `json:"cluster"`
+	PasswordEncrypted string        `json:"passwordEncrypted"`
+	Password          string        `json:"-"`
+	Database          int           `json:"database"`
+	PoolSize          int           `json:"poolSize"`
+	// Wraps key prefix of keys written by transactions into hash tag, "{dash}:shares:roundCurrent",
+	// so MULTI or RENAME across them stay within one Redis Cluster slot. Always on with cluster.
+	HashTag bool `json:"hashTag"`
+}
+
+type SentinelConfig struct {
+	MasterName string   `json:"masterName"`
+	Addrs      []string `json:"addrs"`
+}
+
+type ClusterConfig struct {
+	Addrs []string `json:"addrs"`
+}
+
+// Storage calls are never cancelled
+var ctx = context.Background()
+
+// First segments of keys which transactions write together. They are kept under hash tagged
+// prefix, while hashrates, rejects and the rest spread over the cluster.
+var txKeys = map[string]bool{
+	"miners":   true,
+	"finances": true,
+	"credits":  true,
+	"blocks":   true,
+	"shares":   true,
+	"payments": true,
+	"ledger":   true,
+	"stats":    true,
+	"finders":  true,
+	"spool":    true,
+	"charts":   true,
+	"leader":   true,
 }
 
 type RedisClient struct {
-	client *redis.Client
+	client redis.UniversalClient
 	prefix string
+	// Prefix of txKeys, hash tagged when enabled
+	txPrefix string
+	fence    *fence
 }
 
 type BlockData struct {
@@ -34,6 +76,7 @@ type BlockData struct {
 	UncleHeight    int64    `json:"uncleHeight"`
 	Orphan         bool     `json:"orphan"`
 	Hash           string   `json:"hash"`
+	Finder         string   `json:"finder,omitempty"`
 	Nonce          string   `json:"-"`
 	ENonce1        string   `json:"-"`
 	ENonce2        string   `json:"-"`
@@ -48,6 +91,14 @@ type BlockData struct {
 	immatureKey    string
 }
 
+// Valid share already checked for duplicates, Ms is the time it was accepted
+type ShareData struct {
+	Login string
+	Id    string
+	Diff  int64
+	Ms    int64
+}
+
 type HashRateStatsData struct {
 	SharesCount uint64 `json:"sharesCount"`
 	TotalWorks  uint64 `json:"totalWorks"`
@@ -57,6 +108,15 @@ func (b *BlockData) RewardInSatoshi() int64 {
 	return b.Reward.Int64()
 }
 
+// Block reward plus transaction fees kept by the pool
+func (b *BlockData) RevenueInSatoshi() int64 {
+	revenue := b.Reward.Int64()
+	if b.ExtraReward != nil {
+		revenue += b.ExtraReward.Int64()
+	}
+	return revenue
+}
+
 func (b *BlockData) serializeHash() string {
 	if len(b.Hash) > 0 {
 		return b.Hash
@@ -70,17 +130,7 @@ func (b *BlockData) RoundKey() string {
 }
 
 func (b *BlockData) key() string {
-	return join(
-		b.UncleHeight,
-		b.Orphan,
-		b.Nonce,
-		b.serializeHash(),
-		b.Timestamp,
-		b.Difficulty,
-		b.TotalShares,
-		b.CoinBaseValue,
-		b.BlkTotalFee,
-		b.Reward)
+	return b.record(bigString(b.Reward))
 }
 
 type Miner struct {
@@ -96,30 +146,110 @@ type Worker struct {
 }
 
 func NewRedisClient(cfg *Config, prefix string) *RedisClient {
-	client := redis.NewClient(&redis.Options{
-		Addr:     cfg.Endpoint,
+	var client redis.UniversalClient
+	if opts := failoverOptions(cfg); opts != nil {
+		client = redis.NewFailoverClient(opts)
+	} else if opts := clusterOptions(cfg); opts != nil {
+		client = redis.NewClusterClient(opts)
+	} else {
+		client = redis.NewClient(&redis.Options{
+			Addr:     cfg.Endpoint,
+			Password: cfg.Password,
+			DB:       cfg.Database,
+			PoolSize: cfg.PoolSize,
+		})
+	}
+	txPrefix := prefix
+	if cfg.HashTag || len(cfg.Cluster.Addrs) > 0 {
+		txPrefix = "{" + prefix + "}"
+	}
+	return &RedisClient{client: client, prefix: prefix, txPrefix: txPrefix}
+}
+
+// Options of Sentinel backed client, nil when no Sentinels are set and endpoint is used
+func failoverOptions(cfg *Config) *redis.FailoverOptions {
+	if len(cfg.Sentinel.Addrs) == 0 {
+		return nil
+	}
+	return &redis.FailoverOptions{
+		MasterName:    cfg.Sentinel.MasterName,
+		SentinelAddrs: cfg.Sentinel.Addrs,
+		Password:      cfg.Password,
+		DB:            cfg.Database,
+		PoolSize:      cfg.PoolSize,
+	}
+}
+
+// Options of cluster client, nil when no cluster nodes are set. Cluster has no databases but the first one.
+func clusterOptions(cfg *Config) *redis.ClusterOptions {
+	if len(cfg.Cluster.Addrs) == 0 {
+		return nil
+	}
+	return &redis.ClusterOptions{
+		Addrs:    cfg.Cluster.Addrs,
 		Password: cfg.Password,
-		DB:       cfg.Database,
 		PoolSize: cfg.PoolSize,
-	})
-	return &RedisClient{client: client, prefix: prefix}
+	}
 }
 
-func (r *RedisClient) Client() *redis.Client {
+func (r *RedisClient) Client() redis.UniversalClient {
 	return r.client
 }
 
 func (r *RedisClient) Check() (string, error) {
-	return r.client.Ping().Result()
+	return r.client.Ping(ctx).Result()
 }
 
+// On cluster the master holding balances and payments saves
 func (r *RedisClient) BgSave() (string, error) {
-	return r.client.BgSave().Result()
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		node, err := cluster.MasterForKey(ctx, r.formatKey("finances"))
+		if err != nil {
+			return "", err
+		}
+		return node.BgSave(ctx).Result()
+	}
+	return r.client.BgSave(ctx).Result()
+}
+
+// Keys matching pattern without duplicates, on cluster they are collected from every master
+func (r *RedisClient) scanKeys(match string) ([]string, error) {
+	var mu sync.Mutex
+	seen := make(map[string]struct{})
+	var result []string
+	scan := func(ctx context.Context, client redis.Cmdable) error {
+		var c uint64
+		for {
+			keys, next, err := client.Scan(ctx, c, match, 100).Result()
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			for _, key := range keys {
+				if _, ok := seen[key]; !ok {
+					seen[key] = struct{}{}
+					result = append(result, key)
+				}
+			}
+			mu.Unlock()
+			if next == 0 {
+				return nil
+			}
+			c = next
+		}
+	}
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		err := cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+		return result, err
+	}
+	return result, scan(ctx, r.client)
 }
 
 // Always returns list of addresses. If Redis fails it will return empty list.
 func (r *RedisClient) GetBlacklist() ([]string, error) {
-	cmd := r.client.SMembers(r.formatKey("blacklist"))
+	cmd := r.client.SMembers(ctx, r.formatKey("blacklist"))
 	if cmd.Err() != nil {
 		return []string{}, cmd.Err()
 	}
@@ -128,57 +258,38 @@ func (r *RedisClient) GetBlacklist() ([]string, error) {
 
 // Always returns list of IPs. If Redis fails it will return empty list.
 func (r *RedisClient) GetWhitelist() ([]string, error) {
-	cmd := r.client.SMembers(r.formatKey("whitelist"))
+	cmd := r.client.SMembers(ctx, r.formatKey("whitelist"))
 	if cmd.Err() != nil {
 		return []string{}, cmd.Err()
 	}
 	return cmd.Val(), nil
 }
 
-func (r *RedisClient) WriteNodeState(id string, height uint32, diff *big.Int) error {
-	tx := r.client.Multi()
-	defer tx.Close()
-
+func (r *RedisClient) WriteNodeState(id string, height uint32, diff *big.Int, spooledShares int64) error {
 	now := MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HSet(r.formatKey("nodes"), join(id, "name"), id)
-		tx.HSet(r.formatKey("nodes"), join(id, "height"), strconv.FormatUint(uint64(height), 10))
-		tx.HSet(r.formatKey("nodes"), join(id, "difficulty"), diff.String())
-		tx.HSet(r.formatKey("nodes"), join(id, "lastBeat"), strconv.FormatInt(now, 10))
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HSet(ctx, r.formatKey("nodes"), join(id, "name"), id)
+		tx.HSet(ctx, r.formatKey("nodes"), join(id, "height"), strconv.FormatUint(uint64(height), 10))
+		tx.HSet(ctx, r.formatKey("nodes"), join(id, "difficulty"), diff.String())
+		tx.HSet(ctx, r.formatKey("nodes"), join(id, "lastBeat"), strconv.FormatInt(now, 10))
+		tx.HSet(ctx, r.formatKey("nodes"), join(id, "spooledShares"), strconv.FormatInt(spooledShares, 10))
 		return nil
 	})
 	return err
 }
 
 func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
-	cmd := r.client.HGetAllMap(r.formatKey("nodes"))
+	cmd := r.client.HGetAll(ctx, r.formatKey("nodes"))
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
-	m := make(map[string]map[string]interface{})
-	for key, value := range cmd.Val() {
-		parts := strings.Split(key, ":")
-		if val, ok := m[parts[0]]; ok {
-			val[parts[1]] = value
-		} else {
-			node := make(map[string]interface{})
-			node[parts[1]] = value
-			m[parts[0]] = node
-		}
-	}
-	v := make([]map[string]interface{}, len(m), len(m))
-	i := 0
-	for _, value := range m {
-		v[i] = value
-		i++
-	}
-	return v, nil
+	return convertNodeStates(cmd.Val()), nil
 }
 
 func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error) {
-	r.client.ZRemRangeByScore(r.formatKey("pow"), "-inf", fmt.Sprint("(", height-3))
-	val, err := r.client.ZAdd(r.formatKey("pow"), redis.Z{Score: float64(height), Member: strings.Join(params, ":")}).Result()
+	r.client.ZRemRangeByScore(ctx, r.formatKey("pow"), "-inf", fmt.Sprint("(", height-3))
+	val, err := r.client.ZAdd(ctx, r.formatKey("pow"), redis.Z{Score: float64(height), Member: strings.Join(params, ":")}).Result()
 	return val == 0, err
 }
 
@@ -191,38 +302,91 @@ func (r *RedisClient) WriteShare(login, id string, params []string, diff int64,
 		return true, nil
 	}
 
-	tx := r.client.Multi()
-	defer tx.Close()
-
-	_, err = tx.Exec(func() error {
-		ms := MakeTimestamp()
-		ts := ms / 1000
+	ms := MakeTimestamp()
+	ts := ms / 1000
 
-		r.writeShare(tx, ms, ts, login, id, diff, window)
-		tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
+	err = r.writeHashrate(window, &ShareData{Login: login, Id: id, Diff: diff, Ms: ms})
+	if err != nil {
+		return false, err
+	}
+	_, err = r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		r.writeShare(tx, ts, login, diff)
+		tx.HIncrBy(ctx, r.formatKey("stats"), "roundShares", diff)
 		return nil
 	})
 	return false, err
 }
 
-func (r *RedisClient) WriteInvalidShare(ms, ts int64, login, id string, diff int64) error {
-	cmd := r.client.ZAdd(r.formatKey("invalidhashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
-	if cmd.Err() != nil {
-		return cmd.Err()
+// Writes a batch of shares in one transaction, shares must be checked for duplicates by caller
+func (r *RedisClient) WriteShares(shares []*ShareData, window time.Duration) error {
+	err := r.writeHashrate(window, shares...)
+	if err != nil {
+		return err
 	}
-	return nil
+	_, err = r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		for _, share := range shares {
+			r.writeShare(tx, share.Ms/1000, share.Login, share.Diff)
+			tx.HIncrBy(ctx, r.formatKey("stats"), "roundShares", share.Diff)
+		}
+		return nil
+	})
+	return err
 }
 
-func (r *RedisClient) WriteRejectShare(ms, ts int64, login, id string, diff int64) error {
-	cmd := r.client.ZAdd(r.formatKey("rejecthashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
-	if cmd.Err() != nil {
-		return cmd.Err()
+// Returns offset up to which spool segment of the node was replayed
+func (r *RedisClient) GetSpoolOffset(node, segment string) (int64, error) {
+	cmd := r.client.HGet(ctx, r.formatKey("spool", node), segment)
+	if cmd.Err() == redis.Nil {
+		return 0, nil
+	} else if cmd.Err() != nil {
+		return 0, cmd.Err()
 	}
-	return nil
+	return cmd.Int64()
+}
+
+// Writes replayed shares along with segment offset after them in one transaction,
+// so every spooled share is written exactly once
+func (r *RedisClient) WriteSpooledShares(node, segment string, offset int64, shares []*ShareData, window time.Duration) error {
+	err := r.writeHashrate(window, shares...)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		for _, share := range shares {
+			r.writeShare(tx, share.Ms/1000, share.Login, share.Diff)
+			tx.HIncrBy(ctx, r.formatKey("stats"), "roundShares", share.Diff)
+		}
+		tx.HSet(ctx, r.formatKey("spool", node), segment, strconv.FormatInt(offset, 10))
+		return nil
+	})
+	return err
+}
+
+// Forgets offset of spool segment once it is removed from disk
+func (r *RedisClient) DeleteSpoolOffset(node, segment string) error {
+	return r.client.HDel(ctx, r.formatKey("spool", node), segment).Err()
+}
+
+func (r *RedisClient) WriteInvalidShare(ms, ts int64, login, id string, diff int64, reason string) error {
+	return r.writeRejectedShare("invalidhashrate", ms, ts, login, id, diff, reason)
+}
+
+func (r *RedisClient) WriteRejectShare(ms, ts int64, login, id string, diff int64, reason string) error {
+	return r.writeRejectedShare("rejecthashrate", ms, ts, login, id, diff, reason)
+}
+
+// Rejects are statistics only, so they are written by a pipeline and may land on different cluster slots
+func (r *RedisClient) writeRejectedShare(key string, ms, ts int64, login, id string, diff int64, reason string) error {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, r.formatKey(key), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
+		pipe.HIncrBy(ctx, r.formatKey("rejects", login), join(id, reason), 1)
+		return nil
+	})
+	return err
 }
 
 func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64,
-	coinBaseValue int64, blkTotalFee int64, window time.Duration) (bool, error) {
+	blockHash string, coinBaseValue int64, blkTotalFee int64, window time.Duration) (bool, error) {
 	exist, err := r.checkPoWExist(height, params)
 	if err != nil {
 		return false, err
@@ -230,50 +394,74 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundD
 	if exist {
 		return true, nil
 	}
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	ms := MakeTimestamp()
 	ts := ms / 1000
 
-	cmds, err := tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, window)
-		tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
-		tx.HDel(r.formatKey("stats"), "roundShares")
-		tx.ZIncrBy(r.formatKey("finders"), 1, login)
-		tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
-		tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), params[0]))
-		tx.HGetAllMap(r.formatRound(int64(height), params[0]))
+	err = r.writeHashrate(window, &ShareData{Login: login, Id: id, Diff: diff, Ms: ms})
+	if err != nil {
+		return false, err
+	}
+	cmds, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		r.writeShare(tx, ts, login, diff)
+		tx.HSet(ctx, r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
+		tx.HDel(ctx, r.formatKey("stats"), "roundShares")
+		tx.ZIncrBy(ctx, r.formatKey("finders"), 1, login)
+		tx.HIncrBy(ctx, r.formatKey("miners", login), "blocksFound", 1)
+		tx.Rename(ctx, r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), params[0]))
+		tx.HGetAll(ctx, r.formatRound(int64(height), params[0]))
 		return nil
 	})
 	if err != nil {
 		return false, err
 	} else {
-		sharesMap, _ := cmds[10].(*redis.StringStringMapCmd).Result()
+		sharesMap, _ := cmds[7].(*redis.MapStringStringCmd).Result()
 		totalShares := int64(0)
 		for _, v := range sharesMap {
 			n, _ := strconv.ParseInt(v, 10, 64)
 			totalShares += n
 		}
-		hashHex := strings.Join(params, ":")
-		s := join(hashHex, ts, roundDiff, totalShares, coinBaseValue, blkTotalFee)
-		cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
+		s := candidateRecord(login, params, ts, roundDiff, totalShares, coinBaseValue, blkTotalFee, blockHash)
+		cmd := r.client.ZAdd(ctx, r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
 		return false, cmd.Err()
 	}
 }
 
-func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
-	tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
-	tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
-	tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
-	tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
-	tx.HSet(r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
+// Round shares of login, written by transaction along with the rest of round state
+func (r *RedisClient) writeShare(tx redis.Pipeliner, ts int64, login string, diff int64) {
+	tx.HIncrBy(ctx, r.formatKey("shares", "roundCurrent"), login, diff)
+	tx.HSet(ctx, r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
+}
+
+// Hashrate entries of shares spread over cluster slots by login, so they are written by a pipeline
+// ahead of the round. Entry of a share is unique, so writing it again on retry changes nothing.
+func (r *RedisClient) writeHashrate(expire time.Duration, shares ...*ShareData) error {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, share := range shares {
+			ts := share.Ms / 1000
+			pipe.ZAdd(ctx, r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(share.Diff, share.Login, share.Id, share.Ms)})
+			pipe.ZAdd(ctx, r.formatKey("hashrate", share.Login), redis.Z{Score: float64(ts), Member: join(share.Diff, share.Id, share.Ms)})
+			pipe.Expire(ctx, r.formatKey("hashrate", share.Login), expire) // Will delete hashrates for miners that gone
+		}
+		return nil
+	})
+	return err
 }
 
 func (r *RedisClient) formatKey(args ...interface{}) string {
+	if group, ok := args[0].(string); ok && txKeys[strings.SplitN(group, ":", 2)[0]] {
+		return join(r.txPrefix, join(args...))
+	}
 	return join(r.prefix, join(args...))
 }
 
+// Key name relative to prefix
+func (r *RedisClient) keyName(key string) string {
+	if strings.HasPrefix(key, r.txPrefix+":") {
+		return strings.TrimPrefix(key, r.txPrefix+":")
+	}
+	return strings.TrimPrefix(key, r.prefix+":")
+}
+
 func (r *RedisClient) formatRound(height int64, nonce string) string {
 	return r.formatKey("shares", "round"+strconv.FormatInt(height, 10), nonce)
 }
@@ -311,26 +499,26 @@ func join(args ...interface{}) string {
 }
 
 func (r *RedisClient) GetCandidates(maxHeight int64) ([]*BlockData, error) {
-	option := redis.ZRangeByScore{Min: "0", Max: strconv.FormatInt(maxHeight, 10)}
-	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("blocks", "candidates"), option)
+	option := &redis.ZRangeBy{Min: "0", Max: strconv.FormatInt(maxHeight, 10)}
+	cmd := r.client.ZRangeByScoreWithScores(ctx, r.formatKey("blocks", "candidates"), option)
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
-	return convertCandidateResults(cmd), nil
+	return convertCandidateResults(cmd.Val()), nil
 }
 
 func (r *RedisClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
-	option := redis.ZRangeByScore{Min: "0", Max: strconv.FormatInt(maxHeight, 10)}
-	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("blocks", "immature"), option)
+	option := &redis.ZRangeBy{Min: "0", Max: strconv.FormatInt(maxHeight, 10)}
+	cmd := r.client.ZRangeByScoreWithScores(ctx, r.formatKey("blocks", "immature"), option)
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
-	return convertBlockResults(cmd), nil
+	return convertBlockResults(cmd.Val()), nil
 }
 
 func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
 	result := make(map[string]int64)
-	cmd := r.client.HGetAllMap(r.formatRound(height, nonce))
+	cmd := r.client.HGetAll(ctx, r.formatRound(height, nonce))
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
@@ -345,22 +533,14 @@ func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int
 func (r *RedisClient) GetPayees() ([]string, error) {
 	payees := make(map[string]struct{})
 	var result []string
-	var c int64
 
-	for {
-		var keys []string
-		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("miners", "*"), 100).Result()
-		if err != nil {
-			return nil, err
-		}
-		for _, row := range keys {
-			login := strings.Split(row, ":")[2]
-			payees[login] = struct{}{}
-		}
-		if c == 0 {
-			break
-		}
+	keys, err := r.scanKeys(r.formatKey("miners", "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range keys {
+		login := strings.Split(row, ":")[2]
+		payees[login] = struct{}{}
 	}
 	for login, _ := range payees {
 		result = append(result, login)
@@ -369,7 +549,7 @@ func (r *RedisClient) GetPayees() ([]string, error) {
 }
 
 func (r *RedisClient) GetBalance(login string) (int64, error) {
-	cmd := r.client.HGet(r.formatKey("miners", login), "balance")
+	cmd := r.client.HGet(ctx, r.formatKey("miners", login), "balance")
 	if cmd.Err() == redis.Nil {
 		return 0, nil
 	} else if cmd.Err() != nil {
@@ -378,10 +558,90 @@ func (r *RedisClient) GetBalance(login string) (int64, error) {
 	return cmd.Int64()
 }
 
+var ErrStaleSettings = errors.New("miner settings are updated by a later request")
+
+type MinerSettings struct {
+	Threshold     int64  `json:"threshold"`
+	Email         string `json:"email"`
+	PayoutAddress string `json:"payoutAddress"`
+	UpdatedAt     int64  `json:"updatedAt"`
+}
+
+func (r *RedisClient) GetMinerSettings(login string) (*MinerSettings, error) {
+	cmd := r.client.HMGet(ctx, r.formatKey("miners", login), "payoutThreshold", "email", "payoutAddress", "settingsUpdatedAt")
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	settings := &MinerSettings{}
+	values := cmd.Val()
+	if v, ok := values[0].(string); ok {
+		settings.Threshold, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := values[1].(string); ok {
+		settings.Email = v
+	}
+	if v, ok := values[2].(string); ok {
+		settings.PayoutAddress = v
+	}
+	if v, ok := values[3].(string); ok {
+		settings.UpdatedAt, _ = strconv.ParseInt(v, 10, 64)
+	}
+	return settings, nil
+}
+
+// Overwrites miner settings unless they were updated by a later request, empty values reset setting
+// to pool defaults
+func (r *RedisClient) WriteMinerSettings(login string, settings *MinerSettings) error {
+	key := r.formatKey("miners", login)
+	return r.client.Watch(ctx, func(tx *redis.Tx) error {
+		updatedAt, err := tx.HGet(ctx, key, "settingsUpdatedAt").Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if settings.UpdatedAt <= updatedAt {
+			return ErrStaleSettings
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if settings.Threshold > 0 {
+				pipe.HSet(ctx, key, "payoutThreshold", strconv.FormatInt(settings.Threshold, 10))
+			} else {
+				pipe.HDel(ctx, key, "payoutThreshold")
+			}
+			if len(settings.Email) > 0 {
+				pipe.HSet(ctx, key, "email", settings.Email)
+			} else {
+				pipe.HDel(ctx, key, "email")
+			}
+			if len(settings.PayoutAddress) > 0 {
+				pipe.HSet(ctx, key, "payoutAddress", settings.PayoutAddress)
+			} else {
+				pipe.HDel(ctx, key, "payoutAddress")
+			}
+			pipe.HSet(ctx, key, "settingsUpdatedAt", strconv.FormatInt(settings.UpdatedAt, 10))
+			return nil
+		})
+		return err
+	}, key)
+}
+
 func (r *RedisClient) LockPayouts(login string, amount int64) error {
 	key := r.formatKey("payments", "lock")
-	result := r.client.SetNX(key, join(login, amount), 0).Val()
-	if !result {
+	var locked bool
+	err := r.watch(func(tx redis.Cmdable) error {
+		cmds, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetNX(ctx, key, join(login, amount), 0)
+			return nil
+		})
+		if err == nil {
+			locked = cmds[0].(*redis.BoolCmd).Val()
+		}
+		return err
+	})
+	if err != nil {
+		return r.fencedErr(err)
+	}
+	if !locked {
 		return fmt.Errorf("Unable to acquire lock '%s'", key)
 	}
 	return nil
@@ -389,12 +649,12 @@ func (r *RedisClient) LockPayouts(login string, amount int64) error {
 
 func (r *RedisClient) UnlockPayouts() error {
 	key := r.formatKey("payments", "lock")
-	_, err := r.client.Del(key).Result()
+	_, err := r.client.Del(ctx, key).Result()
 	return err
 }
 
 func (r *RedisClient) IsPayoutsLocked() (bool, error) {
-	_, err := r.client.Get(r.formatKey("payments", "lock")).Result()
+	_, err := r.client.Get(ctx, r.formatKey("payments", "lock")).Result()
 	if err == redis.Nil {
 		return false, nil
 	} else if err != nil {
@@ -411,7 +671,7 @@ type PendingPayment struct {
 }
 
 func (r *RedisClient) GetPendingPayments() []*PendingPayment {
-	raw := r.client.ZRevRangeWithScores(r.formatKey("payments", "pending"), 0, -1)
+	raw := r.client.ZRevRangeWithScores(ctx, r.formatKey("payments", "pending"), 0, -1)
 	var result []*PendingPayment
 	for _, v := range raw.Val() {
 		// timestamp -> "address:amount"
@@ -427,201 +687,253 @@ func (r *RedisClient) GetPendingPayments() []*PendingPayment {
 
 // Deduct miner's balance for payment
 func (r *RedisClient) UpdateBalance(login string, amount int64) error {
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	ts := MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
-		tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "pending", amount)
-		tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
-		return nil
+	err := r.watch(func(tx redis.Cmdable) error {
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HIncrBy(ctx, r.formatKey("miners", login), "balance", (amount * -1))
+			pipe.HIncrBy(ctx, r.formatKey("miners", login), "pending", amount)
+			pipe.HIncrBy(ctx, r.formatKey("finances"), "balance", (amount * -1))
+			pipe.HIncrBy(ctx, r.formatKey("finances"), "pending", amount)
+			pipe.ZAdd(ctx, r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
+			r.writeLedger(pipe, MakeTimestamp(), LedgerEntry{Kind: LedgerPayout, Debit: MinerAccount(login, "balance"),
+				Credit: MinerAccount(login, "pending"), Amount: amount, Ref: join("pending", ts)})
+			return nil
+		})
+		return err
 	})
-	return err
+	return r.fencedErr(err)
 }
 
 func (r *RedisClient) RollbackBalance(login string, amount int64) error {
-	tx := r.client.Multi()
-	defer tx.Close()
-
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "balance", amount)
-		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+	ms := MakeTimestamp()
+
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HIncrBy(ctx, r.formatKey("miners", login), "balance", amount)
+		tx.HIncrBy(ctx, r.formatKey("miners", login), "pending", (amount * -1))
+		tx.HIncrBy(ctx, r.formatKey("finances"), "balance", amount)
+		tx.HIncrBy(ctx, r.formatKey("finances"), "pending", (amount * -1))
+		tx.ZRem(ctx, r.formatKey("payments", "pending"), join(login, amount))
+		r.writeLedger(tx, ms, LedgerEntry{Kind: LedgerRollback, Debit: MinerAccount(login, "pending"),
+			Credit: MinerAccount(login, "balance"), Amount: amount, Ref: join("rollback", ms/1000)})
 		return nil
 	})
 	return err
 }
 
 func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	ts := MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
-		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "paid", amount)
-		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
-		tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
-		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
-		tx.Del(r.formatKey("payments", "lock"))
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HIncrBy(ctx, r.formatKey("miners", login), "pending", (amount * -1))
+		tx.HIncrBy(ctx, r.formatKey("miners", login), "paid", amount)
+		tx.HIncrBy(ctx, r.formatKey("finances"), "pending", (amount * -1))
+		tx.HIncrBy(ctx, r.formatKey("finances"), "paid", amount)
+		tx.ZAdd(ctx, r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: paymentMember(txHash, login, amount)})
+		tx.ZAdd(ctx, r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: paymentMember(txHash, "", amount)})
+		tx.ZRem(ctx, r.formatKey("payments", "pending"), join(login, amount))
+		tx.Del(ctx, r.formatKey("payments", "lock"))
+		r.writeLedger(tx, MakeTimestamp(), LedgerEntry{Kind: LedgerPaid, Debit: MinerAccount(login, "pending"),
+			Credit: MinerAccount(login, "paid"), Amount: amount, Ref: txHash})
 		return nil
 	})
 	return err
 }
 
 func (r *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
-	tx := r.client.Multi()
-	defer tx.Close()
-
-	_, err := tx.Exec(func() error {
-		r.writeImmatureBlock(tx, block)
-		total := int64(0)
-		for login, amount := range roundRewards {
-			total += amount
-			tx.HIncrBy(r.formatKey("miners", login), "immature", amount)
-			tx.HSetNX(r.formatKey("credits", "immature", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
-		}
-		tx.HIncrBy(r.formatKey("finances"), "immature", total)
-		return nil
+	ms := MakeTimestamp()
+	ref := join(block.Height, block.Hash)
+
+	err := r.watch(func(tx redis.Cmdable) error {
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.writeImmatureBlock(pipe, block)
+			total := int64(0)
+			for login, amount := range roundRewards {
+				total += amount
+				pipe.HIncrBy(ctx, r.formatKey("miners", login), "immature", amount)
+				pipe.HSetNX(ctx, r.formatKey("credits", "immature", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+				r.writeLedger(pipe, ms, LedgerEntry{Kind: LedgerImmature, Debit: AccountPoolImmature,
+					Credit: MinerAccount(login, "immature"), Amount: amount, Ref: ref})
+			}
+			pipe.HIncrBy(ctx, r.formatKey("finances"), "immature", total)
+			return nil
+		})
+		return err
 	})
-	return err
+	return r.fencedErr(err)
 }
 
-func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64) error {
+func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64, residual int64) error {
 	creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
-	tx, err := r.client.Watch(creditKey)
-	// Must decrement immatures using existing log entry
-	immatureCredits := tx.HGetAllMap(creditKey)
-	if err != nil {
-		return err
-	}
-	defer tx.Close()
+	err := r.watch(func(tx redis.Cmdable) error {
+		// Must decrement immatures using existing log entry
+		immatureCredits := tx.HGetAll(ctx, creditKey)
+		if immatureCredits.Err() != nil {
+			return immatureCredits.Err()
+		}
 
-	ts := MakeTimestamp() / 1000
-	value := join(block.Hash, ts, block.Reward)
-
-	_, err = tx.Exec(func() error {
-		r.writeMaturedBlock(tx, block)
-		tx.ZAdd(r.formatKey("credits", "all"), redis.Z{Score: float64(block.Height), Member: value})
-
-		// Decrement immature balances
-		totalImmature := int64(0)
-		for login, amountString := range immatureCredits.Val() {
-			amount, _ := strconv.ParseInt(amountString, 10, 64)
-			totalImmature += amount
-			tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
-		}
-
-		// Increment balances
-		total := int64(0)
-		for login, amount := range roundRewards {
-			total += amount
-			// NOTICE: Maybe expire round reward entry in 604800 (a week)?
-			tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
-			tx.HSetNX(r.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
-		}
-		tx.Del(creditKey)
-		tx.HIncrBy(r.formatKey("finances"), "balance", total)
-		tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
-		tx.HSet(r.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
-		tx.HSet(r.formatKey("finances"), "lastCreditHash", block.Hash)
-		tx.HIncrBy(r.formatKey("finances"), "totalMined", block.RewardInSatoshi())
-		return nil
-	})
-	return err
+		ms := MakeTimestamp()
+		ts := ms / 1000
+		value := join(block.Hash, ts, block.Reward)
+		ref := join(block.Height, block.Hash)
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.writeMaturedBlock(pipe, block)
+			pipe.ZAdd(ctx, r.formatKey("credits", "all"), redis.Z{Score: float64(block.Height), Member: value})
+
+			// Decrement immature balances
+			totalImmature := int64(0)
+			for login, amountString := range immatureCredits.Val() {
+				amount, _ := strconv.ParseInt(amountString, 10, 64)
+				totalImmature += amount
+				pipe.HIncrBy(ctx, r.formatKey("miners", login), "immature", (amount * -1))
+				r.writeLedger(pipe, ms, LedgerEntry{Kind: LedgerImmatureReversal, Debit: MinerAccount(login, "immature"),
+					Credit: AccountPoolImmature, Amount: amount, Ref: ref})
+			}
+
+			// Increment balances
+			total := int64(0)
+			for login, amount := range roundRewards {
+				total += amount
+				// NOTICE: Maybe expire round reward entry in 604800 (a week)?
+				pipe.HIncrBy(ctx, r.formatKey("miners", login), "balance", amount)
+				pipe.HSetNX(ctx, r.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+				r.writeLedger(pipe, ms, LedgerEntry{Kind: LedgerCredit, Debit: AccountPoolMined,
+					Credit: MinerAccount(login, "balance"), Amount: amount, Ref: ref})
+			}
+			// Whatever was mined and not credited to miners is kept by the pool
+			r.writeLedger(pipe, ms, LedgerEntry{Kind: LedgerFee, Debit: AccountPoolMined,
+				Credit: AccountPoolFee, Amount: block.RevenueInSatoshi() - total, Ref: ref})
+			pipe.Del(ctx, creditKey)
+			pipe.HIncrBy(ctx, r.formatKey("finances"), "balance", total)
+			pipe.HIncrBy(ctx, r.formatKey("finances"), "immature", (totalImmature * -1))
+			pipe.HSet(ctx, r.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
+			pipe.HSet(ctx, r.formatKey("finances"), "lastCreditHash", block.Hash)
+			pipe.HIncrBy(ctx, r.formatKey("finances"), "totalMined", block.RewardInSatoshi())
+			// Rounding dust kept by the pool, so that credits plus fees always add up to totalMined
+			if residual != 0 {
+				pipe.HIncrBy(ctx, r.formatKey("finances"), "residual", residual)
+			}
+			return nil
+		})
+		return err
+	}, creditKey)
+	return r.fencedErr(err)
 }
 
 func (r *RedisClient) WriteOrphan(block *BlockData) error {
 	creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
-	tx, err := r.client.Watch(creditKey)
-	// Must decrement immatures using existing log entry
-	immatureCredits := tx.HGetAllMap(creditKey)
-	if err != nil {
-		return err
-	}
-	defer tx.Close()
-
-	_, err = tx.Exec(func() error {
-		r.writeMaturedBlock(tx, block)
-
-		// Decrement immature balances
-		totalImmature := int64(0)
-		for login, amountString := range immatureCredits.Val() {
-			amount, _ := strconv.ParseInt(amountString, 10, 64)
-			totalImmature += amount
-			tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
+	err := r.watch(func(tx redis.Cmdable) error {
+		// Must decrement immatures using existing log entry
+		immatureCredits := tx.HGetAll(ctx, creditKey)
+		if immatureCredits.Err() != nil {
+			return immatureCredits.Err()
 		}
-		tx.Del(creditKey)
-		tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
-		return nil
-	})
-	return err
+
+		ms := MakeTimestamp()
+		ref := join(block.Height, block.Hash)
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.writeMaturedBlock(pipe, block)
+
+			// Decrement immature balances
+			totalImmature := int64(0)
+			for login, amountString := range immatureCredits.Val() {
+				amount, _ := strconv.ParseInt(amountString, 10, 64)
+				totalImmature += amount
+				pipe.HIncrBy(ctx, r.formatKey("miners", login), "immature", (amount * -1))
+				r.writeLedger(pipe, ms, LedgerEntry{Kind: LedgerImmatureReversal, Debit: MinerAccount(login, "immature"),
+					Credit: AccountPoolImmature, Amount: amount, Ref: ref})
+			}
+			pipe.Del(ctx, creditKey)
+			pipe.HIncrBy(ctx, r.formatKey("finances"), "immature", (totalImmature * -1))
+			return nil
+		})
+		return err
+	}, creditKey)
+	return r.fencedErr(err)
 }
 
 func (r *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
-	tx := r.client.Multi()
-	defer tx.Close()
-
-	_, err := tx.Exec(func() error {
-		for _, block := range blocks {
-			r.writeImmatureBlock(tx, block)
-		}
-		return nil
+	err := r.watch(func(tx redis.Cmdable) error {
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, block := range blocks {
+				r.writeImmatureBlock(pipe, block)
+			}
+			return nil
+		})
+		return err
 	})
-	return err
+	return r.fencedErr(err)
 }
 
-func (r *RedisClient) writeImmatureBlock(tx *redis.Multi, block *BlockData) {
+func (r *RedisClient) writeImmatureBlock(tx redis.Pipeliner, block *BlockData) {
 	// Redis 2.8.x returns "ERR source and destination objects are the same"
 	if block.Height != block.RoundHeight {
-		tx.Rename(r.formatRound(block.RoundHeight, block.Nonce), r.formatRound(block.Height, block.Nonce))
+		tx.Rename(ctx, r.formatRound(block.RoundHeight, block.Nonce), r.formatRound(block.Height, block.Nonce))
+	}
+	tx.ZRem(ctx, r.formatKey("blocks", "candidates"), block.candidateKey)
+	tx.ZAdd(ctx, r.formatKey("blocks", "immature"), redis.Z{Score: float64(block.Height), Member: block.key()})
+}
+
+func (r *RedisClient) writeMaturedBlock(tx redis.Pipeliner, block *BlockData) {
+	tx.Del(ctx, r.formatRound(block.RoundHeight, block.Nonce))
+	tx.ZRem(ctx, r.formatKey("blocks", "immature"), block.immatureKey)
+	tx.ZAdd(ctx, r.formatKey("blocks", "matured"), redis.Z{Score: float64(block.Height), Member: block.key()})
+}
+
+// Matured and orphaned blocks, newest first
+func (r *RedisClient) GetMaturedBlocks(start, stop int64) ([]*BlockData, error) {
+	cmd := r.client.ZRevRangeWithScores(ctx, r.formatKey("blocks", "matured"), start, stop)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
 	}
-	tx.ZRem(r.formatKey("blocks", "candidates"), block.candidateKey)
-	tx.ZAdd(r.formatKey("blocks", "immature"), redis.Z{Score: float64(block.Height), Member: block.key()})
+	return convertBlockResults(cmd.Val()), nil
 }
 
-func (r *RedisClient) writeMaturedBlock(tx *redis.Multi, block *BlockData) {
-	tx.Del(r.formatRound(block.RoundHeight, block.Nonce))
-	tx.ZRem(r.formatKey("blocks", "immature"), block.immatureKey)
-	tx.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: float64(block.Height), Member: block.key()})
+// Rewards credited to miners for matured block
+func (r *RedisClient) GetRoundCredits(height int64, hash string) (map[string]int64, error) {
+	cmd := r.client.HGetAll(ctx, r.formatKey("credits", height, hash))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertCredits(cmd.Val()), nil
+}
+
+// Payments of all miners, newest first
+func (r *RedisClient) GetPayments(start, stop int64) ([]map[string]interface{}, error) {
+	cmd := r.client.ZRevRangeWithScores(ctx, r.formatKey("payments", "all"), start, stop)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertPaymentsResults(cmd.Val()), nil
 }
 
 func (r *RedisClient) IsMinerExists(login string) (bool, error) {
-	return r.client.Exists(r.formatKey("miners", login)).Result()
+	n, err := r.client.Exists(ctx, r.formatKey("miners", login)).Result()
+	return n > 0, err
 }
 
-func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error) {
+// Payments of login are paged with GetPaymentsPage
+func (r *RedisClient) GetMinerStats(login string) (map[string]interface{}, error) {
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
-	defer tx.Close()
-
-	cmds, err := tx.Exec(func() error {
-		tx.HGetAllMap(r.formatKey("miners", login))
-		tx.ZRevRangeWithScores(r.formatKey("payments", login), 0, maxPayments-1)
-		tx.ZCard(r.formatKey("payments", login))
-		tx.HGet(r.formatKey("shares", "roundCurrent"), login)
+	cmds, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HGetAll(ctx, r.formatKey("miners", login))
+		tx.ZCard(ctx, r.formatKey("payments", login))
+		tx.HGet(ctx, r.formatKey("shares", "roundCurrent"), login)
 		return nil
 	})
 
 	if err != nil && err != redis.Nil {
 		return nil, err
 	} else {
-		result, _ := cmds[0].(*redis.StringStringMapCmd).Result()
+		result, _ := cmds[0].(*redis.MapStringStringCmd).Result()
+		// Contact details are private
+		delete(result, "email")
 		stats["stats"] = convertStringMap(result)
-		payments := convertPaymentsResults(cmds[1].(*redis.ZSliceCmd))
-		stats["payments"] = payments
-		stats["paymentsTotal"] = cmds[2].(*redis.IntCmd).Val()
-		roundShares, _ := cmds[3].(*redis.StringCmd).Int64()
+		stats["paymentsTotal"] = cmds[1].(*redis.IntCmd).Val()
+		roundShares, _ := cmds[2].(*redis.StringCmd).Int64()
 		stats["roundShares"] = roundShares
 	}
 
@@ -645,47 +957,39 @@ func convertStringMap(m map[string]string) map[string]interface{} {
 func (r *RedisClient) FlushStaleStats(window, largeWindow time.Duration) (int64, error) {
 	now := MakeTimestamp() / 1000
 	max := fmt.Sprint("(", now-int64(window/time.Second))
-	total, err := r.client.ZRemRangeByScore(r.formatKey("hashrate"), "-inf", max).Result()
+	total, err := r.client.ZRemRangeByScore(ctx, r.formatKey("hashrate"), "-inf", max).Result()
 	if err != nil {
 		return total, err
 	}
 
-	n, err := r.client.ZRemRangeByScore(r.formatKey("invalidhashrate"), "-inf", max).Result()
+	n, err := r.client.ZRemRangeByScore(ctx, r.formatKey("invalidhashrate"), "-inf", max).Result()
 	if err != nil {
 		return total, err
 	}
 	total += n
 
-	n, err = r.client.ZRemRangeByScore(r.formatKey("rejecthashrate"), "-inf", max).Result()
+	n, err = r.client.ZRemRangeByScore(ctx, r.formatKey("rejecthashrate"), "-inf", max).Result()
 	if err != nil {
 		return total, err
 	}
 	total += n
 
-	var c int64
 	miners := make(map[string]struct{})
 	max = fmt.Sprint("(", now-int64(largeWindow/time.Second))
 
-	for {
-		var keys []string
-		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("hashrate", "*"), 100).Result()
-		if err != nil {
-			return total, err
-		}
-		for _, row := range keys {
-			login := strings.Split(row, ":")[2]
-			if _, ok := miners[login]; !ok {
-				n, err := r.client.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", max).Result()
-				if err != nil {
-					return total, err
-				}
-				miners[login] = struct{}{}
-				total += n
+	keys, err := r.scanKeys(r.formatKey("hashrate", "*"))
+	if err != nil {
+		return total, err
+	}
+	for _, row := range keys {
+		login := strings.Split(row, ":")[2]
+		if _, ok := miners[login]; !ok {
+			n, err := r.client.ZRemRangeByScore(ctx, r.formatKey("hashrate", login), "-inf", max).Result()
+			if err != nil {
+				return total, err
 			}
-		}
-		if c == 0 {
-			break
+			miners[login] = struct{}{}
+			total += n
 		}
 	}
 
@@ -696,23 +1000,21 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 	window := int64(smallWindow / time.Second)
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	now := MakeTimestamp() / 1000
 
-	cmds, err := tx.Exec(func() error {
-		tx.ZRemRangeByScore(r.formatKey("hashrate"), "-inf", fmt.Sprint("(", now-window))
-		tx.ZRangeWithScores(r.formatKey("hashrate"), 0, -1)
-		tx.HGetAllMap(r.formatKey("stats"))
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "candidates"), 0, -1)
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "immature"), 0, -1)
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "matured"), 0, maxBlocks-1)
-		tx.ZCard(r.formatKey("blocks", "candidates"))
-		tx.ZCard(r.formatKey("blocks", "immature"))
-		tx.ZCard(r.formatKey("blocks", "matured"))
-		tx.ZCard(r.formatKey("payments", "all"))
-		tx.ZRevRangeWithScores(r.formatKey("payments", "all"), 0, maxPayments-1)
+	// Pool hashrate and blocks are on different cluster slots, so they are read by a pipeline
+	cmds, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, r.formatKey("hashrate"), "-inf", fmt.Sprint("(", now-window))
+		pipe.ZRangeWithScores(ctx, r.formatKey("hashrate"), 0, -1)
+		pipe.HGetAll(ctx, r.formatKey("stats"))
+		pipe.ZRevRangeWithScores(ctx, r.formatKey("blocks", "candidates"), 0, -1)
+		pipe.ZRevRangeWithScores(ctx, r.formatKey("blocks", "immature"), 0, -1)
+		pipe.ZRevRangeWithScores(ctx, r.formatKey("blocks", "matured"), 0, maxBlocks-1)
+		pipe.ZCard(ctx, r.formatKey("blocks", "candidates"))
+		pipe.ZCard(ctx, r.formatKey("blocks", "immature"))
+		pipe.ZCard(ctx, r.formatKey("blocks", "matured"))
+		pipe.ZCard(ctx, r.formatKey("payments", "all"))
+		pipe.ZRevRangeWithScores(ctx, r.formatKey("payments", "all"), 0, maxPayments-1)
 		return nil
 	})
 
@@ -720,25 +1022,25 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 		return nil, err
 	}
 
-	result, _ := cmds[2].(*redis.StringStringMapCmd).Result()
+	result, _ := cmds[2].(*redis.MapStringStringCmd).Result()
 	stats["stats"] = convertStringMap(result)
-	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd))
+	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd).Val())
 	stats["candidates"] = candidates
 	stats["candidatesTotal"] = cmds[6].(*redis.IntCmd).Val()
 
-	immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd))
+	immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd).Val())
 	stats["immature"] = immature
 	stats["immatureTotal"] = cmds[7].(*redis.IntCmd).Val()
 
-	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd))
+	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd).Val())
 	stats["matured"] = matured
 	stats["maturedTotal"] = cmds[8].(*redis.IntCmd).Val()
 
-	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd))
+	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd).Val())
 	stats["payments"] = payments
 	stats["paymentsTotal"] = cmds[9].(*redis.IntCmd).Val()
 
-	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd))
+	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd).Val())
 	stats["miners"] = miners
 	stats["minersTotal"] = len(miners)
 	stats["hashrate"] = totalHashrate
@@ -748,16 +1050,13 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error) {
 	smallWindow := int64(sWindow / time.Second)
 	largeWindow := int64(lWindow / time.Second)
-	stats := make(map[string]interface{})
-
-	tx := r.client.Multi()
-	defer tx.Close()
 
 	now := MakeTimestamp() / 1000
 
-	cmds, err := tx.Exec(func() error {
-		tx.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
-		tx.ZRangeWithScores(r.formatKey("hashrate", login), 0, -1)
+	cmds, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, r.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
+		pipe.ZRangeWithScores(ctx, r.formatKey("hashrate", login), 0, -1)
+		pipe.HGetAll(ctx, r.formatKey("rejects", login))
 		return nil
 	})
 
@@ -765,67 +1064,31 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 		return nil, err
 	}
 
-	totalHashrate := int64(0)
-	currentHashrate := int64(0)
-	online := int64(0)
-	offline := int64(0)
-	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
-
-	for id, worker := range workers {
-		timeOnline := now - worker.startedAt
-		if timeOnline < 600 {
-			timeOnline = 600
-		}
-
-		boundary := timeOnline
-		if timeOnline >= smallWindow {
-			boundary = smallWindow
-		}
-		worker.HR = worker.HR / boundary
-
-		boundary = timeOnline
-		if timeOnline >= largeWindow {
-			boundary = largeWindow
-		}
-		worker.TotalHR = worker.TotalHR / boundary
-
-		if worker.LastBeat < (now - smallWindow/2) {
-			worker.Offline = true
-			offline++
-		} else {
-			online++
-		}
-
-		currentHashrate += worker.HR
-		totalHashrate += worker.TotalHR
-		workers[id] = worker
-	}
-	stats["workers"] = workers
-	stats["workersTotal"] = len(workers)
-	stats["workersOnline"] = online
-	stats["workersOffline"] = offline
-	stats["hashrate"] = totalHashrate
-	stats["currentHashrate"] = currentHashrate
-	return stats, nil
+	return convertWorkersResults(now, smallWindow, largeWindow, cmds[1].(*redis.ZSliceCmd).Val(),
+		cmds[2].(*redis.MapStringStringCmd).Val()), nil
 }
 
 func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, error) {
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	max := int64(windows[len(windows)-1])
 
-	cmds, err := tx.Exec(func() error {
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "immature"), 0, -1)
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "matured"), 0, max-1)
+	cmds, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.ZRevRangeWithScores(ctx, r.formatKey("blocks", "immature"), 0, -1)
+		tx.ZRevRangeWithScores(ctx, r.formatKey("blocks", "matured"), 0, max-1)
 		return nil
 	})
 	if err != nil {
 		return stats, err
 	}
-	blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd), cmds[1].(*redis.ZSliceCmd))
+	blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd).Val(), cmds[1].(*redis.ZSliceCmd).Val())
+
+	return convertLuckResults(windows, blocks), nil
+}
+
+// Average luck, uncle and orphan rates over the last blocks for every window size
+func convertLuckResults(windows []int, blocks []*BlockData) map[string]interface{} {
+	stats := make(map[string]interface{})
 
 	calcLuck := func(max int) (int, float64, float64, float64) {
 		var total int
@@ -860,70 +1123,124 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 			break
 		}
 	}
-	return stats, nil
+	return stats
+}
+
+// Groups "id:field" node state entries by node
+func convertNodeStates(raw map[string]string) []map[string]interface{} {
+	m := make(map[string]map[string]interface{})
+	for key, value := range raw {
+		parts := strings.Split(key, ":")
+		if val, ok := m[parts[0]]; ok {
+			val[parts[1]] = value
+		} else {
+			node := make(map[string]interface{})
+			node[parts[1]] = value
+			m[parts[0]] = node
+		}
+	}
+	v := make([]map[string]interface{}, len(m), len(m))
+	i := 0
+	for _, value := range m {
+		v[i] = value
+		i++
+	}
+	return v
 }
 
-func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
+func convertCandidateResults(raw []redis.Z) []*BlockData {
 	var result []*BlockData
-	for _, v := range raw.Val() {
-		// "nonce:eNonce1:eNonce2:timestamp:diff:totalShares:coinBaseValue:blkTotalFee"
-		block := BlockData{}
+	for _, v := range raw {
+		block, err := decodeCandidate(v.Member.(string))
+		if err != nil {
+			Error.Printf("Skipping candidate at height %v: %v", int64(v.Score), err)
+			continue
+		}
 		block.Height = int64(v.Score)
 		block.RoundHeight = block.Height
-		fields := strings.Split(v.Member.(string), ":")
-		block.Nonce = fields[0]
-		block.ENonce1 = fields[1]
-		block.ENonce2 = fields[2]
-		block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
-		block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
-		block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
-		coinBaseValue, _ := strconv.ParseInt(fields[6], 10, 64)
-		block.CoinBaseValue = big.NewInt(coinBaseValue)
-		blkTotalFee, _ := strconv.ParseInt(fields[7], 10, 64)
-		block.BlkTotalFee = big.NewInt(blkTotalFee)
 		block.candidateKey = v.Member.(string)
-		result = append(result, &block)
+		result = append(result, block)
 	}
 	return result
 }
 
-func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
+func convertBlockResults(rows ...[]redis.Z) []*BlockData {
 	var result []*BlockData
 	for _, row := range rows {
-		for _, v := range row.Val() {
-			// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:coinBaseValue:blkTotalFee:rewardInSatoshi"
-			block := BlockData{}
+		for _, v := range row {
+			block, err := decodeBlock(v.Member.(string))
+			if err != nil {
+				Error.Printf("Skipping block at height %v: %v", int64(v.Score), err)
+				continue
+			}
 			block.Height = int64(v.Score)
 			block.RoundHeight = block.Height
-			fields := strings.Split(v.Member.(string), ":")
-			block.UncleHeight = 0
-			block.Uncle = false
-			block.Orphan, _ = strconv.ParseBool(fields[1])
-			block.Nonce = fields[2]
-			block.Hash = fields[3]
-			block.Timestamp, _ = strconv.ParseInt(fields[4], 10, 64)
-			block.Difficulty, _ = strconv.ParseInt(fields[5], 10, 64)
-			block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
-
-			block.CoinBaseValue, _ = new(big.Int).SetString(fields[7], 10)
-			block.BlkTotalFee, _ = new(big.Int).SetString(fields[8], 10)
-
-			block.RewardString = fields[9]
-			block.ImmatureReward = fields[9]
 			block.immatureKey = v.Member.(string)
-			result = append(result, &block)
+			result = append(result, block)
 		}
 	}
 	return result
 }
 
+// Per worker hashrates of login from its hashrate entries, along with rejected share counters
+func convertWorkersResults(now, smallWindow, largeWindow int64, hashrate []redis.Z, rejects map[string]string) map[string]interface{} {
+	stats := make(map[string]interface{})
+
+	totalHashrate := int64(0)
+	currentHashrate := int64(0)
+	online := int64(0)
+	offline := int64(0)
+	workers := convertWorkersStats(smallWindow, hashrate)
+
+	for id, worker := range workers {
+		timeOnline := now - worker.startedAt
+		if timeOnline < 600 {
+			timeOnline = 600
+		}
+
+		boundary := timeOnline
+		if timeOnline >= smallWindow {
+			boundary = smallWindow
+		}
+		worker.HR = worker.HR / boundary
+
+		boundary = timeOnline
+		if timeOnline >= largeWindow {
+			boundary = largeWindow
+		}
+		worker.TotalHR = worker.TotalHR / boundary
+
+		if worker.LastBeat < (now - smallWindow/2) {
+			worker.Offline = true
+			offline++
+		} else {
+			online++
+		}
+
+		currentHashrate += worker.HR
+		totalHashrate += worker.TotalHR
+		workers[id] = worker
+	}
+	stats["workers"] = workers
+	stats["workersTotal"] = len(workers)
+	stats["workersOnline"] = online
+	stats["workersOffline"] = offline
+	stats["hashrate"] = totalHashrate
+	stats["currentHashrate"] = currentHashrate
+
+	rejectsByWorker, rejectsTotal := convertRejectsStats(rejects)
+	stats["rejects"] = rejectsByWorker
+	stats["rejectsTotal"] = rejectsTotal
+	return stats
+}
+
 // Build per login workers's total shares map {'rig-1': 12345, 'rig-2': 6789, ...}
 // TS => diff, id, ms
-func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
+func convertWorkersStats(window int64, raw []redis.Z) map[string]Worker {
 	now := MakeTimestamp() / 1000
 	workers := make(map[string]Worker)
 
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		parts := strings.Split(v.Member.(string), ":")
 		share, _ := strconv.ParseInt(parts[0], 10, 64)
 		id := parts[1]
@@ -949,12 +1266,34 @@ func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
 	return workers
 }
 
-func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]Miner) {
+// Rejected share counters by worker and reason, and totals by reason
+func convertRejectsStats(raw map[string]string) (map[string]map[string]int64, map[string]int64) {
+	rejects := make(map[string]map[string]int64)
+	total := make(map[string]int64)
+
+	for k, v := range raw {
+		// "id:reason"
+		parts := strings.Split(k, ":")
+		if len(parts) != 2 {
+			continue
+		}
+		n, _ := strconv.ParseInt(v, 10, 64)
+		id, reason := parts[0], parts[1]
+		if _, ok := rejects[id]; !ok {
+			rejects[id] = make(map[string]int64)
+		}
+		rejects[id][reason] += n
+		total[reason] += n
+	}
+	return rejects, total
+}
+
+func convertMinersStats(window int64, raw []redis.Z) (int64, map[string]Miner) {
 	now := MakeTimestamp() / 1000
 	miners := make(map[string]Miner)
 	totalHashrate := int64(0)
 
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		parts := strings.Split(v.Member.(string), ":")
 		share, _ := strconv.ParseInt(parts[0], 10, 64)
 		id := parts[1]
@@ -992,20 +1331,23 @@ func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]M
 	return totalHashrate, miners
 }
 
-func convertPaymentsResults(raw *redis.ZSliceCmd) []map[string]interface{} {
+func convertCredits(raw map[string]string) map[string]int64 {
+	credits := make(map[string]int64)
+	for login, v := range raw {
+		credits[login], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return credits
+}
+
+func convertPaymentsResults(raw []redis.Z) []map[string]interface{} {
 	var result []map[string]interface{}
-	for _, v := range raw.Val() {
-		tx := make(map[string]interface{})
-		tx["timestamp"] = int64(v.Score)
-		fields := strings.Split(v.Member.(string), ":")
-		tx["tx"] = fields[0]
-		// Individual or whole payments row
-		if len(fields) < 3 {
-			tx["amount"], _ = strconv.ParseInt(fields[1], 10, 64)
-		} else {
-			tx["address"] = fields[1]
-			tx["amount"], _ = strconv.ParseInt(fields[2], 10, 64)
+	for _, v := range raw {
+		tx, err := decodePayment(v.Member.(string))
+		if err != nil {
+			Error.Printf("Skipping payment at %v: %v", int64(v.Score), err)
+			continue
 		}
+		tx["timestamp"] = int64(v.Score)
 		result = append(result, tx)
 	}
 	return result
@@ -1,12 +1,19 @@
 package storage
 
 import (
+	"encoding/json"
+	"math"
+	"math/big"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
-	"gopkg.in/redis.v3"
+	"github.com/redis/go-redis/v9"
+
+	. "github.com/PowPool/dashpool/util"
 )
 
 var r *RedisClient
@@ -14,6 +21,7 @@ var r *RedisClient
 const prefix = "test"
 
 func TestMain(m *testing.M) {
+	InitLog(os.DevNull, os.DevNull, os.DevNull, os.DevNull, ERROR)
 	r = NewRedisClient(&Config{Endpoint: "127.0.0.1:6379"}, prefix)
 	reset()
 	c := m.Run()
@@ -46,12 +54,489 @@ func TestWriteShareCheckExist(t *testing.T) {
 	}
 }
 
+func TestRejectReasons(t *testing.T) {
+	reset()
+
+	r.WriteInvalidShare(1000, 1, "x", "rig1", 10, "duplicate")
+	r.WriteInvalidShare(2000, 2, "x", "rig1", 10, "duplicate")
+	r.WriteInvalidShare(3000, 3, "x", "rig2", 10, "jobNotFound")
+	r.WriteRejectShare(4000, 4, "x", "rig2", 10, "lowDifficulty")
+
+	stats, err := r.CollectWorkersStats(time.Minute, time.Hour, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejects := stats["rejects"].(map[string]map[string]int64)
+	if rejects["rig1"]["duplicate"] != 2 || rejects["rig2"]["jobNotFound"] != 1 || rejects["rig2"]["lowDifficulty"] != 1 {
+		t.Errorf("Invalid rejects by worker: %v", rejects)
+	}
+	total := stats["rejectsTotal"].(map[string]int64)
+	if total["duplicate"] != 2 || total["jobNotFound"] != 1 || total["lowDifficulty"] != 1 {
+		t.Errorf("Invalid rejects total: %v", total)
+	}
+	if n, _ := r.client.ZCard(ctx, r.formatKey("rejecthashrate")).Result(); n != 1 {
+		t.Errorf("Expected 1 reject hashrate entry, got %v", n)
+	}
+}
+
+func TestSpoolOffset(t *testing.T) {
+	reset()
+
+	if offset, err := r.GetSpoolOffset("pool1", "segment"); offset != 0 || err != nil {
+		t.Errorf("Offset of new segment must be zero: %v, %v", offset, err)
+	}
+	shares := []*ShareData{{Login: "x", Id: "rig1", Diff: 10, Ms: 1000}, {Login: "z", Id: "rig1", Diff: 20, Ms: 2000}}
+	r.WriteSpooledShares("pool1", "segment", 42, shares, time.Hour)
+	if offset, _ := r.GetSpoolOffset("pool1", "segment"); offset != 42 {
+		t.Errorf("Offset must be written along with shares: %v", offset)
+	}
+	round := r.client.HGetAll(ctx, r.formatKey("shares", "roundCurrent")).Val()
+	if round["x"] != "10" || round["z"] != "20" {
+		t.Errorf("Shares must be written: %v", round)
+	}
+	r.DeleteSpoolOffset("pool1", "segment")
+	if offset, _ := r.GetSpoolOffset("pool1", "segment"); offset != 0 {
+		t.Errorf("Offset must be deleted: %v", offset)
+	}
+}
+
+func TestFailoverOptions(t *testing.T) {
+	var cfg Config
+	data := `{"endpoint": "127.0.0.1:6379", "database": 2, "poolSize": 5}`
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if opts := failoverOptions(&cfg); opts != nil {
+		t.Errorf("Must use endpoint without Sentinels: %+v", opts)
+	}
+
+	data = `{"endpoint": "127.0.0.1:6379", "database": 2, "poolSize": 5,
+		"sentinel": {"masterName": "dashpool", "addrs": ["10.0.0.1:26379", "10.0.0.2:26379"]}}`
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Password = "secret"
+	expected := &redis.FailoverOptions{MasterName: "dashpool", SentinelAddrs: []string{"10.0.0.1:26379", "10.0.0.2:26379"},
+		Password: "secret", DB: 2, PoolSize: 5}
+	if opts := failoverOptions(&cfg); !reflect.DeepEqual(opts, expected) {
+		t.Errorf("Invalid failover options: %+v", opts)
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	reset()
+	tagged := NewRedisClient(&Config{Endpoint: "127.0.0.1:6379", HashTag: true}, prefix)
+	defer func() {
+		for _, k := range tagged.client.Keys(ctx, "{"+prefix+"}:*").Val() {
+			tagged.client.Del(ctx, k)
+		}
+	}()
+
+	tagged.WriteShare("x", "rig1", []string{"0x1", "0x0", "0x0"}, 100, 10, time.Hour)
+	tagged.WriteBlock("x", "rig1", []string{"0x2", "0x0", "0x0"}, 100, 500, 10, "0xb10c", 1000, 0, time.Hour)
+
+	if key := tagged.formatRound(10, "0x2"); key != "{test}:shares:round10:0x2" {
+		t.Errorf("Invalid round key: %v", key)
+	}
+	if tagged.client.Exists(ctx, tagged.formatRound(10, "0x2")).Val() != 1 {
+		t.Error("Must rename current round within hash tag")
+	}
+	// Hashrates are not written by transactions, so they spread over the cluster
+	if key := tagged.formatKey("hashrate", "x"); key != "test:hashrate:x" {
+		t.Errorf("Invalid hashrate key: %v", key)
+	}
+	for _, k := range tagged.client.Keys(ctx, prefix+":*").Val() {
+		if name := tagged.keyName(k); txKeys[strings.SplitN(name, ":", 2)[0]] {
+			t.Errorf("Must write %v under hash tag", k)
+		}
+	}
+	candidates, _ := tagged.GetCandidates(10)
+	if len(candidates) != 1 || candidates[0].Height != 10 {
+		t.Errorf("Must read back tagged candidates: %v", candidates)
+	}
+	if payees, _ := tagged.GetPayees(); len(payees) != 1 || payees[0] != "x" {
+		t.Errorf("Must find tagged miners: %v", payees)
+	}
+	dumps, _ := tagged.DumpKeys()
+	names := make([]string, len(dumps))
+	for i, dump := range dumps {
+		names[i] = dump.Key
+	}
+	if !reflect.DeepEqual(names, []string{"blocks:candidates", "miners:x", "shares:round10:0x2"}) {
+		t.Errorf("Must dump tagged keys by their names: %v", names)
+	}
+}
+
+// Cluster client refuses transactions and watches over keys of different slots, so running the
+// tests with it proves each of them stays within one slot. Miniredis serves all slots as one node.
+func TestCluster(t *testing.T) {
+	standalone := r
+	r = NewRedisClient(&Config{Cluster: ClusterConfig{Addrs: []string{"127.0.0.1:6379"}}}, prefix)
+	defer func() {
+		reset()
+		r = standalone
+	}()
+
+	tests := []struct {
+		name string
+		test func(*testing.T)
+	}{
+		{"RejectReasons", TestRejectReasons},
+		{"SpoolOffset", TestSpoolOffset},
+		{"MigrateSchema", TestMigrateSchema},
+		{"DumpKeys", TestDumpKeys},
+		{"HistoryPages", TestHistoryPages},
+		{"Charts", TestCharts},
+		{"GetPayees", TestGetPayees},
+		{"MinerSettings", TestMinerSettings},
+		{"Halt", TestHalt},
+		{"LockPayouts", TestLockPayouts},
+		{"UpdateBalance", TestUpdateBalance},
+		{"RollbackBalance", TestRollbackBalance},
+		{"WritePayment", TestWritePayment},
+		{"LedgerReconcile", TestLedgerReconcile},
+		{"CollectLuckStats", TestCollectLuckStats},
+		{"LeaseAndFencing", TestLeaseAndFencing},
+		{"MemoryMatchesRedis", TestMemoryMatchesRedis},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, tt.test)
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	reset()
+
+	for _, b := range []Backend{r, NewMemoryBackend(prefix)} {
+		if err := b.CheckSchema(); err != nil {
+			t.Fatalf("Empty dataset must be stamped with schema: %v", err)
+		}
+		if version, _ := b.GetSchemaVersion(); version != SchemaVersion {
+			t.Errorf("Invalid schema version of empty dataset: %v", version)
+		}
+	}
+	reset()
+
+	for _, b := range []Backend{r, NewMemoryBackend(prefix)} {
+		// Members written by version 1
+		zAdd := func(key string, score float64, member string) {
+			switch b := b.(type) {
+			case *RedisClient:
+				b.client.ZAdd(ctx, b.formatKey(key), redis.Z{Score: score, Member: member})
+			case *MemoryBackend:
+				b.store.zAdd(b.formatKey(key), score, member)
+			}
+		}
+		zAdd("blocks:candidates", 12, "0x1:0xa:0xb:1000:500:700:1000:5:0xb10c")
+		zAdd("blocks:immature", 11, "0:0:0x2:0xb10d:1001:500:600:1000:5:990")
+		zAdd("blocks:matured", 10, "0:1:0x3:0x0:1002:500:650:1000:5:0")
+		zAdd("payments:all", 2000, "0xbeef:x:490")
+		zAdd("payments:x", 2000, "0xbeef:490")
+		zAdd("payments:pending", 2001, "x:10")
+
+		candidates, _ := b.GetCandidates(20)
+		immature, _ := b.GetImmatureBlocks(20)
+		matured, _ := b.GetMaturedBlocks(0, -1)
+		payments, _ := b.GetPayments(0, -1)
+		loginPayments, _, _ := b.GetPaymentsPage(&HistoryQuery{Login: "x", Limit: 10})
+
+		if err := b.CheckSchema(); err != ErrSchemaOutdated {
+			t.Errorf("Legacy dataset must not pass schema check: %v", err)
+		}
+		report, err := b.MigrateSchema(true)
+		expected := map[string]int64{"blocks:candidates": 1, "blocks:immature": 1, "blocks:matured": 1,
+			"payments:all": 1, "payments:x": 1}
+		if err != nil || !reflect.DeepEqual(report.Upgraded, expected) || report.Verified != 0 {
+			t.Errorf("Invalid dry run report: %+v, %v", report, err)
+		}
+		if version, _ := b.GetSchemaVersion(); version != 1 {
+			t.Errorf("Dry run must not change schema version: %v", version)
+		}
+
+		report, err = b.MigrateSchema(false)
+		if err != nil || !reflect.DeepEqual(report.Upgraded, expected) || report.Verified != 5 {
+			t.Fatalf("Invalid migration report: %+v, %v", report, err)
+		}
+		if err := b.CheckSchema(); err != nil {
+			t.Errorf("Migrated dataset must pass schema check: %v", err)
+		}
+		if report, _ := b.MigrateSchema(false); report.Upgraded["blocks:matured"] != 0 || report.Verified != 5 {
+			t.Errorf("Second migration must not upgrade anything: %+v", report)
+		}
+
+		sameBlocks := func(a, b []*BlockData) bool {
+			if len(a) != len(b) {
+				return false
+			}
+			for i := range a {
+				if a[i].Height != b[i].Height || !reflect.DeepEqual(summarizeBlock(a[i]), summarizeBlock(b[i])) {
+					return false
+				}
+			}
+			return true
+		}
+		newCandidates, _ := b.GetCandidates(20)
+		newImmature, _ := b.GetImmatureBlocks(20)
+		newMatured, _ := b.GetMaturedBlocks(0, -1)
+		if !sameBlocks(candidates, newCandidates) || !sameBlocks(immature, newImmature) || !sameBlocks(matured, newMatured) {
+			t.Errorf("Blocks must read the same after migration: %+v, %+v, %+v", newCandidates[0], newImmature[0], newMatured[0])
+		}
+		newPayments, _ := b.GetPayments(0, -1)
+		newLoginPayments, _, _ := b.GetPaymentsPage(&HistoryQuery{Login: "x", Limit: 10})
+		if !reflect.DeepEqual(payments, newPayments) || !reflect.DeepEqual(loginPayments, newLoginPayments) {
+			t.Errorf("Payments must read the same after migration: %v, %v", newPayments, newLoginPayments)
+		}
+		if pending := b.GetPendingPayments(); len(pending) != 1 || pending[0].Amount != 10 {
+			t.Errorf("Pending payments must be left as is: %v", pending)
+		}
+
+		// Migrated candidate is moved by its new member
+		newCandidates[0].Reward = big.NewInt(1000)
+		b.WriteImmatureBlock(newCandidates[0], map[string]int64{"x": 990})
+		if candidates, _ := b.GetCandidates(20); len(candidates) != 0 {
+			t.Errorf("Migrated candidate must be removed: %v", candidates)
+		}
+	}
+	reset()
+
+	for _, b := range []Backend{r, NewMemoryBackend(prefix)} {
+		zAdd := func(key string, score float64, member string) {
+			switch b := b.(type) {
+			case *RedisClient:
+				b.client.ZAdd(ctx, b.formatKey(key), redis.Z{Score: score, Member: member})
+			case *MemoryBackend:
+				b.store.zAdd(b.formatKey(key), score, member)
+			}
+		}
+		zAdd("blocks:matured", 10, "0:0:0x3:0x0:1002:500:650:1000:5:0")
+		zAdd("blocks:matured", 9, "0:0:0x4:0x0:1002")
+
+		if blocks, _ := b.GetMaturedBlocks(0, -1); len(blocks) != 1 || blocks[0].Height != 10 {
+			t.Errorf("Malformed record must be skipped: %v", blocks)
+		}
+		if _, err := b.MigrateSchema(false); err == nil {
+			t.Error("Malformed record must fail migration")
+		}
+		if version, _ := b.GetSchemaVersion(); version != 1 {
+			t.Errorf("Failed migration must not change schema version: %v", version)
+		}
+	}
+}
+
+func TestDumpKeys(t *testing.T) {
+	reset()
+
+	for _, b := range []Backend{r, NewMemoryBackend(prefix)} {
+		b.WriteShare("x", "rig1", []string{"0x1", "0x0", "0x0"}, 100, 10, time.Hour)
+		b.WriteBlock("x", "rig1", []string{"0x2", "0x0", "0x0"}, 100, 500, 10, "0xb10c", 1000, 0, time.Hour)
+		b.LockPayouts("x", 10)
+
+		dumps, err := b.DumpKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, dump := range dumps {
+			names = append(names, dump.Key+"/"+dump.Type)
+		}
+		expected := []string{"blocks:candidates/zset", "miners:x/hash", "payments:lock/string", "shares:round10:0x2/hash"}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("Must dump pool state only: %v", names)
+		}
+
+		kept := []*KeyDump{dumps[0], dumps[1], dumps[3]}
+		if err := b.RestoreKeys(kept, []string{"payments:lock"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		restored, _ := b.DumpKeys()
+		if !reflect.DeepEqual(restored, kept) {
+			t.Errorf("Must restore dumped keys: %v", restored)
+		}
+		if err := b.RestoreKeys([]*KeyDump{{Key: "hashrate", Type: "zset"}}, nil, nil); err == nil {
+			t.Error("Must not restore keys beyond pool state")
+		}
+
+		// Restored balance is posted to ledger and pool finances
+		miner := &KeyDump{Key: "miners:x", Type: "hash", Hash: map[string]string{"balance": "700"}}
+		if err := b.RestoreKeys([]*KeyDump{miner}, nil, []LedgerEntry{RestoreEntry("x", "balance", 700)}); err != nil {
+			t.Fatal(err)
+		}
+		if report, _ := b.Reconcile(); !report.Balanced() || report.Accounts[AccountPoolRestore] != -700 {
+			t.Errorf("Restored balance must reconcile: %+v", report)
+		}
+	}
+}
+
+func TestPageHistoryBound(t *testing.T) {
+	total := historyChunk*historyMaxChunks + 10
+	var fetched int
+	fetch := func(min, max float64, offset, count int64) ([]redis.Z, error) {
+		var rows []redis.Z
+		for score := total; score > 0; score-- {
+			if float64(score) <= max && float64(score) >= min {
+				rows = append(rows, redis.Z{Score: float64(score), Member: strconv.Itoa(score)})
+			}
+		}
+		if offset >= int64(len(rows)) {
+			return nil, nil
+		}
+		rows = rows[offset:]
+		if int64(len(rows)) > count {
+			rows = rows[:count]
+		}
+		fetched += len(rows)
+		return rows, nil
+	}
+	match := func(member string) bool {
+		return member == "5"
+	}
+
+	rows, next, err := pageHistory(fetch, math.Inf(-1), math.Inf(1), "", 10, match)
+	if err != nil || len(rows) != 0 || len(next) == 0 || fetched != historyChunk*historyMaxChunks {
+		t.Fatalf("Scan must stop with partial page after %v chunks: %v, %v, %v fetched", historyMaxChunks, rows, next, fetched)
+	}
+	rows, next, _ = pageHistory(fetch, math.Inf(-1), math.Inf(1), next, 10, match)
+	if len(rows) != 1 || rows[0].Score != 5 || len(next) != 0 {
+		t.Errorf("Next page must continue after scanned entries: %v, %v", rows, next)
+	}
+}
+
+func TestHistoryPages(t *testing.T) {
+	reset()
+
+	for _, b := range []Backend{r, NewMemoryBackend(prefix)} {
+		for i, login := range []string{"x", "x", "z", "z"} {
+			height := uint64(10 + i)
+			b.WriteBlock(login, "rig1", []string{strconv.Itoa(i), "0x0", "0x0"}, 100, 500, height, "0xb10c", 1000, 0, time.Hour)
+		}
+
+		heights := func(blocks []*BlockData) []int64 {
+			result := []int64{}
+			for _, block := range blocks {
+				result = append(result, block.Height)
+			}
+			return result
+		}
+		page, next, err := b.GetBlocksPage(BlocksCandidates, &HistoryQuery{Limit: 3})
+		if err != nil || !reflect.DeepEqual(heights(page), []int64{13, 12, 11}) || len(next) == 0 {
+			t.Fatalf("Invalid first page: %v, %v, %v", heights(page), next, err)
+		}
+		page, next, _ = b.GetBlocksPage(BlocksCandidates, &HistoryQuery{Limit: 3, Cursor: next})
+		if !reflect.DeepEqual(heights(page), []int64{10}) || len(next) != 0 {
+			t.Errorf("Invalid last page: %v, %v", heights(page), next)
+		}
+		page, _, _ = b.GetBlocksPage(BlocksCandidates, &HistoryQuery{Limit: 10, Login: "x", MinHeight: 11})
+		if !reflect.DeepEqual(heights(page), []int64{11}) || page[0].Finder != "x" {
+			t.Errorf("Must filter by finder and height: %v", heights(page))
+		}
+		now := MakeTimestamp() / 1000
+		if page, _, _ := b.GetBlocksPage(BlocksCandidates, &HistoryQuery{Limit: 10, From: now + 10}); len(page) != 0 {
+			t.Errorf("Must filter by time: %v", heights(page))
+		}
+		if _, _, err := b.GetBlocksPage(BlocksCandidates, &HistoryQuery{Limit: 10, Cursor: "!"}); err != ErrInvalidCursor {
+			t.Errorf("Must reject invalid cursor: %v", err)
+		}
+
+		candidates, _ := b.GetCandidates(20)
+		for _, block := range candidates {
+			block.Reward = big.NewInt(1000)
+			b.WriteImmatureBlock(block, map[string]int64{block.Finder: 1000})
+		}
+		immature, _ := b.GetImmatureBlocks(12)
+		for _, block := range immature {
+			block.Reward = big.NewInt(1000)
+			if block.Height == 11 {
+				block.Orphan = true
+				b.WriteOrphan(block)
+			} else {
+				b.WriteMaturedBlock(block, map[string]int64{block.Finder: 1000}, 0)
+			}
+		}
+		for kind, expected := range map[string][]int64{BlocksCandidates: {}, BlocksImmature: {13}, BlocksMatured: {12, 10},
+			BlocksOrphans: {11}} {
+			page, _, _ := b.GetBlocksPage(kind, &HistoryQuery{Limit: 10})
+			if !reflect.DeepEqual(heights(page), expected) {
+				t.Errorf("Invalid %v blocks: %v", kind, heights(page))
+			}
+		}
+		if page, _, _ := b.GetBlocksPage(BlocksMatured, &HistoryQuery{Limit: 10, Login: "z"}); !reflect.DeepEqual(heights(page), []int64{12}) {
+			t.Errorf("Matured blocks must keep finder: %v", heights(page))
+		}
+
+		// Payments of one session share timestamp
+		for i, login := range []string{"x", "x", "z", "x"} {
+			b.WritePayment(login, "0x"+strconv.Itoa(i), 100)
+		}
+		seen := make(map[string]bool)
+		cursor := ""
+		for i := 0; i < 3; i++ {
+			payments, next, err := b.GetPaymentsPage(&HistoryQuery{Limit: 2, Cursor: cursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, payment := range payments {
+				seen[payment["tx"].(string)] = true
+			}
+			cursor = next
+		}
+		if len(seen) != 4 || len(cursor) != 0 {
+			t.Errorf("Pages must cover every payment once: %v, %v", seen, cursor)
+		}
+		if payments, _, _ := b.GetPaymentsPage(&HistoryQuery{Limit: 10, Login: "x"}); len(payments) != 3 {
+			t.Errorf("Must return payments of login: %v", payments)
+		}
+		if payments, _, _ := b.GetPaymentsPage(&HistoryQuery{Limit: 10, To: now - 10}); len(payments) != 0 {
+			t.Errorf("Must filter payments by time: %v", payments)
+		}
+	}
+}
+
+func TestCharts(t *testing.T) {
+	reset()
+
+	for _, b := range []Backend{r, NewMemoryBackend(prefix)} {
+		now := MakeTimestamp() / 1000
+		// Completed bucket within hashrate window
+		bucket := (now-60)/600*600 - 600
+		b.WriteShares([]*ShareData{
+			{Login: "x", Id: "rig1", Diff: 3600, Ms: (bucket + 5) * 1000},
+			{Login: "x", Id: "rig2", Diff: 7200, Ms: (bucket + 100) * 1000},
+			{Login: "z", Id: "rig1", Diff: 3600, Ms: (bucket + 599) * 1000},
+			// Bucket in progress
+			{Login: "z", Id: "rig1", Diff: 3600, Ms: (bucket + 600) * 1000},
+		}, time.Hour)
+
+		if n, err := b.WriteCharts(30 * time.Minute); n == 0 || err != nil {
+			t.Fatalf("Must write completed buckets: %v, %v", n, err)
+		}
+		if n, _ := b.WriteCharts(30 * time.Minute); n != 0 {
+			t.Errorf("Buckets must be written once, %v written again", n)
+		}
+
+		res := GetChartResolution("10m")
+		pool, _ := b.GetChart(res, "", "", bucket, bucket+600)
+		miner, _ := b.GetChart(res, "x", "", bucket-600, bucket+600)
+		worker, _ := b.GetChart(res, "x", "rig2", bucket, bucket+600)
+		expected := []ChartPoint{{Timestamp: bucket - 600, Hashrate: 0}, {Timestamp: bucket, Hashrate: 18}}
+		if len(pool) != 1 || pool[0].Hashrate != 24 || !reflect.DeepEqual(miner, expected) || worker[0].Hashrate != 12 {
+			t.Errorf("Invalid 10m charts: %v, %v, %v", pool, miner, worker)
+		}
+		hourly, _ := b.GetChart(GetChartResolution("1h"), "", "", bucket/3600*3600, bucket/3600*3600+3600)
+		if len(hourly) != 1 || hourly[0].Hashrate != 4 {
+			t.Errorf("Invalid 1h chart: %v", hourly)
+		}
+		if n, _ := b.FlushStaleCharts(); n != 0 {
+			t.Errorf("Recent buckets must be kept, %v removed", n)
+		}
+	}
+}
+
 func TestGetPayees(t *testing.T) {
 	reset()
 
 	n := 256
 	for i := 0; i < n; i++ {
-		r.client.HSet(r.formatKey("miners", strconv.Itoa(i)), "balance", strconv.Itoa(i))
+		r.client.HSet(ctx, r.formatKey("miners", strconv.Itoa(i)), "balance", strconv.Itoa(i))
 	}
 
 	var payees []string
@@ -71,7 +556,7 @@ func TestGetPayees(t *testing.T) {
 func TestGetBalance(t *testing.T) {
 	reset()
 
-	r.client.HSet(r.formatKey("miners:x"), "balance", "750")
+	r.client.HSet(ctx, r.formatKey("miners:x"), "balance", "750")
 
 	v, _ := r.GetBalance("x")
 	if v != 750 {
@@ -87,11 +572,76 @@ func TestGetBalance(t *testing.T) {
 	}
 }
 
+func TestMinerSettings(t *testing.T) {
+	reset()
+
+	for _, b := range []Backend{r, NewMemoryBackend(prefix)} {
+		settings, _ := b.GetMinerSettings("x")
+		if settings.Threshold != 0 || len(settings.PayoutAddress) != 0 {
+			t.Error("Must return empty settings")
+		}
+
+		b.WriteMinerSettings("x", &MinerSettings{Threshold: 100, Email: "x@y.z", PayoutAddress: "y", UpdatedAt: 10})
+		settings, _ = b.GetMinerSettings("x")
+		if settings.Threshold != 100 || settings.Email != "x@y.z" || settings.PayoutAddress != "y" || settings.UpdatedAt != 10 {
+			t.Errorf("Must return stored settings: %v", settings)
+		}
+
+		// Request signed earlier must not overwrite settings
+		for _, updatedAt := range []int64{9, 10} {
+			if err := b.WriteMinerSettings("x", &MinerSettings{Threshold: 200, UpdatedAt: updatedAt}); err != ErrStaleSettings {
+				t.Errorf("Must reject settings of %v: %v", updatedAt, err)
+			}
+		}
+		if settings, _ = b.GetMinerSettings("x"); settings.Threshold != 100 {
+			t.Errorf("Stale settings must not be written: %v", settings)
+		}
+
+		b.WriteMinerSettings("x", &MinerSettings{UpdatedAt: 11})
+		settings, _ = b.GetMinerSettings("x")
+		if settings.Threshold != 0 || len(settings.Email) != 0 || len(settings.PayoutAddress) != 0 {
+			t.Errorf("Must reset settings: %v", settings)
+		}
+	}
+}
+
+func TestHalt(t *testing.T) {
+	reset()
+
+	state, err := r.GetHalt("unlocker")
+	if state != nil || err != nil {
+		t.Error("Must not be halted")
+	}
+
+	r.WriteHalt("unlocker", "credits do not match revenue")
+	state, _ = r.GetHalt("unlocker")
+	if state == nil || state.Reason != "credits do not match revenue" {
+		t.Errorf("Must return halt reason: %v", state)
+	}
+	halts, _ := r.GetHalts()
+	if len(halts) != 1 || halts["unlocker"] == nil {
+		t.Errorf("Must list halted modules: %v", halts)
+	}
+
+	cleared, _ := r.ClearHalt("unlocker")
+	if !cleared {
+		t.Error("Must clear halt")
+	}
+	state, _ = r.GetHalt("unlocker")
+	if state != nil {
+		t.Error("Must not be halted after clear")
+	}
+	cleared, _ = r.ClearHalt("unlocker")
+	if cleared {
+		t.Error("Must report that module was not halted")
+	}
+}
+
 func TestLockPayouts(t *testing.T) {
 	reset()
 
 	r.LockPayouts("x", 1000)
-	v := r.client.Get("test:payments:lock").Val()
+	v := r.client.Get(ctx, r.formatKey("payments", "lock")).Val()
 	if v != "x:1000" {
 		t.Errorf("Invalid lock amount: %v", v)
 	}
@@ -105,10 +655,10 @@ func TestLockPayouts(t *testing.T) {
 func TestUnlockPayouts(t *testing.T) {
 	reset()
 
-	r.client.Set(r.formatKey("payments:lock"), "x:1000", 0)
+	r.client.Set(ctx, r.formatKey("payments:lock"), "x:1000", 0)
 
 	r.UnlockPayouts()
-	err := r.client.Get(r.formatKey("payments:lock")).Err()
+	err := r.client.Get(ctx, r.formatKey("payments:lock")).Err()
 	if err != redis.Nil {
 		t.Errorf("Must release lock")
 	}
@@ -126,18 +676,18 @@ func TestIsPayoutsLocked(t *testing.T) {
 func TestUpdateBalance(t *testing.T) {
 	reset()
 
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("miners:x"),
 		map[string]string{"paid": "50", "balance": "1000"},
 	)
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("finances"),
 		map[string]string{"paid": "500", "balance": "10000"},
 	)
 
 	amount := int64(250)
 	r.UpdateBalance("x", amount)
-	result := r.client.HGetAllMap(r.formatKey("miners:x")).Val()
+	result := r.client.HGetAll(ctx, r.formatKey("miners:x")).Val()
 	if result["pending"] != "250" {
 		t.Error("Must set pending amount")
 	}
@@ -148,7 +698,7 @@ func TestUpdateBalance(t *testing.T) {
 		t.Error("Must not touch paid")
 	}
 
-	result = r.client.HGetAllMap(r.formatKey("finances")).Val()
+	result = r.client.HGetAll(ctx, r.formatKey("finances")).Val()
 	if result["pending"] != "250" {
 		t.Error("Must set pool pending amount")
 	}
@@ -159,7 +709,7 @@ func TestUpdateBalance(t *testing.T) {
 		t.Error("Must not touch pool paid")
 	}
 
-	rank := r.client.ZRank(r.formatKey("payments:pending"), join("x", amount)).Val()
+	rank := r.client.ZRank(ctx, r.formatKey("payments:pending"), join("x", amount)).Val()
 	if rank != 0 {
 		t.Error("Must add pending payment")
 	}
@@ -168,19 +718,19 @@ func TestUpdateBalance(t *testing.T) {
 func TestRollbackBalance(t *testing.T) {
 	reset()
 
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("miners:x"),
 		map[string]string{"paid": "100", "balance": "750", "pending": "250"},
 	)
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("finances"),
 		map[string]string{"paid": "500", "balance": "10000", "pending": "250"},
 	)
-	r.client.ZAdd(r.formatKey("payments:pending"), redis.Z{Score: 1, Member: "xx"})
+	r.client.ZAdd(ctx, r.formatKey("payments:pending"), redis.Z{Score: 1, Member: "xx"})
 
 	amount := int64(250)
 	r.RollbackBalance("x", amount)
-	result := r.client.HGetAllMap(r.formatKey("miners:x")).Val()
+	result := r.client.HGetAll(ctx, r.formatKey("miners:x")).Val()
 	if result["paid"] != "100" {
 		t.Error("Must not touch paid")
 	}
@@ -191,7 +741,7 @@ func TestRollbackBalance(t *testing.T) {
 		t.Error("Must deduct pending")
 	}
 
-	result = r.client.HGetAllMap(r.formatKey("finances")).Val()
+	result = r.client.HGetAll(ctx, r.formatKey("finances")).Val()
 	if result["paid"] != "500" {
 		t.Error("Must not touch pool paid")
 	}
@@ -202,7 +752,7 @@ func TestRollbackBalance(t *testing.T) {
 		t.Error("Must deduct pool pending")
 	}
 
-	err := r.client.ZRank(r.formatKey("payments:pending"), join("x", amount)).Err()
+	err := r.client.ZRank(ctx, r.formatKey("payments:pending"), join("x", amount)).Err()
 	if err != redis.Nil {
 		t.Errorf("Must remove pending payment")
 	}
@@ -211,18 +761,18 @@ func TestRollbackBalance(t *testing.T) {
 func TestWritePayment(t *testing.T) {
 	reset()
 
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("miners:x"),
 		map[string]string{"paid": "50", "balance": "1000", "pending": "250"},
 	)
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("finances"),
 		map[string]string{"paid": "500", "balance": "10000", "pending": "250"},
 	)
 
 	amount := int64(250)
 	r.WritePayment("x", "0x0", amount)
-	result := r.client.HGetAllMap(r.formatKey("miners:x")).Val()
+	result := r.client.HGetAll(ctx, r.formatKey("miners:x")).Val()
 	if result["pending"] != "0" {
 		t.Error("Must unset pending amount")
 	}
@@ -233,7 +783,7 @@ func TestWritePayment(t *testing.T) {
 		t.Error("Must increase paid")
 	}
 
-	result = r.client.HGetAllMap(r.formatKey("finances")).Val()
+	result = r.client.HGetAll(ctx, r.formatKey("finances")).Val()
 	if result["pending"] != "0" {
 		t.Error("Must deduct pool pending amount")
 	}
@@ -244,20 +794,20 @@ func TestWritePayment(t *testing.T) {
 		t.Error("Must increase pool paid")
 	}
 
-	err := r.client.Get(r.formatKey("payments:lock")).Err()
+	err := r.client.Get(ctx, r.formatKey("payments:lock")).Err()
 	if err != redis.Nil {
 		t.Errorf("Must release lock")
 	}
 
-	err = r.client.ZRank(r.formatKey("payments:pending"), join("x", amount)).Err()
+	err = r.client.ZRank(ctx, r.formatKey("payments:pending"), join("x", amount)).Err()
 	if err != redis.Nil {
 		t.Error("Must remove pending payment")
 	}
-	err = r.client.ZRank(r.formatKey("payments:all"), join("0x0", "x", amount)).Err()
+	err = r.client.ZRank(ctx, r.formatKey("payments:all"), paymentMember("0x0", "x", amount)).Err()
 	if err == redis.Nil {
 		t.Error("Must add payment to set")
 	}
-	err = r.client.ZRank(r.formatKey("payments:x"), join("0x0", amount)).Err()
+	err = r.client.ZRank(ctx, r.formatKey("payments:x"), paymentMember("0x0", "", amount)).Err()
 	if err == redis.Nil {
 		t.Error("Must add payment to set")
 	}
@@ -266,7 +816,7 @@ func TestWritePayment(t *testing.T) {
 func TestGetPendingPayments(t *testing.T) {
 	reset()
 
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("miners:x"),
 		map[string]string{"paid": "100", "balance": "750", "pending": "250"},
 	)
@@ -289,41 +839,160 @@ func TestGetPendingPayments(t *testing.T) {
 	}
 }
 
+func TestLedgerReconcile(t *testing.T) {
+	reset()
+
+	block := &BlockData{Height: 10, RoundHeight: 10, Hash: "0x0", Nonce: "0x0",
+		CoinBaseValue: big.NewInt(1000), BlkTotalFee: big.NewInt(0), Reward: big.NewInt(1000)}
+	rewards := map[string]int64{"x": 600, "z": 390}
+
+	r.WriteImmatureBlock(block, rewards)
+	r.WriteMaturedBlock(block, rewards, 0)
+	r.UpdateBalance("x", 600)
+	r.WritePayment("x", "0x0", 600)
+	r.UpdateBalance("z", 390)
+	r.RollbackBalance("z", 390)
+
+	report, err := r.Reconcile()
+	if err != nil {
+		t.Fatalf("Must reconcile ledger: %v", err)
+	}
+	if !report.Balanced() {
+		t.Errorf("Ledger must be balanced: %v", report.Mismatches)
+	}
+	if report.Accounts[MinerAccount("x", "paid")] != 600 || report.Accounts[MinerAccount("z", "balance")] != 390 {
+		t.Errorf("Must sum up miner accounts: %v", report.Accounts)
+	}
+	if report.Accounts[AccountPoolFee] != 10 {
+		t.Errorf("Must post pool fee: %v", report.Accounts[AccountPoolFee])
+	}
+
+	r.client.HIncrBy(ctx, r.formatKey("miners", "z"), "balance", 1)
+	report, _ = r.Reconcile()
+	if report.Balanced() {
+		t.Error("Must detect balance which does not match ledger")
+	}
+	reset()
+
+	for _, b := range []Backend{r, NewMemoryBackend(prefix)} {
+		// Balances and finances written before ledger was kept
+		hIncrBy := func(key, field string, n int64) {
+			switch b := b.(type) {
+			case *RedisClient:
+				b.client.HIncrBy(ctx, b.formatKey(key), field, n)
+			case *MemoryBackend:
+				b.store.hIncrBy(b.formatKey(key), field, n)
+			}
+		}
+		hIncrBy("miners:w", "balance", 500)
+		hIncrBy("miners:w", "paid", 2000)
+		hIncrBy("finances", "balance", 507)
+		hIncrBy("finances", "paid", 2000)
+		b.WriteImmatureBlock(block, rewards)
+
+		if report, _ := b.Reconcile(); report.Balanced() {
+			t.Error("Legacy balances must not match empty ledger")
+		}
+		entries, err := b.OpenLedger()
+		if err != nil || len(entries) != 3 {
+			t.Fatalf("Must post opening entries: %v, %v", entries, err)
+		}
+		report, _ := b.Reconcile()
+		if !report.Balanced() || report.Accounts[FinancesAccount("balance")] != 7 || report.Accounts[AccountPoolOpening] != -2507 {
+			t.Errorf("Opened ledger must be balanced: %v, %v", report.Mismatches, report.Accounts)
+		}
+		if _, err := b.OpenLedger(); err != ErrLedgerOpened {
+			t.Errorf("Ledger must be opened once: %v", err)
+		}
+
+		// Movements after opening are proven as usual
+		b.WriteMaturedBlock(block, rewards, 0)
+		b.UpdateBalance("w", 500)
+		if report, _ := b.Reconcile(); !report.Balanced() {
+			t.Errorf("Ledger must stay balanced: %v", report.Mismatches)
+		}
+	}
+}
+
 func TestCollectLuckStats(t *testing.T) {
 	reset()
 
 	members := []redis.Z{
-		redis.Z{Score: 0, Member: "1:0:0x0:0x0:0:100:100:0"},
+		redis.Z{Score: 0, Member: "0:0:0x0:0x0:0:100:100:1000:5:0"},
 	}
-	r.client.ZAdd(r.formatKey("blocks:immature"), members...)
+	r.client.ZAdd(ctx, r.formatKey("blocks:immature"), members...)
 	members = []redis.Z{
-		redis.Z{Score: 1, Member: "1:0:0x2:0x0:0:50:100:0"},
-		redis.Z{Score: 2, Member: "0:1:0x1:0x0:0:100:100:0"},
-		redis.Z{Score: 3, Member: "0:0:0x3:0x0:0:200:100:0"},
+		// Malformed records are skipped
+		redis.Z{Score: 0, Member: "0:0:0x4:0x0:0:100:100:0"},
+		redis.Z{Score: 1, Member: "0:0:0x2:0x0:0:50:100:1000:5:0"},
+		redis.Z{Score: 2, Member: "0:1:0x1:0x0:0:100:100:1000:5:0"},
+		redis.Z{Score: 3, Member: "0:0:0x3:0x0:0:200:100:1000:5:0"},
 	}
-	r.client.ZAdd(r.formatKey("blocks:matured"), members...)
+	r.client.ZAdd(ctx, r.formatKey("blocks:matured"), members...)
 
 	stats, _ := r.CollectLuckStats([]int{1, 2, 5, 10})
 	expectedStats := map[string]interface{}{
 		"1": map[string]float64{
-			"luck": 1, "uncleRate": 1, "orphanRate": 0,
+			"luck": 1, "uncleRate": 0, "orphanRate": 0,
 		},
 		"2": map[string]float64{
-			"luck": 0.75, "uncleRate": 0.5, "orphanRate": 0,
+			"luck": 0.75, "uncleRate": 0, "orphanRate": 0,
 		},
 		"4": map[string]float64{
-			"luck": 1.125, "uncleRate": 0.5, "orphanRate": 0.25,
+			"luck": 1.125, "uncleRate": 0, "orphanRate": 0.25,
 		},
 	}
 
 	if !reflect.DeepEqual(stats, expectedStats) {
-		t.Error("Stats != expected stats")
+		t.Errorf("Stats != expected stats: %v", stats)
 	}
 }
 
 func reset() {
-	keys := r.client.Keys(r.prefix + ":*").Val()
-	for _, k := range keys {
-		r.client.Del(k)
+	for _, pattern := range []string{prefix + ":*", "{" + prefix + "}:*"} {
+		for _, k := range r.client.Keys(ctx, pattern).Val() {
+			r.client.Del(ctx, k)
+		}
+	}
+}
+
+func TestLeaseAndFencing(t *testing.T) {
+	reset()
+
+	token1, err := r.AcquireLease("jobs", "pool1", time.Minute)
+	if err != nil || token1 == 0 {
+		t.Fatalf("Must acquire free lease: %v, %v", token1, err)
+	}
+	token, _ := r.AcquireLease("jobs", "pool2", time.Minute)
+	if token != 0 {
+		t.Error("Must not acquire lease held by another node")
+	}
+	token, _ = r.AcquireLease("jobs", "pool1", time.Minute)
+	if token != token1 {
+		t.Errorf("Renewal must keep token: %v vs %v", token1, token)
+	}
+	holder, token, _ := r.GetLeader("jobs")
+	if holder != "pool1" || token != token1 {
+		t.Errorf("Invalid leader: %v:%v", holder, token)
+	}
+
+	current := token1
+	fenced := r.Fenced("jobs", func() int64 { return current })
+	if err := fenced.LockPayouts("x", 100); err != nil {
+		t.Errorf("Leader must be able to write: %v", err)
+	}
+	fenced.UnlockPayouts()
+
+	// Lease expires and is taken over by another node
+	r.ReleaseLease("jobs", "pool1")
+	token2, _ := r.AcquireLease("jobs", "pool2", time.Minute)
+	if token2 <= token1 {
+		t.Errorf("New leader must get greater token: %v vs %v", token2, token1)
+	}
+	if err := fenced.LockPayouts("x", 100); err != ErrFenced {
+		t.Errorf("Stale leader must be fenced: %v", err)
+	}
+	if locked, _ := r.IsPayoutsLocked(); locked {
+		t.Error("Fenced write must not be applied")
 	}
 }
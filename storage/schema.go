@@ -0,0 +1,491 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Version of key layout this code writes. Version 1 kept block and payment records
+// as colon joined members, version 2 keeps them as JSON objects. Datasets without
+// schema key were written by version 1.
+const SchemaVersion = 2
+
+var ErrSchemaOutdated = errors.New("dataset has outdated schema, run \"dashpool migrate\"")
+
+// Members of blocks:candidates, blocks:immature and blocks:matured
+type blockRecord struct {
+	Nonce         string `json:"nonce"`
+	ENonce1       string `json:"enonce1,omitempty"`
+	ENonce2       string `json:"enonce2,omitempty"`
+	Hash          string `json:"hash"`
+	Finder        string `json:"finder,omitempty"`
+	Timestamp     int64  `json:"timestamp"`
+	Difficulty    int64  `json:"difficulty"`
+	TotalShares   int64  `json:"shares"`
+	CoinBaseValue string `json:"coinBaseValue"`
+	BlkTotalFee   string `json:"blkTotalFee"`
+	Reward        string `json:"reward,omitempty"`
+	UncleHeight   int64  `json:"uncleHeight,omitempty"`
+	Orphan        bool   `json:"orphan,omitempty"`
+}
+
+// Members of payments:all and payments:<login>, the latter have no address
+type paymentRecord struct {
+	TxHash  string `json:"tx"`
+	Address string `json:"address,omitempty"`
+	Amount  int64  `json:"amount"`
+}
+
+// How members of a key holding records are encoded
+type recordKind int
+
+const (
+	candidateRecords recordKind = iota
+	blockRecords
+	paymentRecords
+)
+
+// Outcome of schema migration, keys are relative to prefix
+type SchemaReport struct {
+	Version int64 `json:"version"`
+	Target  int64 `json:"target"`
+	DryRun  bool  `json:"dryRun"`
+	// Legacy records converted, or to be converted on dry run, by key
+	Upgraded map[string]int64 `json:"upgraded"`
+	// Records read back and decoded after migration
+	Verified int64 `json:"verified"`
+}
+
+func newSchemaReport(version int64, dryRun bool) *SchemaReport {
+	return &SchemaReport{Version: version, Target: SchemaVersion, DryRun: dryRun, Upgraded: make(map[string]int64)}
+}
+
+func parseSchemaVersion(value string, ok bool) (int64, error) {
+	if !ok {
+		return 1, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// Verifies that version is the one this code writes, dataset without records may be stamped with it
+func checkSchemaVersion(version int64, empty bool) (bool, error) {
+	if version > SchemaVersion {
+		return false, fmt.Errorf("dataset schema version %v is newer than supported %v", version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		return false, nil
+	}
+	if !empty {
+		return false, ErrSchemaOutdated
+	}
+	return true, nil
+}
+
+// Per login payment keys, as "payments:pending" and "payments:lock" hold no records
+func isPaymentRecordsKey(key string) bool {
+	parts := strings.Split(key, ":")
+	login := parts[len(parts)-1]
+	return login != "pending" && login != "lock" && login != "all"
+}
+
+func marshalRecord(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func isRecord(member string) bool {
+	return strings.HasPrefix(member, "{")
+}
+
+func bigString(n *big.Int) string {
+	if n == nil {
+		return "0"
+	}
+	return n.String()
+}
+
+// Candidate written by WriteBlock for finder login, params are nonce, extranonce1 and extranonce2
+func candidateRecord(login string, params []string, ts, roundDiff, totalShares, coinBaseValue, blkTotalFee int64, blockHash string) string {
+	return marshalRecord(&blockRecord{
+		Nonce:         params[0],
+		ENonce1:       params[1],
+		ENonce2:       params[2],
+		Hash:          blockHash,
+		Finder:        login,
+		Timestamp:     ts,
+		Difficulty:    roundDiff,
+		TotalShares:   totalShares,
+		CoinBaseValue: strconv.FormatInt(coinBaseValue, 10),
+		BlkTotalFee:   strconv.FormatInt(blkTotalFee, 10),
+	})
+}
+
+// Member of immature or matured block with reward in satoshi
+func (b *BlockData) record(reward string) string {
+	return marshalRecord(&blockRecord{
+		Nonce:         b.Nonce,
+		Hash:          b.serializeHash(),
+		Finder:        b.Finder,
+		Timestamp:     b.Timestamp,
+		Difficulty:    b.Difficulty,
+		TotalShares:   b.TotalShares,
+		CoinBaseValue: bigString(b.CoinBaseValue),
+		BlkTotalFee:   bigString(b.BlkTotalFee),
+		Reward:        reward,
+		UncleHeight:   b.UncleHeight,
+		Orphan:        b.Orphan,
+	})
+}
+
+func paymentMember(txHash, login string, amount int64) string {
+	return marshalRecord(&paymentRecord{TxHash: txHash, Address: login, Amount: amount})
+}
+
+// Fields of legacy members, fails unless there are at least min of them
+func splitMember(member string, min int) ([]string, error) {
+	fields := strings.Split(member, ":")
+	if len(fields) < min {
+		return nil, fmt.Errorf("record %q has %v fields instead of %v", member, len(fields), min)
+	}
+	return fields, nil
+}
+
+func decodeCandidate(member string) (*BlockData, error) {
+	if !isRecord(member) {
+		return parseCandidateV1(member)
+	}
+	rec := blockRecord{}
+	if err := json.Unmarshal([]byte(member), &rec); err != nil {
+		return nil, fmt.Errorf("record %q: %v", member, err)
+	}
+	block := &BlockData{
+		Nonce:       rec.Nonce,
+		ENonce1:     rec.ENonce1,
+		ENonce2:     rec.ENonce2,
+		Hash:        rec.Hash,
+		Finder:      rec.Finder,
+		Timestamp:   rec.Timestamp,
+		Difficulty:  rec.Difficulty,
+		TotalShares: rec.TotalShares,
+	}
+	coinBaseValue, _ := strconv.ParseInt(rec.CoinBaseValue, 10, 64)
+	block.CoinBaseValue = big.NewInt(coinBaseValue)
+	blkTotalFee, _ := strconv.ParseInt(rec.BlkTotalFee, 10, 64)
+	block.BlkTotalFee = big.NewInt(blkTotalFee)
+	return block, nil
+}
+
+func decodeBlock(member string) (*BlockData, error) {
+	if !isRecord(member) {
+		return parseBlockV1(member)
+	}
+	rec := blockRecord{}
+	if err := json.Unmarshal([]byte(member), &rec); err != nil {
+		return nil, fmt.Errorf("record %q: %v", member, err)
+	}
+	block := &BlockData{
+		Orphan:      rec.Orphan,
+		Nonce:       rec.Nonce,
+		Hash:        rec.Hash,
+		Finder:      rec.Finder,
+		Timestamp:   rec.Timestamp,
+		Difficulty:  rec.Difficulty,
+		TotalShares: rec.TotalShares,
+	}
+	block.CoinBaseValue, _ = new(big.Int).SetString(rec.CoinBaseValue, 10)
+	block.BlkTotalFee, _ = new(big.Int).SetString(rec.BlkTotalFee, 10)
+	block.RewardString = rec.Reward
+	block.ImmatureReward = rec.Reward
+	return block, nil
+}
+
+func decodePayment(member string) (map[string]interface{}, error) {
+	if !isRecord(member) {
+		return parsePaymentV1(member)
+	}
+	rec := paymentRecord{}
+	if err := json.Unmarshal([]byte(member), &rec); err != nil {
+		return nil, fmt.Errorf("record %q: %v", member, err)
+	}
+	tx := map[string]interface{}{"tx": rec.TxHash, "amount": rec.Amount}
+	if len(rec.Address) > 0 {
+		tx["address"] = rec.Address
+	}
+	return tx, nil
+}
+
+// "nonce:eNonce1:eNonce2:timestamp:diff:totalShares:coinBaseValue:blkTotalFee:blockHash"
+func parseCandidateV1(member string) (*BlockData, error) {
+	fields, err := splitMember(member, 8)
+	if err != nil {
+		return nil, err
+	}
+	block := &BlockData{}
+	block.Nonce = fields[0]
+	block.ENonce1 = fields[1]
+	block.ENonce2 = fields[2]
+	block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
+	block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
+	block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
+	coinBaseValue, _ := strconv.ParseInt(fields[6], 10, 64)
+	block.CoinBaseValue = big.NewInt(coinBaseValue)
+	blkTotalFee, _ := strconv.ParseInt(fields[7], 10, 64)
+	block.BlkTotalFee = big.NewInt(blkTotalFee)
+	// candidates written before block hash was stored have no such field
+	if len(fields) > 8 {
+		block.Hash = fields[8]
+	}
+	return block, nil
+}
+
+// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:coinBaseValue:blkTotalFee:rewardInSatoshi"
+func parseBlockV1(member string) (*BlockData, error) {
+	fields, err := splitMember(member, 10)
+	if err != nil {
+		return nil, err
+	}
+	block := &BlockData{}
+	block.Orphan, _ = strconv.ParseBool(fields[1])
+	block.Nonce = fields[2]
+	block.Hash = fields[3]
+	block.Timestamp, _ = strconv.ParseInt(fields[4], 10, 64)
+	block.Difficulty, _ = strconv.ParseInt(fields[5], 10, 64)
+	block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
+	block.CoinBaseValue, _ = new(big.Int).SetString(fields[7], 10)
+	block.BlkTotalFee, _ = new(big.Int).SetString(fields[8], 10)
+	block.RewardString = fields[9]
+	block.ImmatureReward = fields[9]
+	return block, nil
+}
+
+// "txHash:login:amount" of all payments or "txHash:amount" of login payments
+func parsePaymentV1(member string) (map[string]interface{}, error) {
+	fields, err := splitMember(member, 2)
+	if err != nil {
+		return nil, err
+	}
+	tx := make(map[string]interface{})
+	tx["tx"] = fields[0]
+	if len(fields) < 3 {
+		tx["amount"], _ = strconv.ParseInt(fields[1], 10, 64)
+	} else {
+		tx["address"] = fields[1]
+		tx["amount"], _ = strconv.ParseInt(fields[2], 10, 64)
+	}
+	return tx, nil
+}
+
+// Record form of legacy member, fails unless the record decodes to the same values
+func upgradeMember(kind recordKind, member string) (string, error) {
+	var record string
+	var ok bool
+	switch kind {
+	case candidateRecords:
+		block, err := parseCandidateV1(member)
+		if err != nil {
+			return "", err
+		}
+		params := []string{block.Nonce, block.ENonce1, block.ENonce2}
+		record = candidateRecord("", params, block.Timestamp, block.Difficulty, block.TotalShares,
+			block.CoinBaseValue.Int64(), block.BlkTotalFee.Int64(), block.Hash)
+		decoded, err := decodeCandidate(record)
+		ok = err == nil && reflect.DeepEqual(summarizeBlock(block), summarizeBlock(decoded))
+	case blockRecords:
+		block, err := parseBlockV1(member)
+		if err != nil {
+			return "", err
+		}
+		record = block.record(block.RewardString)
+		decoded, err := decodeBlock(record)
+		ok = err == nil && reflect.DeepEqual(summarizeBlock(block), summarizeBlock(decoded))
+	case paymentRecords:
+		tx, err := parsePaymentV1(member)
+		if err != nil {
+			return "", err
+		}
+		address, _ := tx["address"].(string)
+		record = paymentMember(tx["tx"].(string), address, tx["amount"].(int64))
+		decoded, err := decodePayment(record)
+		ok = err == nil && reflect.DeepEqual(tx, decoded)
+	}
+	if !ok {
+		return "", fmt.Errorf("record %q does not survive conversion", member)
+	}
+	return record, nil
+}
+
+// Record forms of legacy members, by legacy member
+func upgradeMembers(kind recordKind, raw []redis.Z) (map[string]redis.Z, error) {
+	upgrades := make(map[string]redis.Z)
+	for _, v := range raw {
+		member := v.Member.(string)
+		if isRecord(member) {
+			continue
+		}
+		record, err := upgradeMember(kind, member)
+		if err != nil {
+			return nil, err
+		}
+		upgrades[member] = redis.Z{Score: v.Score, Member: record}
+	}
+	return upgrades, nil
+}
+
+// Migrated key must hold the same number of entries, each one a record with its original score
+func verifyMembers(raw, migrated []redis.Z) error {
+	if len(raw) != len(migrated) {
+		return fmt.Errorf("%v records before migration, %v after", len(raw), len(migrated))
+	}
+	for i, v := range migrated {
+		if !isRecord(v.Member.(string)) {
+			return fmt.Errorf("legacy record %q left after migration", v.Member)
+		}
+		// Both are sorted by score
+		if v.Score != raw[i].Score {
+			return fmt.Errorf("record %q has score %v instead of %v", v.Member, v.Score, raw[i].Score)
+		}
+	}
+	return nil
+}
+
+func blockKind(key string) recordKind {
+	switch {
+	case strings.HasSuffix(key, ":candidates"):
+		return candidateRecords
+	case strings.HasSuffix(key, ":payments:all"):
+		return paymentRecords
+	}
+	return blockRecords
+}
+
+// Comparable form of decoded block, as big integers may differ in representation of the same value
+func summarizeBlock(b *BlockData) []string {
+	return []string{b.Nonce, b.ENonce1, b.ENonce2, b.Hash, strconv.FormatBool(b.Orphan),
+		strconv.FormatInt(b.Timestamp, 10), strconv.FormatInt(b.Difficulty, 10), strconv.FormatInt(b.TotalShares, 10),
+		bigString(b.CoinBaseValue), bigString(b.BlkTotalFee), b.RewardString, b.ImmatureReward}
+}
+
+func (r *RedisClient) GetSchemaVersion() (int64, error) {
+	value, err := r.client.Get(ctx, r.formatKey("schema")).Result()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	return parseSchemaVersion(value, err == nil)
+}
+
+// Fails unless dataset has the schema this code writes, dataset without records is stamped with it
+func (r *RedisClient) CheckSchema() error {
+	version, err := r.GetSchemaVersion()
+	if err != nil {
+		return err
+	}
+	keys, err := r.recordKeys()
+	if err != nil {
+		return err
+	}
+	stamp, err := checkSchemaVersion(version, len(keys) == 0)
+	if err != nil || !stamp {
+		return err
+	}
+	return r.client.SetNX(ctx, r.formatKey("schema"), strconv.Itoa(SchemaVersion), 0).Err()
+}
+
+// Keys holding block and payment records, which are zsets of encoded members
+func (r *RedisClient) recordKeys() (map[string]recordKind, error) {
+	keys := make(map[string]recordKind)
+	for _, key := range []string{r.formatKey("blocks", "candidates"), r.formatKey("blocks", "immature"),
+		r.formatKey("blocks", "matured"), r.formatKey("payments", "all")} {
+		exists, err := r.client.Exists(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		if exists > 0 {
+			keys[key] = blockKind(key)
+		}
+	}
+
+	rows, err := r.scanKeys(r.formatKey("payments", "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range rows {
+		if isPaymentRecordsKey(key) {
+			keys[key] = paymentRecords
+		}
+	}
+	return keys, nil
+}
+
+// Converts legacy records in place and stamps the dataset with current schema version.
+// Pool must be stopped, a key changed meanwhile fails the migration, which may be run again.
+func (r *RedisClient) MigrateSchema(dryRun bool) (*SchemaReport, error) {
+	version, err := r.GetSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	report := newSchemaReport(version, dryRun)
+	if version > SchemaVersion {
+		_, err := checkSchemaVersion(version, false)
+		return report, err
+	}
+	keys, err := r.recordKeys()
+	if err != nil {
+		return report, err
+	}
+	for key, kind := range keys {
+		if err := r.migrateKey(key, kind, report); err != nil {
+			return report, fmt.Errorf("%v: %v", key, err)
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+	return report, r.client.Set(ctx, r.formatKey("schema"), strconv.Itoa(SchemaVersion), 0).Err()
+}
+
+func (r *RedisClient) migrateKey(key string, kind recordKind, report *SchemaReport) error {
+	var raw []redis.Z
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		var err error
+		raw, err = tx.ZRangeWithScores(ctx, key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		upgrades, err := upgradeMembers(kind, raw)
+		if err != nil {
+			return err
+		}
+		report.Upgraded[r.keyName(key)] = int64(len(upgrades))
+		if report.DryRun || len(upgrades) == 0 {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for member, z := range upgrades {
+				pipe.ZRem(ctx, key, member)
+				pipe.ZAdd(ctx, key, z)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil || report.DryRun {
+		return err
+	}
+
+	migrated, err := r.client.ZRangeWithScores(ctx, key, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	if err := verifyMembers(raw, migrated); err != nil {
+		return err
+	}
+	report.Verified += int64(len(migrated))
+	return nil
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+
+	"github.com/mutalisk999/bitcoin-lib/src/base58"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
+)
+
+// Address version bytes of a Dash network, full parameters are in dashcoin.Params
+type Network struct {
+	Name             string
+	PubKeyHashAddrID byte
+	ScriptHashAddrID byte
+}
+
+// Network pool runs on, selected once on startup by dashcoin.SelectParams
+var network = &Network{Name: "mainnet", PubKeyHashAddrID: 76, ScriptHashAddrID: 16}
+
+func SetNetwork(n *Network) {
+	network = n
+}
+
+func CurrentNetwork() *Network {
+	return network
+}
+
+// Decodes base58check address and returns its version byte and hash160
+func DecodeDashAddress(address string) (byte, []byte, error) {
+	addrWithCheck, err := base58.Decode(address)
+	if err != nil {
+		return 0, nil, errors.New("invalid base58 encoding")
+	}
+	if len(addrWithCheck) != 25 {
+		return 0, nil, errors.New("invalid address length")
+	}
+	check1 := utility.Sha256(utility.Sha256(addrWithCheck[0:21]))[0:4]
+	check2 := addrWithCheck[21:25]
+	if !bytes.Equal(check1, check2) {
+		return 0, nil, errors.New("invalid address checksum")
+	}
+	return addrWithCheck[0], addrWithCheck[1:21], nil
+}
+
+// Characters and length of base58 addresses, for URL routes. Matching path must still pass IsValidDashAddress.
+const AddressRoutePattern = "[1-9A-HJ-NP-Za-km-z]{26,35}"
+
+// P2PKH or P2SH address of the current network
+func IsValidDashAddress(address string) bool {
+	version, _, err := DecodeDashAddress(address)
+	if err != nil {
+		return false
+	}
+	return version == network.PubKeyHashAddrID || version == network.ScriptHashAddrID
+}
+
+func IsP2PKHAddress(address string) bool {
+	version, _, err := DecodeDashAddress(address)
+	return err == nil && version == network.PubKeyHashAddrID
+}
+
+// Compressed or uncompressed public key in hex, coinbase can pay to it directly
+func IsValidDashPubKey(pubKeyHex string) bool {
+	pubKey, err := hex.DecodeString(pubKeyHex)
+	if err != nil {
+		return false
+	}
+	switch len(pubKey) {
+	case 33:
+		return pubKey[0] == 0x02 || pubKey[0] == 0x03
+	case 65:
+		return pubKey[0] == 0x04
+	}
+	return false
+}
+
+// Any form coinbase output can be built from: address or public key
+func IsValidDashWallet(wallet string) bool {
+	return IsValidDashPubKey(wallet) || IsValidDashAddress(wallet)
+}
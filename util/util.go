@@ -2,14 +2,13 @@ package util
 
 import (
 	"encoding/hex"
-	"github.com/ethereum/go-ethereum/common/hexutil"
+	"fmt"
 	"github.com/mutalisk999/bitcoin-lib/src/bigint"
 	"math/big"
 	"regexp"
 	"strconv"
 	"time"
 
-	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/math"
 )
 
@@ -19,7 +18,6 @@ import (
 var Dash = math.BigPow(10, 8)
 var Satoshi = math.BigPow(10, 0)
 
-var pow256 = math.BigPow(2, 256)
 var addressPattern = regexp.MustCompile("^0x[0-9a-fA-F]{40}$")
 var zeroHash = regexp.MustCompile("^0?x?0+$")
 
@@ -30,26 +28,6 @@ var zeroHash = regexp.MustCompile("^0?x?0+$")
 //	return true
 //}
 
-//func IsValidDashAddress(address string) bool {
-//	addrWithCheck, err := base58.Decode(address)
-//	if err != nil {
-//		return false
-//	}
-//	if len(addrWithCheck) != 25 {
-//		return false
-//	}
-//	check1 := utility.Sha256(utility.Sha256(addrWithCheck[0:21]))[0:4]
-//	check2 := addrWithCheck[21:25]
-//	if bytes.Compare(check1, check2) != 0 {
-//		return false
-//	}
-//	return true
-//}
-
-func IsValidDashAddress(address string) bool {
-	return true
-}
-
 func IsZeroHash(s string) bool {
 	return zeroHash.MatchString(s)
 }
@@ -58,17 +36,6 @@ func MakeTimestamp() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
 }
 
-func GetTargetHex(diff int64) string {
-	difficulty := big.NewInt(diff)
-	diff1 := new(big.Int).Div(pow256, difficulty)
-	return string(hexutil.Encode(diff1.Bytes()))
-}
-
-func TargetHexToDiff(targetHex string) *big.Int {
-	targetBytes := common.FromHex(targetHex)
-	return new(big.Int).Div(pow256, new(big.Int).SetBytes(targetBytes))
-}
-
 func ToHex(n int64) string {
 	return "0x0" + strconv.FormatInt(n, 16)
 }
@@ -89,6 +56,29 @@ func FormatRatReward(reward *big.Rat) string {
 	return reward.FloatString(8)
 }
 
+// Formats Satoshi amount as exact decimal coin string, e.g. 123456789 => "1.23456789"
+func FormatCoinAmount(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%08d", sign, amount/Dash.Int64(), amount%Dash.Int64())
+}
+
+// Parses decimal coin string into Satoshi without going through float
+func ParseCoinAmount(s string) (int64, error) {
+	value, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("invalid amount %v", s)
+	}
+	value.Mul(value, new(big.Rat).SetInt(Dash))
+	if !value.IsInt() {
+		return 0, fmt.Errorf("amount %v has more than 8 decimals", s)
+	}
+	return value.Num().Int64(), nil
+}
+
 func StringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
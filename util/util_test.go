@@ -3,6 +3,9 @@ package util
 import (
 	"fmt"
 	"testing"
+
+	"github.com/mutalisk999/bitcoin-lib/src/base58"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
 )
 
 func TestTargetHash256StratumFormat(t *testing.T) {
@@ -18,3 +21,59 @@ func TestHash256StratumFormat(t *testing.T) {
 	txIdStratumHex, _ := Hash256StratumFormat(txIdHex)
 	fmt.Println("txIdStratumHex:", txIdStratumHex)
 }
+
+func TestCoinAmount(t *testing.T) {
+	if s := FormatCoinAmount(123456789); s != "1.23456789" {
+		t.Errorf("Invalid coin amount: %v", s)
+	}
+	if s := FormatCoinAmount(-5); s != "-0.00000005" {
+		t.Errorf("Invalid coin amount: %v", s)
+	}
+	if v, _ := ParseCoinAmount("21000000.00000001"); v != 2100000000000001 {
+		t.Errorf("Invalid satoshi amount: %v", v)
+	}
+	if _, err := ParseCoinAmount("0.000000001"); err == nil {
+		t.Error("Must reject amount below one satoshi")
+	}
+}
+
+func TestIsValidDashAddress(t *testing.T) {
+	mainnet := CurrentNetwork()
+	defer SetNetwork(mainnet)
+
+	p2pkh := "XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob"
+	p2sh := "7mFVKKgyfRh6WokCP1UNvBEL2gCygwnACP"
+	if !IsValidDashAddress(p2pkh) || !IsValidDashAddress(p2sh) {
+		t.Error("Must accept mainnet addresses")
+	}
+	if IsValidDashAddress("XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7oc") {
+		t.Error("Must reject address with invalid checksum")
+	}
+	if IsValidDashAddress("0x0000000000000000000000000000000000000000") || IsValidDashAddress("") {
+		t.Error("Must reject garbage")
+	}
+
+	_, hash, _ := DecodeDashAddress(p2pkh)
+	payload := append([]byte{140}, hash...)
+	testnet := base58.Encode(append(payload, utility.Sha256(utility.Sha256(payload))[0:4]...))
+	if IsValidDashAddress(testnet) {
+		t.Error("Must reject testnet address on mainnet")
+	}
+
+	SetNetwork(&Network{Name: "testnet", PubKeyHashAddrID: 140, ScriptHashAddrID: 19})
+	if !IsValidDashAddress(testnet) || IsValidDashAddress(p2pkh) {
+		t.Error("Must validate addresses against selected network")
+	}
+
+	pubKey := "034a452d21d26c60076a30bf6701666b30d57ac09c2ff07f34e52cdba13796645d"
+	if !IsValidDashWallet(pubKey) || IsValidDashAddress(pubKey) {
+		t.Error("Public key is valid coinbase wallet only")
+	}
+	if IsValidDashWallet("044a452d21d26c60076a30bf6701666b30d57ac09c2ff07f34e52cdba13796645d") {
+		t.Error("Must reject invalid public key prefix")
+	}
+	uncompressed := "040184710fa689ad5023690c80f3a49c8f13f8d45b8c857fbcbc8bc4a8e4d3eb4b10f4d4604fa08dce601aaf0f470216fe1b51850b4acf21b179c45070ac7b03a9"
+	if !IsValidDashPubKey(uncompressed) || IsValidDashPubKey("06"+uncompressed[2:]) {
+		t.Error("Must accept uncompressed public key only with 04 prefix")
+	}
+}